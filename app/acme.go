@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ACME control plane paths. They follow the "httpreq" DNS provider protocol
+// understood by common ACME clients such as lego.
+const (
+	ACMEPresentPath = "/present"
+	ACMECleanupPath = "/cleanup"
+)
+
+// acmeRequest is the body of a present or cleanup request
+type acmeRequest struct {
+	FQDN  string `json:"fqdn"`  // e.g. "_acme-challenge.example.com."
+	Value string `json:"value"` // the DNS-01 key authorization digest
+}
+
+// ACMEHandler lets an ACME client publish and remove DNS-01 challenge TXT records.
+// Like adminHandler, it serves only loopback callers.
+type ACMEHandler struct {
+	// Cache, when set, has its answers for updated names deleted so the new
+	// records aren't shadowed by ones cached before the update
+	Cache *CachingForwarder
+
+	store *MemoryStore
+	token string // required bearer token, empty to allow any caller
+}
+
+// NewACMEHandler creates a control plane handler updating store. When token is set,
+// requests must carry it in an "Authorization: Bearer" header.
+func NewACMEHandler(store *MemoryStore, token string) *ACMEHandler {
+	return &ACMEHandler{store: store, token: token}
+}
+
+func (a *ACMEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !bearerAuthorized(r, a.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req acmeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "malformed request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSuffix(req.FQDN, ".")
+	if name == "" || req.Value == "" {
+		http.Error(w, "fqdn and value are required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case ACMEPresentPath:
+		fmt.Printf("Publishing ACME challenge TXT record for %s\n", name)
+		a.store.AddTXT(name, req.Value)
+	case ACMECleanupPath:
+		fmt.Printf("Removing ACME challenge TXT record for %s\n", name)
+		a.store.RemoveTXT(name, req.Value)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if a.Cache != nil {
+		a.Cache.Delete(name, RecordTypeTXT, ClassIN)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// bearerAuthorized reports whether the request carries token, or token is empty
+func bearerAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// NewControlServer creates an HTTP server exposing the ACME control plane on addr,
+// and the drain switch and admin commands when drain and admin aren't nil
+func NewControlServer(addr string, store *MemoryStore, drain *Drain, admin *Admin, token string) *http.Server {
+	handler := NewACMEHandler(store, token)
+	if admin != nil {
+		handler.Cache = admin.Cache
+	}
+	mux := http.NewServeMux()
+	mux.Handle(ACMEPresentPath, handler)
+	mux.Handle(ACMECleanupPath, handler)
+	if drain != nil {
+		mux.Handle(DrainPath, &drainHandler{drain: drain, token: token})
+	}
+	if admin != nil {
+		mux.Handle(AdminPath, &adminHandler{admin: admin, token: token})
+	}
+	return &http.Server{Addr: addr, Handler: mux}
+}
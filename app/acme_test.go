@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// lookupTXT queries the handler for name's TXT records and returns their values
+func lookupTXT(t *testing.T, store *MemoryStore, name string) []string {
+	t.Helper()
+
+	queryData := buildTestDNSQuery(0x7478, []Question{{Name: name, Type: RecordTypeTXT, Class: ClassIN}})
+	response, err := NewDNSHandler(queryData, WithStore(store)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	var values []string
+	for _, rr := range respMsg.Answers {
+		var txt TXTData
+		if err := txt.UnmarshalBinary(rr.RData); err != nil {
+			t.Fatalf("Failed to decode TXT RDATA: %v", err)
+		}
+		values = append(values, txt.String())
+	}
+	return values
+}
+
+func TestACMEHandler_PresentAndCleanup(t *testing.T) {
+	store := NewMemoryStore(nil)
+	server := httptest.NewServer(NewControlServer("", store, nil, nil, "secret").Handler)
+	defer server.Close()
+
+	const name = "_acme-challenge.example.com"
+	post := func(path, token, body string) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	body := `{"fqdn": "` + name + `.", "value": "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0"}`
+	if status := post(ACMEPresentPath, "wrong", body); status != http.StatusUnauthorized {
+		t.Errorf("Present with a bad token = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := post(ACMEPresentPath, "secret", `{"fqdn": "`+name+`"}`); status != http.StatusBadRequest {
+		t.Errorf("Present without a value = %d, want %d", status, http.StatusBadRequest)
+	}
+	if values := lookupTXT(t, store, name); len(values) != 0 {
+		t.Fatalf("TXT records published by rejected requests: %v", values)
+	}
+
+	if status := post(ACMEPresentPath, "secret", body); status != http.StatusOK {
+		t.Fatalf("Present = %d, want %d", status, http.StatusOK)
+	}
+	values := lookupTXT(t, store, name)
+	if len(values) != 1 || values[0] != "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0" {
+		t.Fatalf("TXT records after present = %v, want the challenge value", values)
+	}
+
+	if status := post(ACMECleanupPath, "secret", body); status != http.StatusOK {
+		t.Fatalf("Cleanup = %d, want %d", status, http.StatusOK)
+	}
+	if values := lookupTXT(t, store, name); len(values) != 0 {
+		t.Errorf("TXT records after cleanup = %v, want none", values)
+	}
+	if _, found := store.Get(name); found {
+		t.Error("Challenge name still exists after its last record was removed")
+	}
+}
+
+func TestACMEHandler_DeletesCachedAnswers(t *testing.T) {
+	cache := NewCachingForwarder(&flakyForwarder{}, DefaultCacheCapacity)
+	server := httptest.NewServer(NewControlServer("", NewMemoryStore(nil), nil, &Admin{Cache: cache}, "").Handler)
+	defer server.Close()
+
+	const name = "_acme-challenge.example.com"
+	if _, err := cache.Exchange(Question{Name: name, Type: RecordTypeTXT, Class: ClassIN}); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+
+	resp, err := http.Post(server.URL+ACMEPresentPath, "application/json", strings.NewReader(`{"fqdn": "`+name+`.", "value": "token"}`))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", ACMEPresentPath, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Present = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if _, found := cache.Cached(Question{Name: name, Type: RecordTypeTXT, Class: ClassIN}); found {
+		t.Error("Cached TXT answer survived the update")
+	}
+}
+
+func TestACMEHandler_LoopbackOnly(t *testing.T) {
+	handler := NewControlServer("", NewMemoryStore(nil), nil, nil, "").Handler
+	body := `{"fqdn": "_acme-challenge.example.com.", "value": "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0"}`
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       int
+	}{
+		{"ipv4 loopback", "127.0.0.1:40000", http.StatusOK},
+		{"ipv6 loopback", "[::1]:40000", http.StatusOK},
+		{"remote", "192.0.2.1:40000", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, ACMEPresentPath, strings.NewReader(body))
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("Status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
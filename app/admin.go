@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminPath is the control plane path taking admin commands, POSTed as the request body
+const AdminPath = "/admin"
+
+// errNoCache is returned by cache commands when the server isn't resolving through a cache
+var errNoCache = errors.New("no cache configured")
+
+// Admin runs operator commands against a running server:
+//
+//	cache dump          list cached answers
+//	cache flush [name]  drop every cached answer, or only those for name
+//	stats               report query statistics
+//	reload              run the reload hook
+type Admin struct {
+	Cache  *CachingForwarder // nil when not resolving
+	Stats  *QueryStats       // nil when not collected
+	Reload func() error      // nil when there's nothing to reload
+}
+
+// Run executes command, writing its output to w
+func (a *Admin) Run(w io.Writer, command string) error {
+	switch args := strings.Fields(command); {
+	case len(args) == 2 && args[0] == "cache" && args[1] == "dump":
+		if a.Cache == nil {
+			return errNoCache
+		}
+		a.Cache.Dump(w)
+	case len(args) == 2 && args[0] == "cache" && args[1] == "flush":
+		if a.Cache == nil {
+			return errNoCache
+		}
+		fmt.Fprintf(w, "flushed %d entries\n", a.Cache.Flush())
+	case len(args) == 3 && args[0] == "cache" && args[1] == "flush":
+		if a.Cache == nil {
+			return errNoCache
+		}
+		fmt.Fprintf(w, "flushed %d entries for %s\n", a.Cache.FlushName(args[2]), args[2])
+	case len(args) == 1 && args[0] == "stats":
+		if a.Stats == nil {
+			return errors.New("no stats collected")
+		}
+		a.Stats.WriteMetrics(w)
+	case len(args) == 1 && args[0] == "reload":
+		if a.Reload == nil {
+			return errors.New("nothing to reload")
+		}
+		if err := a.Reload(); err != nil {
+			return fmt.Errorf("reload failed: %w", err)
+		}
+		fmt.Fprintln(w, "reloaded")
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return nil
+}
+
+// adminHandler exposes an Admin on the control plane. Only loopback callers are
+// served, whatever address the control plane listens on.
+type adminHandler struct {
+	admin *Admin
+	token string // required bearer token, empty to allow any caller
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !bearerAuthorized(r, h.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	command, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024))
+	if err != nil {
+		http.Error(w, "malformed request body", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("Running admin command %q\n", strings.TrimSpace(string(command)))
+	var out strings.Builder
+	if err := h.admin.Run(&out, string(command)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, out.String())
+}
+
+// fromLoopback reports whether the request came from a loopback address
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdmin_CacheFlushForcesMiss(t *testing.T) {
+	upstream := &flakyForwarder{}
+	cache := NewCachingForwarder(upstream, DefaultCacheCapacity)
+	admin := &Admin{Cache: cache, Stats: NewQueryStats(DefaultStatsCapacity)}
+	server := httptest.NewServer(NewControlServer("", NewMemoryStore(nil), nil, admin, "secret").Handler)
+	defer server.Close()
+
+	run := func(command string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+AdminPath, strings.NewReader(command))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", AdminPath, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	opts := []HandlerOption{WithStore(NewMemoryStore(nil)), WithUpstream(cache)}
+
+	queryRcode(t, opts...)
+	queryRcode(t, opts...)
+	if got := upstream.calls.Load(); got != 1 {
+		t.Fatalf("Upstream called %d times before flushing, want 1", got)
+	}
+
+	status, body := run("cache dump")
+	if status != http.StatusOK || !strings.Contains(body, "stackoverflow.com.\t60\tIN\tA\t10.0.0.1") {
+		t.Errorf("cache dump = %d %q, want the cached answer", status, body)
+	}
+	if status, body := run("cache flush other.example.com"); status != http.StatusOK || body != "flushed 0 entries for other.example.com\n" {
+		t.Errorf("cache flush other.example.com = %d %q, want nothing flushed", status, body)
+	}
+	if status, body := run("cache flush"); status != http.StatusOK || body != "flushed 1 entries\n" {
+		t.Fatalf("cache flush = %d %q, want one entry flushed", status, body)
+	}
+
+	queryRcode(t, opts...)
+	if got := upstream.calls.Load(); got != 2 {
+		t.Errorf("Upstream called %d times after flushing, want 2", got)
+	}
+	if status, _ := run("cache flush stackoverflow.com."); status != http.StatusOK || cache.Len() != 0 {
+		t.Errorf("cache flush stackoverflow.com. = %d, left %d entries", status, cache.Len())
+	}
+
+	if status, body := run("stats"); status != http.StatusOK || !strings.Contains(body, `dns_queries_total`) {
+		t.Errorf("stats = %d %q, want query statistics", status, body)
+	}
+	if status, _ := run("reload"); status != http.StatusBadRequest {
+		t.Errorf("reload without a hook = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status, _ := run("cache explode"); status != http.StatusBadRequest {
+		t.Errorf("Unknown command = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestAdmin_LoopbackOnly(t *testing.T) {
+	handler := NewControlServer("", NewMemoryStore(nil), nil, &Admin{Cache: NewCachingForwarder(&flakyForwarder{}, 1)}, "").Handler
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       int
+	}{
+		{"ipv4 loopback", "127.0.0.1:40000", http.StatusOK},
+		{"ipv6 loopback", "[::1]:40000", http.StatusOK},
+		{"remote", "192.0.2.1:40000", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, AdminPath, strings.NewReader("cache flush"))
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("Status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
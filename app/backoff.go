@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Retry backoff defaults
+const (
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultRetryBackoffMax = 2 * time.Second
+)
+
+// Backoff spaces out retries: the delay before each one doubles from Base up to
+// Max, and a random part of it is dropped so clients failing together don't
+// retry in lockstep
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+
+	jitter func(n int64) int64 // random number in [0, n), replaceable for tests
+}
+
+// Delay returns how long to wait before retry number attempt, counting from 0.
+// It's between half and all of Base doubled attempt times, capped at Max.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Base
+	for range attempt {
+		if delay >= b.Max/2 {
+			delay = b.Max
+			break
+		}
+		delay *= 2
+	}
+	delay = min(delay, b.Max)
+	if delay <= 0 {
+		return 0
+	}
+
+	jitter := b.jitter
+	if jitter == nil {
+		jitter = rand.Int64N
+	}
+	half := delay / 2
+	return delay - half + time.Duration(jitter(int64(half)+1))
+}
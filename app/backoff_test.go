@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		want    time.Duration // before jitter
+	}{
+		{"first retry", 0, 100 * time.Millisecond},
+		{"second retry", 1, 200 * time.Millisecond},
+		{"third retry", 2, 400 * time.Millisecond},
+		{"capped", 3, 500 * time.Millisecond},
+		{"stays capped", 40, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Jitter takes off up to half the delay
+			least := Backoff{Base: 100 * time.Millisecond, Max: 500 * time.Millisecond, jitter: func(n int64) int64 { return 0 }}
+			most := least
+			most.jitter = func(n int64) int64 { return n - 1 }
+
+			if got := least.Delay(tt.attempt); got != tt.want-tt.want/2 {
+				t.Errorf("Delay(%d) with least jitter = %s, want %s", tt.attempt, got, tt.want-tt.want/2)
+			}
+			if got := most.Delay(tt.attempt); got != tt.want {
+				t.Errorf("Delay(%d) with most jitter = %s, want %s", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamSet_RetriesWithBackoff(t *testing.T) {
+	q := Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN}
+
+	tests := []struct {
+		name       string
+		drop       int64 // queries dropped before answering
+		servfail   bool
+		wantDelays []time.Duration
+		wantErr    bool
+	}{
+		{"answers first time", 0, false, nil, false},
+		{"answers after timeouts", 2, false, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, false},
+		{"never answers", 10, false, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond}, true},
+		{"servfail isn't retried", 0, true, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries atomic.Int64
+			addr := startFakeUpstream(t, func(query *Message) []Message {
+				if queries.Add(1) <= tt.drop {
+					return nil
+				}
+				reply := fakeReply(query, query.Questions[0], []byte{4, 4, 4, 4})
+				if tt.servfail {
+					reply.Answers, reply.Header.ANCount = nil, 0
+					reply.Header.SetRcode(RCodeServFail)
+				}
+				return []Message{reply}
+			})
+			upstream := NewUpstream(addr)
+			upstream.Timeout = 50 * time.Millisecond
+			set := NewUpstreamSet(upstream)
+			defer set.Close()
+			set.Retries = 3
+			set.Backoff = Backoff{Base: 10 * time.Millisecond, Max: 25 * time.Millisecond, jitter: func(n int64) int64 { return n - 1 }}
+			var delays []time.Duration
+			set.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+			answers, err := set.Exchange(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exchange() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(answers) != 1 || !bytes.Equal(answers[0].RData, []byte{4, 4, 4, 4})) {
+				t.Errorf("Exchange() = %+v, want the upstream's answer", answers)
+			}
+			if !slices.Equal(delays, tt.wantDelays) {
+				t.Errorf("Backoff delays = %v, want %v", delays, tt.wantDelays)
+			}
+		})
+	}
+}
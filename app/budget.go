@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NameBudget limits how often one client may query one name over UDP. A client
+// over budget is answered with TC=1 and no records, pushing it to TCP, where a
+// spoofed source address can't complete the handshake. This stops a single
+// expensive name being used to amplify traffic at a victim.
+type NameBudget struct {
+	limit  int           // queries allowed per window
+	window time.Duration // counts reset this long after a key's first query
+
+	mu        sync.Mutex
+	counts    map[budgetKey]*budgetCount
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type budgetKey struct {
+	client netip.Addr
+	name   string // lower case
+}
+
+type budgetCount struct {
+	start time.Time // when the current window began
+	n     int
+}
+
+// NewNameBudget creates a budget allowing limit queries per second for each client and name
+func NewNameBudget(limit int) *NameBudget {
+	return &NameBudget{
+		limit:  limit,
+		window: time.Second,
+		counts: make(map[budgetKey]*budgetCount),
+		now:    time.Now,
+	}
+}
+
+// Allow counts a query for name from client and reports whether it's within budget
+func (b *NameBudget) Allow(client netip.Addr, name string) bool {
+	key := budgetKey{client: client, name: strings.ToLower(name)}
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Forget keys whose window has passed, so the map only holds recent senders
+	if now.Sub(b.lastSweep) >= b.window {
+		for k, c := range b.counts {
+			if now.Sub(c.start) >= b.window {
+				delete(b.counts, k)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	c, found := b.counts[key]
+	if !found || now.Sub(c.start) >= b.window {
+		c = &budgetCount{start: now}
+		b.counts[key] = c
+	}
+	c.n++
+	return c.n <= b.limit
+}
+
+// Len returns the number of client and name pairs being counted
+func (b *NameBudget) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.counts)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestNameBudget_Allow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	budget := NewNameBudget(2)
+	budget.now = func() time.Time { return now }
+	client := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+
+	for i, want := range []bool{true, true, false, false} {
+		if got := budget.Allow(client, "expensive.example"); got != want {
+			t.Errorf("Query %d Allow() = %t, want %t", i+1, got, want)
+		}
+	}
+	if !budget.Allow(client, "other.example") {
+		t.Error("Budget for one name was charged for another")
+	}
+	if !budget.Allow(other, "expensive.example") {
+		t.Error("Budget for one client was charged for another")
+	}
+	if !budget.Allow(client, "other.example") || budget.Allow(client, "OTHER.example") {
+		t.Error("Names aren't counted case-insensitively")
+	}
+
+	now = now.Add(time.Second)
+	if !budget.Allow(client, "expensive.example") {
+		t.Error("Budget didn't reset after the window")
+	}
+	if budget.Len() != 1 {
+		t.Errorf("Len() = %d after the window, want old keys forgotten and 1 left", budget.Len())
+	}
+}
+
+func TestServeUDP_NameBudgetForcesTCP(t *testing.T) {
+	addr, _ := StartTestServer(t, WithNameBudget(NewNameBudget(3)))
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	query := func(id uint16, name string) Message {
+		t.Helper()
+		if _, err := client.Write(buildTestDNSQuery(id, []Question{{Name: name, Type: RecordTypeA, Class: ClassIN}})); err != nil {
+			t.Fatalf("Failed to send query: %v", err)
+		}
+		buf := make([]byte, MaxDNSPacketSize)
+		size, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		var respMsg Message
+		if err := respMsg.UnmarshalBinary(buf[:size]); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return respMsg
+	}
+
+	for i := range 5 {
+		resp := query(uint16(0x0415+i), "stackoverflow.com")
+		wantTC := i >= 3
+		if got := resp.Header.GetTC() == 1; got != wantTC {
+			t.Errorf("Query %d TC = %t, want %t", i+1, got, wantTC)
+		}
+		if wantTC && len(resp.Answers) != 0 {
+			t.Errorf("Query %d is over budget but got %d answers", i+1, len(resp.Answers))
+		}
+		if !wantTC && len(resp.Answers) == 0 {
+			t.Errorf("Query %d is within budget but got no answers", i+1)
+		}
+	}
+
+	if resp := query(0x0420, "stackoverflow.design"); resp.Header.GetTC() != 0 {
+		t.Error("Another name was truncated after one name went over budget")
+	}
+}
+
+func TestDNSHandler_OverBudgetKeepsEDNS(t *testing.T) {
+	budget := NewNameBudget(1)
+	client := netip.MustParseAddr("192.0.2.7")
+	cfg := DefaultConfig()
+	cfg.Pad = true
+	header := MessageHeader{Id: 0x0415, QDCount: 1}
+	header.SetRD(1)
+	query := Message{Header: header, Questions: []Question{{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}}, EDNS: &OPTRecord{UDPSize: 4096}}
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	var respMsg Message
+	for range 2 {
+		response, err := NewDNSHandler(queryData, WithConfig(cfg), WithUDP(), WithClient(client), WithNameBudget(budget)).Handle()
+		if err != nil {
+			t.Fatalf("Handle() failed: %v", err)
+		}
+		if err := respMsg.UnmarshalBinary(response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+	}
+	if respMsg.Header.GetTC() != 1 {
+		t.Fatal("Second query within a budget of 1 wasn't truncated")
+	}
+	if respMsg.EDNS == nil {
+		t.Fatal("Truncated response to an EDNS query has no OPT record")
+	}
+	if _, padded := respMsg.EDNS.Option(EDNSOptionPadding); !padded {
+		t.Error("Truncated response wasn't padded with --pad")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// ResponseBuilder assembles a response to a request. Section counts are derived
+// from the records added when Build is called, so they can't drift out of sync.
+type ResponseBuilder struct {
+	header     MessageHeader
+	questions  []Question
+	answers    []ResourceRecord
+	authority  []ResourceRecord
+	additional []ResourceRecord
+	edns       *OPTRecord
+}
+
+// NewResponseBuilder starts a response to request: same ID, opcode and RD flag,
+// the request's questions echoed back, and NOERROR
+func NewResponseBuilder(request *Message) *ResponseBuilder {
+	var header MessageHeader
+	header.Id = request.Header.Id
+	header.SetQR(1)
+	header.SetOpcode(request.Header.GetOpcode())
+	header.SetRD(request.Header.GetRD())
+
+	return &ResponseBuilder{
+		header:    header,
+		questions: request.Questions,
+	}
+}
+
+// AddAnswer appends records to the answer section
+func (b *ResponseBuilder) AddAnswer(records ...ResourceRecord) *ResponseBuilder {
+	b.answers = append(b.answers, records...)
+	return b
+}
+
+// AddAuthority appends records to the authority section
+func (b *ResponseBuilder) AddAuthority(records ...ResourceRecord) *ResponseBuilder {
+	b.authority = append(b.authority, records...)
+	return b
+}
+
+// AddAdditional appends records to the additional section
+func (b *ResponseBuilder) AddAdditional(records ...ResourceRecord) *ResponseBuilder {
+	b.additional = append(b.additional, records...)
+	return b
+}
+
+// SetEDNS sets the OPT record sent with the response, nil for none
+func (b *ResponseBuilder) SetEDNS(opt *OPTRecord) *ResponseBuilder {
+	b.edns = opt
+	return b
+}
+
+// SetRcode sets the response code
+func (b *ResponseBuilder) SetRcode(rcode uint8) *ResponseBuilder {
+	b.header.SetRcode(rcode)
+	return b
+}
+
+// SetAuthoritative sets or clears the AA flag
+func (b *ResponseBuilder) SetAuthoritative(aa bool) *ResponseBuilder {
+	if aa {
+		b.header.SetAA(1)
+	} else {
+		b.header.SetAA(0)
+	}
+	return b
+}
+
+// SetRecursionAvailable sets or clears the RA flag
+func (b *ResponseBuilder) SetRecursionAvailable(ra bool) *ResponseBuilder {
+	if ra {
+		b.header.SetRA(1)
+	} else {
+		b.header.SetRA(0)
+	}
+	return b
+}
+
+// Build returns the response with its section counts filled in and the reserved Z bit cleared.
+// The OPT record isn't counted in the header; MarshalBinary adds it.
+func (b *ResponseBuilder) Build() *Message {
+	header := b.header
+	header.SetZ(0)
+	header.QDCount = uint16(len(b.questions))
+	header.ANCount = uint16(len(b.answers))
+	header.NSCount = uint16(len(b.authority))
+	header.ARCount = uint16(len(b.additional))
+
+	return &Message{
+		Header:     header,
+		Questions:  b.questions,
+		Answers:    b.answers,
+		Authority:  b.authority,
+		Additional: b.additional,
+		EDNS:       b.edns,
+	}
+}
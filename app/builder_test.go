@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestResponseBuilder_Counts(t *testing.T) {
+	request := &Message{
+		Header: MessageHeader{Id: 0xbeef, QDCount: 1},
+		Questions: []Question{
+			{Name: "example.com", Type: RecordTypeA, Class: ClassIN},
+		},
+	}
+	request.Header.SetRD(1)
+	request.Header.SetZ(1)
+
+	a := ResourceRecord{Name: "example.com", Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1}}
+
+	tests := []struct {
+		name                   string
+		build                  func(b *ResponseBuilder)
+		wantAN, wantNS, wantAR uint16
+	}{
+		{"empty", func(b *ResponseBuilder) {}, 0, 0, 0},
+		{"answers", func(b *ResponseBuilder) { b.AddAnswer(a, a) }, 2, 0, 0},
+		{"all sections", func(b *ResponseBuilder) {
+			b.AddAnswer(a).AddAuthority(a, a).AddAdditional(a).AddAdditional(a, a)
+		}, 1, 2, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewResponseBuilder(request)
+			tt.build(b)
+			msg := b.Build()
+
+			h := msg.Header
+			if h.QDCount != 1 || h.ANCount != tt.wantAN || h.NSCount != tt.wantNS || h.ARCount != tt.wantAR {
+				t.Errorf("Counts = %d/%d/%d/%d, want 1/%d/%d/%d",
+					h.QDCount, h.ANCount, h.NSCount, h.ARCount, tt.wantAN, tt.wantNS, tt.wantAR)
+			}
+			if h.Id != 0xbeef || h.GetQR() != 1 || h.GetRD() != 1 {
+				t.Errorf("Header = %+v, want the request ID with QR and RD set", h)
+			}
+			if h.GetZ() != 0 {
+				t.Error("Response has the reserved Z bit set")
+			}
+
+			// Counts must agree with the sections once on the wire
+			data, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+			var decoded Message
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() failed: %v", err)
+			}
+			if len(decoded.Answers) != int(tt.wantAN) || len(decoded.Authority) != int(tt.wantNS) ||
+				len(decoded.Additional) != int(tt.wantAR) {
+				t.Errorf("Decoded sections = %d/%d/%d, want %d/%d/%d",
+					len(decoded.Answers), len(decoded.Authority), len(decoded.Additional),
+					tt.wantAN, tt.wantNS, tt.wantAR)
+			}
+		})
+	}
+}
+
+func TestResponseBuilder_RcodeAndAuthoritative(t *testing.T) {
+	request := &Message{Header: MessageHeader{Id: 1}}
+
+	msg := NewResponseBuilder(request).SetRcode(RCodeNXDomain).SetAuthoritative(true).Build()
+	if msg.Header.GetRcode() != RCodeNXDomain {
+		t.Errorf("RCode = %d, want %d", msg.Header.GetRcode(), RCodeNXDomain)
+	}
+	if msg.Header.GetAA() != 1 {
+		t.Error("AA not set")
+	}
+
+	msg = NewResponseBuilder(request).SetAuthoritative(true).SetAuthoritative(false).Build()
+	if msg.Header.GetAA() != 0 {
+		t.Error("AA still set after SetAuthoritative(false)")
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache defaults
+const (
+	DefaultCacheCapacity = 10000
+	DefaultStaleMaxAge   = 24 * time.Hour          // RFC 8767 suggests 1 to 3 days
+	StaleTTL             = 30                      // TTL of stale answers, in seconds (RFC 8767 section 4)
+	DefaultStaleTimeout  = 1800 * time.Millisecond // RFC 8767 client response timer
+)
+
+// CachingForwarder wraps a Forwarder and caches its answers until their TTL runs out.
+// NXDOMAIN answers are cached too, for as long as their SOA allows (RFC 2308).
+// With ServeStale set, expired answers are kept for StaleMaxAge longer and returned
+// (RFC 8767) when refreshing them fails or takes longer than StaleTimeout.
+type CachingForwarder struct {
+	ServeStale   bool
+	StaleMaxAge  time.Duration // how long past expiry an answer may still be served stale
+	StaleTimeout time.Duration // how long to wait for a refresh before answering stale
+
+	next     Forwarder
+	capacity int
+
+	mu      sync.Mutex
+	entries map[questionKey]*cacheEntry
+	now     func() time.Time // replaceable for tests
+}
+
+// cacheEntry is a cached answer
+type cacheEntry struct {
+	answers    []ResourceRecord
+	stored     time.Time
+	expires    time.Time
+	refreshing bool // a background refresh is in flight
+
+	authoritative bool // answered from a zone we're authoritative for rather than forwarded
+
+	rcode     uint8            // RCodeNXDomain for a negative answer
+	authority []ResourceRecord // the SOA of a negative answer
+}
+
+// NewCachingForwarder creates a cache holding up to capacity answers from next
+func NewCachingForwarder(next Forwarder, capacity int) *CachingForwarder {
+	return &CachingForwarder{
+		StaleMaxAge:  DefaultStaleMaxAge,
+		StaleTimeout: DefaultStaleTimeout,
+		next:         next,
+		capacity:     capacity,
+		entries:      make(map[questionKey]*cacheEntry),
+		now:          time.Now,
+	}
+}
+
+// Exchange implements Forwarder
+func (c *CachingForwarder) Exchange(q Question) ([]ResourceRecord, error) {
+	answers, _, err := c.ExchangeSubnet(q, netip.Prefix{})
+	return answers, err
+}
+
+// ExchangeSubnet implements SubnetForwarder. Answers are cached for the scope the
+// upstream says they apply to, and only served to clients within it, so one
+// tailored to clients in one network isn't handed to clients elsewhere.
+func (c *CachingForwarder) ExchangeSubnet(q Question, subnet netip.Prefix) ([]ResourceRecord, netip.Prefix, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	key, entry, found := c.lookup(q, subnet)
+	if found && now.Before(entry.expires) {
+		answers, authority := entry.remaining(now), entry.remainingAuthority(now)
+		c.mu.Unlock()
+		if entry.rcode != RCodeNoError {
+			return nil, key.Subnet, &RcodeError{Addr: "cache", Rcode: entry.rcode, Authority: authority}
+		}
+		return answers, key.Subnet, nil
+	}
+	// Only positive answers are served stale
+	stale := found && entry.rcode == RCodeNoError && c.ServeStale && now.Before(entry.expires.Add(c.StaleMaxAge))
+	if !stale || entry.refreshing {
+		c.mu.Unlock()
+		if stale {
+			// Someone is already refreshing it, don't pile on
+			return entry.staleAnswers(), key.Subnet, nil
+		}
+		answers, scope, err := exchangeSubnet(c.next, q, subnet)
+		c.replace(key, subnetKeyFor(q, scope), answers, err)
+		return answers, scope, err
+	}
+	entry.refreshing = true
+	c.mu.Unlock()
+
+	// Refresh in the background so a slow upstream can't hold the client past the timer
+	type result struct {
+		answers []ResourceRecord
+		scope   netip.Prefix
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		answers, scope, err := exchangeSubnet(c.next, q, subnet)
+		if !c.replace(key, subnetKeyFor(q, scope), answers, err) {
+			c.mu.Lock()
+			entry.refreshing = false
+			c.mu.Unlock()
+		}
+		done <- result{answers, scope, err}
+	}()
+
+	timer := time.NewTimer(c.StaleTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.err == nil {
+			return cloneRecords(r.answers), r.scope, nil
+		}
+		var rcodeErr *RcodeError
+		if errors.As(r.err, &rcodeErr) && rcodeErr.Negative() {
+			// The name is gone, which is an answer rather than an error to hide
+			return nil, r.scope, r.err
+		}
+		if rcodeErr != nil {
+			// stale-if-error: the upstream answered, but with a failure (RFC 8767 section 4)
+			fmt.Printf("Upstream answered %s with rcode %d, serving stale answer\n", q.Name, rcodeErr.Rcode)
+		} else {
+			fmt.Printf("Refreshing %s failed (%v), serving stale answer\n", q.Name, r.err)
+		}
+	case <-timer.C:
+		fmt.Printf("Refreshing %s is taking longer than %s, serving stale answer\n", q.Name, c.StaleTimeout)
+	}
+	return entry.staleAnswers(), key.Subnet, nil
+}
+
+// lookup finds the entry for q that applies to clients in subnet: the one for the
+// longest scope containing it, or else the one for every client. Must be called with mu held.
+func (c *CachingForwarder) lookup(q Question, subnet netip.Prefix) (questionKey, *cacheEntry, bool) {
+	if subnet.IsValid() {
+		for bits := subnet.Bits(); bits > 0; bits-- {
+			scope, _ := subnet.Addr().Prefix(bits)
+			key := subnetKeyFor(q, scope)
+			if entry, found := c.entries[key]; found {
+				return key, entry, true
+			}
+		}
+	}
+	key := keyFor(q)
+	entry, found := c.entries[key]
+	return key, entry, found
+}
+
+// replace caches what the next forwarder said under key, fresh answers or an
+// NXDOMAIN, first dropping the entry under old they were fetched to replace when
+// the upstream changed the scope they apply to. It reports whether err was
+// an answer, so the entry was replaced, rather than a failure.
+func (c *CachingForwarder) replace(old, key questionKey, answers []ResourceRecord, err error) bool {
+	var rcodeErr *RcodeError
+	negative := errors.As(err, &rcodeErr) && rcodeErr.Negative()
+	if err != nil && !negative {
+		return false
+	}
+	if old != key {
+		c.mu.Lock()
+		delete(c.entries, old)
+		c.mu.Unlock()
+	}
+	if negative {
+		c.storeNegative(key, rcodeErr.Rcode, rcodeErr.Authority)
+	} else {
+		c.store(key, answers, false)
+	}
+	return true
+}
+
+// Cached returns the unexpired cached answers for q without asking the next
+// forwarder, and whether there were any
+func (c *CachingForwarder) Cached(q Question) ([]ResourceRecord, bool) {
+	result, found := c.CachedResult(q)
+	return result.Answers, found
+}
+
+// CachedResult is like Cached, but returns the answers as a Result marked
+// authoritative when they were stored by StoreAuthoritative. A cached NXDOMAIN
+// is returned with its rcode and SOA.
+func (c *CachingForwarder) CachedResult(q Question) (Result, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[keyFor(q)]
+	if !found || !now.Before(entry.expires) {
+		return Result{}, false
+	}
+	return Result{
+		Answers:       entry.remaining(now),
+		Authority:     entry.remainingAuthority(now),
+		Rcode:         entry.rcode,
+		Authoritative: entry.authoritative,
+	}, true
+}
+
+// StoreAuthoritative caches answers for q taken from a zone we're authoritative
+// for, so they keep the AA bit when served from the cache
+func (c *CachingForwarder) StoreAuthoritative(q Question, answers []ResourceRecord) {
+	c.store(keyFor(q), answers, true)
+}
+
+// store caches answers for key until the lowest TTL among them runs out. A CNAME
+// chain is cached whole under the original question, each record keeping its own TTL.
+func (c *CachingForwarder) store(key questionKey, answers []ResourceRecord, authoritative bool) {
+	if len(answers) == 0 {
+		return
+	}
+	ttl := answers[0].TTL
+	for _, rr := range answers[1:] {
+		ttl = min(ttl, rr.TTL)
+	}
+	c.insert(key, &cacheEntry{answers: cloneRecords(answers), authoritative: authoritative}, ttl)
+}
+
+// storeNegative caches a negative answer with the given rcode for key. Its
+// TTL is the lower of the SOA's own and its minimum field (RFC 2308 section 5);
+// without an SOA it isn't cached at all.
+func (c *CachingForwarder) storeNegative(key questionKey, rcode uint8, authority []ResourceRecord) {
+	for _, rr := range authority {
+		var soa SOAData
+		if rr.Type != RecordTypeSOA || soa.UnmarshalBinary(rr.RData) != nil {
+			continue
+		}
+		ttl := min(rr.TTL, soa.Minimum)
+		c.insert(key, &cacheEntry{rcode: rcode, authority: cloneRecords(authority)}, ttl)
+		return
+	}
+}
+
+// insert caches entry under key for ttl seconds, making room if the cache is full
+func (c *CachingForwarder) insert(key questionKey, entry *cacheEntry, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.entries[key]; !found && len(c.entries) >= c.capacity {
+		c.evict(now)
+		if len(c.entries) >= c.capacity {
+			return
+		}
+	}
+	entry.stored = now
+	entry.expires = now.Add(time.Duration(ttl) * time.Second)
+	c.entries[key] = entry
+}
+
+// evict drops entries that can no longer be served, fresh or stale. Must be called with mu held.
+func (c *CachingForwarder) evict(now time.Time) {
+	for key, entry := range c.entries {
+		servable := entry.expires
+		if c.ServeStale {
+			servable = servable.Add(c.StaleMaxAge)
+		}
+		if !now.Before(servable) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Len returns the number of cached answers
+func (c *CachingForwarder) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Dump writes every cached answer, one record per line with its remaining TTL.
+// Expired answers kept for serve-stale are marked as such.
+func (c *CachingForwarder) Dump(w io.Writer) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]questionKey, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b questionKey) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type), cmp.Compare(a.Class, b.Class),
+			strings.Compare(a.Subnet.String(), b.Subnet.String()))
+	})
+	for _, key := range keys {
+		entry := c.entries[key]
+		state := "fresh"
+		answers := entry.remaining(now)
+		if !now.Before(entry.expires) {
+			state = "stale"
+			answers = entry.staleAnswers()
+		}
+		if entry.rcode != RCodeNoError {
+			state = fmt.Sprintf("%s, rcode %d", state, entry.rcode)
+			answers = entry.remainingAuthority(now)
+		}
+		if key.Subnet.IsValid() {
+			fmt.Fprintf(w, "; %s %s for %s (%s)\n", key.Name, TypeName(key.Type), key.Subnet, state)
+		} else {
+			fmt.Fprintf(w, "; %s %s (%s)\n", key.Name, TypeName(key.Type), state)
+		}
+		for _, rr := range answers {
+			fmt.Fprintln(w, rr.String())
+		}
+	}
+}
+
+// Delete drops the cached answer for one question, reporting whether there was
+// one, so the next query for it is looked up afresh
+func (c *CachingForwarder) Delete(name string, qtype, qclass uint16) bool {
+	want := keyFor(Question{Name: strings.TrimSuffix(name, "."), Type: qtype, Class: qclass})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := false
+	for key := range c.entries {
+		// Answers cached for each client subnet all go
+		if key.Name == want.Name && key.Type == want.Type && key.Class == want.Class {
+			delete(c.entries, key)
+			found = true
+		}
+	}
+	return found
+}
+
+// FlushName drops the cached answers for name, of any type and class, and returns how many there were
+func (c *CachingForwarder) FlushName(name string) int {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flushed := 0
+	for key := range c.entries {
+		if key.Name == name {
+			delete(c.entries, key)
+			flushed++
+		}
+	}
+	return flushed
+}
+
+// Flush drops every cached answer and returns how many there were
+func (c *CachingForwarder) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flushed := len(c.entries)
+	clear(c.entries)
+	return flushed
+}
+
+// remaining returns copies of the answers with their TTLs reduced by the time spent in the cache
+func (e *cacheEntry) remaining(now time.Time) []ResourceRecord {
+	return e.aged(e.answers, now)
+}
+
+// remainingAuthority is like remaining, for the authority section of a negative answer
+func (e *cacheEntry) remainingAuthority(now time.Time) []ResourceRecord {
+	return e.aged(e.authority, now)
+}
+
+// aged returns copies of records with their TTLs reduced by the time spent in the cache
+func (e *cacheEntry) aged(records []ResourceRecord, now time.Time) []ResourceRecord {
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	records = cloneRecords(records)
+	for i := range records {
+		records[i].TTL -= min(elapsed, records[i].TTL)
+	}
+	return records
+}
+
+// staleAnswers returns copies of the answers with the stale TTL
+func (e *cacheEntry) staleAnswers() []ResourceRecord {
+	answers := cloneRecords(e.answers)
+	for i := range answers {
+		answers[i].TTL = StaleTTL
+	}
+	return answers
+}
+
+// DelegationCache remembers the name server addresses of zone cuts learned from
+// referrals, so resolution can start at the closest known cut instead of the root
+type DelegationCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]delegation // keyed by lowercase zone name
+	now     func() time.Time      // replaceable for tests
+}
+
+// delegation is the cached name server addresses for one zone cut
+type delegation struct {
+	servers []string
+	expires time.Time
+}
+
+// NewDelegationCache creates a cache holding up to capacity zone cuts
+func NewDelegationCache(capacity int) *DelegationCache {
+	return &DelegationCache{
+		capacity: capacity,
+		entries:  make(map[string]delegation),
+		now:      time.Now,
+	}
+}
+
+// Store caches the server addresses for zone for ttl seconds
+func (c *DelegationCache) Store(zone string, servers []string, ttl uint32) {
+	if ttl == 0 || len(servers) == 0 {
+		return
+	}
+	zone = strings.ToLower(zone)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.entries[zone]; !found && len(c.entries) >= c.capacity {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= c.capacity {
+			return
+		}
+	}
+	c.entries[zone] = delegation{
+		servers: append([]string(nil), servers...),
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// Closest returns the deepest unexpired zone cut at or above name and its server addresses
+func (c *DelegationCache) Closest(name string) (string, []string, bool) {
+	name = strings.ToLower(name)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for zone := name; zone != ""; {
+		if entry, found := c.entries[zone]; found {
+			if now.Before(entry.expires) {
+				return zone, append([]string(nil), entry.servers...), true
+			}
+			delete(c.entries, zone)
+		}
+		_, zone, _ = strings.Cut(zone, ".")
+	}
+	return "", nil, false
+}
+
+// Len returns the number of cached zone cuts
+func (c *DelegationCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyForwarder answers with a fixed A record until down is set, then fails
+type flakyForwarder struct {
+	calls atomic.Int64
+	down  atomic.Bool
+}
+
+func (f *flakyForwarder) Exchange(q Question) ([]ResourceRecord, error) {
+	f.calls.Add(1)
+	if f.down.Load() {
+		return nil, errors.New("upstream unreachable")
+	}
+	return []ResourceRecord{
+		{Name: q.Name, Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{10, 0, 0, 1}},
+	}, nil
+}
+
+// newTestCache returns a cache over upstream and a function advancing its clock
+func newTestCache(upstream Forwarder) (*CachingForwarder, func(time.Duration)) {
+	cache := NewCachingForwarder(upstream, DefaultCacheCapacity)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return cache, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestCachingForwarder_CachesUntilTTL(t *testing.T) {
+	upstream := &flakyForwarder{}
+	cache, advance := newTestCache(upstream)
+	q := Question{Name: "cached.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	if _, err := cache.Exchange(q); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	advance(20 * time.Second)
+	answers, err := cache.Exchange(q)
+	if err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	if upstream.calls.Load() != 1 {
+		t.Errorf("Upstream called %d times, want 1", upstream.calls.Load())
+	}
+	if len(answers) != 1 || answers[0].TTL != 40 {
+		t.Errorf("Cached answers = %+v, want one with TTL 40", answers)
+	}
+
+	advance(40 * time.Second)
+	if _, err := cache.Exchange(q); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	if upstream.calls.Load() != 2 {
+		t.Errorf("Upstream called %d times after expiry, want 2", upstream.calls.Load())
+	}
+}
+
+func TestCachingForwarder_ServeStale(t *testing.T) {
+	tests := []struct {
+		name       string
+		serveStale bool
+		wantErr    bool
+	}{
+		{"serve-stale on", true, false},
+		{"serve-stale off", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &flakyForwarder{}
+			cache, advance := newTestCache(upstream)
+			cache.ServeStale = tt.serveStale
+			q := Question{Name: "stale.example.com", Type: RecordTypeA, Class: ClassIN}
+
+			if _, err := cache.Exchange(q); err != nil {
+				t.Fatalf("Exchange() failed: %v", err)
+			}
+
+			upstream.down.Store(true)
+			advance(2 * time.Minute)
+
+			answers, err := cache.Exchange(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exchange() with upstream down error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(answers) != 1 || answers[0].RData[3] != 1 {
+				t.Fatalf("Stale answers = %+v, want the cached record", answers)
+			}
+			if answers[0].TTL != StaleTTL {
+				t.Errorf("Stale answer TTL = %d, want %d", answers[0].TTL, StaleTTL)
+			}
+			if upstream.calls.Load() != 2 {
+				t.Errorf("Upstream called %d times, want a refresh attempt", upstream.calls.Load())
+			}
+
+			// Past the stale window the answer is gone
+			advance(cache.StaleMaxAge)
+			if _, err := cache.Exchange(q); err == nil {
+				t.Error("Exchange() served an answer past the stale window")
+			}
+		})
+	}
+}
+
+func TestCachingForwarder_StaleWhileSlowRefresh(t *testing.T) {
+	slow := &blockingForwarder{release: make(chan struct{})}
+	close(slow.release) // the first exchange fills the cache immediately
+	cache, advance := newTestCache(slow)
+	cache.ServeStale = true
+	cache.StaleTimeout = 20 * time.Millisecond
+	q := Question{Name: "slow.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	if _, err := cache.Exchange(q); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+
+	slow.release = make(chan struct{})
+	defer close(slow.release)
+	advance(time.Minute)
+
+	answers, err := cache.Exchange(q)
+	if err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	if len(answers) != 1 || answers[0].TTL != StaleTTL {
+		t.Errorf("Answers while refreshing = %+v, want the stale record", answers)
+	}
+}
+
+func TestDelegationCache_Closest(t *testing.T) {
+	cache := NewDelegationCache(DefaultCacheCapacity)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Store("com", []string{"192.0.2.1:53"}, 3600)
+	cache.Store("Example.com", []string{"192.0.2.2:53"}, 60)
+	cache.Store("uncacheable.com", []string{"192.0.2.3:53"}, 0)
+
+	tests := []struct {
+		name     string
+		advance  time.Duration
+		wantZone string
+	}{
+		{"www.example.com", 0, "example.com"},
+		{"EXAMPLE.com", 0, "example.com"},
+		{"www.uncacheable.com", 0, "com"},
+		{"www.example.net", 0, ""},
+		{"www.example.com", time.Minute, "com"},
+		{"www.example.com", time.Hour, ""},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		zone, servers, ok := cache.Closest(tt.name)
+		if zone != tt.wantZone || ok != (tt.wantZone != "") {
+			t.Errorf("Closest(%q) = %q, %v, want %q", tt.name, zone, ok, tt.wantZone)
+		}
+		if ok && len(servers) != 1 {
+			t.Errorf("Closest(%q) returned %d servers, want 1", tt.name, len(servers))
+		}
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Len() = %d after every delegation expired, want 0", cache.Len())
+	}
+}
+
+// chainForwarder answers with a CNAME and its target's A record, each with its own TTL
+type chainForwarder struct {
+	calls          atomic.Int64
+	cnameTTL, aTTL uint32
+}
+
+func (f *chainForwarder) Exchange(q Question) ([]ResourceRecord, error) {
+	f.calls.Add(1)
+	target := []byte{6, 't', 'a', 'r', 'g', 'e', 't', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0}
+	return []ResourceRecord{
+		{Name: q.Name, Type: RecordTypeCNAME, Class: ClassIN, TTL: f.cnameTTL, RData: target},
+		{Name: "target.example", Type: RecordTypeA, Class: ClassIN, TTL: f.aTTL, RData: []byte{10, 0, 0, 2}},
+	}, nil
+}
+
+func TestCachingForwarder_CNAMEChainExpiresAtMinimumTTL(t *testing.T) {
+	tests := []struct {
+		name           string
+		cnameTTL, aTTL uint32
+	}{
+		{"target expires first", 300, 60},
+		{"alias expires first", 60, 300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &chainForwarder{cnameTTL: tt.cnameTTL, aTTL: tt.aTTL}
+			cache, advance := newTestCache(upstream)
+			q := Question{Name: "alias.example", Type: RecordTypeA, Class: ClassIN}
+
+			if _, err := cache.Exchange(q); err != nil {
+				t.Fatalf("Exchange() failed: %v", err)
+			}
+			advance(59 * time.Second)
+			answers, err := cache.Exchange(q)
+			if err != nil {
+				t.Fatalf("Exchange() failed: %v", err)
+			}
+			if upstream.calls.Load() != 1 {
+				t.Fatalf("Upstream called %d times before the minimum TTL, want 1", upstream.calls.Load())
+			}
+			// Each record counts down from its own TTL
+			if len(answers) != 2 || answers[0].TTL != tt.cnameTTL-59 || answers[1].TTL != tt.aTTL-59 {
+				t.Errorf("Cached answers = %+v, want TTLs %d and %d", answers, tt.cnameTTL-59, tt.aTTL-59)
+			}
+
+			advance(time.Second)
+			if _, err := cache.Exchange(q); err != nil {
+				t.Fatalf("Exchange() failed: %v", err)
+			}
+			if upstream.calls.Load() != 2 {
+				t.Errorf("Upstream called %d times once the minimum TTL passed, want 2", upstream.calls.Load())
+			}
+		})
+	}
+}
+
+// typedForwarder answers A and AAAA questions with a record of the asked type, counting calls per type
+type typedForwarder struct {
+	a, aaaa atomic.Int64
+}
+
+func (f *typedForwarder) Exchange(q Question) ([]ResourceRecord, error) {
+	rdata := []byte{10, 0, 0, 4}
+	if q.Type == RecordTypeAAAA {
+		f.aaaa.Add(1)
+		rdata = net.ParseIP("2001:db8::4")
+	} else {
+		f.a.Add(1)
+	}
+	return []ResourceRecord{{Name: q.Name, Type: q.Type, Class: ClassIN, TTL: 60, RData: rdata}}, nil
+}
+
+func TestDNSHandler_PrefetchAAAA(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefetch bool
+	}{
+		{"prefetch on", true},
+		{"prefetch off", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &typedForwarder{}
+			cache, _ := newTestCache(upstream)
+			cfg := DefaultConfig()
+			cfg.PrefetchAAAA = tt.prefetch
+
+			queryData := buildTestDNSQuery(0x7061, []Question{
+				{Name: "dual.example.org", Type: RecordTypeA, Class: ClassIN},
+			})
+			response, err := NewDNSHandler(queryData, WithConfig(cfg), WithUpstream(cache)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(respMsg.Answers) != 1 || respMsg.Answers[0].Type != RecordTypeA {
+				t.Fatalf("Response answers = %+v, want just the A record", respMsg.Answers)
+			}
+
+			if !tt.prefetch {
+				if cache.Len() != 1 || upstream.aaaa.Load() != 0 {
+					t.Errorf("Cache has %d entries and upstream saw %d AAAA queries without prefetch, want 1 and 0",
+						cache.Len(), upstream.aaaa.Load())
+				}
+				return
+			}
+
+			// The prefetch runs in the background, give it a moment
+			deadline := time.Now().Add(time.Second)
+			for cache.Len() < 2 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if cache.Len() != 2 {
+				t.Fatalf("Cache has %d entries after the A query, want the A and prefetched AAAA", cache.Len())
+			}
+			answers, err := cache.Exchange(Question{Name: "dual.example.org", Type: RecordTypeAAAA, Class: ClassIN})
+			if err != nil {
+				t.Fatalf("Exchange() failed: %v", err)
+			}
+			if len(answers) != 1 || answers[0].Type != RecordTypeAAAA {
+				t.Errorf("AAAA answers = %+v, want one AAAA record", answers)
+			}
+			if upstream.aaaa.Load() != 1 {
+				t.Errorf("Upstream saw %d AAAA queries, want just the prefetch", upstream.aaaa.Load())
+			}
+		})
+	}
+}
+
+func TestCachingForwarder_StaleIfServFail(t *testing.T) {
+	tests := []struct {
+		name       string
+		serveStale bool
+		wantRcode  uint8
+	}{
+		{"serve-stale on", true, RCodeNoError},
+		{"serve-stale off", false, RCodeServFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var servfail atomic.Bool
+			addr := startFakeUpstream(t, func(query *Message) []Message {
+				reply := fakeReply(query, query.Questions[0], []byte{192, 0, 2, 1})
+				if servfail.Load() {
+					reply.Answers = nil
+					reply.Header.ANCount = 0
+					reply.Header.SetRcode(RCodeServFail)
+				}
+				return []Message{reply}
+			})
+			cache, advance := newTestCache(NewUpstream(addr))
+			cache.ServeStale = tt.serveStale
+			queryData := buildTestDNSQuery(0x0416, []Question{{Name: "flaky.example.com", Type: RecordTypeA, Class: ClassIN}})
+
+			if _, err := NewDNSHandler(queryData, WithUpstream(cache)).Handle(); err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			servfail.Store(true)
+			advance(time.Minute)
+
+			response, err := NewDNSHandler(queryData, WithUpstream(cache)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() with upstream answering SERVFAIL failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Fatalf("RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if tt.wantRcode != RCodeNoError {
+				return
+			}
+			if len(respMsg.Answers) != 1 || respMsg.Answers[0].TTL != StaleTTL {
+				t.Errorf("Answers = %+v, want the stale record with TTL %d", respMsg.Answers, StaleTTL)
+			}
+		})
+	}
+}
+
+func TestCachingForwarder_Delete(t *testing.T) {
+	upstream := &flakyForwarder{}
+	cache, _ := newTestCache(upstream)
+	q := Question{Name: "Deleted.example.com", Type: RecordTypeA, Class: ClassIN}
+	other := Question{Name: "kept.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	for _, q := range []Question{q, other} {
+		if _, err := cache.Exchange(q); err != nil {
+			t.Fatalf("Exchange() failed: %v", err)
+		}
+	}
+	if cache.Delete("deleted.example.com.", RecordTypeAAAA, ClassIN) {
+		t.Errorf("Delete() of an uncached type reported an entry")
+	}
+	if !cache.Delete("deleted.example.com.", RecordTypeA, ClassIN) {
+		t.Fatalf("Delete() found no entry to delete")
+	}
+
+	for _, q := range []Question{q, other} {
+		if _, err := cache.Exchange(q); err != nil {
+			t.Fatalf("Exchange() failed: %v", err)
+		}
+	}
+	if got := upstream.calls.Load(); got != 3 {
+		t.Errorf("Upstream called %d times, want 3 (one fresh lookup after Delete)", got)
+	}
+
+	if flushed := cache.Flush(); flushed != 2 || cache.Len() != 0 {
+		t.Errorf("Flush() = %d leaving %d entries, want 2 leaving none", flushed, cache.Len())
+	}
+}
+
+func TestDNSHandler_CachedAnswersKeepAuthority(t *testing.T) {
+	upstream := &flakyForwarder{}
+	cache, _ := newTestCache(upstream)
+	opts := []HandlerOption{WithZone(newTestZone(t)), WithUpstream(cache)}
+
+	tests := []struct {
+		name   string
+		q      Question
+		wantAA uint8
+	}{
+		{"in-zone answer", Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}, 1},
+		{"forwarded answer", Question{Name: "www.example.org", Type: RecordTypeA, Class: ClassIN}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first query fills the cache, the second is answered from it
+			for _, attempt := range []string{"first", "cached"} {
+				response, err := NewDNSHandler(buildTestDNSQuery(0x0447, []Question{tt.q}), opts...).Handle()
+				if err != nil {
+					t.Fatalf("Handle() failed: %v", err)
+				}
+				var respMsg Message
+				if err := respMsg.UnmarshalBinary(response); err != nil {
+					t.Fatalf("Failed to parse response: %v", err)
+				}
+				if len(respMsg.Answers) != 1 {
+					t.Fatalf("%s response has %d answers, want 1", attempt, len(respMsg.Answers))
+				}
+				if got := respMsg.Header.GetAA(); got != tt.wantAA {
+					t.Errorf("%s response AA = %d, want %d", attempt, got, tt.wantAA)
+				}
+			}
+			if _, found := cache.Cached(tt.q); !found {
+				t.Errorf("Cached(%s) found nothing, want the answer cached", tt.q.Name)
+			}
+		})
+	}
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Errorf("Upstream called %d times, want 1 for the forwarded name only", calls)
+	}
+}
+
+func TestCachingForwarder_CachesNXDOMAIN(t *testing.T) {
+	var queries atomic.Int64
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		queries.Add(1)
+		return []Message{negativeReply(t, query, RCodeNXDomain)}
+	})
+	cache, advance := newTestCache(NewUpstream(addr))
+	cache.ServeStale = true
+	q := Question{Name: "missing.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	for _, elapsed := range []time.Duration{0, 20 * time.Second} {
+		advance(elapsed)
+		result, err := forwardResult(t, cache, q)
+		if err != nil {
+			t.Fatalf("Handle() failed: %v", err)
+		}
+		if result.Header.GetRcode() != RCodeNXDomain {
+			t.Fatalf("RCode = %d, want NXDOMAIN", result.Header.GetRcode())
+		}
+		if want := uint32(300 - elapsed/time.Second); len(result.Authority) != 1 || result.Authority[0].TTL != want {
+			t.Errorf("Authority = %+v, want the SOA with TTL %d", result.Authority, want)
+		}
+	}
+	if got := queries.Load(); got != 1 {
+		t.Errorf("Upstream received %d queries, want 1 with the NXDOMAIN cached", got)
+	}
+
+	// The answer is cached for the SOA minimum of 60, lower than the SOA's TTL of
+	// 300 (RFC 2308 section 5), and past it is asked for again rather than served stale
+	advance(time.Minute)
+	if _, err := forwardResult(t, cache, q); err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("Upstream received %d queries after the negative TTL, want 2", got)
+	}
+}
+
+// forwardResult answers q through a handler forwarding to upstream and returns the parsed response
+func forwardResult(t *testing.T, upstream Forwarder, q Question) (Message, error) {
+	t.Helper()
+	var respMsg Message
+	response, err := NewDNSHandler(buildTestDNSQuery(0x0380, []Question{q}), WithUpstream(upstream)).Handle()
+	if err != nil {
+		return respMsg, err
+	}
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	return respMsg, nil
+}
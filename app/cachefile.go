@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFileVersion identifies the cache file format, bumped on incompatible changes
+const cacheFileVersion = 1
+
+// cacheFile is the on-disk form of a cache, written by Save and read by Load
+type cacheFile struct {
+	Version int              `json:"version"`
+	Entries []cacheFileEntry `json:"entries"`
+}
+
+// cacheFileEntry is one cached answer. Times are absolute so the TTLs left
+// count down while the server is stopped.
+type cacheFileEntry struct {
+	Name    string           `json:"name"`
+	Type    uint16           `json:"type"`
+	Class   uint16           `json:"class"`
+	Subnet  netip.Prefix     `json:"subnet"`
+	Stored  time.Time        `json:"stored"`
+	Expires time.Time        `json:"expires"`
+	Answers []ResourceRecord `json:"answers"`
+
+	Authoritative bool `json:"authoritative,omitempty"`
+
+	Rcode     uint8            `json:"rcode,omitempty"`     // set for a negative answer
+	Authority []ResourceRecord `json:"authority,omitempty"` // the SOA of a negative answer
+}
+
+// Save writes every answer that hasn't expired yet to w
+func (c *CachingForwarder) Save(w io.Writer) error {
+	now := c.now()
+
+	c.mu.Lock()
+	file := cacheFile{Version: cacheFileVersion, Entries: make([]cacheFileEntry, 0, len(c.entries))}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			continue
+		}
+		file.Entries = append(file.Entries, cacheFileEntry{
+			Name:    key.Name,
+			Type:    key.Type,
+			Class:   key.Class,
+			Subnet:  key.Subnet,
+			Stored:  entry.stored,
+			Expires: entry.expires,
+			Answers: cloneRecords(entry.answers),
+
+			Authoritative: entry.authoritative,
+
+			Rcode:     entry.rcode,
+			Authority: cloneRecords(entry.authority),
+		})
+	}
+	c.mu.Unlock()
+
+	if err := json.NewEncoder(w).Encode(file); err != nil {
+		return fmt.Errorf("failed to encode cache: %w", err)
+	}
+	return nil
+}
+
+// Load adds the answers saved by Save to the cache, discarding those that have
+// expired since, and returns how many were loaded
+func (c *CachingForwarder) Load(r io.Reader) (int, error) {
+	var file cacheFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return 0, fmt.Errorf("failed to decode cache: %w", err)
+	}
+	if file.Version != cacheFileVersion {
+		return 0, fmt.Errorf("unsupported cache file version %d, want %d", file.Version, cacheFileVersion)
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	loaded := 0
+	for _, saved := range file.Entries {
+		if !now.Before(saved.Expires) || len(saved.Answers) == 0 && saved.Rcode == RCodeNoError {
+			continue
+		}
+		if len(c.entries) >= c.capacity {
+			break
+		}
+		key := questionKey{Name: saved.Name, Type: saved.Type, Class: saved.Class, Subnet: saved.Subnet}
+		c.entries[key] = &cacheEntry{
+			answers:       saved.Answers,
+			stored:        saved.Stored,
+			expires:       saved.Expires,
+			authoritative: saved.Authoritative,
+			rcode:         saved.Rcode,
+			authority:     saved.Authority,
+		}
+		loaded++
+	}
+	return loaded, nil
+}
+
+// SaveFile saves the cache to path, replacing it only once fully written
+func (c *CachingForwarder) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := c.Save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache file: %w", err)
+	}
+	return nil
+}
+
+// LoadFile loads the cache saved at path. A missing file loads nothing.
+func (c *CachingForwarder) LoadFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cache file: %w", err)
+	}
+	defer f.Close()
+	return c.Load(f)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachingForwarder_SaveAndLoad(t *testing.T) {
+	cache, advance := newTestCache(&flakyForwarder{})
+	early := Question{Name: "early.example.com", Type: RecordTypeA, Class: ClassIN}
+	late := Question{Name: "late.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	// Both answers have a TTL of 60s: early expires 40s before late
+	if _, err := cache.Exchange(early); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	advance(40 * time.Second)
+	if _, err := cache.Exchange(late); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := cache.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile() failed: %v", err)
+	}
+
+	// Restart 30s later, by which time early has expired
+	restarted, _ := newTestCache(&flakyForwarder{})
+	now := cache.now().Add(30 * time.Second)
+	restarted.now = func() time.Time { return now }
+	loaded, err := restarted.LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile() failed: %v", err)
+	}
+	if loaded != 1 || restarted.Len() != 1 {
+		t.Errorf("LoadFile() loaded %d answers, cache holds %d, want 1", loaded, restarted.Len())
+	}
+	if answers, found := restarted.Cached(late); !found || len(answers) != 1 || answers[0].TTL != 30 {
+		t.Errorf("Cached(%s) = %+v, %v, want one answer with TTL 30", late.Name, answers, found)
+	}
+	if answers, found := restarted.Cached(early); found {
+		t.Errorf("Cached(%s) = %+v, want it dropped as expired", early.Name, answers)
+	}
+}
+
+func TestCachingForwarder_LoadFile(t *testing.T) {
+	cache, _ := newTestCache(&flakyForwarder{})
+	if loaded, err := cache.LoadFile(filepath.Join(t.TempDir(), "missing.json")); err != nil || loaded != 0 {
+		t.Errorf("LoadFile() of a missing file = %d, %v, want 0, nil", loaded, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "future.json")
+	if err := os.WriteFile(path, []byte(`{"version": 99, "entries": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.LoadFile(path); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("LoadFile() of an unknown version error = %v, want a version error", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cache.Save(&buf); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	if loaded, err := cache.Load(&buf); err != nil || loaded != 0 {
+		t.Errorf("Load() of an empty cache = %d, %v, want 0, nil", loaded, err)
+	}
+}
+
+func TestCachingForwarder_SaveAndLoadNegative(t *testing.T) {
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		return []Message{negativeReply(t, query, RCodeNXDomain)}
+	})
+	cache, _ := newTestCache(NewUpstream(addr))
+	q := Question{Name: "missing.example.com", Type: RecordTypeA, Class: ClassIN}
+	if _, err := cache.Exchange(q); err == nil {
+		t.Fatal("Exchange() of a missing name succeeded")
+	}
+
+	var buf bytes.Buffer
+	if err := cache.Save(&buf); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	restarted, _ := newTestCache(&flakyForwarder{})
+	restarted.now = cache.now
+	if loaded, err := restarted.Load(&buf); err != nil || loaded != 1 {
+		t.Fatalf("Load() = %d, %v, want the NXDOMAIN loaded", loaded, err)
+	}
+	result, found := restarted.CachedResult(q)
+	if !found || result.Rcode != RCodeNXDomain || len(result.Authority) != 1 {
+		t.Errorf("CachedResult() = %+v, %v, want the NXDOMAIN with its SOA", result, found)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// CanonicalSort sorts records into DNSSEC canonical order (RFC 4034 section 6): by
+// owner name in canonical name order, then class and type, then RDATA in canonical
+// form compared as left-justified unsigned octet sequences. Within one RRset only
+// the RDATA differs, giving the order signatures are computed over.
+func CanonicalSort(rrs []ResourceRecord) {
+	type keyed struct {
+		rr    ResourceRecord
+		rdata []byte
+	}
+	keys := make([]keyed, len(rrs))
+	for i, rr := range rrs {
+		keys[i] = keyed{rr, canonicalRData(rr)}
+	}
+
+	slices.SortStableFunc(keys, func(a, b keyed) int {
+		if c := compareCanonicalNames(a.rr.Name, b.rr.Name); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.rr.Class, b.rr.Class); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.rr.Type, b.rr.Type); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.rdata, b.rdata)
+	})
+	for i := range keys {
+		rrs[i] = keys[i].rr
+	}
+}
+
+// compareCanonicalNames orders names as RFC 4034 section 6.1 does: label by label
+// from the right, each lower-cased and compared as unsigned octets, with a name
+// that runs out of labels first sorting first
+func compareCanonicalNames(a, b string) int {
+	aLabels, bLabels := canonicalLabels(a), canonicalLabels(b)
+	for i := 1; i <= min(len(aLabels), len(bLabels)); i++ {
+		if c := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(aLabels), len(bLabels))
+}
+
+// canonicalLabels returns the labels of name in lower case, none for the root
+func canonicalLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(asciiLower(name), ".")
+}
+
+// asciiLower lower-cases only A-Z, as DNS case folding does (RFC 4343), working
+// byte by byte, since labels needn't be valid UTF-8
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// canonicalRData returns the RDATA of rr in canonical form: names in it lower-cased
+// and uncompressed (RFC 4034 section 6.2). Types without names in their RDATA, and
+// RDATA that doesn't fit its layout, are used as they are.
+func canonicalRData(rr ResourceRecord) []byte {
+	layout, found := rdataLayouts[rr.Type]
+	if !found {
+		return rr.RData
+	}
+
+	var buf bytes.Buffer
+	offset := 0
+	for _, field := range layout.Fields {
+		if !field.Name {
+			if offset+field.Fixed > len(rr.RData) {
+				return rr.RData
+			}
+			buf.Write(rr.RData[offset : offset+field.Fixed])
+			offset += field.Fixed
+			continue
+		}
+		name, next, err := decodeDNSName(rr.RData, offset)
+		if err != nil || encodeDNSName(asciiLower(name), &buf) != nil {
+			return rr.RData
+		}
+		offset = next
+	}
+	return buf.Bytes()
+}
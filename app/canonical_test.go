@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalSort_RFC4034NameOrder(t *testing.T) {
+	// The example from RFC 4034 section 6.1, with \001 and \200 as raw octets
+	want := []string{
+		"example",
+		"a.example",
+		"yljkjljk.a.example",
+		"Z.a.example",
+		"zABC.a.EXAMPLE",
+		"z.example",
+		"\x01.z.example",
+		"*.z.example",
+		"\x80.z.example",
+	}
+
+	rrs := make([]ResourceRecord, len(want))
+	for i, name := range want {
+		rrs[i] = ResourceRecord{Name: name, Type: RecordTypeA, Class: ClassIN, RData: []byte{192, 0, 2, 1}}
+	}
+	rand.New(rand.NewPCG(4034, 6)).Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+
+	CanonicalSort(rrs)
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CanonicalSort() order = %q, want %q", got, want)
+	}
+}
+
+func TestCanonicalSort_RDataOrder(t *testing.T) {
+	mx := func(pref uint16, exchange string) ResourceRecord {
+		data := MXData{Preference: pref, Exchange: exchange}
+		rdata, err := data.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() failed: %v", err)
+		}
+		return ResourceRecord{Name: "example.com", Type: RecordTypeMX, Class: ClassIN, RData: rdata}
+	}
+	opaque := func(rdata string) ResourceRecord {
+		return ResourceRecord{Name: "example.com", Type: 65280, Class: ClassIN, RData: []byte(rdata)}
+	}
+
+	tests := []struct {
+		name string
+		in   []ResourceRecord
+		want []ResourceRecord
+	}{
+		{"addresses as unsigned octets",
+			[]ResourceRecord{
+				{Name: "example.com", Type: RecordTypeA, Class: ClassIN, RData: []byte{192, 0, 2, 200}},
+				{Name: "example.com", Type: RecordTypeA, Class: ClassIN, RData: []byte{10, 0, 0, 1}},
+				{Name: "example.com", Type: RecordTypeA, Class: ClassIN, RData: []byte{192, 0, 2, 3}},
+			},
+			[]ResourceRecord{
+				{Name: "example.com", Type: RecordTypeA, Class: ClassIN, RData: []byte{10, 0, 0, 1}},
+				{Name: "example.com", Type: RecordTypeA, Class: ClassIN, RData: []byte{192, 0, 2, 3}},
+				{Name: "example.com", Type: RecordTypeA, Class: ClassIN, RData: []byte{192, 0, 2, 200}},
+			}},
+		// Names in RDATA compare in lower case, so B.example sorts between a and c
+		{"names in RDATA lower-cased",
+			[]ResourceRecord{mx(10, "c.example"), mx(10, "B.example"), mx(10, "a.example"), mx(5, "z.example")},
+			[]ResourceRecord{mx(5, "z.example"), mx(10, "a.example"), mx(10, "B.example"), mx(10, "c.example")}},
+		// Absent octets sort before zero: "ab" is a prefix of "abc"
+		{"shorter RDATA first", []ResourceRecord{opaque("abc"), opaque("ab"), opaque("b")}, []ResourceRecord{opaque("ab"), opaque("abc"), opaque("b")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			CanonicalSort(tt.in)
+			for i := range tt.want {
+				if !bytes.Equal(tt.in[i].RData, tt.want[i].RData) {
+					t.Errorf("CanonicalSort()[%d] RDATA = %x, want %x", i, tt.in[i].RData, tt.want[i].RData)
+				}
+			}
+		})
+	}
+}
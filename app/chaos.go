@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// serverIdentityNames are the CHAOS TXT names that ask which server is answering,
+// for telling anycast nodes apart (RFC 4892)
+var serverIdentityNames = []string{"id.server", "hostname.bind"}
+
+// resolveChaos answers a CHAOS class question. Only the server identity names are
+// answered, and only with a configured identity; everything else is refused.
+func (h *DNSHandler) resolveChaos(q Question) Result {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if !slices.Contains(serverIdentityNames, name) || q.Type != RecordTypeTXT || h.config.ServerID == "" {
+		fmt.Printf("Refusing CHAOS query for %s %s\n", q.Name, TypeName(q.Type))
+		return Result{Rcode: RCodeRefused}
+	}
+
+	txt := NewTXTData(h.config.ServerID)
+	rdata, err := txt.MarshalBinary()
+	if err != nil {
+		fmt.Printf("Refusing CHAOS query for %s: %v\n", q.Name, err)
+		return Result{Rcode: RCodeRefused}
+	}
+	// The identity is of this server, not something to be cached by the client
+	answer := ResourceRecord{Name: q.Name, Type: RecordTypeTXT, Class: ClassCH, TTL: 0, RData: rdata}
+	return Result{Answers: []ResourceRecord{answer}, Authoritative: true}
+}
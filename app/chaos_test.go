@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestDNSHandler_ServerIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		serverID  string
+		question  Question
+		wantRcode uint8
+	}{
+		{"id.server", "anycast-ams-1", Question{Name: "id.server", Type: RecordTypeTXT, Class: ClassCH}, RCodeNoError},
+		{"hostname.bind", "anycast-ams-1", Question{Name: "HOSTNAME.BIND", Type: RecordTypeTXT, Class: ClassCH}, RCodeNoError},
+		{"no identity configured", "", Question{Name: "id.server", Type: RecordTypeTXT, Class: ClassCH}, RCodeRefused},
+		{"other CHAOS name", "anycast-ams-1", Question{Name: "version.bind", Type: RecordTypeTXT, Class: ClassCH}, RCodeRefused},
+		{"not TXT", "anycast-ams-1", Question{Name: "id.server", Type: RecordTypeA, Class: ClassCH}, RCodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ServerID = tt.serverID
+			queryData := buildTestDNSQuery(0x0411, []Question{tt.question})
+			response, err := NewDNSHandler(queryData, WithConfig(cfg)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Fatalf("RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if tt.wantRcode != RCodeNoError {
+				if len(respMsg.Answers) != 0 {
+					t.Errorf("Refused response has %d answers", len(respMsg.Answers))
+				}
+				return
+			}
+
+			if len(respMsg.Answers) != 1 {
+				t.Fatalf("Response has %d answers, want 1", len(respMsg.Answers))
+			}
+			answer := respMsg.Answers[0]
+			if answer.Type != RecordTypeTXT || answer.Class != ClassCH {
+				t.Errorf("Answer type %d class %d, want TXT CH", answer.Type, answer.Class)
+			}
+			var txt TXTData
+			if err := txt.UnmarshalBinary(answer.RData); err != nil {
+				t.Fatalf("Failed to decode TXT RDATA: %v", err)
+			}
+			if txt.String() != tt.serverID {
+				t.Errorf("Identity = %q, want %q", txt.String(), tt.serverID)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// questionKey identifies a question for coalescing and caching. Names compare case-insensitively.
+// Questions asked on behalf of different client subnets (RFC 7871) are told apart.
+type questionKey struct {
+	Name   string
+	Type   uint16
+	Class  uint16
+	Subnet netip.Prefix // invalid when asked without a client subnet
+}
+
+// keyFor returns the key identifying q
+func keyFor(q Question) questionKey {
+	return questionKey{Name: strings.ToLower(q.Name), Type: q.Type, Class: q.Class}
+}
+
+// subnetKeyFor returns the key identifying q asked on behalf of a client in subnet
+func subnetKeyFor(q Question, subnet netip.Prefix) questionKey {
+	key := keyFor(q)
+	key.Subnet = subnet
+	return key
+}
+
+// CoalescingForwarder wraps a Forwarder so that identical questions in flight at
+// the same time share a single upstream exchange (like x/sync/singleflight).
+type CoalescingForwarder struct {
+	next Forwarder
+
+	mu       sync.Mutex
+	inflight map[questionKey]*flight
+}
+
+// flight is one upstream exchange that any number of callers wait on
+type flight struct {
+	done    chan struct{}
+	waiters int // callers sharing this exchange besides the one that started it
+	answers []ResourceRecord
+	scope   netip.Prefix // clients the answers apply to, invalid for all
+	err     error
+}
+
+// NewCoalescingForwarder creates a forwarder that coalesces duplicate questions sent to next
+func NewCoalescingForwarder(next Forwarder) *CoalescingForwarder {
+	return &CoalescingForwarder{
+		next:     next,
+		inflight: make(map[questionKey]*flight),
+	}
+}
+
+// Exchange implements Forwarder
+func (c *CoalescingForwarder) Exchange(q Question) ([]ResourceRecord, error) {
+	answers, _, err := c.ExchangeSubnet(q, netip.Prefix{})
+	return answers, err
+}
+
+// ExchangeSubnet implements SubnetForwarder. Only questions for the same subnet are coalesced.
+func (c *CoalescingForwarder) ExchangeSubnet(q Question, subnet netip.Prefix) ([]ResourceRecord, netip.Prefix, error) {
+	key := subnetKeyFor(q, subnet)
+
+	c.mu.Lock()
+	if f, ok := c.inflight[key]; ok {
+		f.waiters++
+		c.mu.Unlock()
+		<-f.done
+		return cloneRecords(f.answers), f.scope, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.mu.Unlock()
+
+	// Release the waiters even if next panics; the panic carries on up to the
+	// caller that started the exchange, and they get an error
+	completed := false
+	defer func() {
+		if !completed {
+			f.answers, f.err = nil, fmt.Errorf("exchange for %s %s did not complete", q.Name, TypeName(q.Type))
+		}
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.answers, f.scope, f.err = exchangeSubnet(c.next, q, subnet)
+	completed = true
+	return cloneRecords(f.answers), f.scope, f.err
+}
+
+// waiting returns how many callers are sharing the in-flight exchange for q
+func (c *CoalescingForwarder) waiting(q Question) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.inflight[keyFor(q)]; ok {
+		return f.waiters
+	}
+	return 0
+}
+
+// inflightFor returns the in-flight exchange for q, nil when there's none
+func (c *CoalescingForwarder) inflightFor(q Question) *flight {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight[keyFor(q)]
+}
+
+// cloneRecords returns a copy of records so callers sharing a result can't affect each other
+func cloneRecords(records []ResourceRecord) []ResourceRecord {
+	if records == nil {
+		return nil
+	}
+	clone := make([]ResourceRecord, len(records))
+	for i, rr := range records {
+		clone[i] = rr
+		clone[i].RData = cloneBytes(rr.RData)
+	}
+	return clone
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingForwarder counts exchanges and holds each one until release is closed
+type blockingForwarder struct {
+	calls   atomic.Int64
+	release chan struct{}
+}
+
+func (f *blockingForwarder) Exchange(q Question) ([]ResourceRecord, error) {
+	f.calls.Add(1)
+	<-f.release
+	return []ResourceRecord{
+		{Name: q.Name, Type: RecordTypeA, Class: ClassIN, TTL: 30, RData: []byte{7, 7, 7, 7}},
+	}, nil
+}
+
+func TestCoalescingForwarder_SingleUpstreamCall(t *testing.T) {
+	const clients = 20
+
+	upstream := &blockingForwarder{release: make(chan struct{})}
+	coalescer := NewCoalescingForwarder(upstream)
+	q := Question{Name: "popular.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	var wg sync.WaitGroup
+	results := make([][]ResourceRecord, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Vary the case: names are compared case-insensitively
+			query := q
+			if i%2 == 1 {
+				query.Name = "POPULAR.example.com"
+			}
+			answers, err := coalescer.Exchange(query)
+			if err != nil {
+				t.Errorf("Exchange() failed: %v", err)
+			}
+			results[i] = answers
+		}()
+	}
+
+	// Wait for every client to join the in-flight exchange before letting it finish
+	deadline := time.Now().Add(5 * time.Second)
+	for coalescer.waiting(q) != clients-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d clients joined the in-flight exchange, want %d", coalescer.waiting(q), clients-1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.release)
+	wg.Wait()
+
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Errorf("Upstream received %d exchanges, want 1", calls)
+	}
+	for i, answers := range results {
+		if len(answers) != 1 || answers[0].RData[0] != 7 {
+			t.Errorf("Client %d got %+v, want the shared answer", i, answers)
+		}
+	}
+
+	// Results are copies, so one client can't corrupt another's answer
+	results[0][0].RData[0] = 0
+	if results[1][0].RData[0] != 7 {
+		t.Errorf("Clients share RDATA memory")
+	}
+
+	// Once finished, the next identical question goes upstream again
+	if _, err := coalescer.Exchange(q); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	if calls := upstream.calls.Load(); calls != 2 {
+		t.Errorf("Upstream received %d exchanges, want 2", calls)
+	}
+}
+
+// panickingForwarder panics once release is closed
+type panickingForwarder struct {
+	release chan struct{}
+}
+
+func (f *panickingForwarder) Exchange(q Question) ([]ResourceRecord, error) {
+	<-f.release
+	panic("deliberate test panic")
+}
+
+func TestCoalescingForwarder_PanicReleasesWaiters(t *testing.T) {
+	upstream := &panickingForwarder{release: make(chan struct{})}
+	coalescer := NewCoalescingForwarder(upstream)
+	q := Question{Name: "broken.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	leader := make(chan any)
+	go func() {
+		defer func() { leader <- recover() }()
+		coalescer.Exchange(q)
+	}()
+	for coalescer.inflightFor(q) == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiter := make(chan error)
+	go func() {
+		_, err := coalescer.Exchange(q)
+		waiter <- err
+	}()
+	for coalescer.waiting(q) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.release)
+
+	if recovered := <-leader; recovered == nil {
+		t.Error("Panic didn't reach the caller that started the exchange")
+	}
+	select {
+	case err := <-waiter:
+		if err == nil {
+			t.Error("Waiter on a panicked exchange got no error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Waiter on a panicked exchange was never released")
+	}
+	if coalescer.inflightFor(q) != nil {
+		t.Error("Panicked exchange is still in flight")
+	}
+}
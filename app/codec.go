@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RDataCodec converts the RDATA of one record type between wire format, a typed
+// value and presentation format. RDATA given to a codec has its names expanded,
+// as it is in a parsed ResourceRecord.
+type RDataCodec interface {
+	Encode(value any) ([]byte, error)
+	Decode(rdata []byte) (any, error)
+	String(rdata []byte) (string, error)
+}
+
+// RDataNamer is implemented by codecs of types with domain names in their
+// RDATA. The layout lets messages expand compressed names on input and, where
+// it allows, compress them on output.
+type RDataNamer interface {
+	NameLayout() (RDataLayout, bool)
+}
+
+// rdataCodecs holds the codec of each record type we can decode
+var rdataCodecs = map[uint16]RDataCodec{}
+
+// RegisterRDataCodec makes codec the codec for rrType, replacing any registered before.
+// If codec is an RDataNamer, its layout replaces rrType's too; otherwise rrType's
+// RDATA is opaque to messages. Register at init, the registry isn't safe to change
+// while messages are being handled.
+func RegisterRDataCodec(rrType uint16, codec RDataCodec) {
+	rdataCodecs[rrType] = codec
+	delete(rdataLayouts, rrType)
+	if namer, ok := codec.(RDataNamer); ok {
+		if layout, ok := namer.NameLayout(); ok {
+			rdataLayouts[rrType] = layout
+		}
+	}
+}
+
+// LookupRDataCodec returns the codec registered for rrType
+func LookupRDataCodec(rrType uint16) (RDataCodec, bool) {
+	codec, ok := rdataCodecs[rrType]
+	return codec, ok
+}
+
+func init() {
+	RegisterRDataCodec(RecordTypeA, addressCodec{size: net.IPv4len})
+	RegisterRDataCodec(RecordTypeAAAA, addressCodec{size: net.IPv6len})
+	RegisterRDataCodec(RecordTypeCNAME, nameCodec{})
+	RegisterRDataCodec(RecordTypeNS, nameCodec{})
+	RegisterRDataCodec(RecordTypePTR, nameCodec{})
+	RegisterRDataCodec(RecordTypeTXT, valueCodec[TXTData, *TXTData]{format: formatTXT})
+	RegisterRDataCodec(RecordTypeSPF, valueCodec[TXTData, *TXTData]{format: formatTXT})
+	RegisterRDataCodec(RecordTypeMX, valueCodec[MXData, *MXData]{
+		layout: &RDataLayout{Fields: []RDataField{{Fixed: 2}, nameField}, Compress: true},
+	})
+	// SOA and RP names are never compressed on output, so consumers treating
+	// them as opaque RFC 3597 data can't be handed a pointer into a message
+	// they don't have. Old servers did compress them (SOA is an RFC 1035
+	// type), so their layouts are still given for pointers to be expanded.
+	RegisterRDataCodec(RecordTypeSOA, valueCodec[SOAData, *SOAData]{
+		layout: &RDataLayout{Fields: []RDataField{nameField, nameField, {Fixed: 20}}},
+	})
+	RegisterRDataCodec(RecordTypeRP, valueCodec[RPData, *RPData]{
+		layout: &RDataLayout{Fields: []RDataField{nameField, nameField}},
+	})
+	RegisterRDataCodec(RecordTypeLOC, valueCodec[LOCData, *LOCData]{})
+	// SRV targets must not be compressed (RFC 2782), but later names can
+	// still point at them, like an A record for the target in the additional section
+	RegisterRDataCodec(RecordTypeSRV, valueCodec[SRVData, *SRVData]{
+		layout: &RDataLayout{Fields: []RDataField{{Fixed: 6}, nameField}},
+	})
+	RegisterRDataCodec(RecordTypeDS, valueCodec[DSData, *DSData]{})
+}
+
+// addressCodec handles A and AAAA RDATA, decoded as a net.IP
+type addressCodec struct {
+	size int // net.IPv4len or net.IPv6len
+}
+
+func (c addressCodec) Encode(value any) ([]byte, error) {
+	ip, ok := value.(net.IP)
+	if !ok {
+		return nil, fmt.Errorf("address RDATA must be a net.IP, got %T", value)
+	}
+	if c.size == net.IPv4len {
+		ip = ip.To4()
+	} else if ip.To4() == nil {
+		ip = ip.To16()
+	} else {
+		ip = nil // IPv4 addresses don't belong in AAAA records
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("%v is not a %d byte address", value, c.size)
+	}
+	return append([]byte(nil), ip...), nil
+}
+
+func (c addressCodec) Decode(rdata []byte) (any, error) {
+	if len(rdata) != c.size {
+		return nil, fmt.Errorf("address RDATA is %d bytes, want %d", len(rdata), c.size)
+	}
+	return net.IP(append([]byte(nil), rdata...)), nil
+}
+
+func (c addressCodec) String(rdata []byte) (string, error) {
+	ip, err := c.Decode(rdata)
+	if err != nil {
+		return "", err
+	}
+	return ip.(net.IP).String(), nil
+}
+
+// nameCodec handles RDATA that is a single domain name, decoded as a string
+type nameCodec struct{}
+
+func (nameCodec) Encode(value any) ([]byte, error) {
+	name, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("name RDATA must be a string, got %T", value)
+	}
+	buf := new(bytes.Buffer)
+	if err := encodeDNSName(name, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (nameCodec) Decode(rdata []byte) (any, error) {
+	name, offset, err := decodeDNSName(rdata, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset != len(rdata) {
+		return nil, fmt.Errorf("unexpected %d bytes after RDATA name", len(rdata)-offset)
+	}
+	return name, nil
+}
+
+func (c nameCodec) String(rdata []byte) (string, error) {
+	name, err := c.Decode(rdata)
+	if err != nil {
+		return "", err
+	}
+	return fqdn(name.(string)), nil
+}
+
+func (nameCodec) NameLayout() (RDataLayout, bool) {
+	return RDataLayout{Fields: []RDataField{nameField}, Compress: true}, true
+}
+
+// rdataValue is an RDATA type with its own wire and presentation formats
+type rdataValue[T any] interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	fmt.Stringer
+}
+
+// valueCodec handles RDATA decoded as a T, such as MXData. Encode takes a T or *T.
+type valueCodec[T any, P rdataValue[T]] struct {
+	format func(P) string // presentation format, P.String when nil
+	layout *RDataLayout   // where the names are, nil when there are none
+}
+
+func (c valueCodec[T, P]) Encode(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case T:
+		return P(&v).MarshalBinary()
+	case P:
+		return v.MarshalBinary()
+	}
+	var zero T
+	return nil, fmt.Errorf("RDATA must be a %T, got %T", zero, value)
+}
+
+func (c valueCodec[T, P]) Decode(rdata []byte) (any, error) {
+	var v T
+	if err := P(&v).UnmarshalBinary(rdata); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c valueCodec[T, P]) String(rdata []byte) (string, error) {
+	var v T
+	if err := P(&v).UnmarshalBinary(rdata); err != nil {
+		return "", err
+	}
+	if c.format != nil {
+		return c.format(&v), nil
+	}
+	return P(&v).String(), nil
+}
+
+func (c valueCodec[T, P]) NameLayout() (RDataLayout, bool) {
+	if c.layout == nil {
+		return RDataLayout{}, false
+	}
+	return *c.layout, true
+}
+
+// formatTXT quotes each character-string, e.g. `"v=spf1" "-all"`
+func formatTXT(t *TXTData) string {
+	quoted := make([]string, len(t.Strings))
+	for i, s := range t.Strings {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Decode returns the typed value of the record's RDATA, e.g. a net.IP for an A
+// record or an MXData for an MX record
+func (rr *ResourceRecord) Decode() (any, error) {
+	codec, ok := LookupRDataCodec(rr.Type)
+	if !ok {
+		return nil, fmt.Errorf("no RDATA codec for %s", TypeName(rr.Type))
+	}
+	value, err := codec.Decode(rr.RData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s RDATA: %w", TypeName(rr.Type), err)
+	}
+	return value, nil
+}
+
+// String returns the record in zone file format. RDATA of types without a codec,
+// or that fails to decode, is written in the RFC 3597 generic form.
+func (rr *ResourceRecord) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(rr.Name), rr.TTL, className(rr.Class), TypeName(rr.Type), rr.rdataString())
+}
+
+func (rr *ResourceRecord) rdataString() string {
+	if codec, ok := LookupRDataCodec(rr.Type); ok {
+		if s, err := codec.String(rr.RData); err == nil {
+			return s
+		}
+	}
+	return fmt.Sprintf("\\# %d %s", len(rr.RData), hex.EncodeToString(rr.RData))
+}
+
+// className returns the mnemonic for a class, or the RFC 3597 CLASSnnn form
+func className(class uint16) string {
+	switch class {
+	case ClassIN:
+		return "IN"
+	case ClassCH:
+		return "CH"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+// String returns the message in the style of dig's output
+func (m *Message) String() string {
+	var b strings.Builder
+	h := m.Header
+	fmt.Fprintf(&b, ";; opcode: %d, status: %d, id: %d\n", h.GetOpcode(), h.GetRcode(), h.Id)
+	b.WriteString(";; flags:")
+	for _, flag := range []struct {
+		name string
+		set  uint8
+	}{{"qr", h.GetQR()}, {"aa", h.GetAA()}, {"tc", h.GetTC()}, {"rd", h.GetRD()}, {"ra", h.GetRA()}, {"ad", h.GetAD()}, {"cd", h.GetCD()}} {
+		if flag.set == 1 {
+			b.WriteString(" " + flag.name)
+		}
+	}
+	b.WriteString("\n")
+	if m.EDNS != nil {
+		fmt.Fprintf(&b, ";; EDNS: version: %d, udp: %d\n", m.EDNS.Version, m.EDNS.UDPSize)
+	}
+
+	if len(m.Questions) > 0 {
+		b.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range m.Questions {
+			fmt.Fprintf(&b, ";%s\t\t%s\t%s\n", fqdn(q.Name), className(q.Class), TypeName(q.Type))
+		}
+	}
+	for _, section := range []struct {
+		name    string
+		records []ResourceRecord
+	}{{"ANSWER", m.Answers}, {"AUTHORITY", m.Authority}, {"ADDITIONAL", m.Additional}} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n;; %s SECTION:\n", section.name)
+		for _, rr := range section.records {
+			b.WriteString(rr.String() + "\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRDataCodecs_BuiltIn(t *testing.T) {
+	tests := []struct {
+		name   string
+		rrType uint16
+		value  any
+		text   string
+	}{
+		{"A", RecordTypeA, net.IP{192, 0, 2, 1}, "192.0.2.1"},
+		{"AAAA", RecordTypeAAAA, net.ParseIP("2001:db8::1"), "2001:db8::1"},
+		{"CNAME", RecordTypeCNAME, "www.example.com", "www.example.com."},
+		{"TXT", RecordTypeTXT, TXTData{Strings: []string{"v=spf1", "-all"}}, `"v=spf1" "-all"`},
+		{"MX", RecordTypeMX, MXData{Preference: 10, Exchange: "mail.example.com"}, "10 mail.example.com."},
+		{"SRV", RecordTypeSRV, SRVData{Priority: 10, Weight: 60, Port: 5060, Target: "sip.example.com"}, "10 60 5060 sip.example.com."},
+		{"DS", RecordTypeDS, DSData{KeyTag: 60485, Algorithm: 5, DigestType: 1, Digest: []byte{0x2b, 0xb1, 0x83, 0xaf}}, "60485 5 1 2BB183AF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, ok := LookupRDataCodec(tt.rrType)
+			if !ok {
+				t.Fatalf("No codec registered for %s", tt.name)
+			}
+
+			rdata, err := codec.Encode(tt.value)
+			if err != nil {
+				t.Fatalf("Encode() failed: %v", err)
+			}
+			decoded, err := codec.Decode(rdata)
+			if err != nil {
+				t.Fatalf("Decode() failed: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.value) {
+				t.Errorf("Decode() = %#v, want %#v", decoded, tt.value)
+			}
+			text, err := codec.String(rdata)
+			if err != nil {
+				t.Fatalf("String() failed: %v", err)
+			}
+			if text != tt.text {
+				t.Errorf("String() = %q, want %q", text, tt.text)
+			}
+		})
+	}
+}
+
+func TestRDataCodecs_InvalidValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		rrType uint16
+		value  any
+	}{
+		{"IPv6 address in A", RecordTypeA, net.ParseIP("2001:db8::1")},
+		{"IPv4 address in AAAA", RecordTypeAAAA, net.IP{192, 0, 2, 1}},
+		{"string in A", RecordTypeA, "192.0.2.1"},
+		{"address in CNAME", RecordTypeCNAME, net.IP{192, 0, 2, 1}},
+		{"string in MX", RecordTypeMX, "10 mail.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, _ := LookupRDataCodec(tt.rrType)
+			if _, err := codec.Encode(tt.value); err == nil {
+				t.Errorf("Encode(%#v) succeeded, want error", tt.value)
+			}
+		})
+	}
+}
+
+// upperCodec is a test codec for a private type whose RDATA is text shown in upper case
+type upperCodec struct{}
+
+func (upperCodec) Encode(value any) ([]byte, error) { return []byte(value.(string)), nil }
+func (upperCodec) Decode(rdata []byte) (any, error) { return string(rdata), nil }
+func (upperCodec) String(rdata []byte) (string, error) {
+	return strings.ToUpper(string(rdata)), nil
+}
+
+func TestRegisterRDataCodec(t *testing.T) {
+	const privateType = 65281
+	rr := ResourceRecord{Name: "example.com", Type: privateType, Class: ClassIN, TTL: 60, RData: []byte("hello")}
+
+	if _, err := rr.Decode(); err == nil {
+		t.Error("Decode() succeeded before a codec was registered")
+	}
+	if got, want := rr.String(), "example.com.\t60\tIN\tTYPE65281\t\\# 5 68656c6c6f"; got != want {
+		t.Errorf("String() = %q, want the generic form %q", got, want)
+	}
+
+	RegisterRDataCodec(privateType, upperCodec{})
+	t.Cleanup(func() { delete(rdataCodecs, privateType) })
+
+	value, err := rr.Decode()
+	if err != nil {
+		t.Fatalf("Decode() failed: %v", err)
+	}
+	if value != "hello" {
+		t.Errorf("Decode() = %v, want hello", value)
+	}
+	if got, want := rr.String(), "example.com.\t60\tIN\tTYPE65281\tHELLO"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestResourceRecord_Decode(t *testing.T) {
+	mx := MXData{Preference: 5, Exchange: "mx.example.com"}
+	rdata, err := mx.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	rr := ResourceRecord{Name: "example.com", Type: RecordTypeMX, Class: ClassIN, TTL: 300, RData: rdata}
+
+	value, err := rr.Decode()
+	if err != nil {
+		t.Fatalf("Decode() failed: %v", err)
+	}
+	if got, ok := value.(MXData); !ok || got != mx {
+		t.Errorf("Decode() = %#v, want %#v", value, mx)
+	}
+
+	rr.RData = rdata[:1]
+	if _, err := rr.Decode(); err == nil {
+		t.Error("Decode() of truncated MX RDATA succeeded, want error")
+	}
+}
+
+func TestMessage_String(t *testing.T) {
+	msg := NewResponseBuilder(&Message{
+		Header:    MessageHeader{Id: 1234, QDCount: 1},
+		Questions: []Question{{Name: "example.com", Type: RecordTypeA, Class: ClassIN}},
+	}).AddAnswer(ResourceRecord{
+		Name: "example.com", Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1},
+	}).Build()
+
+	got := msg.String()
+	for _, want := range []string{
+		"id: 1234",
+		";; flags: qr",
+		";; QUESTION SECTION:\n;example.com.\t\tIN\tA\n",
+		";; ANSWER SECTION:\nexample.com.\t60\tIN\tA\t192.0.2.1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("String() missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "AUTHORITY") {
+		t.Errorf("String() shows an empty authority section:\n%s", got)
+	}
+}
+
+func TestRDataCodecs_SPF(t *testing.T) {
+	spf := TXTData{Strings: []string{"v=spf1 ip4:192.0.2.0/24", " -all"}}
+	codec, ok := LookupRDataCodec(RecordTypeSPF)
+	if !ok {
+		t.Fatal("No codec registered for SPF")
+	}
+	rdata, err := codec.Encode(spf)
+	if err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+
+	msg := Message{
+		Header:    MessageHeader{Id: 0x0420, QDCount: 1, ANCount: 1},
+		Questions: []Question{{Name: "example.com", Type: RecordTypeSPF, Class: ClassIN}},
+		Answers:   []ResourceRecord{{Name: "example.com", Type: RecordTypeSPF, Class: ClassIN, TTL: 300, RData: rdata}},
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	var parsed Message
+	if err := parsed.UnmarshalBinaryStrict(data); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict() failed: %v", err)
+	}
+
+	rr := parsed.Answers[0]
+	value, err := rr.Decode()
+	if err != nil {
+		t.Fatalf("Decode() failed: %v", err)
+	}
+	if !reflect.DeepEqual(value, spf) {
+		t.Errorf("Decode() = %#v, want %#v", value, spf)
+	}
+	if want := "example.com.\t300\tIN\tSPF\t\"v=spf1 ip4:192.0.2.0/24\" \" -all\""; rr.String() != want {
+		t.Errorf("String() = %q, want %q", rr.String(), want)
+	}
+
+	// A character-string running past the RDATA isn't valid SPF
+	rr.RData = []byte{10, 'v', '=', 's', 'p', 'f', '1'}
+	if _, err := rr.Decode(); err == nil {
+		t.Error("Decode() of a truncated character-string succeeded, want error")
+	}
+	if want := `\# 7 0a763d73706631`; !strings.HasSuffix(rr.String(), want) {
+		t.Errorf("String() = %q, want the generic form %q", rr.String(), want)
+	}
+}
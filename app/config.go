@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings that can be changed from the command line
+type Config struct {
+	Addr     string // UDP address to listen on
+	Resolver string // comma-separated upstream resolver addresses, empty to answer from the record store
+
+	ResolverTLS         bool          // forward over DNS-over-TLS instead of UDP/TCP
+	UpstreamIdleTimeout time.Duration // how long idle upstream TCP/TLS connections are kept
+	UpstreamMaxConns    int           // maximum idle upstream connections kept per resolver
+	HealthInterval      time.Duration // how often upstreams are health checked, 0 to disable
+	UpstreamRetries     int           // how many more times to try the upstreams when none answers
+	RetryBackoff        time.Duration // delay before the first retry, doubling for each one after
+	RetryBackoffMax     time.Duration // cap on the delay between retries
+
+	EDNSBuffer int // UDP payload size advertised to upstreams, 0 to query them without EDNS
+
+	NameQPS int // UDP queries per second one client may send for one name before being sent to TCP, 0 for no limit
+
+	PrefetchAAAA bool // on A queries, fetch the AAAA for the same name into the cache in the background
+
+	ServeStale  bool          // answer from expired cache entries when upstreams fail (RFC 8767)
+	StaleMaxAge time.Duration // how long past expiry cached answers may be served stale
+	CacheFile   string        // where the cache is saved on shutdown and loaded from on startup, empty for none
+
+	MetricsAddr string // HTTP address for the metrics endpoint, empty to disable
+
+	ControlAddr  string // HTTP address for the ACME challenge control plane, empty to disable
+	ControlToken string // bearer token required by the control plane, empty for none
+	DrainRcode   uint8  // rcode answered while draining, SERVFAIL or REFUSED
+
+	RootHints   string // named.root file with the root servers served for NS queries for ".", empty for the built-in hints
+	RootServers string // comma-separated root server addresses to resolve from iteratively when Resolver is empty
+
+	ServerID string // identity answered to CHAOS TXT id.server and hostname.bind queries, empty to refuse them
+
+	CatchAll  netip.Addr // answer every A query with this address, overriding the store and upstreams
+	CatchAll6 netip.Addr // answer every AAAA query with this address
+
+	TTL uint32 // TTL applied to synthesized answers
+	// TypeTTLs overrides TTL per record type for records that don't have their own,
+	// e.g. long for NS and short for A records behind a load balancer
+	TypeTTLs map[uint16]uint32
+	Serial   uint32 // serial number reported in synthesized SOA records
+
+	TCPIdleTimeout time.Duration // how long TCP and DNS-over-TLS connections may idle, announced to EDNS keepalive clients
+
+	TLSAddr  string // DNS-over-TLS address to listen on, empty to disable
+	DoHAddr  string // DNS-over-HTTPS address to listen on, empty to disable
+	CertFile string // TLS certificate (PEM) for encrypted listeners
+	KeyFile  string // TLS private key (PEM) for encrypted listeners
+
+	Pad          bool // pad every EDNS response, not just those whose query asked for it
+	PadBlockSize int  // padded responses are rounded up to a multiple of this size
+
+	MaxUDPSize int // cap on UDP responses regardless of the size EDNS clients advertise
+
+	NoCompression bool // write names in responses in full, for clients that mishandle compression pointers
+	StrictMirror  bool // copy each query's question section and OPT record into the response byte for byte
+
+	// MinimalResponses leaves the zone's NS records and their glue out of positive
+	// answers; referrals and negative answers still carry what they need
+	MinimalResponses bool
+
+	NoRecursion bool // clear RA and refuse queries that need forwarding, answering only from zone and cache
+
+	ShuffleAnswers bool // shuffle the records of each answer RRset, for round-robin load spreading
+
+	// ECS forwards the client's subnet, cut to ECSPrefix4 or ECSPrefix6 bits, to
+	// upstreams in an EDNS Client Subnet option (RFC 7871)
+	ECS        bool
+	ECSPrefix4 int
+	ECSPrefix6 int
+
+	DNS64       bool         // answer AAAA queries for IPv4-only names with addresses synthesized from their A records (RFC 6147)
+	DNS64Prefix netip.Prefix // NAT64 prefix the IPv4 addresses are embedded in
+
+	RPZFile string // response policy zone overriding resolution of the names in it, empty for none
+
+	ResponseDelay time.Duration // sleep before answering each query, for testing client timeouts
+
+	Debug bool // log an annotated hex dump of every request and response
+
+	StrictZ     bool // reject queries with the reserved Z bit set with FORMERR
+	StrictParse bool // reject queries with bytes after their last record with FORMERR
+}
+
+// DefaultConfig returns the configuration used when no flags are given
+func DefaultConfig() Config {
+	return Config{
+		Addr:   "127.0.0.1:2053",
+		TTL:    60,
+		Serial: 1,
+
+		UpstreamIdleTimeout: DefaultPoolIdleTimeout,
+		UpstreamMaxConns:    DefaultPoolMaxPerHost,
+		HealthInterval:      DefaultHealthInterval,
+		RetryBackoff:        DefaultRetryBackoff,
+		RetryBackoffMax:     DefaultRetryBackoffMax,
+		StaleMaxAge:         DefaultStaleMaxAge,
+		DrainRcode:          RCodeServFail,
+		TCPIdleTimeout:      TCPIdleTimeout,
+		EDNSBuffer:          EDNSUDPSize,
+
+		DNS64Prefix: DefaultNAT64Prefix,
+		ECSPrefix4:  DefaultECSPrefix4,
+		ECSPrefix6:  DefaultECSPrefix6,
+
+		PadBlockSize: 468, // RFC 8467 recommended block size for responses
+		MaxUDPSize:   4096,
+	}
+}
+
+// ParseConfig builds a Config from command line arguments (without the program name)
+func ParseConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("dns-server", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "UDP address to listen on")
+	fs.StringVar(&cfg.Resolver, "resolver", cfg.Resolver, "comma-separated upstream resolver addresses (host:port) to forward queries to, in failover order")
+	fs.StringVar(&cfg.RootHints, "root-hints", cfg.RootHints, "named.root file with the root servers to answer NS queries for the root with, instead of the built-in hints")
+	fs.StringVar(&cfg.RootServers, "root-servers", cfg.RootServers, "comma-separated root server addresses (host:port) to resolve A/AAAA queries from iteratively when no resolver is set")
+	ttl := fs.Uint("ttl", uint(cfg.TTL), "TTL in seconds for synthesized answers")
+	fs.BoolVar(&cfg.ResolverTLS, "resolver-tls", cfg.ResolverTLS, "forward to the resolver over DNS-over-TLS")
+	fs.DurationVar(&cfg.UpstreamIdleTimeout, "upstream-idle-timeout", cfg.UpstreamIdleTimeout, "how long idle upstream TCP/TLS connections are kept for reuse")
+	fs.IntVar(&cfg.UpstreamMaxConns, "upstream-max-conns", cfg.UpstreamMaxConns, "maximum idle upstream TCP/TLS connections per resolver")
+	fs.DurationVar(&cfg.HealthInterval, "health-interval", cfg.HealthInterval, "how often to health check upstreams, 0 to disable")
+	fs.IntVar(&cfg.UpstreamRetries, "upstream-retries", cfg.UpstreamRetries, "how many more times to try the upstreams when none of them answers")
+	fs.DurationVar(&cfg.RetryBackoff, "retry-backoff", cfg.RetryBackoff, "delay before the first upstream retry, doubling with jitter for each one after")
+	fs.DurationVar(&cfg.RetryBackoffMax, "retry-backoff-max", cfg.RetryBackoffMax, "longest delay between upstream retries")
+	fs.IntVar(&cfg.EDNSBuffer, "edns-buffer", cfg.EDNSBuffer, "EDNS UDP payload size to advertise in forwarded queries, 0 to forward without EDNS")
+	fs.IntVar(&cfg.NameQPS, "name-qps", cfg.NameQPS, "UDP queries per second one client may send for one name before being answered with TC=1 to force TCP, 0 for no limit")
+	fs.BoolVar(&cfg.PrefetchAAAA, "prefetch-aaaa", cfg.PrefetchAAAA, "on A queries, also fetch the AAAA record into the cache in the background")
+	fs.BoolVar(&cfg.ServeStale, "serve-stale", cfg.ServeStale, "answer from expired cache entries when upstreams are down or slow")
+	fs.DurationVar(&cfg.StaleMaxAge, "stale-max-age", cfg.StaleMaxAge, "how long past expiry cached answers may be served stale")
+	fs.StringVar(&cfg.CacheFile, "cache-file", cfg.CacheFile, "file to save the cache to on shutdown and load it from on startup")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "HTTP address to serve metrics on, e.g. 127.0.0.1:9153")
+	fs.StringVar(&cfg.ControlAddr, "control-addr", cfg.ControlAddr, "HTTP address for the ACME DNS-01 control plane, drain switch and admin commands, e.g. 127.0.0.1:8053")
+	fs.StringVar(&cfg.ControlToken, "control-token", cfg.ControlToken, "bearer token required by the control plane")
+	drainRcode := fs.String("drain-rcode", "servfail", "rcode to answer with while draining via the control plane: servfail or refused")
+	fs.StringVar(&cfg.TLSAddr, "tls-addr", cfg.TLSAddr, "DNS-over-TLS address to listen on, e.g. :853")
+	fs.StringVar(&cfg.DoHAddr, "doh-addr", cfg.DoHAddr, "DNS-over-HTTPS address to listen on, e.g. :443")
+	fs.DurationVar(&cfg.TCPIdleTimeout, "tcp-idle-timeout", cfg.TCPIdleTimeout, "how long TCP and DNS-over-TLS connections may sit idle, announced to clients using EDNS keepalive")
+	fs.StringVar(&cfg.CertFile, "cert", cfg.CertFile, "TLS certificate file (PEM)")
+	fs.StringVar(&cfg.KeyFile, "key", cfg.KeyFile, "TLS private key file (PEM)")
+	fs.BoolVar(&cfg.Pad, "pad", cfg.Pad, "pad all EDNS responses (RFC 7830)")
+	fs.IntVar(&cfg.PadBlockSize, "pad-block", cfg.PadBlockSize, "block size padded responses are rounded up to")
+	fs.IntVar(&cfg.MaxUDPSize, "max-udp-size", cfg.MaxUDPSize, "largest UDP response to send, e.g. 1232 to avoid fragmentation")
+	fs.BoolVar(&cfg.NoCompression, "no-compression", cfg.NoCompression, "never compress names in responses, for interop testing and packet inspection")
+	fs.BoolVar(&cfg.NoRecursion, "no-recursion", cfg.NoRecursion, "advertise RA=0 and refuse queries outside the zone that aren't cached")
+	fs.BoolVar(&cfg.ShuffleAnswers, "shuffle-answers", cfg.ShuffleAnswers, "shuffle the order of records within each answer RRset")
+	fs.BoolVar(&cfg.ECS, "ecs", cfg.ECS, "send upstreams the client's subnet in an EDNS Client Subnet option, for geo-aware answers")
+	fs.IntVar(&cfg.ECSPrefix4, "ecs-prefix4", cfg.ECSPrefix4, "how many bits of IPv4 client addresses --ecs sends")
+	fs.IntVar(&cfg.ECSPrefix6, "ecs-prefix6", cfg.ECSPrefix6, "how many bits of IPv6 client addresses --ecs sends")
+	fs.BoolVar(&cfg.DNS64, "dns64", cfg.DNS64, "synthesize AAAA records from A records for IPv4-only names, for clients behind NAT64")
+	fs.Func("dns64-prefix", "NAT64 prefix synthesized AAAA records are built from (default 64:ff9b::/96)", func(s string) error {
+		return parseNAT64Prefix(s, &cfg.DNS64Prefix)
+	})
+	fs.StringVar(&cfg.RPZFile, "rpz", cfg.RPZFile, "response policy zone file whose names are answered with NXDOMAIN, NODATA or replacement records")
+	fs.BoolVar(&cfg.StrictMirror, "strict-mirror", cfg.StrictMirror, "echo the question section and OPT record of each query byte for byte in its response")
+	fs.BoolVar(&cfg.MinimalResponses, "minimal-responses", cfg.MinimalResponses, "leave optional authority and additional records out of positive answers")
+	fs.DurationVar(&cfg.ResponseDelay, "response-delay", cfg.ResponseDelay, "delay every response by this long, e.g. 50ms, to test client timeouts")
+	fs.BoolVar(&cfg.StrictZ, "strict-z", cfg.StrictZ, "reject queries that set the reserved Z header bit with FORMERR")
+	fs.BoolVar(&cfg.StrictParse, "strict-parse", cfg.StrictParse, "reject queries with trailing bytes after the last record with FORMERR")
+	fs.StringVar(&cfg.ServerID, "server-id", cfg.ServerID, "identity to answer CHAOS TXT id.server and hostname.bind queries with, e.g. the anycast node name")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "log an annotated hex dump of every request and response")
+	fs.Func("catch-all", "answer every A query, whatever the name, with this IPv4 address", func(s string) error {
+		return parseCatchAll(s, &cfg.CatchAll, netip.Addr.Is4)
+	})
+	fs.Func("catch-all6", "answer every AAAA query, whatever the name, with this IPv6 address", func(s string) error {
+		return parseCatchAll(s, &cfg.CatchAll6, netip.Addr.Is6)
+	})
+	fs.Func("type-ttl", "default TTL for one record type, as TYPE=seconds (e.g. NS=86400); repeat for more types", func(s string) error {
+		return parseTypeTTL(s, &cfg.TypeTTLs)
+	})
+	serial := fs.Uint("serial", uint(cfg.Serial), "serial number for synthesized SOA records")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *ttl > 0xFFFFFFFF {
+		return Config{}, fmt.Errorf("ttl %d out of range", *ttl)
+	}
+	if (cfg.TLSAddr != "" || cfg.DoHAddr != "") && (cfg.CertFile == "" || cfg.KeyFile == "") {
+		return Config{}, fmt.Errorf("tls-addr and doh-addr require both cert and key")
+	}
+	if cfg.UpstreamMaxConns < 0 {
+		return Config{}, fmt.Errorf("upstream-max-conns must not be negative")
+	}
+	if cfg.PadBlockSize <= 0 || cfg.PadBlockSize > 0xFFFF {
+		return Config{}, fmt.Errorf("pad-block %d out of range", cfg.PadBlockSize)
+	}
+	if cfg.MaxUDPSize < MaxDNSPacketSize || cfg.MaxUDPSize > 0xFFFF {
+		return Config{}, fmt.Errorf("max-udp-size %d out of range (%d-65535)", cfg.MaxUDPSize, MaxDNSPacketSize)
+	}
+	if cfg.EDNSBuffer != 0 && (cfg.EDNSBuffer < MaxDNSPacketSize || cfg.EDNSBuffer > 0xFFFF) {
+		return Config{}, fmt.Errorf("edns-buffer %d out of range (0 or %d-65535)", cfg.EDNSBuffer, MaxDNSPacketSize)
+	}
+	if cfg.TCPIdleTimeout <= 0 {
+		return Config{}, fmt.Errorf("tcp-idle-timeout must be positive")
+	}
+	if cfg.UpstreamRetries < 0 {
+		return Config{}, fmt.Errorf("upstream-retries must not be negative")
+	}
+	if cfg.RetryBackoff < 0 || cfg.RetryBackoffMax < cfg.RetryBackoff {
+		return Config{}, fmt.Errorf("retry-backoff must not be negative or more than retry-backoff-max")
+	}
+	if cfg.NameQPS < 0 {
+		return Config{}, fmt.Errorf("name-qps must not be negative")
+	}
+	if cfg.StaleMaxAge < 0 {
+		return Config{}, fmt.Errorf("stale-max-age must not be negative")
+	}
+	if cfg.ResponseDelay < 0 {
+		return Config{}, fmt.Errorf("response-delay must not be negative")
+	}
+	if cfg.ECSPrefix4 < 0 || cfg.ECSPrefix4 > 32 {
+		return Config{}, fmt.Errorf("ecs-prefix4 %d out of range (0-32)", cfg.ECSPrefix4)
+	}
+	if cfg.ECSPrefix6 < 0 || cfg.ECSPrefix6 > 128 {
+		return Config{}, fmt.Errorf("ecs-prefix6 %d out of range (0-128)", cfg.ECSPrefix6)
+	}
+	drain, err := parseDrainRcode(*drainRcode)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.DrainRcode = drain
+	if *serial > 0xFFFFFFFF {
+		return Config{}, fmt.Errorf("serial %d out of range", *serial)
+	}
+	cfg.TTL = uint32(*ttl)
+	cfg.Serial = uint32(*serial)
+
+	return cfg, nil
+}
+
+// DefaultTTL returns the TTL for records of rrType that don't have their own:
+// the type's entry in TypeTTLs if it has one, otherwise TTL
+func (c Config) DefaultTTL(rrType uint16) uint32 {
+	if ttl, ok := c.TypeTTLs[rrType]; ok {
+		return ttl
+	}
+	return c.TTL
+}
+
+// parseTypeTTL parses a --type-ttl TYPE=seconds value into ttls
+func parseTypeTTL(s string, ttls *map[uint16]uint32) error {
+	name, value, found := strings.Cut(s, "=")
+	if !found {
+		return fmt.Errorf("%q is not TYPE=seconds", s)
+	}
+	rrType, ok := TypeByName(name)
+	if !ok {
+		return fmt.Errorf("unknown record type %q", name)
+	}
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || ttl == 0 {
+		return fmt.Errorf("invalid TTL %q for %s", value, name)
+	}
+	if *ttls == nil {
+		*ttls = make(map[uint16]uint32)
+	}
+	(*ttls)[rrType] = uint32(ttl)
+	return nil
+}
+
+// parseCatchAll parses a --catch-all address into addr, requiring family to hold for it
+func parseCatchAll(s string, addr *netip.Addr, family func(netip.Addr) bool) error {
+	parsed, err := netip.ParseAddr(s)
+	if err != nil {
+		return err
+	}
+	if !family(parsed) {
+		return fmt.Errorf("%s is the wrong address family", s)
+	}
+	*addr = parsed
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(nil)
+	if err != nil {
+		t.Fatalf("ParseConfig(nil) failed: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, DefaultConfig()) {
+		t.Errorf("ParseConfig(nil) = %+v, want defaults %+v", cfg, DefaultConfig())
+	}
+
+	cfg, err = ParseConfig([]string{"--ttl", "300", "--serial", "2024010101"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+	if cfg.TTL != 300 {
+		t.Errorf("TTL = %d, want 300", cfg.TTL)
+	}
+	if cfg.Serial != 2024010101 {
+		t.Errorf("Serial = %d, want 2024010101", cfg.Serial)
+	}
+
+	if _, err := ParseConfig([]string{"--ttl", "4294967296"}); err == nil {
+		t.Errorf("ParseConfig() accepted an out of range TTL")
+	}
+
+	if _, err := ParseConfig([]string{"--max-udp-size", "100"}); err == nil {
+		t.Errorf("ParseConfig() accepted a max UDP size below 512")
+	}
+}
+
+func TestParseConfig_EDNSBuffer(t *testing.T) {
+	for _, value := range []string{"100", "65536"} {
+		if _, err := ParseConfig([]string{"--edns-buffer", value}); err == nil {
+			t.Errorf("ParseConfig() accepted edns-buffer %s", value)
+		}
+	}
+}
+
+func TestParseConfig_CatchAll(t *testing.T) {
+	for _, args := range [][]string{
+		{"--catch-all", "fd00::1"},
+		{"--catch-all6", "10.0.0.1"},
+		{"--catch-all", "not-an-address"},
+	} {
+		if _, err := ParseConfig(args); err == nil {
+			t.Errorf("ParseConfig(%v) succeeded, want error", args)
+		}
+	}
+}
+
+func TestParseConfig_TypeTTL(t *testing.T) {
+	cfg, err := ParseConfig([]string{"--ttl", "300", "--type-ttl", "ns=86400", "--type-ttl", "A=30"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+	for rrType, want := range map[uint16]uint32{RecordTypeNS: 86400, RecordTypeA: 30, RecordTypeAAAA: 300} {
+		if got := cfg.DefaultTTL(rrType); got != want {
+			t.Errorf("DefaultTTL(%s) = %d, want %d", TypeName(rrType), got, want)
+		}
+	}
+
+	for _, value := range []string{"A", "BOGUS=30", "A=0", "A=-1", "A=4294967296"} {
+		if _, err := ParseConfig([]string{"--type-ttl", value}); err == nil {
+			t.Errorf("ParseConfig() accepted type-ttl %s", value)
+		}
+	}
+}
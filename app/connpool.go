@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection pool defaults
+const (
+	DefaultPoolIdleTimeout = 30 * time.Second
+	DefaultPoolMaxPerHost  = 4
+)
+
+// ConnPool keeps idle upstream stream connections (TCP or TLS) for reuse, keyed by server address
+type ConnPool struct {
+	IdleTimeout time.Duration // idle connections older than this are closed instead of reused
+	MaxPerHost  int           // maximum idle connections kept per address
+
+	mu   sync.Mutex
+	idle map[string][]idleConn
+	now  func() time.Time // replaceable for tests
+}
+
+// idleConn is a pooled connection and the time it was returned
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// NewConnPool creates a pool with the given idle timeout and per-host limit
+func NewConnPool(idleTimeout time.Duration, maxPerHost int) *ConnPool {
+	return &ConnPool{
+		IdleTimeout: idleTimeout,
+		MaxPerHost:  maxPerHost,
+		idle:        make(map[string][]idleConn),
+		now:         time.Now,
+	}
+}
+
+// Get returns an idle connection to addr if one is available, dialing a new one otherwise.
+// reused reports whether the connection came from the pool.
+func (p *ConnPool) Get(addr string, dial func() (net.Conn, error)) (conn net.Conn, reused bool, err error) {
+	p.mu.Lock()
+	for len(p.idle[addr]) > 0 {
+		// Take the most recently returned connection, it's the least likely to be stale
+		conns := p.idle[addr]
+		ic := conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+
+		if p.now().Sub(ic.since) > p.IdleTimeout {
+			ic.conn.Close()
+			continue
+		}
+		p.mu.Unlock()
+		return ic.conn, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err = dial()
+	return conn, false, err
+}
+
+// Put returns a healthy connection to the pool, closing it if the pool for addr is full
+func (p *ConnPool) Put(addr string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[addr]) >= p.MaxPerHost {
+		conn.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], idleConn{conn: conn, since: p.now()})
+}
+
+// Idle returns the number of idle connections pooled for addr
+func (p *ConnPool) Idle(addr string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[addr])
+}
+
+// Close closes all idle connections
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conns := range p.idle {
+		for _, ic := range conns {
+			ic.conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnPool_ReuseAndLimits(t *testing.T) {
+	pool := NewConnPool(time.Minute, 1)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	dials := 0
+	dial := func() (net.Conn, error) {
+		dials++
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	first, reused, err := pool.Get("upstream:53", dial)
+	if err != nil || reused {
+		t.Fatalf("Get() on empty pool = reused %v, err %v, want a fresh dial", reused, err)
+	}
+	second, _, _ := pool.Get("upstream:53", dial)
+
+	pool.Put("upstream:53", first)
+	pool.Put("upstream:53", second) // over MaxPerHost, closed instead of kept
+	if idle := pool.Idle("upstream:53"); idle != 1 {
+		t.Errorf("Idle() = %d, want 1", idle)
+	}
+
+	conn, reused, _ := pool.Get("upstream:53", dial)
+	if !reused || conn != first {
+		t.Errorf("Get() did not reuse the pooled connection")
+	}
+	if dials != 2 {
+		t.Errorf("dials = %d, want 2", dials)
+	}
+
+	// Connections idle past the timeout are discarded
+	pool.Put("upstream:53", conn)
+	now = now.Add(2 * time.Minute)
+	if _, reused, _ := pool.Get("upstream:53", dial); reused {
+		t.Errorf("Get() reused a connection past its idle timeout")
+	}
+	if dials != 3 {
+		t.Errorf("dials = %d, want 3", dials)
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // DNS protocol related constants
 const (
 	DNSHeaderSize    = 12
-	MaxDNSPacketSize = 512 // classic UDP DNS size without EDNS0
+	MaxDNSPacketSize = 512  // classic UDP DNS size without EDNS0
+	MaxUDPQuerySize  = 4096 // largest UDP query read, since EDNS queries may exceed 512 bytes
 )
 
 // Opcode values
@@ -22,12 +29,20 @@ const (
 	RecordTypePTR   uint16 = 12
 	RecordTypeMX    uint16 = 15
 	RecordTypeTXT   uint16 = 16
+	RecordTypeRP    uint16 = 17
 	RecordTypeAAAA  uint16 = 28
+	RecordTypeLOC   uint16 = 29
+	RecordTypeSRV   uint16 = 33
+	RecordTypeDS    uint16 = 43
+	RecordTypeSPF   uint16 = 99 // deprecated by RFC 7208, same RDATA as TXT
 )
 
 // Class codes
 const (
 	ClassIN uint16 = 1
+	ClassCH uint16 = 3 // CHAOS, used for server identity queries
+
+	ClassANY uint16 = 255 // QCLASS * matching any class (RFC 1035 section 3.2.5)
 )
 
 // RCODE values
@@ -39,3 +54,44 @@ const (
 	RCodeNotImpl  uint8 = 4
 	RCodeRefused  uint8 = 5
 )
+
+// recordTypeNames maps record types to their mnemonics
+var recordTypeNames = map[uint16]string{
+	RecordTypeA:     "A",
+	RecordTypeNS:    "NS",
+	RecordTypeCNAME: "CNAME",
+	RecordTypeSOA:   "SOA",
+	RecordTypePTR:   "PTR",
+	RecordTypeMX:    "MX",
+	RecordTypeTXT:   "TXT",
+	RecordTypeRP:    "RP",
+	RecordTypeAAAA:  "AAAA",
+	RecordTypeLOC:   "LOC",
+	RecordTypeSRV:   "SRV",
+	RecordTypeDS:    "DS",
+	RecordTypeSPF:   "SPF",
+	RecordTypeOPT:   "OPT",
+}
+
+// TypeByName is the inverse of TypeName, ignoring case
+func TypeByName(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	for t, mnemonic := range recordTypeNames {
+		if mnemonic == name {
+			return t, true
+		}
+	}
+	if n, found := strings.CutPrefix(name, "TYPE"); found {
+		t, err := strconv.ParseUint(n, 10, 16)
+		return uint16(t), err == nil
+	}
+	return 0, false
+}
+
+// TypeName returns the mnemonic for a record type, or the RFC 3597 TYPEnnn form for unknown types
+func TypeName(t uint16) string {
+	if name, ok := recordTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// DialFunc returns a dial function for net.Resolver that connects to an in-process
+// instance of this server configured with opts, so a program's stdlib lookups can
+// be answered from a test store:
+//
+//	r := &net.Resolver{PreferGo: true, Dial: DialFunc(WithStore(store))}
+//
+// Every connection is an in-memory stream whatever network is asked for. The Go
+// resolver frames queries with a length prefix on connections that aren't a
+// net.PacketConn, so responses never need truncating and there's no TCP fallback.
+func DialFunc(opts ...HandlerOption) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		client, server := net.Pipe()
+		go serveStream(server, TCPIdleTimeout, opts)
+		return client, nil
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDialFunc_StdlibResolver(t *testing.T) {
+	store := NewMemoryStore(map[string]HostEntry{
+		"app.internal.test": {
+			A:    []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)},
+			AAAA: []net.IP{net.ParseIP("fd00::1")},
+		},
+		"www.internal.test": {CNAME: "app.internal.test"},
+	})
+	resolver := &net.Resolver{PreferGo: true, Dial: DialFunc(WithStore(store))}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The Go resolver sends A and AAAA queries, each with an EDNS OPT record
+	addrs, err := resolver.LookupIPAddr(ctx, "www.internal.test.")
+	if err != nil {
+		t.Fatalf("LookupIPAddr() failed: %v", err)
+	}
+	var got []string
+	for _, addr := range addrs {
+		got = append(got, addr.IP.String())
+	}
+	slices.Sort(got)
+	if want := []string{"10.0.0.1", "10.0.0.2", "fd00::1"}; !slices.Equal(got, want) {
+		t.Errorf("LookupIPAddr() = %v, want %v", got, want)
+	}
+
+	cname, err := resolver.LookupCNAME(ctx, "www.internal.test.")
+	if err != nil {
+		t.Fatalf("LookupCNAME() failed: %v", err)
+	}
+	if cname != "app.internal.test." {
+		t.Errorf("LookupCNAME() = %q, want app.internal.test.", cname)
+	}
+
+	if _, err := resolver.LookupIPAddr(ctx, "missing.internal.test."); err == nil {
+		t.Error("LookupIPAddr() of a missing name succeeded, want error")
+	}
+}
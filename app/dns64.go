@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// DefaultNAT64Prefix is the well-known prefix for IPv4-embedded IPv6 addresses (RFC 6052)
+var DefaultNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// parseNAT64Prefix converts a --dns64-prefix value to an IPv6 prefix of one of
+// the lengths RFC 6052 section 2.2 defines an embedding for
+func parseNAT64Prefix(s string, prefix *netip.Prefix) error {
+	parsed, err := netip.ParsePrefix(s)
+	if err != nil {
+		return err
+	}
+	if !parsed.Addr().Is6() || parsed.Addr().Is4In6() {
+		return fmt.Errorf("%s is not an IPv6 prefix", s)
+	}
+	switch parsed.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("NAT64 prefix length must be 32, 40, 48, 56, 64 or 96, got %d", parsed.Bits())
+	}
+	*prefix = parsed.Masked()
+	return nil
+}
+
+// embedIPv4 returns the address formed by embedding v4 in prefix (RFC 6052
+// section 2.2). Bits 64 to 71 are reserved and stay zero, so with prefixes
+// shorter than /96 the IPv4 address is split around them.
+func embedIPv4(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	addr := prefix.Addr().As16()
+	i := prefix.Bits() / 8
+	for _, b := range v4.As4() {
+		if i == 8 {
+			i++
+		}
+		addr[i] = b
+		i++
+	}
+	return netip.AddrFrom16(addr)
+}
+
+// synthesizeDNS64 answers an AAAA question that found no AAAA records with
+// addresses synthesized from the name's A records (RFC 6147 section 5.1). Each
+// synthesized record keeps the TTL of the A record it came from. Without A
+// records, the original AAAA result stands.
+func (h *DNSHandler) synthesizeDNS64(q Question, aaaa Result) (Result, error) {
+	result, err := h.resolve(Question{Name: q.Name, Type: RecordTypeA, Class: q.Class})
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to resolve A records for DNS64: %w", err)
+	}
+
+	synthesized := false
+	answers := make([]ResourceRecord, 0, len(result.Answers))
+	for _, rr := range result.Answers {
+		if rr.Type == RecordTypeA && len(rr.RData) == 4 {
+			v6 := embedIPv4(h.config.DNS64Prefix, netip.AddrFrom4([4]byte(rr.RData)))
+			rdata := v6.As16()
+			rr = ResourceRecord{Name: rr.Name, Type: RecordTypeAAAA, Class: rr.Class, TTL: rr.TTL, RData: rdata[:]}
+			synthesized = true
+		}
+		answers = append(answers, rr)
+	}
+	if result.Rcode != RCodeNoError || !synthesized {
+		return aaaa, nil
+	}
+
+	fmt.Printf("Synthesized %s AAAA records from A records under %s\n", q.Name, h.config.DNS64Prefix)
+	result.Answers = answers
+	return result, nil
+}
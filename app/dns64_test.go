@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// RFC 6052 section 2.4 examples
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+
+	v4 := netip.MustParseAddr("192.0.2.33")
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			var prefix netip.Prefix
+			if err := parseNAT64Prefix(tt.prefix, &prefix); err != nil {
+				t.Fatalf("parseNAT64Prefix() failed: %v", err)
+			}
+			if got := embedIPv4(prefix, v4); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("embedIPv4(%s, %s) = %s, want %s", tt.prefix, v4, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNAT64Prefix_Invalid(t *testing.T) {
+	for _, s := range []string{"64:ff9b::/80", "192.0.2.0/24", "64:ff9b::"} {
+		var prefix netip.Prefix
+		if err := parseNAT64Prefix(s, &prefix); err == nil {
+			t.Errorf("parseNAT64Prefix(%q) = %s, want an error", s, prefix)
+		}
+	}
+}
+
+func TestDNSHandler_DNS64(t *testing.T) {
+	store := NewMemoryStore(map[string]HostEntry{
+		"v4only.example.com":    {A: []net.IP{net.IPv4(192, 0, 2, 33)}},
+		"dualstack.example.com": {A: []net.IP{net.IPv4(192, 0, 2, 1)}, AAAA: []net.IP{net.ParseIP("2001:db8::1")}},
+		"alias.example.com":     {CNAME: "v4only.example.com"},
+	})
+
+	tests := []struct {
+		name string
+		args []string
+		host string
+		want []string // AAAA answers, in order
+	}{
+		{"default prefix", []string{"--dns64"}, "v4only.example.com", []string{"64:ff9b::c000:221"}},
+		{"configured prefix", []string{"--dns64", "--dns64-prefix", "2001:db8:64::/96"}, "v4only.example.com", []string{"2001:db8:64::c000:221"}},
+		{"through a CNAME", []string{"--dns64"}, "alias.example.com", []string{"64:ff9b::c000:221"}},
+		{"real AAAA kept", []string{"--dns64"}, "dualstack.example.com", []string{"2001:db8::1"}},
+		{"disabled", nil, "v4only.example.com", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ParseConfig(append(tt.args, "--type-ttl", "A=120"))
+			if err != nil {
+				t.Fatalf("ParseConfig() failed: %v", err)
+			}
+			query := buildTestDNSQuery(0x0064, []Question{{Name: tt.host, Type: RecordTypeAAAA, Class: ClassIN}})
+			response, err := NewDNSHandler(query, WithConfig(cfg), WithStore(store)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != RCodeNoError {
+				t.Fatalf("RCode = %d, want NOERROR", got)
+			}
+
+			var got []string
+			for _, rr := range respMsg.Answers {
+				if rr.Type == RecordTypeA {
+					t.Errorf("Answer carries an A record: %s", rr.String())
+				}
+				if rr.Type != RecordTypeAAAA {
+					continue
+				}
+				got = append(got, net.IP(rr.RData).String())
+				if tt.host == "v4only.example.com" && rr.TTL != 120 {
+					t.Errorf("Synthesized AAAA TTL = %d, want the A record's 120", rr.TTL)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("AAAA answers = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("AAAA answer %d = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DNS-over-HTTPS constants (RFC 8484)
+const (
+	DoHPath        = "/dns-query"
+	DoHContentType = "application/dns-message"
+	maxDoHBodySize = 0xFFFF // a DNS message can't be longer than this
+)
+
+// DoHHandler serves DNS-over-HTTPS requests by running them through DNSHandler
+type DoHHandler struct {
+	opts []HandlerOption
+}
+
+// NewDoHHandler creates an HTTP handler answering queries with the given handler options
+func NewDoHHandler(opts []HandlerOption) *DoHHandler {
+	return &DoHHandler{opts: opts}
+}
+
+func (d *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, status, err := d.readQuery(r)
+	if err != nil {
+		fmt.Printf("Rejecting DoH request from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var request Message
+	if err := request.UnmarshalBinary(query); err != nil {
+		fmt.Printf("Rejecting malformed DoH query from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	response, err := NewDNSHandler(query, d.opts...).HandleSafely()
+	if err != nil {
+		fmt.Printf("Failed to handle DoH query from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, "failed to resolve query", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DoHContentType)
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err == nil {
+		if ttl, ok := minTTL(&respMsg); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		}
+	}
+	w.Write(response)
+}
+
+// readQuery extracts the wire-format query from a GET or POST request. On error it
+// also returns the HTTP status to reply with.
+func (d *DoHHandler) readQuery(r *http.Request) ([]byte, int, error) {
+	var query []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing dns parameter")
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid base64url in dns parameter: %w", err)
+		}
+		query = decoded
+
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != DoHContentType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", ct)
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxDoHBodySize+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("failed to read body: %w", err)
+		}
+		if len(body) > maxDoHBodySize {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", maxDoHBodySize)
+		}
+		query = body
+
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)
+	}
+
+	if len(query) < DNSHeaderSize {
+		return nil, http.StatusBadRequest, fmt.Errorf("message too small: %d bytes", len(query))
+	}
+	return query, 0, nil
+}
+
+// minTTL returns the smallest TTL among the answer and authority records.
+// OPT records are skipped since their TTL field holds flags.
+func minTTL(m *Message) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]ResourceRecord{m.Answers, m.Authority} {
+		for _, rr := range section {
+			if rr.Type == RecordTypeOPT {
+				continue
+			}
+			if !found || rr.TTL < ttl {
+				ttl = rr.TTL
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// NewDoHServer creates an HTTP server exposing the DoH endpoint on addr
+func NewDoHServer(addr string, opts []HandlerOption) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(DoHPath, NewDoHHandler(opts))
+	return &http.Server{Addr: addr, Handler: mux}
+}
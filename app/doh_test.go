@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDoH_GetAndPost(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TTL = 120
+	server := httptest.NewServer(NewDoHServer("", []HandlerOption{WithConfig(cfg)}).Handler)
+	defer server.Close()
+
+	query := buildTestDNSQuery(0, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+
+	getURL := server.URL + DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(query)
+	getResp, err := http.Get(getURL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	postResp, err := http.Post(server.URL+DoHPath, DoHContentType, bytes.NewReader(query))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+
+	for method, resp := range map[string]*http.Response{"GET": getResp, "POST": postResp} {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s status = %d, want 200 (%s)", method, resp.StatusCode, body)
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != DoHContentType {
+			t.Errorf("%s content-type = %q, want %q", method, ct, DoHContentType)
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != "max-age=120" {
+			t.Errorf("%s cache-control = %q, want max-age=120", method, cc)
+		}
+
+		var respMsg Message
+		if err := respMsg.UnmarshalBinary(body); err != nil {
+			t.Fatalf("%s: failed to parse response: %v", method, err)
+		}
+		if len(respMsg.Answers) != 1 || !bytes.Equal(respMsg.Answers[0].RData, []byte{151, 101, 129, 69}) {
+			t.Errorf("%s answers = %+v, want stackoverflow.com's address", method, respMsg.Answers)
+		}
+	}
+}
+
+func TestDoH_MalformedRequests(t *testing.T) {
+	server := httptest.NewServer(NewDoHServer("", nil).Handler)
+	defer server.Close()
+
+	truncated := buildTestDNSQuery(0, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	truncated = truncated[:len(truncated)-3]
+
+	tests := []struct {
+		name   string
+		do     func() (*http.Response, error)
+		status int
+	}{
+		{"GET without dns parameter", func() (*http.Response, error) {
+			return http.Get(server.URL + DoHPath)
+		}, http.StatusBadRequest},
+		{"GET with invalid base64", func() (*http.Response, error) {
+			return http.Get(server.URL + DoHPath + "?dns=!!!")
+		}, http.StatusBadRequest},
+		{"POST truncated message", func() (*http.Response, error) {
+			return http.Post(server.URL+DoHPath, DoHContentType, bytes.NewReader(truncated))
+		}, http.StatusBadRequest},
+		{"POST wrong content type", func() (*http.Response, error) {
+			return http.Post(server.URL+DoHPath, "text/plain", bytes.NewReader(truncated))
+		}, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.do()
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// DrainPath is the control plane path that starts (POST) and stops (DELETE) draining
+const DrainPath = "/drain"
+
+// Drain is a switch that, while on, answers every new query with a fixed rcode
+// so the server can be taken out of a load balancer before shutdown. Queries
+// already past the drain check when it's turned on complete normally.
+type Drain struct {
+	rcode    uint8
+	draining atomic.Bool
+}
+
+// NewDrain creates a drain switch, initially off, that answers with rcode while on
+func NewDrain(rcode uint8) *Drain {
+	return &Drain{rcode: rcode}
+}
+
+// parseDrainRcode converts a --drain-rcode value to an rcode
+func parseDrainRcode(name string) (uint8, error) {
+	switch strings.ToLower(name) {
+	case "servfail":
+		return RCodeServFail, nil
+	case "refused":
+		return RCodeRefused, nil
+	}
+	return 0, fmt.Errorf("drain-rcode must be servfail or refused, got %q", name)
+}
+
+// Start begins answering new queries with the drain rcode
+func (d *Drain) Start() {
+	if !d.draining.Swap(true) {
+		fmt.Printf("Draining: answering new queries with rcode %d\n", d.rcode)
+	}
+}
+
+// Stop resumes answering queries normally
+func (d *Drain) Stop() {
+	if d.draining.Swap(false) {
+		fmt.Println("Stopped draining")
+	}
+}
+
+// Draining reports whether the switch is on
+func (d *Drain) Draining() bool {
+	return d.draining.Load()
+}
+
+// Middleware answers requests with the drain rcode while draining
+func (d *Drain) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(req *Message) (*Message, error) {
+			if d.Draining() {
+				b := NewResponseBuilder(req).SetRcode(d.rcode)
+				// EDNS clients get an OPT record back, as in any other response
+				if req.EDNS != nil {
+					b.SetEDNS(&OPTRecord{UDPSize: EDNSUDPSize})
+				}
+				return b.Build(), nil
+			}
+			return next.ServeDNS(req)
+		})
+	}
+}
+
+// drainHandler exposes a Drain on the control plane: POST starts draining,
+// DELETE stops and GET reports whether it's on. Only loopback callers are served.
+type drainHandler struct {
+	drain *Drain
+	token string // required bearer token, empty to allow any caller
+}
+
+func (h *drainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !bearerAuthorized(r, h.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		h.drain.Start()
+	case http.MethodDelete:
+		h.drain.Stop()
+	case http.MethodGet:
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "draining=%t\n", h.drain.Draining())
+}
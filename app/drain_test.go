@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// queryRcode sends one A query through a handler with opts and returns the response rcode
+func queryRcode(t *testing.T, opts ...HandlerOption) uint8 {
+	t.Helper()
+
+	queryData := buildTestDNSQuery(0x6472, []Question{{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}})
+	response, err := NewDNSHandler(queryData, opts...).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	return respMsg.Header.GetRcode()
+}
+
+func TestDrain_ToggledFromControlPlane(t *testing.T) {
+	tests := []struct {
+		name  string
+		rcode uint8
+	}{
+		{"servfail", RCodeServFail},
+		{"refused", RCodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ParseConfig([]string{"--drain-rcode", tt.name})
+			if err != nil {
+				t.Fatalf("ParseConfig() failed: %v", err)
+			}
+			drain := NewDrain(cfg.DrainRcode)
+			server := httptest.NewServer(NewControlServer("", NewMemoryStore(nil), drain, nil, "secret").Handler)
+			defer server.Close()
+
+			call := func(method, token string) int {
+				req, err := http.NewRequest(method, server.URL+DrainPath, nil)
+				if err != nil {
+					t.Fatalf("Failed to build request: %v", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("%s %s failed: %v", method, DrainPath, err)
+				}
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			opts := []HandlerOption{WithMiddleware(drain.Middleware())}
+
+			if got := queryRcode(t, opts...); got != RCodeNoError {
+				t.Errorf("RCode before draining = %d, want NOERROR", got)
+			}
+			if status := call(http.MethodPost, "wrong"); status != http.StatusUnauthorized || drain.Draining() {
+				t.Errorf("Drain with a bad token = %d (draining %v), want %d", status, drain.Draining(), http.StatusUnauthorized)
+			}
+			if status := call(http.MethodPost, "secret"); status != http.StatusOK {
+				t.Fatalf("Drain = %d, want %d", status, http.StatusOK)
+			}
+			if got := queryRcode(t, opts...); got != tt.rcode {
+				t.Errorf("RCode while draining = %d, want %d", got, tt.rcode)
+			}
+			if status := call(http.MethodDelete, "secret"); status != http.StatusOK {
+				t.Fatalf("Undrain = %d, want %d", status, http.StatusOK)
+			}
+			if got := queryRcode(t, opts...); got != RCodeNoError {
+				t.Errorf("RCode after draining stopped = %d, want NOERROR", got)
+			}
+		})
+	}
+
+	if _, err := ParseConfig([]string{"--drain-rcode", "nxdomain"}); err == nil {
+		t.Error("ParseConfig() accepted a drain rcode other than servfail or refused")
+	}
+}
+
+func TestDrain_InFlightQueriesComplete(t *testing.T) {
+	drain := NewDrain(RCodeServFail)
+	upstream := &blockingForwarder{release: make(chan struct{})}
+	opts := []HandlerOption{WithMiddleware(drain.Middleware()), WithUpstream(upstream)}
+
+	inFlight := make(chan []byte)
+	go func() {
+		queryData := buildTestDNSQuery(0x6466, []Question{{Name: "slow.example.com", Type: RecordTypeA, Class: ClassIN}})
+		response, _ := NewDNSHandler(queryData, opts...).Handle()
+		inFlight <- response
+	}()
+	for upstream.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	drain.Start()
+	close(upstream.release)
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(<-inFlight); err != nil {
+		t.Fatalf("Failed to parse the in-flight response: %v", err)
+	}
+	if got := respMsg.Header.GetRcode(); got != RCodeNoError || len(respMsg.Answers) != 1 {
+		t.Errorf("Query in flight when draining started got RCode %d with %d answers, want NOERROR with 1",
+			got, len(respMsg.Answers))
+	}
+	if got := queryRcode(t, opts...); got != RCodeServFail {
+		t.Errorf("RCode of a new query while draining = %d, want SERVFAIL", got)
+	}
+}
+
+func TestDrain_KeepsEDNS(t *testing.T) {
+	drain := NewDrain(RCodeRefused)
+	drain.Start()
+	header := MessageHeader{Id: 0x6470, QDCount: 1}
+	header.SetRD(1)
+	query := Message{Header: header, Questions: []Question{{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}}, EDNS: &OPTRecord{UDPSize: 4096}}
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	for _, pad := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.Pad = pad
+		response, err := NewDNSHandler(queryData, WithConfig(cfg), WithMiddleware(drain.Middleware())).Handle()
+		if err != nil {
+			t.Fatalf("Handle() with pad=%v failed: %v", pad, err)
+		}
+		var respMsg Message
+		if err := respMsg.UnmarshalBinary(response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if got := respMsg.Header.GetRcode(); got != RCodeRefused {
+			t.Errorf("RCode with pad=%v = %d, want REFUSED", pad, got)
+		}
+		if respMsg.EDNS == nil {
+			t.Fatalf("Drain response with pad=%v has no OPT record", pad)
+		}
+		if _, padded := respMsg.EDNS.Option(EDNSOptionPadding); padded != pad {
+			t.Errorf("Drain response with pad=%v padded = %v", pad, padded)
+		}
+	}
+}
+
+func TestDrain_LoopbackOnly(t *testing.T) {
+	drain := NewDrain(RCodeServFail)
+	handler := NewControlServer("", NewMemoryStore(nil), drain, nil, "").Handler
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       int
+	}{
+		{"remote", "192.0.2.1:40000", http.StatusForbidden},
+		{"ipv4 loopback", "127.0.0.1:40000", http.StatusOK},
+		{"ipv6 loopback", "[::1]:40000", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, DrainPath, nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("Status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, DrainPath, nil)
+	req.RemoteAddr = "192.0.2.1:40000"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if drain.Draining() {
+		t.Error("Remote caller started draining")
+	}
+}
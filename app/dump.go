@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// hexDumpWidth is the number of bytes shown on each line of a hex dump
+const hexDumpWidth = 16
+
+// HexDump formats data like `hexdump -C`: offsets, hex bytes and an ASCII sidebar
+//
+//	00000000  4e 53 01 00 00 01 00 00  00 00 00 00 07 65 78 61  |NS...........exa|
+func HexDump(data []byte) string {
+	var b strings.Builder
+	writeHexDump(&b, data, 0)
+	fmt.Fprintf(&b, "%08x\n", len(data))
+	return b.String()
+}
+
+// writeHexDump writes data as hex dump lines, numbering offsets from base
+func writeHexDump(b *strings.Builder, data []byte, base int) {
+	for start := 0; start < len(data); start += hexDumpWidth {
+		line := data[start:min(start+hexDumpWidth, len(data))]
+		fmt.Fprintf(b, "%08x ", base+start)
+		for i := range hexDumpWidth {
+			if i == hexDumpWidth/2 {
+				b.WriteByte(' ')
+			}
+			if i < len(line) {
+				fmt.Fprintf(b, " %02x", line[i])
+			} else {
+				b.WriteString("   ")
+			}
+		}
+		b.WriteString("  |")
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			b.WriteByte(c)
+		}
+		b.WriteString("|\n")
+	}
+}
+
+// DumpMessage is like HexDump for a DNS message, with a comment line before the
+// header, each question and each record. Whatever can't be parsed is dumped
+// after a comment saying why.
+func DumpMessage(data []byte) string {
+	var b strings.Builder
+	p := NewParser(data)
+	part := func(label string, start int) {
+		fmt.Fprintf(&b, "; %s\n", label)
+		writeHexDump(&b, data[start:p.Offset()], start)
+	}
+
+	header, err := p.ReadHeader()
+	if err == nil {
+		part(fmt.Sprintf("header: id %d, %d questions, %d answers, %d authority, %d additional",
+			header.Id, header.QDCount, header.ANCount, header.NSCount, header.ARCount), 0)
+		err = dumpSections(p, header, part)
+	}
+	if err != nil {
+		fmt.Fprintf(&b, "; unparsed: %v\n", err)
+	} else if p.Remaining() > 0 {
+		b.WriteString("; trailing bytes\n")
+	}
+	writeHexDump(&b, data[p.Offset():], p.Offset())
+	fmt.Fprintf(&b, "%08x\n", len(data))
+	return b.String()
+}
+
+// dumpSections reads the questions and records announced in header, calling part
+// after each with its label and start offset
+func dumpSections(p *Parser, header MessageHeader, part func(label string, start int)) error {
+	for i := range int(header.QDCount) {
+		start := p.Offset()
+		q, err := p.ReadQuestion()
+		if err != nil {
+			return err
+		}
+		part(fmt.Sprintf("question %d: %s %s %s", i+1, fqdn(q.Name), className(q.Class), TypeName(q.Type)), start)
+	}
+
+	sections := []struct {
+		name  string
+		count uint16
+	}{{"answer", header.ANCount}, {"authority", header.NSCount}, {"additional", header.ARCount}}
+	for _, section := range sections {
+		for i := range int(section.count) {
+			start := p.Offset()
+			rr, err := p.ReadRR()
+			if err != nil {
+				return err
+			}
+			part(fmt.Sprintf("%s %d: %s", section.name, i+1, rr.String()), start)
+		}
+	}
+	return nil
+}
+
+// ParseAndDescribe parses a captured DNS message and describes it in the style of dig
+func ParseAndDescribe(data []byte) (string, error) {
+	var msg Message
+	if err := msg.UnmarshalBinary(data); err != nil {
+		return "", fmt.Errorf("failed to parse message: %w", err)
+	}
+	return msg.String(), nil
+}
+
+// decodeHexPacket decodes a packet written as hex digits, ignoring whitespace so
+// it may be split over lines or into byte groups
+func decodeHexPacket(text string) ([]byte, error) {
+	digits := strings.Join(strings.Fields(text), "")
+	data, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex packet: %w", err)
+	}
+	return data, nil
+}
+
+// runParse implements `parse <hexfile>`: it describes the packet written as hex in
+// hexfile, followed by an annotated dump of its bytes, and returns the exit status
+func runParse(args []string, w io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(w, "usage: parse <hexfile>")
+		return 2
+	}
+	text, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintln(w, "Failed to read packet:", err)
+		return 1
+	}
+	data, err := decodeHexPacket(string(text))
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	description, err := ParseAndDescribe(data)
+	if err != nil {
+		fmt.Fprint(w, DumpMessage(data))
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	fmt.Fprintln(w, description)
+	fmt.Fprint(w, DumpMessage(data))
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHexDump(t *testing.T) {
+	data := []byte("\x4e\x53\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x07example\x03com\x00\x00\x01\x00\x01")
+
+	want := "" +
+		"00000000  4e 53 01 00 00 01 00 00  00 00 00 00 07 65 78 61  |NS...........exa|\n" +
+		"00000010  6d 70 6c 65 03 63 6f 6d  00 00 01 00 01           |mple.com.....|\n" +
+		"0000001d\n"
+	if got := HexDump(data); got != want {
+		t.Errorf("HexDump() =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := HexDump(nil); got != "00000000\n" {
+		t.Errorf("HexDump(nil) = %q, want just the zero offset", got)
+	}
+}
+
+func TestDumpMessage(t *testing.T) {
+	msg := Message{
+		Header:    MessageHeader{Id: 0x4e53, QDCount: 1, ANCount: 1},
+		Questions: []Question{{Name: "example.com", Type: RecordTypeA, Class: ClassIN}},
+		Answers:   []ResourceRecord{{Name: "example.com", Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1}}},
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	dump := DumpMessage(data)
+	for _, want := range []string{
+		"; header: id 20051, 1 questions, 1 answers, 0 authority, 0 additional\n00000000  4e 53",
+		"; question 1: example.com. IN A\n0000000c  07 65 78 61 6d 70 6c 65  03 63 6f 6d 00 00 01 00  |.example.com....|\n0000001c  01  ",
+		"; answer 1: example.com.\t60\tIN\tA\t192.0.2.1\n0000001d  c0 0c 00 01",
+		"|.........<......|\n0000002d\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("DumpMessage() missing %q in:\n%s", want, dump)
+		}
+	}
+
+	// A truncated message dumps what parsed, then the rest raw
+	dump = DumpMessage(data[:20])
+	if !strings.Contains(dump, "; header:") || !strings.Contains(dump, "; unparsed:") || !strings.Contains(dump, "0000000c  07 65 78 61") {
+		t.Errorf("DumpMessage() of a truncated message =\n%s", dump)
+	}
+}
+
+// capturedQuery is a query for www.example.com A as captured off the wire, in hex
+const capturedQuery = "12340100000100000000000003777777076578616d706c6503636f6d0000010001"
+
+func TestParseAndDescribe(t *testing.T) {
+	data, err := decodeHexPacket(capturedQuery)
+	if err != nil {
+		t.Fatalf("decodeHexPacket() failed: %v", err)
+	}
+	description, err := ParseAndDescribe(data)
+	if err != nil {
+		t.Fatalf("ParseAndDescribe() failed: %v", err)
+	}
+	for _, want := range []string{"id: 4660", "flags: rd", ";www.example.com.\t\tIN\tA\n"} {
+		if !strings.Contains(description, want) {
+			t.Errorf("ParseAndDescribe() missing %q in:\n%s", want, description)
+		}
+	}
+
+	if _, err := ParseAndDescribe(data[:20]); err == nil {
+		t.Error("ParseAndDescribe() of a truncated packet succeeded, want error")
+	}
+}
+
+func TestRunParse(t *testing.T) {
+	dir := t.TempDir()
+	// Captures are often split into byte groups over several lines
+	spaced := filepath.Join(dir, "spaced.hex")
+	if err := os.WriteFile(spaced, []byte("1234 0100 0001 0000 0000 0000\n03777777076578616d706c6503636f6d00\n0001 0001\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.hex")
+	if err := os.WriteFile(invalid, []byte("12 34 zz"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantStatus int
+		wantOutput string
+	}{
+		{"packet", []string{spaced}, 0, ";www.example.com."},
+		{"invalid hex", []string{invalid}, 1, "invalid hex packet"},
+		{"missing file", []string{filepath.Join(dir, "missing.hex")}, 1, "Failed to read packet"},
+		{"no file", nil, 2, "usage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if status := runParse(tt.args, &out); status != tt.wantStatus {
+				t.Errorf("runParse() = %d, want %d", status, tt.wantStatus)
+			}
+			if !strings.Contains(out.String(), tt.wantOutput) {
+				t.Errorf("runParse() output missing %q in:\n%s", tt.wantOutput, out.String())
+			}
+		})
+	}
+}
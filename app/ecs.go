@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// EDNSOptionClientSubnet is the EDNS Client Subnet option code (RFC 7871)
+const EDNSOptionClientSubnet uint16 = 8
+
+// How much of a client's address is sent upstream by default (RFC 7871 section 11.1)
+const (
+	DefaultECSPrefix4 = 24
+	DefaultECSPrefix6 = 56
+)
+
+// Address families used in the ECS option (IANA address family numbers)
+const (
+	ecsFamilyIPv4 uint16 = 1
+	ecsFamilyIPv6 uint16 = 2
+)
+
+// ClientSubnet is the content of an EDNS Client Subnet option
+type ClientSubnet struct {
+	Source netip.Prefix // the client's network, its length being the source prefix length
+	Scope  uint8        // prefix length the answer is valid for, 0 in queries
+}
+
+// Option encodes the subnet as an EDNS option. Only the bytes covering the
+// source prefix are sent, with the bits past it cleared.
+func (c ClientSubnet) Option() EDNSOption {
+	source := c.Source.Masked()
+	family := ecsFamilyIPv6
+	if source.Addr().Is4() {
+		family = ecsFamilyIPv4
+	}
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, uint8(source.Bits()), c.Scope)
+	data = append(data, source.Addr().AsSlice()[:(source.Bits()+7)/8]...)
+	return EDNSOption{Code: EDNSOptionClientSubnet, Data: data}
+}
+
+// parseClientSubnet decodes an ECS option, rejecting the malformed ones a server
+// must answer with FORMERR (RFC 7871 section 7.1.1)
+func parseClientSubnet(opt EDNSOption) (ClientSubnet, error) {
+	if len(opt.Data) < 4 {
+		return ClientSubnet{}, fmt.Errorf("client subnet option is %d bytes, want at least 4", len(opt.Data))
+	}
+	family := binary.BigEndian.Uint16(opt.Data[0:2])
+	sourceBits, scope := int(opt.Data[2]), opt.Data[3]
+	address := opt.Data[4:]
+
+	var full []byte
+	switch family {
+	case ecsFamilyIPv4:
+		full = make([]byte, 4)
+	case ecsFamilyIPv6:
+		full = make([]byte, 16)
+	default:
+		return ClientSubnet{}, fmt.Errorf("unknown client subnet address family %d", family)
+	}
+	if sourceBits > len(full)*8 || int(scope) > len(full)*8 {
+		return ClientSubnet{}, fmt.Errorf("client subnet prefix lengths %d/%d too long for family %d", sourceBits, scope, family)
+	}
+	if len(address) != (sourceBits+7)/8 {
+		return ClientSubnet{}, fmt.Errorf("client subnet address is %d bytes, want %d for /%d", len(address), (sourceBits+7)/8, sourceBits)
+	}
+	copy(full, address)
+
+	addr, _ := netip.AddrFromSlice(full)
+	source := netip.PrefixFrom(addr, sourceBits)
+	if source.Masked() != source {
+		return ClientSubnet{}, fmt.Errorf("client subnet address %s has bits set past /%d", addr, sourceBits)
+	}
+	return ClientSubnet{Source: source, Scope: scope}, nil
+}
+
+// setClientSubnet works out the subnet to send upstream on behalf of the client:
+// the one in the client's own ECS option if it has one, otherwise its address.
+// Either way no more than the configured prefix length is sent.
+func (h *DNSHandler) setClientSubnet() error {
+	if h.request.EDNS != nil {
+		if opt, found := h.request.EDNS.Option(EDNSOptionClientSubnet); found {
+			subnet, err := parseClientSubnet(opt)
+			if err != nil {
+				return err
+			}
+			h.clientSubnet = &subnet
+			h.subnet = h.truncateSubnet(subnet.Source.Addr(), subnet.Source.Bits())
+			return nil
+		}
+	}
+	if h.client.IsValid() {
+		h.subnet = h.truncateSubnet(h.client, h.client.BitLen())
+	}
+	return nil
+}
+
+// truncateSubnet returns the network of addr at most bits long, and no longer
+// than the configured ECS prefix length for its family
+func (h *DNSHandler) truncateSubnet(addr netip.Addr, bits int) netip.Prefix {
+	limit := h.config.ECSPrefix6
+	if addr.Is4() {
+		limit = h.config.ECSPrefix4
+	}
+	subnet, _ := addr.Prefix(min(bits, limit))
+	return subnet
+}
+
+// replyScope returns the clients a reply to a query sent for subnet applies to,
+// going by its ECS option (RFC 7871 section 7.3). A reply without one, or with
+// scope 0, applies to every client and gets an invalid prefix. A scope longer
+// than the subnet sent can only be honoured as far as the subnet goes.
+func replyScope(reply *Message, subnet netip.Prefix) netip.Prefix {
+	if !subnet.IsValid() || reply.EDNS == nil {
+		return netip.Prefix{}
+	}
+	opt, found := reply.EDNS.Option(EDNSOptionClientSubnet)
+	if !found {
+		return netip.Prefix{}
+	}
+	ecs, err := parseClientSubnet(opt)
+	if err != nil || ecs.Source != subnet.Masked() {
+		// Don't guess at what it applies to: keep it to the subnet it was asked for
+		fmt.Printf("Reply has a client subnet option for %v that doesn't match %s\n", ecs.Source, subnet)
+		return subnet.Masked()
+	}
+	if ecs.Scope == 0 {
+		return netip.Prefix{}
+	}
+	scope, _ := subnet.Addr().Prefix(min(int(ecs.Scope), subnet.Bits()))
+	return scope
+}
+
+// exchangeSubnet sends q to f on behalf of a client in subnet when f can pass
+// that on, and as a plain question otherwise or when subnet isn't valid
+func exchangeSubnet(f Forwarder, q Question, subnet netip.Prefix) ([]ResourceRecord, netip.Prefix, error) {
+	if sf, ok := f.(SubnetForwarder); ok && subnet.IsValid() {
+		return sf.ExchangeSubnet(q, subnet)
+	}
+	answers, err := f.Exchange(q)
+	return answers, netip.Prefix{}, err
+}
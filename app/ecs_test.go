@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestClientSubnet_Option(t *testing.T) {
+	tests := []struct {
+		name   string
+		subnet ClientSubnet
+		data   []byte
+	}{
+		{"IPv4 /24", ClientSubnet{Source: netip.MustParsePrefix("192.0.2.0/24")}, []byte{0, 1, 24, 0, 192, 0, 2}},
+		{"IPv4 /20", ClientSubnet{Source: netip.MustParsePrefix("198.51.96.0/20"), Scope: 16}, []byte{0, 1, 20, 16, 198, 51, 96}},
+		{"IPv6 /56", ClientSubnet{Source: netip.MustParsePrefix("2001:db8:1:2300::/56")}, []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 0x23}},
+		{"/0", ClientSubnet{Source: netip.MustParsePrefix("0.0.0.0/0")}, []byte{0, 1, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := tt.subnet.Option()
+			if opt.Code != EDNSOptionClientSubnet || !bytes.Equal(opt.Data, tt.data) {
+				t.Fatalf("Option() = %d %x, want %d %x", opt.Code, opt.Data, EDNSOptionClientSubnet, tt.data)
+			}
+			parsed, err := parseClientSubnet(opt)
+			if err != nil {
+				t.Fatalf("parseClientSubnet() failed: %v", err)
+			}
+			if parsed != tt.subnet {
+				t.Errorf("parseClientSubnet() = %+v, want %+v", parsed, tt.subnet)
+			}
+		})
+	}
+
+	malformed := map[string][]byte{
+		"short":             {0, 1, 24},
+		"unknown family":    {0, 3, 8, 0, 10},
+		"prefix too long":   {0, 1, 33, 0, 192, 0, 2, 1, 0},
+		"address too long":  {0, 1, 16, 0, 192, 0, 2},
+		"bits past prefix":  {0, 1, 23, 0, 192, 0, 3},
+		"scope too long v6": {0, 2, 0, 129},
+	}
+	for name, data := range malformed {
+		if _, err := parseClientSubnet(EDNSOption{Code: EDNSOptionClientSubnet, Data: data}); err == nil {
+			t.Errorf("parseClientSubnet() accepted the %s option %x", name, data)
+		}
+	}
+}
+
+// startECSUpstream runs a fake geo-aware upstream recording the client subnet
+// option of each query. It answers IPv4 subnets with their first address but
+// for a final 1, and echoes the option with the scope returned by scope.
+func startECSUpstream(t *testing.T, scope func(source netip.Prefix) int) (addr string, forwarded func() []EDNSOption) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var options []EDNSOption
+	addr = startFakeUpstream(t, func(query *Message) []Message {
+		var opt EDNSOption
+		if query.EDNS != nil {
+			opt, _ = query.EDNS.Option(EDNSOptionClientSubnet)
+		}
+		mu.Lock()
+		options = append(options, opt)
+		mu.Unlock()
+
+		subnet, err := parseClientSubnet(opt)
+		if err != nil {
+			return []Message{fakeReply(query, query.Questions[0], []byte{192, 0, 2, 1})}
+		}
+		ip := []byte{192, 0, 2, 1}
+		if subnet.Source.Addr().Is4() {
+			first := subnet.Source.Addr().As4()
+			ip = []byte{first[0], first[1], first[2], 1}
+		}
+		reply := fakeReply(query, query.Questions[0], ip)
+		subnet.Scope = uint8(scope(subnet.Source))
+		reply.EDNS = &OPTRecord{UDPSize: 1232, Options: []EDNSOption{subnet.Option()}}
+		return []Message{reply}
+	})
+	return addr, func() []EDNSOption {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]EDNSOption(nil), options...)
+	}
+}
+
+// sourceScope answers for exactly the subnet asked about
+func sourceScope(source netip.Prefix) int {
+	return source.Bits()
+}
+
+func TestDNSHandler_ForwardsClientSubnet(t *testing.T) {
+	q := Question{Name: "geo.example.com", Type: RecordTypeA, Class: ClassIN}
+
+	tests := []struct {
+		name      string
+		args      []string
+		client    string
+		clientECS *ClientSubnet // ECS option sent by the client
+		want      []byte        // forwarded ECS option data, nil for none
+	}{
+		{"IPv4 client", []string{"--ecs"}, "192.0.2.77", nil, []byte{0, 1, 24, 0, 192, 0, 2}},
+		{"IPv6 client", []string{"--ecs"}, "2001:db8:1:23ff::1", nil, []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 0x23}},
+		{"configured prefix", []string{"--ecs", "--ecs-prefix4", "20"}, "198.51.100.7", nil, []byte{0, 1, 20, 0, 198, 51, 96}},
+		{"client option passed on", []string{"--ecs"}, "192.0.2.77", &ClientSubnet{Source: netip.MustParsePrefix("203.0.0.0/16")}, []byte{0, 1, 16, 0, 203, 0}},
+		{"client option truncated", []string{"--ecs"}, "192.0.2.77", &ClientSubnet{Source: netip.MustParsePrefix("203.0.113.9/32")}, []byte{0, 1, 24, 0, 203, 0, 113}},
+		{"disabled", nil, "192.0.2.77", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, forwarded := startECSUpstream(t, sourceScope)
+			cfg, err := ParseConfig(tt.args)
+			if err != nil {
+				t.Fatalf("ParseConfig() failed: %v", err)
+			}
+
+			opt := OPTRecord{UDPSize: 1232}
+			if tt.clientECS != nil {
+				opt.Options = []EDNSOption{tt.clientECS.Option()}
+			}
+			query := buildTestEDNSQuery(0x0443, q, opt)
+			opts := []HandlerOption{WithConfig(cfg), WithUpstream(NewUpstream(addr)), WithClient(netip.MustParseAddr(tt.client))}
+			response, err := NewDNSHandler(query, opts...).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(respMsg.Answers) != 1 {
+				t.Fatalf("Got %d answers, want 1", len(respMsg.Answers))
+			}
+
+			options := forwarded()
+			if len(options) != 1 || !bytes.Equal(options[0].Data, tt.want) {
+				t.Errorf("Forwarded client subnet options = %x, want %x", options, tt.want)
+			}
+
+			echoed, found := respMsg.EDNS.Option(EDNSOptionClientSubnet)
+			if tt.clientECS == nil || tt.args == nil {
+				if found {
+					t.Errorf("Response carries a client subnet option %x the client didn't send", echoed.Data)
+				}
+			} else if want := (ClientSubnet{Source: tt.clientECS.Source, Scope: tt.want[2]}).Option(); !found || !bytes.Equal(echoed.Data, want.Data) {
+				t.Errorf("Echoed client subnet option = %x, want %x", echoed.Data, want.Data)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_MalformedClientSubnet(t *testing.T) {
+	cfg, err := ParseConfig([]string{"--ecs"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+	opt := OPTRecord{UDPSize: 1232, Options: []EDNSOption{{Code: EDNSOptionClientSubnet, Data: []byte{0, 1, 23, 0, 192, 0, 3}}}}
+	query := buildTestEDNSQuery(0x0443, Question{Name: "geo.example.com", Type: RecordTypeA, Class: ClassIN}, opt)
+
+	response, err := NewDNSHandler(query, WithConfig(cfg)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if got := respMsg.Header.GetRcode(); got != RCodeFormat {
+		t.Errorf("RCode = %d, want FORMERR", got)
+	}
+}
+
+func TestCachingForwarder_CachesPerClientSubnet(t *testing.T) {
+	addr, forwarded := startECSUpstream(t, sourceScope)
+	cache := NewCachingForwarder(NewCoalescingForwarder(NewUpstreamSet(NewUpstream(addr))), DefaultCacheCapacity)
+	cfg, err := ParseConfig([]string{"--ecs"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+
+	query := buildTestDNSQuery(0x0443, []Question{{Name: "geo.example.com", Type: RecordTypeA, Class: ClassIN}})
+	for _, client := range []string{"192.0.2.10", "192.0.2.20", "198.51.100.10"} {
+		opts := []HandlerOption{WithConfig(cfg), WithUpstream(cache), WithClient(netip.MustParseAddr(client))}
+		if _, err := NewDNSHandler(query, opts...).Handle(); err != nil {
+			t.Fatalf("Handle() failed: %v", err)
+		}
+	}
+
+	// The second client shares the first one's /24 and its cached answer
+	options := forwarded()
+	if len(options) != 2 {
+		t.Fatalf("Upstream queried %d times, want 2: %x", len(options), options)
+	}
+	if !bytes.Equal(options[1].Data, []byte{0, 1, 24, 0, 198, 51, 100}) {
+		t.Errorf("Second upstream query for subnet %x, want 198.51.100.0/24", options[1].Data)
+	}
+}
+
+func TestCachingForwarder_ServesWithinScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   func(source netip.Prefix) int
+		clients []string // queried in order
+		want    []string // answer for each client
+		queries int      // upstream queries expected
+	}{
+		{
+			"scope of the subnet",
+			sourceScope,
+			[]string{"192.0.2.10", "198.51.100.10", "192.0.2.99", "198.51.100.99"},
+			[]string{"192.0.2.1", "198.51.100.1", "192.0.2.1", "198.51.100.1"},
+			2,
+		},
+		{
+			"wider scope",
+			func(netip.Prefix) int { return 16 },
+			[]string{"203.0.113.10", "203.0.5.10", "198.51.100.10"},
+			[]string{"203.0.113.1", "203.0.113.1", "198.51.100.1"},
+			2,
+		},
+		{
+			"scope 0 applies to every client",
+			func(netip.Prefix) int { return 0 },
+			[]string{"192.0.2.10", "198.51.100.10"},
+			[]string{"192.0.2.1", "192.0.2.1"},
+			1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, forwarded := startECSUpstream(t, tt.scope)
+			cache := NewCachingForwarder(NewCoalescingForwarder(NewUpstreamSet(NewUpstream(addr))), DefaultCacheCapacity)
+			cfg, err := ParseConfig([]string{"--ecs"})
+			if err != nil {
+				t.Fatalf("ParseConfig() failed: %v", err)
+			}
+
+			query := buildTestDNSQuery(0x0444, []Question{{Name: "geo.example.com", Type: RecordTypeA, Class: ClassIN}})
+			for i, client := range tt.clients {
+				opts := []HandlerOption{WithConfig(cfg), WithUpstream(cache), WithClient(netip.MustParseAddr(client))}
+				response, err := NewDNSHandler(query, opts...).Handle()
+				if err != nil {
+					t.Fatalf("Handle() failed: %v", err)
+				}
+				var respMsg Message
+				if err := respMsg.UnmarshalBinary(response); err != nil {
+					t.Fatalf("Failed to parse response: %v", err)
+				}
+				if len(respMsg.Answers) != 1 || net.IP(respMsg.Answers[0].RData).String() != tt.want[i] {
+					t.Errorf("Client %s got %+v, want %s", client, respMsg.Answers, tt.want[i])
+				}
+			}
+			if got := len(forwarded()); got != tt.queries {
+				t.Errorf("Upstream queried %d times, want %d", got, tt.queries)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// EDNS(0) related constants (RFC 6891)
+const (
+	RecordTypeOPT       uint16 = 41
+	EDNSUDPSize                = 1232 // UDP payload size we advertise in responses
+	EDNSOptionKeepalive uint16 = 11   // RFC 7828
+	EDNSOptionPadding   uint16 = 12   // RFC 7830
+	EDNSOptionHeaderLen        = 4    // option code + option length
+)
+
+// EDNSOption is a single option carried in an OPT record
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPTRecord is the EDNS(0) pseudo-record. On the wire it is a resource record
+// whose class holds the UDP payload size and whose TTL holds the extended flags.
+type OPTRecord struct {
+	UDPSize       uint16
+	ExtendedRcode uint8
+	Version       uint8
+	Flags         uint16 // DO bit and reserved flags
+	Options       []EDNSOption
+}
+
+// Option returns the first option with the given code
+func (o *OPTRecord) Option(code uint16) (EDNSOption, bool) {
+	for _, opt := range o.Options {
+		if opt.Code == code {
+			return opt, true
+		}
+	}
+	return EDNSOption{}, false
+}
+
+// ResourceRecord encodes the OPT record as a resource record for the additional section
+func (o *OPTRecord) ResourceRecord() ResourceRecord {
+	return ResourceRecord{
+		Name:  "",
+		Type:  RecordTypeOPT,
+		Class: o.UDPSize,
+		TTL:   uint32(o.ExtendedRcode)<<24 | uint32(o.Version)<<16 | uint32(o.Flags),
+		RData: appendEDNSOptions(nil, o.Options),
+	}
+}
+
+// appendEDNSOptions appends options to b in wire format, in order. Options are
+// written the same whether we know their code or not.
+func appendEDNSOptions(b []byte, options []EDNSOption) []byte {
+	for _, opt := range options {
+		b = binary.BigEndian.AppendUint16(b, opt.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	return b
+}
+
+// parseEDNSOptions splits OPT RDATA into its options, in order. Unknown options
+// are kept as they are so they can be passed on or written back unchanged.
+func parseEDNSOptions(data []byte) ([]EDNSOption, error) {
+	var options []EDNSOption
+	for len(data) > 0 {
+		if len(data) < EDNSOptionHeaderLen {
+			return nil, fmt.Errorf("truncated EDNS option header: %d bytes left", len(data))
+		}
+		code := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if EDNSOptionHeaderLen+length > len(data) {
+			return nil, fmt.Errorf("EDNS option %d length %d exceeds remaining %d bytes", code, length, len(data)-EDNSOptionHeaderLen)
+		}
+		options = append(options, EDNSOption{
+			Code: code,
+			Data: cloneBytes(data[EDNSOptionHeaderLen : EDNSOptionHeaderLen+length]),
+		})
+		data = data[EDNSOptionHeaderLen+length:]
+	}
+	return options, nil
+}
+
+// parseOPTRecord decodes an OPT resource record
+func parseOPTRecord(rr ResourceRecord) (*OPTRecord, error) {
+	if rr.Type != RecordTypeOPT {
+		return nil, fmt.Errorf("record type %d is not OPT", rr.Type)
+	}
+	if rr.Name != "" {
+		return nil, fmt.Errorf("OPT record owner must be the root, got %q", rr.Name)
+	}
+
+	opt := &OPTRecord{
+		UDPSize:       rr.Class,
+		ExtendedRcode: uint8(rr.TTL >> 24),
+		Version:       uint8(rr.TTL >> 16),
+		Flags:         uint16(rr.TTL),
+	}
+
+	options, err := parseEDNSOptions(rr.RData)
+	if err != nil {
+		return nil, err
+	}
+	opt.Options = options
+	return opt, nil
+}
+
+// keepaliveUnit is the unit of the EDNS TCP keepalive timeout (RFC 7828 section 3.1)
+const keepaliveUnit = 100 * time.Millisecond
+
+// KeepaliveOption returns the EDNS TCP keepalive option announcing timeout,
+// rounded down to 100ms and capped at the largest value the option can carry
+func KeepaliveOption(timeout time.Duration) EDNSOption {
+	units := min(timeout/keepaliveUnit, 0xFFFF)
+	return EDNSOption{Code: EDNSOptionKeepalive, Data: binary.BigEndian.AppendUint16(nil, uint16(units))}
+}
+
+// parseKeepalive returns the timeout in a keepalive option. Clients send the
+// option empty, which reports ok false.
+func parseKeepalive(opt EDNSOption) (timeout time.Duration, ok bool, err error) {
+	switch len(opt.Data) {
+	case 0:
+		return 0, false, nil
+	case 2:
+		return time.Duration(binary.BigEndian.Uint16(opt.Data)) * keepaliveUnit, true, nil
+	}
+	return 0, false, fmt.Errorf("keepalive option is %d bytes, want 0 or 2", len(opt.Data))
+}
+
+// padMessage sets the padding option of m.EDNS so the marshaled message length
+// is a multiple of blockSize (RFC 7830, RFC 8467), marshaling it with opts.
+// m must have an OPT record.
+func padMessage(m *Message, blockSize int, opts MarshalOptions) ([]byte, error) {
+	if m.EDNS == nil {
+		return nil, fmt.Errorf("cannot pad a message without an OPT record")
+	}
+
+	// Start from an empty padding option so its header is part of the measured size
+	opt := *m.EDNS
+	options := make([]EDNSOption, 0, len(opt.Options)+1)
+	for _, o := range opt.Options {
+		if o.Code != EDNSOptionPadding {
+			options = append(options, o)
+		}
+	}
+	opt.Options = append(options, EDNSOption{Code: EDNSOptionPadding})
+	m.EDNS = &opt
+
+	data, err := m.MarshalWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize <= 0 || len(data)%blockSize == 0 {
+		return data, nil
+	}
+
+	padding := blockSize - len(data)%blockSize
+	opt.Options[len(opt.Options)-1].Data = make([]byte, padding)
+	return m.MarshalWithOptions(opts)
+}
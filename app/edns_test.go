@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// buildTestEDNSQuery builds a query for a single question carrying the given OPT record
+func buildTestEDNSQuery(id uint16, q Question, opt OPTRecord) []byte {
+	header := MessageHeader{Id: id, QDCount: 1}
+	header.SetRD(1)
+
+	msg := Message{
+		Header:    header,
+		Questions: []Question{q},
+		EDNS:      &opt,
+	}
+	data, _ := msg.MarshalBinary()
+	return data
+}
+
+func TestOPTRecord_RoundTrip(t *testing.T) {
+	original := OPTRecord{
+		UDPSize: 4096,
+		Version: 0,
+		Flags:   0x8000, // DO bit
+		Options: []EDNSOption{
+			{Code: EDNSOptionPadding, Data: make([]byte, 8)},
+			{Code: 65001, Data: []byte("hello")},
+		},
+	}
+
+	parsed, err := parseOPTRecord(original.ResourceRecord())
+	if err != nil {
+		t.Fatalf("parseOPTRecord() failed: %v", err)
+	}
+	if parsed.UDPSize != 4096 || parsed.Flags != 0x8000 || len(parsed.Options) != 2 {
+		t.Fatalf("parseOPTRecord() = %+v, want %+v", parsed, original)
+	}
+	if opt, ok := parsed.Option(65001); !ok || !bytes.Equal(opt.Data, []byte("hello")) {
+		t.Errorf("Option(65001) = %+v, %v, want hello", opt, ok)
+	}
+
+	// A truncated option must be rejected
+	rr := original.ResourceRecord()
+	rr.RData = rr.RData[:len(rr.RData)-1]
+	if _, err := parseOPTRecord(rr); err == nil {
+		t.Errorf("parseOPTRecord() accepted a truncated option")
+	}
+}
+
+func TestDNSHandler_Padding(t *testing.T) {
+	q := Question{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}
+
+	tests := []struct {
+		name      string
+		query     []byte
+		pad       bool
+		blockSize int
+		wantPad   bool
+	}{
+		{
+			name:      "client requests padding",
+			query:     buildTestEDNSQuery(1, q, OPTRecord{UDPSize: 1232, Options: []EDNSOption{{Code: EDNSOptionPadding}}}),
+			blockSize: 468,
+			wantPad:   true,
+		},
+		{
+			name:      "server always pads",
+			query:     buildTestEDNSQuery(2, q, OPTRecord{UDPSize: 1232}),
+			pad:       true,
+			blockSize: 128,
+			wantPad:   true,
+		},
+		{
+			name:      "EDNS client without padding",
+			query:     buildTestEDNSQuery(3, q, OPTRecord{UDPSize: 1232}),
+			blockSize: 468,
+		},
+		{
+			name:      "non-EDNS client is never padded",
+			query:     buildTestDNSQuery(4, []Question{q}),
+			pad:       true,
+			blockSize: 468,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Pad = tt.pad
+			cfg.PadBlockSize = tt.blockSize
+
+			response, err := NewDNSHandler(tt.query, WithConfig(cfg)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(respMsg.Answers) != 1 {
+				t.Errorf("Response has %d answers, want 1", len(respMsg.Answers))
+			}
+
+			opt := respMsg.EDNS
+
+			if !tt.wantPad {
+				if opt != nil {
+					if _, padded := opt.Option(EDNSOptionPadding); padded {
+						t.Errorf("Response carries a padding option, want none")
+					}
+				}
+				return
+			}
+
+			if opt == nil {
+				t.Fatalf("Padded response has no OPT record")
+			}
+			if _, padded := opt.Option(EDNSOptionPadding); !padded {
+				t.Errorf("Padded response has no padding option")
+			}
+			if len(response)%tt.blockSize != 0 {
+				t.Errorf("Response length %d is not a multiple of %d", len(response), tt.blockSize)
+			}
+		})
+	}
+}
+
+func TestOPTRecord_PreservesUnknownOptions(t *testing.T) {
+	original := OPTRecord{
+		UDPSize: 1232,
+		Options: []EDNSOption{
+			KeepaliveOption(30 * time.Second),
+			{Code: 65001, Data: []byte{0xde, 0xad, 0xbe, 0xef}},
+		},
+	}
+	wire := []byte{
+		0x00, 0x0b, 0x00, 0x02, 0x01, 0x2c, // keepalive, 300 units of 100ms
+		0xfd, 0xe9, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef, // unknown option 65001
+	}
+	if rdata := original.ResourceRecord().RData; !bytes.Equal(rdata, wire) {
+		t.Fatalf("RDATA = %x, want %x", rdata, wire)
+	}
+
+	msg := Message{
+		Header:    MessageHeader{Id: 0x0442, QDCount: 1},
+		Questions: []Question{{Name: "example.com", Type: RecordTypeA, Class: ClassIN}},
+		EDNS:      &original,
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	var parsed Message
+	if err := parsed.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() failed: %v", err)
+	}
+	if parsed.EDNS == nil || !reflect.DeepEqual(parsed.EDNS.Options, original.Options) {
+		t.Fatalf("Options after a round trip = %+v, want %+v", parsed.EDNS, original.Options)
+	}
+	keepalive, _ := parsed.EDNS.Option(EDNSOptionKeepalive)
+	if timeout, ok, err := parseKeepalive(keepalive); err != nil || !ok || timeout != 30*time.Second {
+		t.Errorf("parseKeepalive() = %v, %v, %v, want 30s", timeout, ok, err)
+	}
+
+	again, err := parsed.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() of parsed message failed: %v", err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Errorf("Re-marshaled message = %x, want %x", again, data)
+	}
+}
+
+func TestMessage_EDNSField(t *testing.T) {
+	q := Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN}
+	opt := OPTRecord{UDPSize: 1232, Options: []EDNSOption{{Code: 65001, Data: []byte("x")}}}
+	glue := ResourceRecord{Name: "ns.example.com", Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, 53}}
+
+	tests := []struct {
+		name           string
+		msg            Message
+		wantAdditional int
+		wantErr        bool
+	}{
+		{
+			"OPT in additional",
+			Message{
+				Header:     MessageHeader{QDCount: 1, ARCount: 2},
+				Questions:  []Question{q},
+				Additional: []ResourceRecord{glue, opt.ResourceRecord()},
+			},
+			1, false,
+		},
+		{
+			"OPT misplaced in answers",
+			Message{
+				Header:    MessageHeader{QDCount: 1, ANCount: 1},
+				Questions: []Question{q},
+				Answers:   []ResourceRecord{opt.ResourceRecord()},
+			},
+			0, false,
+		},
+		{
+			"two OPT records",
+			Message{
+				Header:     MessageHeader{QDCount: 1, ARCount: 2},
+				Questions:  []Question{q},
+				Additional: []ResourceRecord{opt.ResourceRecord(), opt.ResourceRecord()},
+			},
+			0, true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+
+			var parsed Message
+			err = parsed.UnmarshalBinary(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalBinary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if parsed.EDNS == nil || parsed.EDNS.UDPSize != 1232 || len(parsed.EDNS.Options) != 1 {
+				t.Fatalf("EDNS = %+v, want the OPT record", parsed.EDNS)
+			}
+			if len(parsed.Answers) != 0 || len(parsed.Additional) != tt.wantAdditional {
+				t.Errorf("Sections hold %d answers and %d additional, want 0 and %d",
+					len(parsed.Answers), len(parsed.Additional), tt.wantAdditional)
+			}
+			if parsed.Header.ANCount != 0 || int(parsed.Header.ARCount) != tt.wantAdditional {
+				t.Errorf("Header counts AN=%d AR=%d, want the OPT record left out",
+					parsed.Header.ANCount, parsed.Header.ARCount)
+			}
+
+			// Marshaling puts the OPT record back at the end of the additional section
+			again, err := parsed.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() of parsed message failed: %v", err)
+			}
+			var reparsed Message
+			if err := reparsed.UnmarshalBinary(again); err != nil {
+				t.Fatalf("UnmarshalBinary() of re-marshaled message failed: %v", err)
+			}
+			if reparsed.EDNS == nil || len(reparsed.Additional) != tt.wantAdditional {
+				t.Errorf("Re-parsed EDNS = %+v with %d additional records", reparsed.EDNS, len(reparsed.Additional))
+			}
+		})
+	}
+}
+
+func TestKeepaliveOption(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{10 * time.Second, 10 * time.Second},
+		{250 * time.Millisecond, 200 * time.Millisecond}, // rounded down to 100ms units
+		{3 * time.Hour, 0xFFFF * 100 * time.Millisecond}, // capped
+	}
+	for _, tt := range tests {
+		got, ok, err := parseKeepalive(KeepaliveOption(tt.timeout))
+		if err != nil || !ok || got != tt.want {
+			t.Errorf("KeepaliveOption(%s) parsed as %s (ok %t, err %v), want %s", tt.timeout, got, ok, err, tt.want)
+		}
+	}
+
+	if _, ok, err := parseKeepalive(EDNSOption{Code: EDNSOptionKeepalive}); ok || err != nil {
+		t.Errorf("Empty keepalive option parsed with ok %t err %v, want no timeout", ok, err)
+	}
+	if _, _, err := parseKeepalive(EDNSOption{Code: EDNSOptionKeepalive, Data: []byte{1}}); err == nil {
+		t.Error("1 byte keepalive option parsed, want error")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// fuzzSeedPackets returns hand-written packets from the other tests to seed the fuzz corpus
+func fuzzSeedPackets(f *testing.F) [][]byte {
+	f.Helper()
+
+	realWorld, err := hex.DecodeString("12340100000100000000000003777777076578616d706c6503636f6d0000010001")
+	if err != nil {
+		f.Fatalf("Invalid seed packet: %v", err)
+	}
+
+	seeds := [][]byte{
+		realWorld,
+		// Compression pointer pointing at itself
+		{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1},
+		buildTestDNSQuery(0x1234, []Question{
+			{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+			{Name: "www.stackoverflow.com", Type: RecordTypeAAAA, Class: ClassIN},
+		}),
+		buildTestEDNSQuery(0x2345, Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN},
+			OPTRecord{UDPSize: 4096, Options: []EDNSOption{{Code: EDNSOptionPadding, Data: make([]byte, 8)}}}),
+	}
+
+	// A response with compressed names in owner and RDATA fields
+	response, err := NewDNSHandler(buildTestDNSQuery(0x3456, []Question{
+		{Name: "mail.example.com", Type: RecordTypeSOA, Class: ClassIN},
+	})).Handle()
+	if err != nil {
+		f.Fatalf("Failed to build seed response: %v", err)
+	}
+	return append(seeds, response)
+}
+
+func FuzzUnmarshalMessage(f *testing.F) {
+	for _, seed := range fuzzSeedPackets(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return
+		}
+
+		// Anything we accept must be something we can send back out
+		out, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() of a parsed message failed: %v", err)
+		}
+
+		var again Message
+		if err := again.UnmarshalBinary(out); err != nil {
+			t.Fatalf("Re-parsing a marshalled message failed: %v", err)
+		}
+		if len(again.Questions) != len(msg.Questions) || len(again.Answers) != len(msg.Answers) ||
+			len(again.Authority) != len(msg.Authority) || len(again.Additional) != len(msg.Additional) {
+			t.Fatalf("Section sizes changed on re-parse")
+		}
+	})
+}
+
+func FuzzDecodeDNSName(f *testing.F) {
+	for _, seed := range fuzzSeedPackets(f) {
+		f.Add(seed, DNSHeaderSize)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, offset int) {
+		if offset < 0 {
+			offset = -offset
+		}
+		name, next, err := decodeDNSName(data, offset)
+		if err != nil {
+			return
+		}
+		if next <= offset || next > len(data) {
+			t.Fatalf("decodeDNSName() returned offset %d for a name at %d in %d bytes", next, offset, len(data))
+		}
+		if len(name) > MaxDomainLength {
+			t.Fatalf("decodeDNSName() returned a %d byte name", len(name))
+		}
+	})
+}
@@ -1,175 +1,855 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"time"
 )
 
 // mockDNSRecords is a map of domain names to their IP addresses for testing
 // Supports wildcard patterns like "*.codecrafters.io"
-var mockDNSRecords = map[string][]byte{
-	"stackoverflow.com":    {151, 101, 129, 69},
-	"stackoverflow.design": {151, 101, 1, 69},
-	"*.codecrafters.io":    {76, 76, 21, 21},
-	"mail.example.com":     {192, 168, 0, 2},
+var mockDNSRecords = map[string]HostEntry{
+	"stackoverflow.com":     {A: []net.IP{net.IPv4(151, 101, 129, 69)}},
+	"stackoverflow.design":  {A: []net.IP{net.IPv4(151, 101, 1, 69)}},
+	"www.stackoverflow.com": {CNAME: "stackoverflow.com"},
+	"*.codecrafters.io":     {A: []net.IP{net.IPv4(76, 76, 21, 21)}},
+	"mail.example.com":      {A: []net.IP{net.IPv4(192, 168, 0, 2)}},
+	"dual.example.com": {
+		A:    []net.IP{net.IPv4(192, 0, 2, 10)},
+		AAAA: []net.IP{net.ParseIP("2001:db8::10")},
+	},
 }
 
 // defaultMockIP is used when a domain is not found in the mock records
-var defaultMockIP = []byte{8, 8, 8, 8}
+var defaultMockIP = net.IPv4(8, 8, 8, 8)
 
 // DNSHandler processes DNS requests and builds responses
 type DNSHandler struct {
-	requestData []byte   // raw request data
-	request     *Message // parsed request message
-	response    *Message // built response message
+	requestData []byte        // raw request data
+	request     *Message      // parsed request message
+	response    *Message      // built response message
+	store       RecordStore   // records used to answer questions
+	config      Config        // server settings
+	upstream    Forwarder     // resolvers to forward to, nil to answer locally
+	stats       *QueryStats   // query counters, nil to disable
+	zone        *Zone         // zone answered authoritatively, nil when not authoritative
+	trailing    int           // bytes in the request after its last record
+	udp         bool          // the request arrived over UDP, so the response may need truncating
+	client      netip.Addr    // address the request came from, when the transport knows it
+	budget      *NameBudget   // per client and name UDP query limit, nil for none
+	keepalive   time.Duration // idle timeout of the stream the request arrived on, 0 when not a stream
+	shuffler    *Shuffler     // reorders answer RRsets, nil to keep them in order
+	rpz         *RPZ          // overrides resolution of the names in it, nil for none
+	rootHints   *RootHints    // root servers answered for NS queries for the root
+
+	// With ECS on, the client's own ECS option, if it sent one, the subnet
+	// forwarded upstream on its behalf, invalid to forward none, and the longest
+	// scope of the answers
+	clientSubnet *ClientSubnet
+	subnet       netip.Prefix
+	subnetScope  int
+
+	// Raw request bytes echoed into the response in strict mirror mode
+	questionBytes []byte // the question section
+	optBytes      []byte // the OPT record, nil without one
+
+	resolver   func(Question) (Result, error) // replaces forward when set
+	middleware []Middleware                   // wrapped around ServeDNS, outermost first
+}
+
+// HandlerOption configures a DNSHandler
+type HandlerOption func(*DNSHandler)
+
+// WithStore makes the handler answer from the given record store
+func WithStore(store RecordStore) HandlerOption {
+	return func(h *DNSHandler) {
+		h.store = store
+	}
+}
+
+// WithConfig applies the given server settings to the handler
+func WithConfig(cfg Config) HandlerOption {
+	return func(h *DNSHandler) {
+		h.config = cfg
+	}
+}
+
+// WithUpstream makes the handler forward questions to the given resolvers
+func WithUpstream(upstream Forwarder) HandlerOption {
+	return func(h *DNSHandler) {
+		h.upstream = upstream
+	}
+}
+
+// WithStats makes the handler count every question it receives
+func WithStats(stats *QueryStats) HandlerOption {
+	return func(h *DNSHandler) {
+		h.stats = stats
+	}
+}
+
+// WithZone makes the handler authoritative for zone, answering from its records
+// and referring queries below its delegations to the child zone's name servers
+func WithZone(zone *Zone) HandlerOption {
+	return func(h *DNSHandler) {
+		h.zone = zone
+		h.store = zone
+	}
+}
+
+// WithMiddleware wraps the handler's resolution of each request in mw, outermost first
+func WithMiddleware(mw ...Middleware) HandlerOption {
+	return func(h *DNSHandler) {
+		h.middleware = append(h.middleware, mw...)
+	}
+}
+
+// WithUDP marks the request as received over UDP, so oversized responses are truncated
+func WithUDP() HandlerOption {
+	return func(h *DNSHandler) {
+		h.udp = true
+	}
+}
+
+// WithKeepalive marks the request as received on a TCP or TLS stream that is kept
+// open for timeout while idle, announced to clients asking with EDNS keepalive
+func WithKeepalive(timeout time.Duration) HandlerOption {
+	return func(h *DNSHandler) {
+		h.keepalive = timeout
+	}
+}
+
+// WithClient records the address the request came from
+func WithClient(addr netip.Addr) HandlerOption {
+	return func(h *DNSHandler) {
+		h.client = addr
+	}
+}
+
+// WithNameBudget truncates UDP responses to clients that query one name more
+// often than budget allows, so they retry over TCP
+func WithNameBudget(budget *NameBudget) HandlerOption {
+	return func(h *DNSHandler) {
+		h.budget = budget
+	}
+}
+
+// WithShuffler makes the handler shuffle the records of each answer RRset
+func WithShuffler(shuffler *Shuffler) HandlerOption {
+	return func(h *DNSHandler) {
+		h.shuffler = shuffler
+	}
+}
+
+// WithRPZ makes the handler apply the response policy zone before resolving each question
+func WithRPZ(rpz *RPZ) HandlerOption {
+	return func(h *DNSHandler) {
+		h.rpz = rpz
+	}
+}
+
+// WithRootHints makes the handler answer NS queries for the root with hints
+// instead of DefaultRootHints
+func WithRootHints(hints *RootHints) HandlerOption {
+	return func(h *DNSHandler) {
+		h.rootHints = hints
+	}
 }
 
 // NewDNSHandler creates a new handler for the given request data
-func NewDNSHandler(requestData []byte) *DNSHandler {
-	return &DNSHandler{
+func NewDNSHandler(requestData []byte, opts ...HandlerOption) *DNSHandler {
+	h := &DNSHandler{
 		requestData: requestData,
+		store:       defaultStore,
+		config:      DefaultConfig(),
+		rootHints:   DefaultRootHints,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Request returns the parsed request, nil until Handle has parsed it
+func (h *DNSHandler) Request() *Message {
+	return h.request
+}
+
+// SetResolver makes the handler answer each question with resolve instead of its
+// store, zone or upstream
+func (h *DNSHandler) SetResolver(resolve func(q Question) (Result, error)) {
+	h.resolver = resolve
 }
 
 // parseRequest parses the raw request data into a Message struct
 func (h *DNSHandler) parseRequest() error {
-	var header MessageHeader
-	if err := header.UnmarshalBinary(h.requestData); err != nil {
+	p := NewParser(h.requestData)
+	header, err := p.ReadHeader()
+	if err != nil {
 		return fmt.Errorf("failed to parse DNS header: %w", err)
 	}
 
 	fmt.Printf("Request Header: ID=%d, QR=%d, Opcode=%d, QDCount=%d, ANCount=%d\n",
 		header.Id, header.GetQR(), header.GetOpcode(),
 		header.QDCount, header.ANCount)
-	fmt.Printf("Request Header Details: RD=%d, TC=%d, AA=%d, Z=%d, RA=%d, RCode=%d\n",
+	fmt.Printf("Request Header Details: RD=%d, TC=%d, AA=%d, Z=%d, AD=%d, CD=%d, RA=%d, RCode=%d\n",
 		header.GetRD(), header.GetTC(), header.GetAA(),
-		header.GetZ(), header.GetRA(), header.GetRcode())
+		header.GetZ(), header.GetAD(), header.GetCD(), header.GetRA(), header.GetRcode())
+
+	// Only QUERY is implemented, and other opcodes (IQUERY's answer-only format,
+	// UPDATE's zone and prerequisite sections) don't use the standard question
+	// format, so there's nothing more worth parsing
+	if header.GetOpcode() != OpcodeQuery {
+		h.request = &Message{Header: header}
+		return nil
+	}
 
-	fmt.Printf("Parsing %d questions starting at offset %d\n", header.QDCount, DNSHeaderSize)
+	fmt.Printf("Parsing %d questions starting at offset %d\n", header.QDCount, p.Offset())
 	questions := make([]Question, 0, header.QDCount)
-	offset := DNSHeaderSize
 	for i := 0; i < int(header.QDCount); i++ {
-		var q Question
-		newOffset, err := q.UnmarshalFrom(h.requestData, offset)
+		offset := p.Offset()
+		q, err := p.ReadQuestion()
 		if err != nil {
 			return fmt.Errorf("failed to parse question #%d: %w", i+1, err)
 		}
 		questions = append(questions, q)
+		if h.stats != nil {
+			h.stats.Record(q)
+		}
 		fmt.Printf("Question %d: Name=%s, Type=%d, Class=%d (parsed %d bytes, next offset: %d)\n",
-			i+1, q.Name, q.Type, q.Class, newOffset-offset, newOffset)
-		offset = newOffset
+			i+1, q.Name, q.Type, q.Class, p.Offset()-offset, p.Offset())
+	}
+	fmt.Printf("Finished parsing questions, next offset: %d\n", p.Offset())
+	if h.config.StrictMirror {
+		h.questionBytes = h.requestData[DNSHeaderSize:p.Offset()]
+	}
+
+	answers, err := p.ReadRRs(header.ANCount)
+	if err != nil {
+		return fmt.Errorf("failed to parse answer section: %w", err)
+	}
+	authority, err := p.ReadRRs(header.NSCount)
+	if err != nil {
+		return fmt.Errorf("failed to parse authority section: %w", err)
+	}
+	if h.config.StrictMirror {
+		h.optBytes = rawOPT(h.requestData, p.Offset(), header.ARCount)
+	}
+	additional, err := p.ReadRRs(header.ARCount)
+	if err != nil {
+		return fmt.Errorf("failed to parse additional section: %w", err)
+	}
+	h.trailing = p.Remaining()
+	if h.trailing > 0 {
+		fmt.Printf("Request has %d trailing bytes after the last record\n", h.trailing)
 	}
-	fmt.Printf("Finished parsing questions, next offset: %d\n", offset)
 
 	h.request = &Message{
-		Header:    header,
-		Questions: questions,
+		Header:     header,
+		Questions:  questions,
+		Answers:    answers,
+		Authority:  authority,
+		Additional: additional,
+	}
+	if err := h.request.extractEDNS(); err != nil {
+		return fmt.Errorf("failed to parse EDNS: %w", err)
+	}
+	if edns := h.request.EDNS; edns != nil {
+		fmt.Printf("Request EDNS: UDPSize=%d, Version=%d, Options=%d\n",
+			edns.UDPSize, edns.Version, len(edns.Options))
+	}
+	return nil
+}
+
+// rawOPT returns the bytes of the OPT record among the count records starting at
+// offset in data, nil if there isn't one
+func rawOPT(data []byte, offset int, count uint16) []byte {
+	for range count {
+		var rr ResourceRecord
+		next, err := rr.UnmarshalFrom(data, offset)
+		if err != nil {
+			return nil
+		}
+		if rr.Type == RecordTypeOPT {
+			return data[offset:next]
+		}
+		offset = next
 	}
 	return nil
 }
 
+// Result is the outcome of resolving a single question. A negative answer has no
+// answers and the zone's SOA in authority: NXDOMAIN when the name doesn't exist,
+// NOERROR (NODATA) when it exists without records of the requested type.
+type Result struct {
+	Answers       []ResourceRecord
+	Authority     []ResourceRecord // NS records for referrals, SOA for negative answers
+	Additional    []ResourceRecord // glue for referrals
+	Rcode         uint8
+	Authoritative bool // the answer comes from a zone we're authoritative for
+}
+
 // forward sends a single question to upstream DNS server and returns the response
-// For now, this is a mimic that returns hardcoded responses from mockDNSRecords
-func (h *DNSHandler) forward(q Question) ([]ResourceRecord, error) {
+// Without an upstream, this is a mimic that returns hardcoded responses from the record store
+func (h *DNSHandler) forward(q Question) (Result, error) {
 	fmt.Printf("Forwarding question: %s (Type=%d, Class=%d)\n", q.Name, q.Type, q.Class)
 
-	// Look up the IP address from mock records
-	ip, found := lookupMockRecord(q.Name)
-	if !found {
-		ip = defaultMockIP
-		fmt.Printf("Domain %s not found in mock records, using default IP\n", q.Name)
-	} else {
-		fmt.Printf("Found mock record for %s: %d.%d.%d.%d\n", q.Name, ip[0], ip[1], ip[2], ip[3])
+	if q.Class == ClassCH {
+		return h.resolveChaos(q), nil
+	}
+	if h.rpz != nil {
+		if result, ok := h.rpz.Rewrite(q); ok {
+			fmt.Printf("Response policy zone overrides %s\n", q.Name)
+			h.applyDefaultTTLs(result.Answers)
+			return result, nil
+		}
+	}
+	if answers, ok := h.catchAll(q); ok {
+		return Result{Answers: answers}, nil
+	}
+
+	if h.zone != nil && inDomain(q.Name, h.zone.Origin) {
+		return h.resolveZone(q)
+	}
+	if h.upstream != nil && h.config.NoRecursion {
+		return h.resolveWithoutRecursion(q)
+	}
+	if h.upstream != nil {
+		if h.config.PrefetchAAAA && q.Type == RecordTypeA {
+			go h.prefetch(Question{Name: q.Name, Type: RecordTypeAAAA, Class: q.Class})
+		}
+		answers, scope, err := exchangeSubnet(h.upstream, q, h.subnet)
+		if scope.IsValid() {
+			h.subnetScope = max(h.subnetScope, scope.Bits())
+		}
+		var rcodeErr *RcodeError
+		if errors.As(err, &rcodeErr) {
+			return Result{Rcode: rcodeErr.Rcode, Authority: cloneRecords(rcodeErr.Authority)}, nil
+		}
+		return Result{Answers: answers}, err
+	}
+
+	if h.zone != nil {
+		// Authoritative-only: we don't recurse, so names elsewhere are refused
+		// rather than answered with made-up records
+		fmt.Printf("Refusing %s, outside zone %s with recursion unavailable\n", q.Name, h.zone.Origin)
+		return Result{Rcode: RCodeRefused}, nil
+	}
+
+	if q.Type == RecordTypeNS && isRootName(q.Name) {
+		return h.answerRootHints(q), nil
+	}
+	var answers []ResourceRecord
+	var err error
+	switch {
+	case q.Type == RecordTypeSOA:
+		answers, err = h.synthesizeSOA(q)
+	default:
+		answers, err = h.lookup(q)
+	}
+	return Result{Answers: answers}, err
+}
+
+// resolveWithoutRecursion answers q from what the upstream has cached, refusing
+// anything that would need a query sent on the client's behalf
+func (h *DNSHandler) resolveWithoutRecursion(q Question) (Result, error) {
+	if cache, ok := h.upstream.(*CachingForwarder); ok {
+		if result, found := cache.CachedResult(q); found {
+			return result, nil
+		}
+	}
+	fmt.Printf("Refusing %s, not cached and recursion is disabled\n", q.Name)
+	return Result{Rcode: RCodeRefused}, nil
+}
+
+// catchAll answers A and AAAA questions with the configured catch-all address
+// for their type, if there is one. Middleware, such as a blocklist, runs before
+// this and may still answer first.
+func (h *DNSHandler) catchAll(q Question) ([]ResourceRecord, bool) {
+	var addr netip.Addr
+	switch q.Type {
+	case RecordTypeA:
+		addr = h.config.CatchAll
+	case RecordTypeAAAA:
+		addr = h.config.CatchAll6
+	}
+	if !addr.IsValid() {
+		return nil, false
+	}
+	fmt.Printf("Answering %s with catch-all address %s\n", q.Name, addr)
+	answer := ResourceRecord{Name: q.Name, Type: q.Type, Class: q.Class, TTL: h.config.TTL, RData: addr.AsSlice()}
+	return []ResourceRecord{answer}, true
+}
+
+// resolve answers q with the injected resolver if there is one, otherwise forwards it
+func (h *DNSHandler) resolve(q Question) (Result, error) {
+	if h.resolver != nil {
+		return h.resolver(q)
+	}
+	return h.forward(q)
+}
+
+// prefetch resolves q through the upstream and discards the answer, so that a
+// caching upstream has it ready for the client's likely follow-up query
+func (h *DNSHandler) prefetch(q Question) {
+	if _, _, err := exchangeSubnet(h.upstream, q, h.subnet); err != nil {
+		fmt.Printf("Prefetching %s %s failed: %v\n", q.Name, TypeName(q.Type), err)
+	}
+}
+
+// lookup answers q from the record store
+func (h *DNSHandler) lookup(q Question) ([]ResourceRecord, error) {
+	records, err := h.store.Lookup(q.Name, q.Type, q.Class)
+	if err != nil {
+		return nil, fmt.Errorf("record store lookup for %s failed: %w", q.Name, err)
+	}
+
+	fmt.Printf("Found %d records for %s in record store\n", len(records), q.Name)
+	h.applyDefaultTTLs(records)
+	return records, nil
+}
+
+// applyDefaultTTLs gives records without a TTL of their own the configured default for their type
+func (h *DNSHandler) applyDefaultTTLs(records []ResourceRecord) {
+	for i := range records {
+		if records[i].TTL == 0 {
+			records[i].TTL = h.config.DefaultTTL(records[i].Type)
+		}
+	}
+}
+
+// resolveZone answers a question for a name inside our zone, through the cache
+// when there is one. Cached zone answers are stored as authoritative, so unlike
+// forwarded answers they keep the AA bit when served from the cache.
+func (h *DNSHandler) resolveZone(q Question) (Result, error) {
+	cache, ok := h.upstream.(*CachingForwarder)
+	if !ok {
+		return h.resolveInZone(q)
+	}
+	if result, found := cache.CachedResult(q); found {
+		return result, nil
+	}
+	result, err := h.resolveInZone(q)
+	if err == nil && result.Authoritative && len(result.Answers) > 0 {
+		cache.StoreAuthoritative(q, result.Answers)
+	}
+	return result, err
+}
+
+// resolveInZone answers a question for a name inside our zone: a referral below a
+// delegation, otherwise an authoritative answer or negative answer
+func (h *DNSHandler) resolveInZone(q Question) (Result, error) {
+	// DS records live on the parent side of the cut, so we answer those ourselves (RFC 4035 section 3.1.4.1)
+	dsAtCut := q.Type == RecordTypeDS && h.zone.IsDelegation(q.Name)
+	if ns, glue, ok := h.zone.Referral(q.Name, 0); ok && !dsAtCut {
+		fmt.Printf("Referring %s to %d delegated name servers\n", q.Name, len(ns))
+		h.applyDefaultTTLs(ns)
+		h.applyDefaultTTLs(glue)
+		// Referrals aren't authoritative answers (RFC 1034 section 4.3.2)
+		return Result{Authority: ns, Additional: glue}, nil
+	}
+
+	soa, err := h.synthesizeSOA(Question{Name: h.zone.Origin, Type: RecordTypeSOA, Class: ClassIN})
+	if err != nil {
+		return Result{}, err
+	}
+	if q.Type == RecordTypeSOA && strings.EqualFold(q.Name, h.zone.Origin) {
+		return Result{Answers: soa, Authoritative: true}, nil
+	}
+
+	answers, err := h.lookup(q)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(answers) > 0 {
+		result := Result{Answers: answers, Authoritative: true}
+		if !h.config.MinimalResponses {
+			result.Authority, result.Additional = h.zone.NameServers(0)
+			h.applyDefaultTTLs(result.Authority)
+			h.applyDefaultTTLs(result.Additional)
+		}
+		return result, nil
+	}
+
+	// The SOA in a negative answer tells resolvers how long to cache it (RFC 2308)
+	result := Result{Authority: soa, Authoritative: true}
+	if !h.zone.Exists(q.Name) {
+		result.Rcode = RCodeNXDomain
+	}
+	return result, nil
+}
+
+// isRootName reports whether name is the root, which decodes as "" but may be written "."
+func isRootName(name string) bool {
+	return name == "" || name == "."
+}
+
+// answerRootHints answers an NS question for the root with the root hints, their
+// addresses going in the additional section as glue
+func (h *DNSHandler) answerRootHints(q Question) Result {
+	if q.Class != ClassIN {
+		return Result{}
+	}
+	fmt.Printf("Answering root NS query with %d root hints\n", len(h.rootHints.NS))
+	return Result{Answers: cloneRecords(h.rootHints.NS), Additional: cloneRecords(h.rootHints.Glue)}
+}
+
+// synthesizeSOA answers an SOA question as if we were authoritative for the name,
+// using the configured serial so clients can observe zone changes
+func (h *DNSHandler) synthesizeSOA(q Question) ([]ResourceRecord, error) {
+	soa := SOAData{
+		MName:   "ns1." + q.Name,
+		RName:   "hostmaster." + q.Name,
+		Serial:  h.config.Serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minimum: h.config.TTL,
+	}
+	rdata, err := soa.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode SOA for %s: %w", q.Name, err)
 	}
 
-	// Return a single answer record for the question
 	answer := ResourceRecord{
 		Name:  q.Name,
-		Type:  RecordTypeA,
+		Type:  RecordTypeSOA,
 		Class: q.Class,
-		TTL:   60,
-		RData: ip,
+		TTL:   h.config.TTL,
+		RData: rdata,
 	}
 	return []ResourceRecord{answer}, nil
 }
 
-// lookupMockRecord looks up a domain in mockDNSRecords, supporting wildcard patterns
-func lookupMockRecord(name string) ([]byte, bool) {
-	// Try exact match first
-	if ip, found := mockDNSRecords[name]; found {
-		return ip, true
+// newResponseBuilder starts a response to req, refusing opcodes other than QUERY
+func newResponseBuilder(req *Message) *ResponseBuilder {
+	b := NewResponseBuilder(req)
+	if req.Header.GetOpcode() != OpcodeQuery {
+		b.SetRcode(RCodeNotImpl)
 	}
+	return b
+}
 
-	// Try wildcard match: *.example.com matches foo.example.com
-	parts := strings.SplitN(name, ".", 2)
-	if len(parts) == 2 {
-		wildcard := "*." + parts[1]
-		if ip, found := mockDNSRecords[wildcard]; found {
-			return ip, true
-		}
+// wantsPadding reports whether the response should be padded (RFC 7830).
+// Padding needs an OPT record, so only responses carrying one can be padded.
+func (h *DNSHandler) wantsPadding() bool {
+	if h.response.EDNS == nil {
+		return false
 	}
-
-	return nil, false
+	if h.config.Pad {
+		return true
+	}
+	if h.request.EDNS == nil {
+		return false
+	}
+	_, requested := h.request.EDNS.Option(EDNSOptionPadding)
+	return requested
 }
 
-// buildResponseHeader creates the response header based on the request and answers
-func (h *DNSHandler) buildResponseHeader(answers []ResourceRecord) MessageHeader {
-	reqHeader := h.request.Header
+// hasKeepalive reports whether the request carries an EDNS TCP keepalive option
+func (h *DNSHandler) hasKeepalive() bool {
+	if h.request.EDNS == nil {
+		return false
+	}
+	_, ok := h.request.EDNS.Option(EDNSOptionKeepalive)
+	return ok
+}
 
-	responseHeader := MessageHeader{
-		Id:      reqHeader.Id,
-		QDCount: reqHeader.QDCount,
-		ANCount: uint16(len(answers)),
-		NSCount: 0,
-		ARCount: 0,
+// badKeepalive reports whether the request's keepalive option carries a timeout,
+// which only servers may send (RFC 7828 section 3.2.1)
+func (h *DNSHandler) badKeepalive() bool {
+	if h.request.EDNS == nil {
+		return false
 	}
-	responseHeader.SetQR(1)
-	responseHeader.SetOpcode(reqHeader.GetOpcode())
-	responseHeader.SetRD(reqHeader.GetRD())
+	opt, found := h.request.EDNS.Option(EDNSOptionKeepalive)
+	if !found {
+		return false
+	}
+	_, hasTimeout, err := parseKeepalive(opt)
+	return hasTimeout || err != nil
+}
 
-	if reqHeader.GetOpcode() == 0 {
-		responseHeader.SetRcode(RCodeNoError)
-	} else {
-		responseHeader.SetRcode(RCodeNotImpl)
+// overBudget reports whether a UDP request exceeds the client's budget for its first question
+func (h *DNSHandler) overBudget() bool {
+	if h.budget == nil || !h.udp || !h.client.IsValid() || len(h.request.Questions) == 0 {
+		return false
 	}
+	return !h.budget.Allow(h.client, h.request.Questions[0].Name)
+}
 
-	return responseHeader
+// errorResponse builds a response echoing the questions with the given rcode and no answers
+func (h *DNSHandler) errorResponse(rcode uint8) ([]byte, error) {
+	h.response = NewResponseBuilder(h.request).SetRcode(rcode).Build()
+	response, err := h.response.MarshalWithOptions(h.marshalOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal error response: %w", err)
+	}
+	return response, nil
 }
 
 // Handle processes the DNS request and returns the binary response
 func (h *DNSHandler) Handle() ([]byte, error) {
+	if h.config.Debug {
+		fmt.Printf("Request:\n%s", DumpMessage(h.requestData))
+	}
+
 	// Step 1: Parse the request
 	if err := h.parseRequest(); err != nil {
 		return nil, err
 	}
 
-	// Step 2: Forward each question to upstream and collect answers
-	allAnswers := make([]ResourceRecord, 0)
-	for i, q := range h.request.Questions {
-		fmt.Printf("Forwarding question %d/%d to upstream\n", i+1, len(h.request.Questions))
-		answers, err := h.forward(q)
-		if err != nil {
-			return nil, fmt.Errorf("failed to forward question #%d: %w", i+1, err)
+	if opcode := h.request.Header.GetOpcode(); opcode != OpcodeQuery {
+		fmt.Printf("Opcode %d not implemented\n", opcode)
+		return h.errorResponse(RCodeNotImpl)
+	}
+	// A query needs a question, except a bare EDNS keepalive (RFC 7828) that only
+	// asks about the connection. NOTIFY, which also may have none, was refused above.
+	if len(h.request.Questions) == 0 && !h.hasKeepalive() {
+		fmt.Println("Rejecting query with no questions")
+		return h.errorResponse(RCodeFormat)
+	}
+	if h.keepalive > 0 && h.badKeepalive() {
+		fmt.Println("Rejecting query with a timeout in its keepalive option")
+		return h.errorResponse(RCodeFormat)
+	}
+	if h.config.StrictZ && h.request.Header.GetZ() != 0 {
+		fmt.Println("Rejecting query with the reserved Z bit set")
+		return h.errorResponse(RCodeFormat)
+	}
+	if h.config.StrictParse && h.trailing > 0 {
+		fmt.Println("Rejecting query with trailing bytes")
+		return h.errorResponse(RCodeFormat)
+	}
+	if h.config.ECS {
+		if err := h.setClientSubnet(); err != nil {
+			fmt.Printf("Rejecting query with a malformed client subnet option: %v\n", err)
+			return h.errorResponse(RCodeFormat)
 		}
-		allAnswers = append(allAnswers, answers...)
 	}
-	fmt.Printf("Collected %d answers from upstream\n", len(allAnswers))
 
-	// Step 3: Build the response
-	h.response = &Message{
-		Header:    h.buildResponseHeader(allAnswers),
-		Questions: h.request.Questions,
-		Answers:   allAnswers,
+	// Step 2: Answer the request through any middleware, or only with TC=1 when
+	// the client is over its budget for the name
+	var response *Message
+	var err error
+	if h.overBudget() {
+		fmt.Printf("%s is over its query budget for %s, truncating\n", h.client, h.request.Questions[0].Name)
+		b := NewResponseBuilder(h.request)
+		if h.request.EDNS != nil {
+			b.SetEDNS(&OPTRecord{UDPSize: EDNSUDPSize})
+		}
+		response = b.Build()
+		response.Header.SetTC(1)
+	} else if response, err = Chain(h.middleware...)(h).ServeDNS(h.request); err != nil {
+		return nil, err
 	}
+	if response == nil {
+		return nil, fmt.Errorf("no response to request %d", h.request.Header.Id)
+	}
+	// Middleware may have added or dropped records without updating the header
+	response.setCounts()
+	h.response = response
 
-	// Step 4: Marshal the response to binary
+	// Step 3: Marshal the response to binary
 	fmt.Printf("Marshalling response with %d questions and %d answers\n",
 		len(h.response.Questions), len(h.response.Answers))
-	response, err := h.response.MarshalBinary()
+	data, err := h.marshalResponse()
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal response: %w", err)
+		return nil, err
 	}
 
-	fmt.Printf("Response marshalled successfully: %d bytes\n", len(response))
+	if h.udp {
+		if limit := h.udpLimit(); len(data) > limit {
+			fmt.Printf("Response of %d bytes exceeds the UDP limit of %d, truncating\n", len(data), limit)
+			h.truncateResponse()
+			if data, err = h.marshalResponse(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fmt.Printf("Response marshalled successfully: %d bytes\n", len(data))
+	if h.config.Debug {
+		fmt.Printf("Response:\n%s", DumpMessage(data))
+	}
+
+	// Sleeping here delays only this query, serveUDP and serveStream handling each in its own goroutine
+	if h.config.ResponseDelay > 0 {
+		fmt.Printf("Delaying response by %s\n", h.config.ResponseDelay)
+		time.Sleep(h.config.ResponseDelay)
+	}
+	return data, nil
+}
+
+// HandleSafely is like Handle, but a panic while handling the request is logged
+// with its stack and answered with SERVFAIL, so a bug costs one query rather than
+// the server. It fails only if the request is too short to echo the ID of.
+func (h *DNSHandler) HandleSafely() (response []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic handling DNS request: %v\n%s", r, debug.Stack())
+			response, err = h.panicResponse()
+		}
+	}()
+	return h.Handle()
+}
+
+// panicResponse builds a SERVFAIL for a request whose handling panicked, echoing
+// the questions if they were parsed before the panic
+func (h *DNSHandler) panicResponse() ([]byte, error) {
+	req := h.request
+	if req == nil {
+		var header MessageHeader
+		if err := header.UnmarshalBinary(h.requestData); err != nil {
+			return nil, fmt.Errorf("no response after panic: %w", err)
+		}
+		req = &Message{Header: header}
+	}
+	response := NewResponseBuilder(&Message{Header: req.Header, Questions: req.Questions}).SetRcode(RCodeServFail).Build()
+	return response.MarshalBinary()
+}
+
+// ServeDNS implements Handler: it resolves each question in req and builds the response.
+// It's the innermost handler that middleware configured with WithMiddleware wraps.
+// A message has one rcode however many questions it carries, so it's NOERROR if any
+// question was answered without error, otherwise the first question's error. A
+// question that can't be resolved, such as when the upstream doesn't answer, is
+// a SERVFAIL; the client still gets a response.
+func (h *DNSHandler) ServeDNS(req *Message) (*Message, error) {
+	b := newResponseBuilder(req)
+	rcode := RCodeNoError
+	succeeded := len(req.Questions) == 0
+	authoritative := len(req.Questions) > 0
+	answerCount := 0
+	for i, q := range req.Questions {
+		fmt.Printf("Forwarding question %d/%d to upstream\n", i+1, len(req.Questions))
+		result, err := h.resolve(q)
+		if err == nil && h.wantsDNS64(q, result) {
+			result, err = h.synthesizeDNS64(q, result)
+		}
+		if err != nil {
+			fmt.Printf("Failed to resolve question #%d, answering SERVFAIL: %v\n", i+1, err)
+			result = Result{Rcode: RCodeServFail}
+		}
+		if h.shuffler != nil {
+			// Answers may be shared with a cache, so shuffle a copy
+			result.Answers = slices.Clone(result.Answers)
+			h.shuffler.Shuffle(result.Answers)
+		}
+		b.AddAnswer(result.Answers...).AddAuthority(result.Authority...).AddAdditional(result.Additional...)
+		answerCount += len(result.Answers)
+
+		if result.Rcode == RCodeNoError {
+			succeeded = true
+		} else if rcode == RCodeNoError {
+			rcode = result.Rcode
+		}
+		authoritative = authoritative && result.Authoritative
+	}
+	fmt.Printf("Collected %d answers from upstream\n", answerCount)
+
+	if !succeeded {
+		b.SetRcode(rcode)
+	}
+	b.SetAuthoritative(authoritative)
+	b.SetRecursionAvailable(h.upstream != nil && !h.config.NoRecursion)
+
+	// EDNS clients get an OPT record back; others must not (RFC 6891)
+	if req.EDNS != nil {
+		opt := &OPTRecord{UDPSize: EDNSUDPSize}
+		// Keepalive is only meaningful, and only allowed, on streams (RFC 7828 section 3.2.2)
+		if _, asked := req.EDNS.Option(EDNSOptionKeepalive); asked && h.keepalive > 0 {
+			opt.Options = append(opt.Options, KeepaliveOption(h.keepalive))
+		}
+		// A client sending ECS gets its option back (RFC 7871 section 7.2.2)
+		if h.clientSubnet != nil {
+			opt.Options = append(opt.Options, ClientSubnet{Source: h.clientSubnet.Source, Scope: uint8(h.subnetScope)}.Option())
+		}
+		b.SetEDNS(opt)
+	}
+	return b.Build(), nil
+}
+
+// wantsDNS64 reports whether result, the answer to q, should be replaced by AAAA
+// records synthesized from A records: DNS64 is on and q is an IN AAAA question
+// answered without error but with no AAAA records
+func (h *DNSHandler) wantsDNS64(q Question, result Result) bool {
+	return h.config.DNS64 && q.Type == RecordTypeAAAA && q.Class == ClassIN && result.Rcode == RCodeNoError &&
+		!slices.ContainsFunc(result.Answers, func(rr ResourceRecord) bool { return rr.Type == RecordTypeAAAA })
+}
+
+// marshalOptions returns how responses are encoded under the server settings
+func (h *DNSHandler) marshalOptions() MarshalOptions {
+	return MarshalOptions{NoCompression: h.config.NoCompression}
+}
+
+// marshalResponse serializes h.response, padding it if the client wants padding
+func (h *DNSHandler) marshalResponse() ([]byte, error) {
+	var response []byte
+	var err error
+	if h.config.StrictMirror && h.questionBytes != nil {
+		response, err = h.mirrorResponse()
+	} else if h.wantsPadding() {
+		response, err = padMessage(h.response, h.config.PadBlockSize, h.marshalOptions())
+	} else {
+		response, err = h.response.MarshalWithOptions(h.marshalOptions())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %w", err)
+	}
 	return response, nil
 }
+
+// mirrorResponse serializes h.response with its question section and OPT record
+// copied byte for byte from the request, for clients that compare them. Names are
+// written uncompressed so that nothing points into the copied questions.
+func (h *DNSHandler) mirrorResponse() ([]byte, error) {
+	response := *h.response
+	response.EDNS = nil
+	data, err := response.MarshalWithOptions(MarshalOptions{NoCompression: true})
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewParser(data)
+	header, err := p.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.ReadQuestions(header.QDCount); err != nil {
+		return nil, err
+	}
+	mirrored := append(data[:DNSHeaderSize:DNSHeaderSize], h.questionBytes...)
+	mirrored = append(mirrored, data[p.Offset():]...)
+	if h.optBytes != nil {
+		mirrored = append(mirrored, h.optBytes...)
+		binary.BigEndian.PutUint16(mirrored[10:12], header.ARCount+1)
+	}
+	return mirrored, nil
+}
+
+// udpLimit returns the largest response that may be sent back over UDP: 512 bytes
+// without EDNS, otherwise what the client advertised capped by the configured maximum
+func (h *DNSHandler) udpLimit() int {
+	if h.request.EDNS == nil {
+		return MaxDNSPacketSize
+	}
+	// Advertised sizes below 512 are treated as 512 (RFC 6891 section 6.2.5)
+	limit := max(int(h.request.EDNS.UDPSize), MaxDNSPacketSize)
+	return min(limit, h.config.MaxUDPSize)
+}
+
+// truncateResponse drops every record and sets TC, telling the client to retry
+// over TCP. The OPT record is kept since it isn't part of the data.
+func (h *DNSHandler) truncateResponse() {
+	h.response.Answers = nil
+	h.response.Authority = nil
+	h.response.Additional = nil
+	h.response.setCounts()
+	h.response.Header.SetTC(1)
+}
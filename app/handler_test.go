@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 // buildTestDNSQuery builds a DNS query with the given questions
@@ -190,3 +195,995 @@ func TestDNSHandler_MultipleQuestions(t *testing.T) {
 
 	t.Logf("Multiple questions test passed: %d questions -> %d answers", len(questions), len(respMsg.Answers))
 }
+
+func TestDNSHandler_MultipleQuestionsShareCompression(t *testing.T) {
+	questions := []Question{
+		{Name: "abc.codecrafters.io", Type: RecordTypeA, Class: ClassIN},
+		{Name: "def.codecrafters.io", Type: RecordTypeA, Class: ClassIN},
+		{Name: "ghi.codecrafters.io", Type: RecordTypeA, Class: ClassIN},
+	}
+	queryData := buildTestDNSQuery(0x9abc, questions)
+
+	handler := NewDNSHandler(queryData)
+	response, err := handler.Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != len(questions) {
+		t.Fatalf("Response has %d answers, want %d", len(respMsg.Answers), len(questions))
+	}
+	for i, q := range questions {
+		if respMsg.Questions[i].Name != q.Name || respMsg.Answers[i].Name != q.Name {
+			t.Errorf("Question/answer %d name = %s/%s, want %s",
+				i, respMsg.Questions[i].Name, respMsg.Answers[i].Name, q.Name)
+		}
+	}
+
+	// Size of the same message with every name encoded on its own
+	uncompressed := DNSHeaderSize
+	for _, q := range respMsg.Questions {
+		data, err := q.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Question.MarshalBinary() failed: %v", err)
+		}
+		uncompressed += len(data)
+	}
+	for _, rr := range respMsg.Answers {
+		data, err := rr.MarshalBinary()
+		if err != nil {
+			t.Fatalf("ResourceRecord.MarshalBinary() failed: %v", err)
+		}
+		uncompressed += len(data)
+	}
+
+	if len(response) >= uncompressed {
+		t.Errorf("Response size = %d bytes, want less than uncompressed %d bytes", len(response), uncompressed)
+	}
+
+	// The second question is "def" followed by a pointer to "codecrafters.io"
+	// inside the first question name (offset 12 + len("\x03abc") = 16)
+	secondName := DNSHeaderSize + 1 + len("abc.codecrafters.io") + 1 + 4
+	pointerAt := secondName + 1 + len("def")
+	if response[pointerAt]&CompressionMask != CompressionMask {
+		t.Fatalf("Second question suffix at offset %d is %02x, want a compression pointer", pointerAt, response[pointerAt])
+	}
+	if target := int(response[pointerAt]&^CompressionMask)<<8 | int(response[pointerAt+1]); target != 16 {
+		t.Errorf("Second question pointer targets offset %d, want 16", target)
+	}
+
+	t.Logf("Compressed response: %d bytes, uncompressed: %d bytes", len(response), uncompressed)
+}
+
+func TestDNSHandler_ConfiguredTTLAndSerial(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TTL = 300
+	cfg.Serial = 2024010101
+
+	queryData := buildTestDNSQuery(0x0303, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+		{Name: "example.com", Type: RecordTypeSOA, Class: ClassIN},
+	})
+
+	response, err := NewDNSHandler(queryData, WithConfig(cfg)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 2 {
+		t.Fatalf("Response has %d answers, want 2", len(respMsg.Answers))
+	}
+
+	if respMsg.Answers[0].TTL != 300 {
+		t.Errorf("A answer TTL = %d, want 300", respMsg.Answers[0].TTL)
+	}
+
+	soaAnswer := respMsg.Answers[1]
+	if soaAnswer.Type != RecordTypeSOA {
+		t.Fatalf("Second answer type = %d, want SOA", soaAnswer.Type)
+	}
+	if soaAnswer.TTL != 300 {
+		t.Errorf("SOA answer TTL = %d, want 300", soaAnswer.TTL)
+	}
+
+	var soa SOAData
+	if err := soa.UnmarshalBinary(soaAnswer.RData); err != nil {
+		t.Fatalf("Failed to parse SOA RDATA: %v", err)
+	}
+	if soa.Serial != 2024010101 {
+		t.Errorf("SOA serial = %d, want 2024010101", soa.Serial)
+	}
+	if soa.MName != "ns1.example.com" {
+		t.Errorf("SOA MNAME = %s, want ns1.example.com", soa.MName)
+	}
+}
+
+// fakeStore is a RecordStore that records lookups and returns canned results
+type fakeStore struct {
+	records map[string][]ResourceRecord
+	err     error
+	lookups []Question
+}
+
+func (s *fakeStore) Lookup(name string, qtype, qclass uint16) ([]ResourceRecord, error) {
+	s.lookups = append(s.lookups, Question{Name: name, Type: qtype, Class: qclass})
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.records[name], nil
+}
+
+func TestDNSHandler_UsesRecordStore(t *testing.T) {
+	store := &fakeStore{
+		records: map[string][]ResourceRecord{
+			"fake.example.com": {
+				{Name: "fake.example.com", Type: RecordTypeA, Class: ClassIN, TTL: 42, RData: []byte{10, 1, 2, 3}},
+				{Name: "fake.example.com", Type: RecordTypeA, Class: ClassIN, RData: []byte{10, 1, 2, 4}},
+			},
+		},
+	}
+
+	queryData := buildTestDNSQuery(0x0361, []Question{
+		{Name: "fake.example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData, WithStore(store)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	if len(store.lookups) != 1 || store.lookups[0].Name != "fake.example.com" {
+		t.Errorf("Store lookups = %+v, want one lookup for fake.example.com", store.lookups)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 2 {
+		t.Fatalf("Response has %d answers, want 2", len(respMsg.Answers))
+	}
+	if respMsg.Answers[0].TTL != 42 {
+		t.Errorf("Answer[0] TTL = %d, want the store's 42", respMsg.Answers[0].TTL)
+	}
+	if respMsg.Answers[1].TTL != DefaultConfig().TTL {
+		t.Errorf("Answer[1] TTL = %d, want default %d", respMsg.Answers[1].TTL, DefaultConfig().TTL)
+	}
+}
+
+func TestDNSHandler_RecordStoreError(t *testing.T) {
+	store := &fakeStore{err: errors.New("backend unavailable")}
+
+	queryData := buildTestDNSQuery(0x0362, []Question{
+		{Name: "fake.example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData, WithStore(store)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if got := respMsg.Header.GetRcode(); got != RCodeServFail || len(respMsg.Answers) != 0 {
+		t.Errorf("Response RCode %d with %d answers, want SERVFAIL with none", got, len(respMsg.Answers))
+	}
+}
+
+func TestDNSHandler_DualStackAndNoData(t *testing.T) {
+	store := NewMemoryStore(map[string]HostEntry{
+		"dual.example.com":   {A: []net.IP{net.IPv4(192, 0, 2, 1)}, AAAA: []net.IP{net.ParseIP("2001:db8::1")}},
+		"v6only.example.com": {AAAA: []net.IP{net.ParseIP("2001:db8::3")}},
+	})
+
+	queryData := buildTestDNSQuery(0x0362, []Question{
+		{Name: "dual.example.com", Type: RecordTypeA, Class: ClassIN},
+		{Name: "dual.example.com", Type: RecordTypeAAAA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData, WithStore(store)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 2 {
+		t.Fatalf("Response has %d answers, want 2", len(respMsg.Answers))
+	}
+	if respMsg.Answers[0].Type != RecordTypeA || len(respMsg.Answers[0].RData) != 4 {
+		t.Errorf("Answer[0] = %+v, want an A record", respMsg.Answers[0])
+	}
+	if respMsg.Answers[1].Type != RecordTypeAAAA || len(respMsg.Answers[1].RData) != 16 {
+		t.Errorf("Answer[1] = %+v, want an AAAA record", respMsg.Answers[1])
+	}
+
+	// An IPv6-only host has no A records: NOERROR with an empty answer section
+	queryData = buildTestDNSQuery(0x0363, []Question{
+		{Name: "v6only.example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err = NewDNSHandler(queryData, WithStore(store)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if respMsg.Header.GetRcode() != RCodeNoError || respMsg.Header.ANCount != 0 {
+		t.Errorf("NODATA response rcode = %d, ANCount = %d, want NOERROR and 0", respMsg.Header.GetRcode(), respMsg.Header.ANCount)
+	}
+}
+
+func TestDNSHandler_StrictZ(t *testing.T) {
+	queryData := buildTestDNSQuery(0x5a5a, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	// Set the reserved Z bit (bit 6 of the flags)
+	queryData[3] |= 1 << 6
+
+	tests := []struct {
+		name      string
+		strict    bool
+		wantRcode uint8
+		wantCount int
+	}{
+		{"strict mode rejects", true, RCodeFormat, 0},
+		{"lenient mode answers", false, RCodeNoError, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.StrictZ = tt.strict
+			response, err := NewDNSHandler(queryData, WithConfig(cfg)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if got := len(respMsg.Answers); got != tt.wantCount {
+				t.Errorf("Response has %d answers, want %d", got, tt.wantCount)
+			}
+			if respMsg.Header.GetZ() != 0 {
+				t.Error("Response has the reserved Z bit set")
+			}
+			if respMsg.Header.Id != 0x5a5a || len(respMsg.Questions) != 1 {
+				t.Errorf("Response does not echo the query: %+v", respMsg.Header)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_StrictParseRejectsTrailingBytes(t *testing.T) {
+	queryData := buildTestDNSQuery(0x7b7b, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	queryData = append(queryData, 0xde, 0xad)
+
+	tests := []struct {
+		name      string
+		strict    bool
+		wantRcode uint8
+	}{
+		{"strict mode rejects", true, RCodeFormat},
+		{"lenient mode answers", false, RCodeNoError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.StrictParse = tt.strict
+			response, err := NewDNSHandler(queryData, WithConfig(cfg)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_RootNSFromHints(t *testing.T) {
+	custom, err := ParseRootHints(strings.NewReader(`
+.                    3600000  NS    A.ROOT-SERVERS.NET.
+.                    3600000  NS    B.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.  3600000  A     192.0.2.1
+B.ROOT-SERVERS.NET.  3600000  AAAA  2001:db8::b
+`))
+	if err != nil {
+		t.Fatalf("ParseRootHints() failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		qname       string
+		opts        []HandlerOption
+		wantServers int
+		wantGlue    int
+	}{
+		{"built-in hints", "", nil, 13, 26},
+		{"built-in hints for a dotted root", ".", nil, 13, 26},
+		{"configured hints", "", []HandlerOption{WithRootHints(custom)}, 2, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryData := buildTestDNSQuery(0x2e2e, []Question{
+				{Name: tt.qname, Type: RecordTypeNS, Class: ClassIN},
+			})
+			// The root is a single zero byte on the wire
+			if got := queryData[DNSHeaderSize]; got != 0 || len(queryData) != DNSHeaderSize+5 {
+				t.Fatalf("Root question encoded as % x", queryData[DNSHeaderSize:])
+			}
+
+			response, err := NewDNSHandler(queryData, tt.opts...).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(respMsg.Questions) != 1 || respMsg.Questions[0].Name != "" {
+				t.Errorf("Response questions = %+v, want the root echoed back", respMsg.Questions)
+			}
+
+			servers := map[string]bool{}
+			for _, rr := range respMsg.Answers {
+				if rr.Name != "" || rr.Type != RecordTypeNS {
+					t.Errorf("Unexpected answer %q type %d", rr.Name, rr.Type)
+				}
+				ns, _, err := decodeDNSName(rr.RData, 0)
+				if err != nil {
+					t.Fatalf("Failed to decode NS RDATA: %v", err)
+				}
+				servers[strings.ToLower(ns)] = true
+			}
+			if len(servers) != tt.wantServers || !servers["a.root-servers.net"] {
+				t.Errorf("Root servers = %v, want %d including a.root-servers.net", servers, tt.wantServers)
+			}
+
+			if len(respMsg.Additional) != tt.wantGlue {
+				t.Fatalf("Response has %d glue records, want %d", len(respMsg.Additional), tt.wantGlue)
+			}
+			for _, rr := range respMsg.Additional {
+				if !servers[strings.ToLower(rr.Name)] || (rr.Type != RecordTypeA && rr.Type != RecordTypeAAAA) {
+					t.Errorf("Unexpected glue %q type %d", rr.Name, rr.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestDNSHandler_UDPTruncation(t *testing.T) {
+	// 100 A records make a response of about 1.6KB
+	q := Question{Name: "big.example.com", Type: RecordTypeA, Class: ClassIN}
+	var records []ResourceRecord
+	for i := 0; i < 100; i++ {
+		records = append(records, ResourceRecord{
+			Name: q.Name, Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, byte(i)},
+		})
+	}
+	store := &fakeStore{records: map[string][]ResourceRecord{q.Name: records}}
+
+	tests := []struct {
+		name       string
+		query      []byte
+		maxUDPSize int
+		udp        bool
+		wantTC     bool
+	}{
+		{"client 4096 capped at 1232", buildTestEDNSQuery(1, q, OPTRecord{UDPSize: 4096}), 1232, true, true},
+		{"client 4096 under 4096 cap", buildTestEDNSQuery(2, q, OPTRecord{UDPSize: 4096}), 4096, true, false},
+		{"client 1232 under larger cap", buildTestEDNSQuery(3, q, OPTRecord{UDPSize: 1232}), 4096, true, true},
+		{"no EDNS limited to 512", buildTestDNSQuery(4, []Question{q}), 4096, true, true},
+		{"not UDP", buildTestDNSQuery(5, []Question{q}), 1232, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.MaxUDPSize = tt.maxUDPSize
+			opts := []HandlerOption{WithConfig(cfg), WithStore(store)}
+			if tt.udp {
+				opts = append(opts, WithUDP())
+			}
+
+			response, err := NewDNSHandler(tt.query, opts...).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetTC() == 1; got != tt.wantTC {
+				t.Errorf("TC = %v, want %v (response is %d bytes)", got, tt.wantTC, len(response))
+			}
+			if tt.wantTC {
+				if len(respMsg.Answers) != 0 {
+					t.Errorf("Truncated response has %d answers, want 0", len(respMsg.Answers))
+				}
+				if tt.udp && len(response) > tt.maxUDPSize {
+					t.Errorf("Truncated response is %d bytes, over the %d byte cap", len(response), tt.maxUDPSize)
+				}
+			} else if len(respMsg.Answers) != len(records) {
+				t.Errorf("Response has %d answers, want %d", len(respMsg.Answers), len(records))
+			}
+		})
+	}
+}
+
+func TestDNSHandler_TruncationCounts(t *testing.T) {
+	q := Question{Name: "big.example.com", Type: RecordTypeA, Class: ClassIN}
+	var records []ResourceRecord
+	for i := 0; i < 100; i++ {
+		records = append(records, ResourceRecord{
+			Name: q.Name, Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, byte(i)},
+		})
+	}
+	store := &fakeStore{records: map[string][]ResourceRecord{q.Name: records}}
+
+	// addGlue adds an additional record without updating ARCount
+	addGlue := func(next Handler) Handler {
+		return HandlerFunc(func(req *Message) (*Message, error) {
+			resp, err := next.ServeDNS(req)
+			if err == nil {
+				resp.Additional = append(resp.Additional, records[0])
+			}
+			return resp, err
+		})
+	}
+
+	tests := []struct {
+		name   string
+		query  []byte
+		wantTC bool
+		wantAR uint16
+	}{
+		{"truncated", buildTestDNSQuery(1, []Question{q}), true, 0},
+		{"truncated with EDNS", buildTestEDNSQuery(2, q, OPTRecord{UDPSize: 1232}), true, 1},
+		{"fits", buildTestEDNSQuery(3, q, OPTRecord{UDPSize: 4096}), false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := NewDNSHandler(tt.query, WithStore(store), WithUDP(), WithMiddleware(addGlue)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			// Read exactly as many records as the header claims: they must all be
+			// there, with nothing left over
+			p := NewParser(response)
+			header, err := p.ReadHeader()
+			if err != nil {
+				t.Fatalf("ReadHeader() failed: %v", err)
+			}
+			if got := header.GetTC() == 1; got != tt.wantTC {
+				t.Errorf("TC = %v, want %v", got, tt.wantTC)
+			}
+			if tt.wantTC && header.ANCount != 0 {
+				t.Errorf("Truncated response ANCount = %d, want 0", header.ANCount)
+			}
+			if header.ARCount != tt.wantAR {
+				t.Errorf("ARCount = %d, want %d", header.ARCount, tt.wantAR)
+			}
+			if _, err := p.ReadQuestions(header.QDCount); err != nil {
+				t.Fatalf("ReadQuestions() failed: %v", err)
+			}
+			for _, count := range []uint16{header.ANCount, header.NSCount, header.ARCount} {
+				if _, err := p.ReadRRs(count); err != nil {
+					t.Fatalf("ReadRRs() failed: %v", err)
+				}
+			}
+			if p.Remaining() != 0 {
+				t.Errorf("%d bytes left after the records the header counts", p.Remaining())
+			}
+		})
+	}
+}
+
+func TestDNSHandler_ResponseDelay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ResponseDelay = 50 * time.Millisecond
+
+	queryData := buildTestDNSQuery(0x6464, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+
+	start := time.Now()
+	if _, err := NewDNSHandler(queryData, WithConfig(cfg)).Handle(); err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.ResponseDelay {
+		t.Errorf("Response took %s, want at least %s", elapsed, cfg.ResponseDelay)
+	}
+}
+
+func TestDNSHandler_RequestAndSetResolver(t *testing.T) {
+	queryData := buildTestDNSQuery(0x5253, []Question{
+		{Name: "injected.example", Type: RecordTypeAAAA, Class: ClassIN},
+	})
+	h := NewDNSHandler(queryData)
+	if h.Request() != nil {
+		t.Error("Request() is set before the request was parsed")
+	}
+
+	var resolved []Question
+	h.SetResolver(func(q Question) (Result, error) {
+		resolved = append(resolved, q)
+		return Result{Rcode: RCodeRefused}, nil
+	})
+	response, err := h.Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	req := h.Request()
+	if req == nil {
+		t.Fatal("Request() is nil after Handle()")
+	}
+	if req.Header.Id != 0x5253 || len(req.Questions) != 1 {
+		t.Fatalf("Request() = ID %#04x with %d questions, want 0x5253 with 1", req.Header.Id, len(req.Questions))
+	}
+	q := req.Questions[0]
+	if q.Name != "injected.example" || q.Type != RecordTypeAAAA || q.Class != ClassIN {
+		t.Errorf("Request() question = %+v, want injected.example AAAA IN", q)
+	}
+	if len(resolved) != 1 || resolved[0] != q {
+		t.Errorf("Resolver was called with %+v, want just the parsed question", resolved)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if got := respMsg.Header.GetRcode(); got != RCodeRefused {
+		t.Errorf("Response RCode = %d, want the injected resolver's %d", got, RCodeRefused)
+	}
+}
+
+func TestDNSHandler_CompressedQuestionNames(t *testing.T) {
+	// Question 1 spells out stackoverflow.com, question 2 is just a pointer to it and
+	// question 3 is a label followed by a pointer. An EDNS OPT record follows, so an
+	// offset that's wrong after a pointer breaks parsing or leaves trailing bytes.
+	packet := []byte{
+		0x51, 0x51, 0x01, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		// stackoverflow.com A IN, at offset 12
+		13, 's', 't', 'a', 'c', 'k', 'o', 'v', 'e', 'r', 'f', 'l', 'o', 'w', 3, 'c', 'o', 'm', 0,
+		0x00, 0x01, 0x00, 0x01,
+		// pointer to offset 12, AAAA IN
+		0xC0, 0x0C, 0x00, 0x1C, 0x00, 0x01,
+		// www + pointer to offset 12, A IN
+		3, 'w', 'w', 'w', 0xC0, 0x0C, 0x00, 0x01, 0x00, 0x01,
+		// OPT: root name, type 41, UDP size 1232, no extended rcode or flags, no options
+		0x00, 0x00, 0x29, 0x04, 0xD0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+
+	cfg := DefaultConfig()
+	cfg.StrictParse = true
+	h := NewDNSHandler(packet, WithConfig(cfg))
+	response, err := h.Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	want := []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+		{Name: "stackoverflow.com", Type: RecordTypeAAAA, Class: ClassIN},
+		{Name: "www.stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	}
+	req := h.Request()
+	if len(req.Questions) != len(want) {
+		t.Fatalf("Parsed %d questions, want %d", len(req.Questions), len(want))
+	}
+	for i, q := range req.Questions {
+		if q != want[i] {
+			t.Errorf("Question %d = %+v, want %+v", i+1, q, want[i])
+		}
+	}
+	if req.EDNS == nil || req.EDNS.UDPSize != 1232 {
+		t.Errorf("EDNS = %+v, want the OPT record after the questions", req.EDNS)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if got := respMsg.Header.GetRcode(); got != RCodeNoError {
+		t.Errorf("Response RCode = %d, want NOERROR", got)
+	}
+	if len(respMsg.Questions) != len(want) {
+		t.Errorf("Response echoes %d questions, want %d", len(respMsg.Questions), len(want))
+	}
+}
+
+func TestDNSHandler_CNAMEToA(t *testing.T) {
+	queryData := buildTestDNSQuery(0x434e, []Question{
+		{Name: "www.stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 2 {
+		t.Fatalf("Response has %d answers, want CNAME then A", len(respMsg.Answers))
+	}
+
+	alias, target := respMsg.Answers[0], respMsg.Answers[1]
+	if alias.Type != RecordTypeCNAME || alias.Name != "www.stackoverflow.com" {
+		t.Errorf("First answer is %s %s, want the CNAME for www.stackoverflow.com", alias.Name, TypeName(alias.Type))
+	}
+	if name, _, err := decodeDNSName(alias.RData, 0); err != nil || name != "stackoverflow.com" {
+		t.Errorf("CNAME target = %q, %v, want stackoverflow.com", name, err)
+	}
+	if target.Type != RecordTypeA || target.Name != "stackoverflow.com" ||
+		!bytes.Equal(target.RData, []byte{151, 101, 129, 69}) {
+		t.Errorf("Second answer = %+v, want stackoverflow.com's A record", target)
+	}
+	if alias.TTL == 0 || target.TTL == 0 {
+		t.Errorf("Answer TTLs are %d and %d, want the configured default", alias.TTL, target.TTL)
+	}
+}
+
+func TestDNSHandler_NoCompression(t *testing.T) {
+	cfg, err := ParseConfig([]string{"--no-compression"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+
+	queryData := buildTestDNSQuery(0x6e63, []Question{
+		{Name: "www.stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData, WithConfig(cfg)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	if got := countCompressionPointers(t, response); got != 0 {
+		t.Errorf("Response has %d compression pointers with --no-compression, want 0", got)
+	}
+}
+
+func TestDNSHandler_UnimplementedOpcodes(t *testing.T) {
+	// An IQUERY carries the record to look up in the answer section
+	iquery := Message{
+		Header: MessageHeader{Id: 0x1001, ANCount: 1},
+		Answers: []ResourceRecord{
+			{Name: "", Type: RecordTypeA, Class: ClassIN, TTL: 0, RData: []byte{192, 0, 2, 1}},
+		},
+	}
+	iquery.Header.SetOpcode(OpcodeIQuery)
+	iqueryData, err := iquery.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	// A STATUS query whose body isn't in the standard question format at all
+	status := MessageHeader{Id: 0x1002, QDCount: 1}
+	status.SetOpcode(OpcodeStatus)
+	statusData, _ := status.MarshalBinary()
+	statusData = append(statusData, 0xFF, 0xFF, 0xFF)
+
+	tests := []struct {
+		name   string
+		query  []byte
+		id     uint16
+		opcode uint8
+	}{
+		{"IQUERY", iqueryData, 0x1001, OpcodeIQuery},
+		{"STATUS", statusData, 0x1002, OpcodeStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewDNSHandler(tt.query)
+			h.SetResolver(func(q Question) (Result, error) {
+				t.Errorf("Resolved %s for an opcode %d query", q.Name, tt.opcode)
+				return Result{}, nil
+			})
+			response, err := h.Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinaryStrict(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if respMsg.Header.Id != tt.id {
+				t.Errorf("Response ID = %#x, want %#x", respMsg.Header.Id, tt.id)
+			}
+			if respMsg.Header.GetQR() != 1 {
+				t.Error("Response QR = 0, want 1")
+			}
+			if got := respMsg.Header.GetOpcode(); got != tt.opcode {
+				t.Errorf("Response opcode = %d, want %d echoed", got, tt.opcode)
+			}
+			if got := respMsg.Header.GetRcode(); got != RCodeNotImpl {
+				t.Errorf("Response rcode = %d, want NOTIMP", got)
+			}
+			if len(respMsg.Questions) != 0 || len(respMsg.Answers) != 0 {
+				t.Errorf("Response has %d questions and %d answers, want none", len(respMsg.Questions), len(respMsg.Answers))
+			}
+		})
+	}
+}
+
+func TestDNSHandler_CatchAll(t *testing.T) {
+	cfg, err := ParseConfig([]string{"--catch-all", "10.0.0.1", "--catch-all6", "fd00::1"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+	// A blocklist-style policy in middleware still answers before the catch-all
+	blocklist := func(next Handler) Handler {
+		return HandlerFunc(func(req *Message) (*Message, error) {
+			if req.Questions[0].Name == "blocked.example" {
+				return NewResponseBuilder(req).SetRcode(RCodeNXDomain).Build(), nil
+			}
+			return next.ServeDNS(req)
+		})
+	}
+
+	tests := []struct {
+		name      string
+		question  Question
+		wantRcode uint8
+		want      net.IP
+	}{
+		{"arbitrary name", Question{Name: "anything.invalid", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, net.IP{10, 0, 0, 1}},
+		{"name in the store", Question{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, net.IP{10, 0, 0, 1}},
+		{"AAAA", Question{Name: "anything.invalid", Type: RecordTypeAAAA, Class: ClassIN}, RCodeNoError, net.ParseIP("fd00::1")},
+		{"blocklisted", Question{Name: "blocked.example", Type: RecordTypeA, Class: ClassIN}, RCodeNXDomain, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryData := buildTestDNSQuery(0x0414, []Question{tt.question})
+			response, err := NewDNSHandler(queryData, WithConfig(cfg), WithMiddleware(blocklist)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Fatalf("RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if tt.want == nil {
+				if len(respMsg.Answers) != 0 {
+					t.Errorf("Response has %d answers, want none", len(respMsg.Answers))
+				}
+				return
+			}
+			if len(respMsg.Answers) != 1 || !net.IP(respMsg.Answers[0].RData).Equal(tt.want) {
+				t.Errorf("Answers = %+v, want just %s", respMsg.Answers, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_ZeroQuestions(t *testing.T) {
+	const opcodeNotify = 4 // RFC 1996
+	tests := []struct {
+		name      string
+		opcode    uint8
+		edns      *OPTRecord
+		wantRcode uint8
+	}{
+		{"standard query", OpcodeQuery, nil, RCodeFormat},
+		{"EDNS without keepalive", OpcodeQuery, &OPTRecord{UDPSize: 1232}, RCodeFormat},
+		{"EDNS keepalive", OpcodeQuery, &OPTRecord{UDPSize: 1232, Options: []EDNSOption{{Code: EDNSOptionKeepalive}}}, RCodeNoError},
+		{"NOTIFY", opcodeNotify, nil, RCodeNotImpl},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := Message{Header: MessageHeader{Id: 0x0418}, EDNS: tt.edns}
+			query.Header.SetOpcode(tt.opcode)
+			queryData, err := query.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+
+			response, err := NewDNSHandler(queryData).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if respMsg.Header.Id != 0x0418 {
+				t.Errorf("Response ID = %#x, want 0x0418", respMsg.Header.Id)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("RCode = %d, want %d", got, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_NoRecursion(t *testing.T) {
+	upstream := &flakyForwarder{}
+	cache, _ := newTestCache(upstream)
+	cached := Question{Name: "cached.example.org", Type: RecordTypeA, Class: ClassIN}
+	if _, err := cache.Exchange(cached); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	upstream.calls.Store(0)
+
+	cfg, err := ParseConfig([]string{"--no-recursion"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+	opts := []HandlerOption{WithConfig(cfg), WithZone(newTestZone(t)), WithUpstream(cache)}
+
+	tests := []struct {
+		name        string
+		q           Question
+		wantRcode   uint8
+		wantAnswers int
+	}{
+		{"zone answer", Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, 1},
+		{"cached answer", cached, RCodeNoError, 1},
+		{"uncached name outside the zone", Question{Name: "other.example.org", Type: RecordTypeA, Class: ClassIN}, RCodeRefused, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// buildTestDNSQuery sets RD=1
+			response, err := NewDNSHandler(buildTestDNSQuery(0x0430, []Question{tt.q}), opts...).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if respMsg.Header.GetRA() != 0 {
+				t.Error("Response has RA set with --no-recursion")
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if len(respMsg.Answers) != tt.wantAnswers {
+				t.Errorf("Response has %d answers, want %d", len(respMsg.Answers), tt.wantAnswers)
+			}
+		})
+	}
+	if calls := upstream.calls.Load(); calls != 0 {
+		t.Errorf("Upstream was queried %d times with recursion disabled, want 0", calls)
+	}
+}
+
+func TestDNSHandler_MultiQuestionRcode(t *testing.T) {
+	found := Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}
+	missing := Question{Name: "missing.example.com", Type: RecordTypeA, Class: ClassIN}
+	outside := Question{Name: "www.example.org", Type: RecordTypeA, Class: ClassIN}
+
+	// The upstream answers found, refuses outside and has no other names
+	upstream := startFakeUpstream(t, func(query *Message) []Message {
+		switch query.Questions[0].Name {
+		case found.Name:
+			return []Message{fakeReply(query, query.Questions[0], []byte{192, 0, 2, 1})}
+		case outside.Name:
+			return []Message{negativeReply(t, query, RCodeRefused)}
+		}
+		return []Message{negativeReply(t, query, RCodeNXDomain)}
+	})
+
+	tests := []struct {
+		name        string
+		questions   []Question
+		upstream    bool // forward rather than answer from the zone
+		wantRcode   uint8
+		wantAnswers int
+	}{
+		{"success then NXDOMAIN", []Question{found, missing}, false, RCodeNoError, 1},
+		{"NXDOMAIN then success", []Question{missing, found}, false, RCodeNoError, 1},
+		{"all failing takes the first error", []Question{missing, outside}, false, RCodeNXDomain, 0},
+		{"all failing in the other order", []Question{outside, missing}, false, RCodeRefused, 0},
+		{"upstream NXDOMAIN then success", []Question{missing, found}, true, RCodeNoError, 1},
+		{"upstream NXDOMAIN then REFUSED", []Question{missing, outside}, true, RCodeNXDomain, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := WithZone(newTestZone(t))
+			if tt.upstream {
+				opt = WithUpstream(NewUpstream(upstream))
+			}
+			response, err := NewDNSHandler(buildTestDNSQuery(0x0433, tt.questions), opt).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if len(respMsg.Answers) != tt.wantAnswers {
+				t.Errorf("Response has %d answers, want %d", len(respMsg.Answers), tt.wantAnswers)
+			}
+			if tt.wantAnswers > 0 && respMsg.Answers[0].Name != found.Name {
+				t.Errorf("Answer is for %s, want %s", respMsg.Answers[0].Name, found.Name)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_StrictMirror(t *testing.T) {
+	var question bytes.Buffer
+	encodeDNSName("WwW.ExAmPlE.CoM", &question)
+	question.Write([]byte{0, 1, 0, 1})
+	// OPT with a 1400 byte UDP size, DO set and an 8 byte client cookie
+	opt := []byte{0, 0, 41, 0x05, 0x78, 0, 0, 0x80, 0, 0, 12, 0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	query := append([]byte{0x04, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1}, question.Bytes()...)
+	query = append(query, opt...)
+
+	cfg, err := ParseConfig([]string{"--strict-mirror"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+	response, err := NewDNSHandler(query, WithConfig(cfg)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	if got := response[DNSHeaderSize : DNSHeaderSize+question.Len()]; !bytes.Equal(got, question.Bytes()) {
+		t.Errorf("Question section = %x, want the request's %x", got, question.Bytes())
+	}
+	if !bytes.HasSuffix(response, opt) {
+		t.Errorf("Response %x doesn't end with the request's OPT record %x", response, opt)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinaryStrict(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if respMsg.Header.GetQR() != 1 || len(respMsg.Answers) != 1 || respMsg.EDNS == nil {
+		t.Errorf("Response QR=%d answers=%d EDNS=%v, want a response with 1 answer and EDNS",
+			respMsg.Header.GetQR(), len(respMsg.Answers), respMsg.EDNS)
+	}
+
+	// Without the flag the server writes its own OPT record
+	response, err = NewDNSHandler(query).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	if bytes.HasSuffix(response, opt) {
+		t.Error("Response echoes the request's OPT record without --strict-mirror")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHealthInterval is how often upstreams are probed
+const DefaultHealthInterval = 30 * time.Second
+
+// Forwarder sends a question to upstream resolvers and returns the answers
+type Forwarder interface {
+	Exchange(q Question) ([]ResourceRecord, error)
+}
+
+// SubnetForwarder is a Forwarder that can ask on behalf of a client in a given
+// subnet, for upstreams that tailor answers to where clients are (RFC 7871).
+// Along with the answers, it returns the scope of clients they apply to, which
+// is invalid when they apply to every client.
+type SubnetForwarder interface {
+	Forwarder
+	ExchangeSubnet(q Question, subnet netip.Prefix) (answers []ResourceRecord, scope netip.Prefix, err error)
+}
+
+// healthProbe is the well-known question sent to check that an upstream answers
+var healthProbe = Question{Name: "", Type: RecordTypeNS, Class: ClassIN}
+
+// UpstreamSet forwards to a list of upstreams in order, skipping the ones that
+// health checks have marked down and failing over to the next on error. When
+// none of them answers, the whole list is tried again up to Retries times,
+// waiting longer before each retry as Backoff says.
+type UpstreamSet struct {
+	Retries int
+	Backoff Backoff
+
+	upstreams []*Upstream
+	up        []atomic.Bool
+	sleep     func(time.Duration) // replaceable for tests
+}
+
+// NewUpstreamSet creates a set with every upstream initially marked up
+func NewUpstreamSet(upstreams ...*Upstream) *UpstreamSet {
+	s := &UpstreamSet{
+		Backoff:   Backoff{Base: DefaultRetryBackoff, Max: DefaultRetryBackoffMax},
+		upstreams: upstreams,
+		up:        make([]atomic.Bool, len(upstreams)),
+		sleep:     time.Sleep,
+	}
+	for i := range s.up {
+		s.up[i].Store(true)
+	}
+	return s
+}
+
+// newUpstreamSetFromConfig creates a set from the comma-separated resolver list in cfg
+func newUpstreamSetFromConfig(cfg Config) (*UpstreamSet, error) {
+	var upstreams []*Upstream
+	for _, addr := range strings.Split(cfg.Resolver, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		upstreamCfg := cfg
+		upstreamCfg.Resolver = addr
+		upstream, err := newUpstreamFromConfig(upstreamCfg)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no resolvers in %q", cfg.Resolver)
+	}
+	set := NewUpstreamSet(upstreams...)
+	set.Retries = cfg.UpstreamRetries
+	set.Backoff = Backoff{Base: cfg.RetryBackoff, Max: cfg.RetryBackoffMax}
+	return set, nil
+}
+
+// Exchange implements Forwarder. Upstreams marked down are skipped unless all of
+// them are down, in which case every upstream is tried rather than failing outright.
+func (s *UpstreamSet) Exchange(q Question) ([]ResourceRecord, error) {
+	answers, _, err := s.ExchangeSubnet(q, netip.Prefix{})
+	return answers, err
+}
+
+// ExchangeSubnet implements SubnetForwarder. Only timeouts and other transport
+// errors are retried: an upstream that answered, even with SERVFAIL, isn't
+// hammered with the same question again.
+func (s *UpstreamSet) ExchangeSubnet(q Question, subnet netip.Prefix) ([]ResourceRecord, netip.Prefix, error) {
+	for attempt := 0; ; attempt++ {
+		answers, scope, err := s.exchangeOnce(q, subnet)
+		var rcodeErr *RcodeError
+		if err == nil || errors.As(err, &rcodeErr) || attempt >= s.Retries {
+			return answers, scope, err
+		}
+		delay := s.Backoff.Delay(attempt)
+		fmt.Printf("No upstream answered %s, retrying in %s\n", q.Name, delay)
+		s.sleep(delay)
+	}
+}
+
+// exchangeOnce tries each candidate upstream in turn until one answers
+func (s *UpstreamSet) exchangeOnce(q Question, subnet netip.Prefix) ([]ResourceRecord, netip.Prefix, error) {
+	candidates := s.healthy()
+	if len(candidates) == 0 {
+		fmt.Println("All upstreams are marked down, trying them anyway")
+		candidates = s.upstreams
+	}
+
+	var lastErr, answered error
+	for _, upstream := range candidates {
+		answers, scope, err := upstream.ExchangeSubnet(q, subnet)
+		if err == nil {
+			return answers, scope, nil
+		}
+		var rcodeErr *RcodeError
+		if errors.As(err, &rcodeErr) && rcodeErr.Negative() {
+			return nil, scope, err // the name doesn't exist, asking others won't change that
+		}
+		fmt.Printf("Upstream %s failed: %v\n", upstream.Addr, err)
+		lastErr = err
+		if rcodeErr != nil {
+			answered = err
+		}
+	}
+	if answered != nil {
+		// Report the answer over any transport errors, so it isn't retried
+		return nil, netip.Prefix{}, fmt.Errorf("all upstreams failed, last answer: %w", answered)
+	}
+	return nil, netip.Prefix{}, fmt.Errorf("all upstreams failed, last error: %w", lastErr)
+}
+
+// healthy returns the upstreams currently marked up, in configured order
+func (s *UpstreamSet) healthy() []*Upstream {
+	var healthy []*Upstream
+	for i, upstream := range s.upstreams {
+		if s.up[i].Load() {
+			healthy = append(healthy, upstream)
+		}
+	}
+	return healthy
+}
+
+// IsUp reports whether the upstream at addr is currently marked up
+func (s *UpstreamSet) IsUp(addr string) bool {
+	for i, upstream := range s.upstreams {
+		if upstream.Addr == addr {
+			return s.up[i].Load()
+		}
+	}
+	return false
+}
+
+// CheckHealth probes every upstream once and updates its up/down state
+func (s *UpstreamSet) CheckHealth() {
+	for i, upstream := range s.upstreams {
+		_, err := upstream.Exchange(healthProbe)
+		// Any answer but SERVFAIL shows the upstream is working
+		var rcodeErr *RcodeError
+		up := err == nil || errors.As(err, &rcodeErr) && rcodeErr.Rcode != RCodeServFail
+		if was := s.up[i].Swap(up); was != up {
+			if up {
+				fmt.Printf("Upstream %s is back up\n", upstream.Addr)
+			} else {
+				fmt.Printf("Upstream %s marked down: %v\n", upstream.Addr, err)
+			}
+		}
+	}
+}
+
+// StartHealthChecks probes the upstreams every interval until the returned stop function is called
+func (s *UpstreamSet) StartHealthChecks(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.CheckHealth()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// WriteMetrics implements MetricsCollector
+func (s *UpstreamSet) WriteMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP dns_upstream_up Whether the upstream resolver passed its last health check.")
+	fmt.Fprintln(w, "# TYPE dns_upstream_up gauge")
+	for i, upstream := range s.upstreams {
+		up := 0
+		if s.up[i].Load() {
+			up = 1
+		}
+		fmt.Fprintf(w, "dns_upstream_up{upstream=%q} %d\n", upstream.Addr, up)
+	}
+}
+
+// Close releases the pooled connections of every upstream
+func (s *UpstreamSet) Close() {
+	for _, upstream := range s.upstreams {
+		upstream.Pool.Close()
+	}
+}
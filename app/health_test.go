@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamSet_HealthCheckMarksDown(t *testing.T) {
+	var failing atomic.Bool
+	var primaryQueries atomic.Int64
+	primaryAddr := startFakeUpstream(t, func(query *Message) []Message {
+		primaryQueries.Add(1)
+		if failing.Load() {
+			return nil // drop the query, as an unreachable resolver would
+		}
+		return []Message{fakeReply(query, query.Questions[0], []byte{1, 1, 1, 1})}
+	})
+	secondaryAddr := startFakeUpstream(t, func(query *Message) []Message {
+		return []Message{fakeReply(query, query.Questions[0], []byte{2, 2, 2, 2})}
+	})
+
+	primary := NewUpstream(primaryAddr)
+	primary.Timeout = 100 * time.Millisecond
+	secondary := NewUpstream(secondaryAddr)
+	set := NewUpstreamSet(primary, secondary)
+	defer set.Close()
+
+	q := Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN}
+
+	set.CheckHealth()
+	if !set.IsUp(primaryAddr) || !set.IsUp(secondaryAddr) {
+		t.Fatalf("Healthy upstreams marked down")
+	}
+	answers, err := set.Exchange(q)
+	if err != nil || !bytes.Equal(answers[0].RData, []byte{1, 1, 1, 1}) {
+		t.Fatalf("Exchange() = %+v, %v, want the primary's answer", answers, err)
+	}
+
+	failing.Store(true)
+	set.CheckHealth()
+	if set.IsUp(primaryAddr) {
+		t.Fatalf("Failing upstream still marked up")
+	}
+
+	before := primaryQueries.Load()
+	answers, err = set.Exchange(q)
+	if err != nil || !bytes.Equal(answers[0].RData, []byte{2, 2, 2, 2}) {
+		t.Fatalf("Exchange() = %+v, %v, want the secondary's answer", answers, err)
+	}
+	if primaryQueries.Load() != before {
+		t.Errorf("Exchange() queried an upstream that is marked down")
+	}
+
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(set).ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+	metrics := rec.Body.String()
+	for _, want := range []string{
+		`dns_upstream_up{upstream="` + primaryAddr + `"} 0`,
+		`dns_upstream_up{upstream="` + secondaryAddr + `"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Metrics missing %q:\n%s", want, metrics)
+		}
+	}
+
+	// Recovery is picked up by the next check
+	failing.Store(false)
+	set.CheckHealth()
+	if !set.IsUp(primaryAddr) {
+		t.Errorf("Recovered upstream still marked down")
+	}
+}
+
+func TestUpstreamSet_FailsOverOnError(t *testing.T) {
+	deadAddr := startFakeUpstream(t, func(query *Message) []Message { return nil })
+	liveAddr := startFakeUpstream(t, func(query *Message) []Message {
+		return []Message{fakeReply(query, query.Questions[0], []byte{3, 3, 3, 3})}
+	})
+
+	dead := NewUpstream(deadAddr)
+	dead.Timeout = 100 * time.Millisecond
+	set := NewUpstreamSet(dead, NewUpstream(liveAddr))
+	defer set.Close()
+
+	answers, err := set.Exchange(Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN})
+	if err != nil || !bytes.Equal(answers[0].RData, []byte{3, 3, 3, 3}) {
+		t.Fatalf("Exchange() = %+v, %v, want failover to the live upstream", answers, err)
+	}
+}
+
+func TestUpstreamSet_NXDOMAINIsFinal(t *testing.T) {
+	var asked atomic.Int64
+	firstAddr := startFakeUpstream(t, func(query *Message) []Message {
+		return []Message{negativeReply(t, query, RCodeNXDomain)}
+	})
+	secondAddr := startFakeUpstream(t, func(query *Message) []Message {
+		asked.Add(1)
+		return []Message{fakeReply(query, query.Questions[0], []byte{3, 3, 3, 3})}
+	})
+	set := NewUpstreamSet(NewUpstream(firstAddr), NewUpstream(secondAddr))
+	defer set.Close()
+
+	_, err := set.Exchange(Question{Name: "missing.example.com", Type: RecordTypeA, Class: ClassIN})
+	var rcodeErr *RcodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != RCodeNXDomain || len(rcodeErr.Authority) != 1 {
+		t.Fatalf("Exchange() error = %v, want the NXDOMAIN with its SOA", err)
+	}
+	if asked.Load() != 0 {
+		t.Error("Second upstream was asked after the first answered NXDOMAIN")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Iterative resolution limits
+const (
+	DefaultMaxReferrals = 16 // delegations followed for one name
+	DefaultMaxQueries   = 64 // queries sent for one question, including NS and CNAME lookups
+	DefaultMaxDepth     = 4  // nested resolutions of NS addresses and CNAME targets
+)
+
+// IterativeResolver resolves questions itself, starting at the root servers and
+// following referrals down to an authoritative server. A name that doesn't
+// exist is reported as an RcodeError with RCodeNXDomain.
+type IterativeResolver struct {
+	RootServers  []string      // root server addresses (host:port)
+	Port         string        // port used for name servers learned from referrals
+	Timeout      time.Duration // deadline for each query
+	MaxReferrals int
+	MaxQueries   int
+	MaxDepth     int
+
+	// QNAMEMinimization asks each server only about the next label below its zone,
+	// as an NS query, rather than the full name (RFC 9156)
+	QNAMEMinimization bool
+
+	Delegations *DelegationCache // name server addresses learned from referrals, nil to always start at the root
+}
+
+// NewIterativeResolver creates a resolver starting from the given root server addresses
+func NewIterativeResolver(rootServers ...string) *IterativeResolver {
+	return &IterativeResolver{
+		RootServers:  rootServers,
+		Port:         "53",
+		Timeout:      DefaultUpstreamTimeout,
+		MaxReferrals: DefaultMaxReferrals,
+		MaxQueries:   DefaultMaxQueries,
+		MaxDepth:     DefaultMaxDepth,
+
+		QNAMEMinimization: true,
+		Delegations:       NewDelegationCache(DefaultCacheCapacity),
+	}
+}
+
+// newIterativeResolverFromConfig creates a resolver from the comma-separated root server list in cfg
+func newIterativeResolverFromConfig(cfg Config) (*IterativeResolver, error) {
+	var roots []string
+	for _, addr := range strings.Split(cfg.RootServers, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			roots = append(roots, addr)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no root servers in %q", cfg.RootServers)
+	}
+	return NewIterativeResolver(roots...), nil
+}
+
+// resolution tracks the budget shared by everything done to answer one question
+type resolution struct {
+	queries int
+}
+
+// Exchange implements Forwarder
+func (r *IterativeResolver) Exchange(q Question) ([]ResourceRecord, error) {
+	return r.resolve(q, &resolution{}, 0)
+}
+
+// resolve answers q starting from the closest known zone cut, following referrals and CNAMEs
+func (r *IterativeResolver) resolve(q Question, res *resolution, depth int) ([]ResourceRecord, error) {
+	if depth > r.MaxDepth {
+		return nil, fmt.Errorf("resolving %s nested more than %d levels deep", q.Name, r.MaxDepth)
+	}
+
+	zone := ""
+	servers := r.RootServers
+	if r.Delegations != nil {
+		if cut, cached, ok := r.Delegations.Closest(q.Name); ok {
+			zone, servers = cut, cached
+		}
+	}
+	minimize := r.QNAMEMinimization
+	known := zone // deepest name the current servers have been asked about
+	for referrals := 0; referrals <= r.MaxReferrals; {
+		ask := q
+		if minimize {
+			if name := minimizedName(q.Name, known); !strings.EqualFold(name, q.Name) {
+				ask = Question{Name: name, Type: RecordTypeNS, Class: q.Class}
+			}
+		}
+		minimized := ask != q
+
+		reply, err := r.query(ask, servers, res)
+		if err != nil {
+			return nil, err
+		}
+
+		rcode := reply.Header.GetRcode()
+		if minimized && rcode != RCodeNoError {
+			// Some servers answer NXDOMAIN for empty non-terminals or refuse NS
+			// queries, so fall back to asking for the full name
+			fmt.Printf("Iterative: server for %q answered minimized %s with rcode %d, asking for %s\n", zone, ask.Name, rcode, q.Name)
+			minimize = false
+			continue
+		}
+		switch {
+		case rcode == RCodeNXDomain:
+			fmt.Printf("Iterative: %s does not exist\n", q.Name)
+			return nil, &RcodeError{Addr: fmt.Sprintf("server for %q", zone), Rcode: rcode, Authority: matchingClass(q, reply.Authority)}
+		case rcode != RCodeNoError:
+			return nil, fmt.Errorf("server for %q answered %s with rcode %d", zone, q.Name, rcode)
+		}
+
+		if !minimized && len(reply.Answers) > 0 {
+			return r.followAnswers(q, reply.Answers, res, depth)
+		}
+
+		child, nameServers, ttl := referral(reply, ask.Name, zone)
+		if child == "" {
+			if minimized {
+				// No cut at this name, so the same servers are asked one label deeper
+				known = ask.Name
+				continue
+			}
+			// NODATA: the authoritative server has nothing of this type
+			return nil, nil
+		}
+		fmt.Printf("Iterative: %s referred from %q to %q (%d name servers)\n", q.Name, zone, child, len(nameServers))
+
+		servers, ttl, err = r.serverAddrs(reply, nameServers, zone, ttl, res, depth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find servers for %s: %w", child, err)
+		}
+		if r.Delegations != nil {
+			r.Delegations.Store(child, servers, ttl)
+		}
+		zone, known = child, child
+		referrals++
+	}
+	return nil, fmt.Errorf("resolving %s took more than %d referrals", q.Name, r.MaxReferrals)
+}
+
+// query sends q to each server in turn until one replies
+func (r *IterativeResolver) query(q Question, servers []string, res *resolution) (*Message, error) {
+	var lastErr error
+	for _, addr := range servers {
+		if res.queries >= r.MaxQueries {
+			return nil, fmt.Errorf("resolving took more than %d queries", r.MaxQueries)
+		}
+		res.queries++
+
+		upstream := NewUpstream(addr)
+		upstream.Timeout = r.Timeout
+		upstream.NoRecursion = true
+		reply, err := upstream.ExchangeMessage(q)
+		upstream.Pool.Close()
+		if err == nil {
+			return reply, nil
+		}
+		fmt.Printf("Iterative: query to %s failed: %v\n", addr, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("no servers to query for %s", q.Name)
+	}
+	return nil, lastErr
+}
+
+// followAnswers returns the answers for q, resolving the target of a CNAME when
+// the server didn't include the records it points to. A chain longer than
+// MaxCNAMEChain within the reply, as a CNAME loop makes it, is an error.
+func (r *IterativeResolver) followAnswers(q Question, answers []ResourceRecord, res *resolution, depth int) ([]ResourceRecord, error) {
+	name := q.Name
+	var chain []ResourceRecord
+	for range MaxCNAMEChain + 1 {
+		var cname string
+		found := false
+		for _, rr := range answers {
+			if !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			switch rr.Type {
+			case q.Type:
+				chain = append(chain, rr)
+				found = true
+			case RecordTypeCNAME:
+				if target, _, err := decodeDNSName(rr.RData, 0); err == nil {
+					chain = append(chain, rr)
+					cname = target
+				}
+			}
+		}
+		if found || cname == "" {
+			return chain, nil
+		}
+		name = cname
+
+		// Look for the target in the same reply before starting over
+		if !hasOwner(answers, name) {
+			target, err := r.resolve(Question{Name: name, Type: q.Type, Class: q.Class}, res, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve CNAME target %s: %w", name, err)
+			}
+			return append(chain, target...), nil
+		}
+	}
+	return nil, fmt.Errorf("CNAME chain from %s is longer than %d", q.Name, MaxCNAMEChain)
+}
+
+// serverAddrs returns addresses for the name servers of a referral, from glue in
+// the reply when it's in the bailiwick of the server that sent it, resolving them otherwise.
+// The TTL returned is the lowest of ttl and those of the address records used.
+func (r *IterativeResolver) serverAddrs(reply *Message, nameServers []string, zone string, ttl uint32, res *resolution, depth int) ([]string, uint32, error) {
+	var addrs []string
+	var unglued []string
+	for _, ns := range nameServers {
+		glued := false
+		for _, rr := range reply.Additional {
+			if !strings.EqualFold(rr.Name, ns) || !inDomain(rr.Name, zone) {
+				continue
+			}
+			if rr.Type == RecordTypeA || rr.Type == RecordTypeAAAA {
+				addrs = append(addrs, net.JoinHostPort(net.IP(rr.RData).String(), r.Port))
+				ttl = min(ttl, rr.TTL)
+				glued = true
+			}
+		}
+		if !glued {
+			unglued = append(unglued, ns)
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, ttl, nil
+	}
+
+	for _, ns := range unglued {
+		answers, err := r.resolve(Question{Name: ns, Type: RecordTypeA, Class: ClassIN}, res, depth+1)
+		if err != nil {
+			fmt.Printf("Iterative: failed to resolve name server %s: %v\n", ns, err)
+			continue
+		}
+		for _, rr := range answers {
+			if rr.Type == RecordTypeA {
+				addrs = append(addrs, net.JoinHostPort(net.IP(rr.RData).String(), r.Port))
+			}
+			ttl = min(ttl, rr.TTL)
+		}
+		if len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no addresses for name servers %v", nameServers)
+}
+
+// referral returns the delegated zone, its name servers and the lowest TTL of their
+// NS records when reply refers the query for name on to a zone below the current one
+func referral(reply *Message, name, zone string) (string, []string, uint32) {
+	child := ""
+	var nameServers []string
+	var ttl uint32
+	for _, rr := range reply.Authority {
+		if rr.Type != RecordTypeNS {
+			continue
+		}
+		// Only follow delegations that get closer to the name, or we could loop
+		owner := strings.ToLower(rr.Name)
+		if owner == zone || !inDomain(owner, zone) || !inDomain(name, owner) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		ns, _, err := decodeDNSName(rr.RData, 0)
+		if err != nil {
+			continue
+		}
+		if child == "" {
+			ttl = rr.TTL
+		}
+		child = owner
+		nameServers = append(nameServers, ns)
+		ttl = min(ttl, rr.TTL)
+	}
+	return child, nameServers, ttl
+}
+
+// minimizedName returns the ancestor of name one label below known, or name itself
+// when that's all that's left. known must be name or one of its ancestors.
+func minimizedName(name, known string) string {
+	rest := name
+	if known != "" {
+		if len(name) <= len(known) {
+			return name
+		}
+		rest = name[:len(name)-len(known)-1]
+	}
+	if i := strings.LastIndex(rest, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// hasOwner reports whether any record is owned by name
+func hasOwner(records []ResourceRecord, name string) bool {
+	for _, rr := range records {
+		if strings.EqualFold(rr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeHierarchy is a root, com, example.com and net server on 127.0.0.1-4, all on
+// one port so referrals can name them by address alone
+type fakeHierarchy struct {
+	port    string
+	queries chan Message // every query received, by any server
+}
+
+// startFakeHierarchy starts the servers. example.com has an MX record at its
+// apex, www (A and AAAA), alias (CNAME to www.example.net, served by the net server
+// glued in the root zone), loop (a CNAME loop within one reply) and unglued,
+// delegated to a name server in net with no glue.
+// Like servers that predate QNAME minimization, the net server answers NXDOMAIN
+// for the empty non-terminal example.net.
+func startFakeHierarchy(t *testing.T) *fakeHierarchy {
+	t.Helper()
+
+	h := &fakeHierarchy{queries: make(chan Message, 64)}
+	root := h.listen(t, net.IPv4(127, 0, 0, 1), "0")
+	_, h.port, _ = net.SplitHostPort(root.LocalAddr().String())
+	com := h.listen(t, net.IPv4(127, 0, 0, 2), h.port)
+	example := h.listen(t, net.IPv4(127, 0, 0, 3), h.port)
+	netTLD := h.listen(t, net.IPv4(127, 0, 0, 4), h.port)
+
+	go h.serve(root, func(q Question) Message {
+		switch {
+		case inDomain(q.Name, "com"):
+			return referralReply(q, "com", "a.gtld.com", net.IPv4(127, 0, 0, 2))
+		case inDomain(q.Name, "net"):
+			return referralReply(q, "net", "a.gtld.net", net.IPv4(127, 0, 0, 4))
+		}
+		return nxdomainReply(q)
+	})
+	go h.serve(com, func(q Question) Message {
+		switch {
+		case inDomain(q.Name, "unglued.com"):
+			return referralReply(q, "unglued.com", "ns.example.net", nil)
+		case inDomain(q.Name, "example.com"):
+			return referralReply(q, "example.com", "ns.example.com", net.IPv4(127, 0, 0, 3))
+		}
+		return nxdomainReply(q)
+	})
+	go h.serve(example, func(q Question) Message {
+		switch q.Name {
+		case "example.com":
+			reply := answerReply(q)
+			if q.Type == RecordTypeMX {
+				mx, _ := (&MXData{Preference: 10, Exchange: "mail.example.com"}).MarshalBinary()
+				reply.Answers = []ResourceRecord{{Name: q.Name, Type: RecordTypeMX, Class: ClassIN, TTL: 60, RData: mx}}
+				reply.Header.ANCount = 1
+			}
+			return reply
+		case "www.example.com", "www.unglued.com":
+			return addressReply(q, net.IPv4(192, 0, 2, 80), net.ParseIP("2001:db8::80"))
+		case "alias.example.com":
+			reply := answerReply(q)
+			var target bytes.Buffer
+			encodeDNSName("www.example.net", &target)
+			reply.Answers = []ResourceRecord{{Name: q.Name, Type: RecordTypeCNAME, Class: ClassIN, TTL: 60, RData: target.Bytes()}}
+			reply.Header.ANCount = 1
+			return reply
+		case "loop.example.com":
+			reply := answerReply(q)
+			var toLoop, toOther bytes.Buffer
+			encodeDNSName("loop.example.com", &toLoop)
+			encodeDNSName("other.example.com", &toOther)
+			reply.Answers = []ResourceRecord{
+				{Name: "loop.example.com", Type: RecordTypeCNAME, Class: ClassIN, TTL: 60, RData: toOther.Bytes()},
+				{Name: "other.example.com", Type: RecordTypeCNAME, Class: ClassIN, TTL: 60, RData: toLoop.Bytes()},
+			}
+			reply.Header.ANCount = 2
+			return reply
+		}
+		return nxdomainReply(q)
+	})
+	go h.serve(netTLD, func(q Question) Message {
+		switch q.Name {
+		case "www.example.net":
+			return addressReply(q, net.IPv4(198, 51, 100, 80), nil)
+		case "ns.example.net":
+			return addressReply(q, net.IPv4(127, 0, 0, 3), nil)
+		}
+		return nxdomainReply(q)
+	})
+	return h
+}
+
+// listen binds a UDP socket on ip:port, skipping the test when the address isn't available
+func (h *fakeHierarchy) listen(t *testing.T, ip net.IP, port string) *net.UDPConn {
+	t.Helper()
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %v", ip, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Skipf("Can't listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// serve answers queries on conn with respond
+func (h *fakeHierarchy) serve(conn *net.UDPConn, respond func(q Question) Message) {
+	buf := make([]byte, MaxDNSPacketSize)
+	for {
+		size, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query Message
+		if err := query.UnmarshalBinary(buf[:size]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		select {
+		case h.queries <- query:
+		default:
+		}
+		reply := respond(query.Questions[0])
+		reply.Header.Id = query.Header.Id
+		if data, err := reply.MarshalBinary(); err == nil {
+			conn.WriteToUDP(data, source)
+		}
+	}
+}
+
+// drain returns how many queries the servers have received since the last drain
+func (h *fakeHierarchy) drain() int {
+	count := 0
+	for {
+		select {
+		case <-h.queries:
+			count++
+		default:
+			return count
+		}
+	}
+}
+
+// resolver returns an iterative resolver starting at the fake root
+func (h *fakeHierarchy) resolver() *IterativeResolver {
+	resolver := NewIterativeResolver(net.JoinHostPort("127.0.0.1", h.port))
+	resolver.Port = h.port
+	return resolver
+}
+
+// answerReply starts an authoritative NOERROR reply to q
+func answerReply(q Question) Message {
+	var header MessageHeader
+	header.SetQR(1)
+	header.SetAA(1)
+	header.QDCount = 1
+	return Message{Header: header, Questions: []Question{q}}
+}
+
+// nxdomainReply is an authoritative NXDOMAIN reply to q
+func nxdomainReply(q Question) Message {
+	reply := answerReply(q)
+	reply.Header.SetRcode(RCodeNXDomain)
+	return reply
+}
+
+// addressReply answers q with whichever of the addresses matches its type
+func addressReply(q Question, ipv4, ipv6 net.IP) Message {
+	reply := answerReply(q)
+	switch {
+	case q.Type == RecordTypeA && ipv4 != nil:
+		reply.Answers = []ResourceRecord{{Name: q.Name, Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: ipv4.To4()}}
+	case q.Type == RecordTypeAAAA && ipv6 != nil:
+		reply.Answers = []ResourceRecord{{Name: q.Name, Type: RecordTypeAAAA, Class: ClassIN, TTL: 60, RData: ipv6.To16()}}
+	}
+	reply.Header.ANCount = uint16(len(reply.Answers))
+	return reply
+}
+
+// referralReply delegates child to the name server ns, with A glue when glue isn't nil
+func referralReply(q Question, child, ns string, glue net.IP) Message {
+	var header MessageHeader
+	header.SetQR(1)
+	header.QDCount = 1
+	reply := Message{Header: header, Questions: []Question{q}}
+
+	var rdata bytes.Buffer
+	encodeDNSName(ns, &rdata)
+	reply.Authority = []ResourceRecord{{Name: child, Type: RecordTypeNS, Class: ClassIN, TTL: 3600, RData: rdata.Bytes()}}
+	if glue != nil {
+		reply.Additional = []ResourceRecord{{Name: ns, Type: RecordTypeA, Class: ClassIN, TTL: 3600, RData: glue.To4()}}
+	}
+	reply.Header.NSCount = uint16(len(reply.Authority))
+	reply.Header.ARCount = uint16(len(reply.Additional))
+	return reply
+}
+
+func TestIterativeResolver_Exchange(t *testing.T) {
+	h := startFakeHierarchy(t)
+
+	tests := []struct {
+		name      string
+		q         Question
+		wantTypes []uint16
+		wantLast  string // address in the last answer
+	}{
+		{"A through glued referrals", Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN},
+			[]uint16{RecordTypeA}, "192.0.2.80"},
+		{"AAAA through glued referrals", Question{Name: "www.example.com", Type: RecordTypeAAAA, Class: ClassIN},
+			[]uint16{RecordTypeAAAA}, "2001:db8::80"},
+		{"CNAME into another zone", Question{Name: "alias.example.com", Type: RecordTypeA, Class: ClassIN},
+			[]uint16{RecordTypeCNAME, RecordTypeA}, "198.51.100.80"},
+		{"name server without glue", Question{Name: "www.unglued.com", Type: RecordTypeA, Class: ClassIN},
+			[]uint16{RecordTypeA}, "192.0.2.80"},
+		{"MX at the zone apex", Question{Name: "example.com", Type: RecordTypeMX, Class: ClassIN},
+			[]uint16{RecordTypeMX}, ""},
+		{"NODATA", Question{Name: "example.com", Type: RecordTypeTXT, Class: ClassIN}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers, err := h.resolver().Exchange(tt.q)
+			if err != nil {
+				t.Fatalf("Exchange() failed: %v", err)
+			}
+			if len(answers) != len(tt.wantTypes) {
+				t.Fatalf("Got %d answers, want %d", len(answers), len(tt.wantTypes))
+			}
+			for i, rr := range answers {
+				if rr.Type != tt.wantTypes[i] {
+					t.Errorf("Answer %d has type %s, want %s", i, TypeName(rr.Type), TypeName(tt.wantTypes[i]))
+				}
+			}
+			if tt.wantLast != "" {
+				if got := net.IP(answers[len(answers)-1].RData).String(); got != tt.wantLast {
+					t.Errorf("Last answer = %s, want %s", got, tt.wantLast)
+				}
+			}
+		})
+	}
+}
+
+func TestIterativeResolver_NXDOMAIN(t *testing.T) {
+	h := startFakeHierarchy(t)
+
+	q := Question{Name: "missing.example.com", Type: RecordTypeA, Class: ClassIN}
+	_, err := h.resolver().Exchange(q)
+	var rcodeErr *RcodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != RCodeNXDomain {
+		t.Fatalf("Exchange() error = %v, want NXDOMAIN", err)
+	}
+
+	queryData := buildTestDNSQuery(0x0387, []Question{q})
+	response, err := NewDNSHandler(queryData, WithUpstream(h.resolver())).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if got := respMsg.Header.GetRcode(); got != RCodeNXDomain {
+		t.Errorf("RCode = %d, want NXDOMAIN", got)
+	}
+}
+
+func TestIterativeResolver_SendsNonRecursiveQueries(t *testing.T) {
+	h := startFakeHierarchy(t)
+
+	if _, err := h.resolver().Exchange(Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}); err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	count := 0
+	for done := false; !done; {
+		select {
+		case query := <-h.queries:
+			count++
+			if query.Header.GetRD() != 0 {
+				t.Errorf("Query for %s has RD set", query.Questions[0].Name)
+			}
+		default:
+			done = true
+		}
+	}
+	if count != 3 {
+		t.Errorf("Sent %d queries, want 3 (root, com, example.com)", count)
+	}
+}
+
+func TestIterativeResolver_ReusesCachedDelegations(t *testing.T) {
+	h := startFakeHierarchy(t)
+	// The counts below are for full-name queries
+	resolver := h.resolver()
+	resolver.QNAMEMinimization = false
+	now := time.Now()
+	resolver.Delegations.now = func() time.Time { return now }
+
+	www := Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}
+	unglued := Question{Name: "www.unglued.com", Type: RecordTypeA, Class: ClassIN}
+
+	// Without a cache: root, com, example.com and root, com, root, net, example.com
+	uncached := h.resolver()
+	uncached.QNAMEMinimization = false
+	uncached.Delegations = nil
+	for _, q := range []Question{www, unglued} {
+		if _, err := uncached.Exchange(q); err != nil {
+			t.Fatalf("Exchange(%s) failed: %v", q.Name, err)
+		}
+	}
+	uncachedQueries := h.drain()
+
+	if _, err := resolver.Exchange(www); err != nil {
+		t.Fatalf("Exchange(%s) failed: %v", www.Name, err)
+	}
+	if got := h.drain(); got != 3 {
+		t.Errorf("First lookup sent %d queries, want 3", got)
+	}
+	if _, err := resolver.Exchange(unglued); err != nil {
+		t.Fatalf("Exchange(%s) failed: %v", unglued.Name, err)
+	}
+	// com is cached, so this starts there: com, root, net, example.com
+	if got := h.drain(); got != 4 || 3+got >= uncachedQueries {
+		t.Errorf("Lookup under the cached com delegation sent %d queries, want 4 (%d without a cache)", got, uncachedQueries-3)
+	}
+	if _, err := resolver.Exchange(www); err != nil {
+		t.Fatalf("Exchange(%s) failed: %v", www.Name, err)
+	}
+	if got := h.drain(); got != 1 {
+		t.Errorf("Repeat lookup sent %d queries, want 1 straight to example.com", got)
+	}
+
+	// Once the delegations expire, resolution starts from the root again
+	now = now.Add(time.Hour)
+	if _, err := resolver.Exchange(www); err != nil {
+		t.Fatalf("Exchange(%s) failed: %v", www.Name, err)
+	}
+	if got := h.drain(); got != 3 {
+		t.Errorf("Lookup after the delegations expired sent %d queries, want 3", got)
+	}
+}
+
+func TestIterativeResolver_QNAMEMinimization(t *testing.T) {
+	h := startFakeHierarchy(t)
+
+	// sent returns the queries received since the last call, as "name TYPE"
+	sent := func() []string {
+		var queries []string
+		for {
+			select {
+			case query := <-h.queries:
+				q := query.Questions[0]
+				queries = append(queries, q.Name+" "+TypeName(q.Type))
+			default:
+				return queries
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		minimize bool
+		q        Question
+		want     []string
+	}{
+		{"only the authoritative server sees the full name", true,
+			Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN},
+			[]string{"com NS", "example.com NS", "www.example.com A"}},
+		{"falls back to the full name after NXDOMAIN for an empty non-terminal", true,
+			Question{Name: "www.example.net", Type: RecordTypeA, Class: ClassIN},
+			[]string{"net NS", "example.net NS", "www.example.net A"}},
+		{"disabled", false,
+			Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN},
+			[]string{"www.example.com A", "www.example.com A", "www.example.com A"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := h.resolver()
+			resolver.QNAMEMinimization = tt.minimize
+			sent()
+			answers, err := resolver.Exchange(tt.q)
+			if err != nil {
+				t.Fatalf("Exchange() failed: %v", err)
+			}
+			if len(answers) != 1 || answers[0].Type != RecordTypeA {
+				t.Errorf("Exchange() = %+v, want one A record", answers)
+			}
+			if got := sent(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Queries sent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinimizedName(t *testing.T) {
+	tests := []struct {
+		name, known, want string
+	}{
+		{"www.example.com", "", "com"},
+		{"www.example.com", "com", "example.com"},
+		{"www.Example.COM", "example.com", "www.Example.COM"},
+		{"example.com", "example.com", "example.com"},
+		{"com", "", "com"},
+	}
+	for _, tt := range tests {
+		if got := minimizedName(tt.name, tt.known); got != tt.want {
+			t.Errorf("minimizedName(%q, %q) = %q, want %q", tt.name, tt.known, got, tt.want)
+		}
+	}
+}
+
+func TestIterativeResolver_Limits(t *testing.T) {
+	h := startFakeHierarchy(t)
+
+	t.Run("query budget", func(t *testing.T) {
+		resolver := h.resolver()
+		resolver.MaxQueries = 2
+		if _, err := resolver.Exchange(Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}); err == nil {
+			t.Error("Exchange() succeeded with a budget of 2 queries for a 3 level lookup")
+		}
+	})
+	t.Run("CNAME loop", func(t *testing.T) {
+		if _, err := h.resolver().Exchange(Question{Name: "loop.example.com", Type: RecordTypeA, Class: ClassIN}); err == nil {
+			t.Error("Exchange() of a name in a CNAME loop succeeded")
+		}
+	})
+}
+
+func TestNewIterativeResolverFromConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RootServers = " 198.41.0.4:53, ,199.9.14.201:53"
+	resolver, err := newIterativeResolverFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("newIterativeResolverFromConfig() failed: %v", err)
+	}
+	if len(resolver.RootServers) != 2 {
+		t.Errorf("RootServers = %q, want 2 addresses", resolver.RootServers)
+	}
+
+	cfg.RootServers = " , "
+	if _, err := newIterativeResolverFromConfig(cfg); err == nil {
+		t.Error("newIterativeResolverFromConfig() accepted an empty root server list")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LOC record constants (RFC 1876)
+const (
+	locRDataLength  = 16
+	locEquator      = 1 << 31  // latitude/longitude wire value of the equator and prime meridian
+	locAltitudeBase = 10000000 // altitudes are stored in cm above 100,000m below the WGS 84 ellipsoid
+	locMaxPrecision = 9 * 1000000000
+	locMaxDegrees   = 180 * 3600 * 1000
+)
+
+// Default LOC sizes in cm for fields omitted from the presentation format
+const (
+	DefaultLOCSize     = 100     // 1m
+	DefaultLOCHorizPre = 1000000 // 10km
+	DefaultLOCVertPre  = 1000    // 10m
+)
+
+// LOCData is the RDATA of a LOC record. Sizes are in centimeters; on the wire they
+// are stored as a single digit times a power of ten, so Marshal rounds them down.
+type LOCData struct {
+	Version   uint8  // always 0
+	Size      uint64 // diameter of a sphere enclosing the entity, in cm
+	HorizPre  uint64 // horizontal precision, in cm
+	VertPre   uint64 // vertical precision, in cm
+	Latitude  int64  // thousandths of an arc second, north positive
+	Longitude int64  // thousandths of an arc second, east positive
+	Altitude  int64  // cm relative to the WGS 84 reference ellipsoid
+}
+
+func (l *LOCData) MarshalBinary() ([]byte, error) {
+	if l.Version != 0 {
+		return nil, fmt.Errorf("unsupported LOC version %d", l.Version)
+	}
+	if l.Latitude < -90*3600*1000 || l.Latitude > 90*3600*1000 {
+		return nil, fmt.Errorf("LOC latitude %d out of range", l.Latitude)
+	}
+	if l.Longitude < -locMaxDegrees || l.Longitude > locMaxDegrees {
+		return nil, fmt.Errorf("LOC longitude %d out of range", l.Longitude)
+	}
+	altitude := l.Altitude + locAltitudeBase
+	if altitude < 0 || altitude > 0xFFFFFFFF {
+		return nil, fmt.Errorf("LOC altitude %d out of range", l.Altitude)
+	}
+
+	data := make([]byte, locRDataLength)
+	for i, cm := range []uint64{l.Size, l.HorizPre, l.VertPre} {
+		if cm > locMaxPrecision {
+			return nil, fmt.Errorf("LOC size %dcm out of range", cm)
+		}
+		data[1+i] = encodeLOCPrecision(cm)
+	}
+	binary.BigEndian.PutUint32(data[4:8], uint32(locEquator+l.Latitude))
+	binary.BigEndian.PutUint32(data[8:12], uint32(locEquator+l.Longitude))
+	binary.BigEndian.PutUint32(data[12:16], uint32(altitude))
+	return data, nil
+}
+
+func (l *LOCData) UnmarshalBinary(data []byte) error {
+	if len(data) != locRDataLength {
+		return fmt.Errorf("LOC RDATA is %d bytes, want %d", len(data), locRDataLength)
+	}
+	if data[0] != 0 {
+		return fmt.Errorf("unsupported LOC version %d", data[0])
+	}
+
+	var sizes [3]uint64
+	for i := range sizes {
+		cm, err := decodeLOCPrecision(data[1+i])
+		if err != nil {
+			return err
+		}
+		sizes[i] = cm
+	}
+
+	l.Version = 0
+	l.Size, l.HorizPre, l.VertPre = sizes[0], sizes[1], sizes[2]
+	l.Latitude = int64(binary.BigEndian.Uint32(data[4:8])) - locEquator
+	l.Longitude = int64(binary.BigEndian.Uint32(data[8:12])) - locEquator
+	l.Altitude = int64(binary.BigEndian.Uint32(data[12:16])) - locAltitudeBase
+	return nil
+}
+
+// String returns the presentation format, e.g. "51 30 12.748 N 0 7 39.611 W 0m 1m 10000m 10m"
+func (l *LOCData) String() string {
+	return fmt.Sprintf("%s %s %s %s %s %s",
+		formatLOCCoordinate(l.Latitude, 'N', 'S'),
+		formatLOCCoordinate(l.Longitude, 'E', 'W'),
+		formatMeters(l.Altitude),
+		formatMeters(int64(l.Size)),
+		formatMeters(int64(l.HorizPre)),
+		formatMeters(int64(l.VertPre)))
+}
+
+// ParseLOC parses the presentation format of LOC RDATA (RFC 1876 section 3):
+//
+//	d1 [m1 [s1]] {"N"|"S"} d2 [m2 [s2]] {"E"|"W"} alt["m"] [siz["m"] [hp["m"] [vp["m"]]]]
+func ParseLOC(s string) (LOCData, error) {
+	fields := strings.Fields(s)
+	loc := LOCData{Size: DefaultLOCSize, HorizPre: DefaultLOCHorizPre, VertPre: DefaultLOCVertPre}
+
+	latitude, fields, err := parseLOCCoordinate(fields, 90, 'N', 'S')
+	if err != nil {
+		return LOCData{}, fmt.Errorf("invalid LOC latitude: %w", err)
+	}
+	longitude, fields, err := parseLOCCoordinate(fields, 180, 'E', 'W')
+	if err != nil {
+		return LOCData{}, fmt.Errorf("invalid LOC longitude: %w", err)
+	}
+	loc.Latitude, loc.Longitude = latitude, longitude
+
+	if len(fields) == 0 {
+		return LOCData{}, fmt.Errorf("missing LOC altitude")
+	}
+	if loc.Altitude, err = parseMeters(fields[0]); err != nil {
+		return LOCData{}, fmt.Errorf("invalid LOC altitude: %w", err)
+	}
+	fields = fields[1:]
+
+	if len(fields) > 3 {
+		return LOCData{}, fmt.Errorf("unexpected LOC fields %q", fields[3:])
+	}
+	sizes := []*uint64{&loc.Size, &loc.HorizPre, &loc.VertPre}
+	for i, field := range fields {
+		cm, err := parseMeters(field)
+		if err != nil || cm < 0 || cm > locMaxPrecision {
+			return LOCData{}, fmt.Errorf("invalid LOC size %q", field)
+		}
+		*sizes[i] = uint64(cm)
+	}
+
+	if _, err := loc.MarshalBinary(); err != nil {
+		return LOCData{}, err
+	}
+	return loc, nil
+}
+
+// parseLOCCoordinate parses degrees, optional minutes and seconds, and a hemisphere
+// letter from the front of fields, returning thousandths of an arc second
+func parseLOCCoordinate(fields []string, maxDegrees int64, positive, negative byte) (int64, []string, error) {
+	var parts []string
+	for len(fields) > 0 && len(parts) < 4 {
+		field := fields[0]
+		fields = fields[1:]
+		if len(field) == 1 && (field[0] == positive || field[0] == negative) {
+			if len(parts) == 0 {
+				return 0, nil, fmt.Errorf("missing degrees")
+			}
+			value, err := locCoordinateValue(parts, maxDegrees)
+			if err != nil {
+				return 0, nil, err
+			}
+			if field[0] == negative {
+				value = -value
+			}
+			return value, fields, nil
+		}
+		parts = append(parts, field)
+	}
+	return 0, nil, fmt.Errorf("missing %c/%c hemisphere", positive, negative)
+}
+
+// locCoordinateValue converts degrees [minutes [seconds]] to thousandths of an arc second
+func locCoordinateValue(parts []string, maxDegrees int64) (int64, error) {
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("too many fields %q", parts)
+	}
+
+	degrees, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || degrees < 0 || degrees > maxDegrees {
+		return 0, fmt.Errorf("invalid degrees %q", parts[0])
+	}
+	var minutes, seconds int64
+	if len(parts) > 1 {
+		minutes, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || minutes < 0 || minutes >= 60 {
+			return 0, fmt.Errorf("invalid minutes %q", parts[1])
+		}
+	}
+	if len(parts) > 2 {
+		seconds, err = parseFixedPoint(parts[2], 3)
+		if err != nil || seconds < 0 || seconds >= 60*1000 {
+			return 0, fmt.Errorf("invalid seconds %q", parts[2])
+		}
+	}
+
+	value := (degrees*3600+minutes*60)*1000 + seconds
+	if value > maxDegrees*3600*1000 {
+		return 0, fmt.Errorf("%d degrees exceeded", maxDegrees)
+	}
+	return value, nil
+}
+
+// parseMeters parses a distance like "10", "-2.5m" or "0.01m" into centimeters
+func parseMeters(s string) (int64, error) {
+	return parseFixedPoint(strings.TrimSuffix(s, "m"), 2)
+}
+
+// parseFixedPoint parses a decimal number with at most places fractional digits,
+// scaled by 10^places so no precision is lost to floating point
+func parseFixedPoint(s string, places int) (int64, error) {
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if len(frac) > places || (hasFrac && frac == "") {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	negative := strings.HasPrefix(whole, "-")
+	if negative {
+		whole = whole[1:]
+	}
+	if whole == "" || strings.HasPrefix(whole, "+") {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+
+	value, err := strconv.ParseInt(whole+frac+strings.Repeat("0", places-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	if negative {
+		value = -value
+	}
+	return value, nil
+}
+
+// encodeLOCPrecision encodes cm as a mantissa and power of ten exponent in one byte, rounding down
+func encodeLOCPrecision(cm uint64) uint8 {
+	exponent := uint8(0)
+	power := uint64(1)
+	for exponent < 9 && cm >= power*10 {
+		exponent++
+		power *= 10
+	}
+	mantissa := min(cm/power, 9)
+	return uint8(mantissa)<<4 | exponent
+}
+
+// decodeLOCPrecision decodes a size or precision byte into cm
+func decodeLOCPrecision(b uint8) (uint64, error) {
+	mantissa, exponent := uint64(b>>4), int(b&0x0F)
+	if mantissa > 9 || exponent > 9 {
+		return 0, fmt.Errorf("invalid LOC precision byte %#02x", b)
+	}
+	for ; exponent > 0; exponent-- {
+		mantissa *= 10
+	}
+	return mantissa, nil
+}
+
+// formatLOCCoordinate formats thousandths of an arc second as "d m s.sss H"
+func formatLOCCoordinate(value int64, positive, negative byte) string {
+	hemisphere := positive
+	if value < 0 {
+		hemisphere = negative
+		value = -value
+	}
+	degrees := value / 3600000
+	minutes := value / 60000 % 60
+	seconds := value % 60000
+	return fmt.Sprintf("%d %d %d.%03d %c", degrees, minutes, seconds/1000, seconds%1000, hemisphere)
+}
+
+// formatMeters formats centimeters as meters, e.g. "10m" or "-2.50m"
+func formatMeters(cm int64) string {
+	sign := ""
+	if cm < 0 {
+		sign = "-"
+		cm = -cm
+	}
+	if cm%100 == 0 {
+		return fmt.Sprintf("%s%dm", sign, cm/100)
+	}
+	return fmt.Sprintf("%s%d.%02dm", sign, cm/100, cm%100)
+}
@@ -0,0 +1,137 @@
+package main
+
+import "testing"
+
+func TestLOCData_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  LOCData
+	}{
+		{
+			"RFC 1876 example",
+			"51 30 12.748 N 0 7 39.611 W 0.00m 1m 10000m 10m",
+			LOCData{
+				Size: 100, HorizPre: 1000000, VertPre: 1000,
+				Latitude:  (51*3600+30*60)*1000 + 12748,
+				Longitude: -((7 * 60 * 1000) + 39611),
+			},
+		},
+		{
+			"defaults for omitted sizes",
+			"42 21 54 N 71 06 18 W -24m",
+			LOCData{
+				Size: DefaultLOCSize, HorizPre: DefaultLOCHorizPre, VertPre: DefaultLOCVertPre,
+				Latitude:  (42*3600 + 21*60 + 54) * 1000,
+				Longitude: -(71*3600 + 6*60 + 18) * 1000,
+				Altitude:  -2400,
+			},
+		},
+		{
+			"degrees only",
+			"90 S 180 E 42849672.95m 20m",
+			LOCData{
+				Size: 2000, HorizPre: DefaultLOCHorizPre, VertPre: DefaultLOCVertPre,
+				Latitude:  -90 * 3600 * 1000,
+				Longitude: 180 * 3600 * 1000,
+				Altitude:  4284967295,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := ParseLOC(tt.input)
+			if err != nil {
+				t.Fatalf("ParseLOC() failed: %v", err)
+			}
+			if loc != tt.want {
+				t.Fatalf("ParseLOC() = %+v, want %+v", loc, tt.want)
+			}
+
+			data, err := loc.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+			if len(data) != 16 {
+				t.Fatalf("MarshalBinary() produced %d bytes, want 16", len(data))
+			}
+			var decoded LOCData
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() failed: %v", err)
+			}
+			if decoded != loc {
+				t.Errorf("Wire round trip = %+v, want %+v", decoded, loc)
+			}
+
+			reparsed, err := ParseLOC(loc.String())
+			if err != nil {
+				t.Fatalf("ParseLOC(%q) failed: %v", loc.String(), err)
+			}
+			if reparsed != loc {
+				t.Errorf("Presentation round trip of %q = %+v, want %+v", loc.String(), reparsed, loc)
+			}
+		})
+	}
+}
+
+func TestLOCData_PrecisionEncoding(t *testing.T) {
+	tests := []struct {
+		cm   uint64
+		want uint8
+	}{
+		{0, 0x00},
+		{100, 0x12},     // 1m
+		{1000000, 0x16}, // 10km
+		{1500, 0x13},    // 15m rounds down to 10m
+		{9000000000, 0x99},
+	}
+
+	for _, tt := range tests {
+		if got := encodeLOCPrecision(tt.cm); got != tt.want {
+			t.Errorf("encodeLOCPrecision(%d) = %#02x, want %#02x", tt.cm, got, tt.want)
+		}
+	}
+}
+
+func TestLOCData_Invalid(t *testing.T) {
+	valid, err := (&LOCData{Size: 100}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	badVersion := append([]byte(nil), valid...)
+	badVersion[0] = 1
+	badPrecision := append([]byte(nil), valid...)
+	badPrecision[1] = 0xA0
+
+	wireTests := map[string][]byte{
+		"version 1":       badVersion,
+		"mantissa over 9": badPrecision,
+		"short":           valid[:15],
+	}
+	for name, data := range wireTests {
+		var loc LOCData
+		if err := loc.UnmarshalBinary(data); err == nil {
+			t.Errorf("UnmarshalBinary() accepted %s RDATA", name)
+		}
+	}
+
+	for _, input := range []string{
+		"",
+		"51 30 N",
+		"91 N 0 E 0m",
+		"51 60 N 0 E 0m",
+		"51 30 60 N 0 E 0m",
+		"51 N 181 E 0m",
+		"51 N 0 E",
+		"51 N 0 E 0m 1m 1m 1m 1m",
+		"51 N 0 E 0m -1m",
+		"51 N 0 E 0.001m",
+		"51 N 0 E -100000.01m",
+	} {
+		if loc, err := ParseLOC(input); err == nil {
+			t.Errorf("ParseLOC(%q) = %+v, want an error", input, loc)
+		}
+	}
+}
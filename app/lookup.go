@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// LookupA asks the DNS server at server (host:port) for the IPv4 addresses of
+// name, following CNAMEs, like net.Resolver.LookupIP without the system resolver
+func LookupA(ctx context.Context, server, name string) ([]net.IP, error) {
+	return lookupIP(ctx, server, name, RecordTypeA)
+}
+
+// LookupAAAA is like LookupA for IPv6 addresses
+func LookupAAAA(ctx context.Context, server, name string) ([]net.IP, error) {
+	return lookupIP(ctx, server, name, RecordTypeAAAA)
+}
+
+// lookupIP resolves name to addresses of qtype. A CNAME whose target isn't in
+// the same reply is looked up again, up to MaxCNAMEChain times.
+func lookupIP(ctx context.Context, server, name string, qtype uint16) ([]net.IP, error) {
+	upstream := NewUpstream(server)
+	defer upstream.Pool.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		upstream.Timeout = time.Until(deadline)
+	}
+
+	target := strings.TrimSuffix(name, ".")
+	for range MaxCNAMEChain + 1 {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("lookup %s: %w", name, err)
+		}
+		reply, err := upstream.ExchangeMessage(Question{Name: target, Type: qtype, Class: ClassIN})
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s: %w", name, err)
+		}
+		if rcode := reply.Header.GetRcode(); rcode != RCodeNoError {
+			return nil, fmt.Errorf("lookup %s: server answered with rcode %d", name, rcode)
+		}
+
+		ips, next := addressAnswers(reply.Answers, target, qtype)
+		if len(ips) > 0 {
+			return ips, nil
+		}
+		if next == target {
+			return nil, fmt.Errorf("lookup %s: no %s records", name, TypeName(qtype))
+		}
+		target = next
+	}
+	return nil, fmt.Errorf("lookup %s: more than %d CNAMEs", name, MaxCNAMEChain)
+}
+
+// addressAnswers follows the CNAME chain from name through answers and returns
+// the addresses of qtype at its end, along with the name the chain ended at
+func addressAnswers(answers []ResourceRecord, name string, qtype uint16) ([]net.IP, string) {
+	for range MaxCNAMEChain {
+		next := ""
+		for _, rr := range answers {
+			if rr.Type == RecordTypeCNAME && strings.EqualFold(rr.Name, name) {
+				next, _, _ = decodeDNSName(rr.RData, 0)
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	var ips []net.IP
+	for _, rr := range answers {
+		if rr.Type != qtype || !strings.EqualFold(rr.Name, name) {
+			continue
+		}
+		if ip, err := rr.Decode(); err == nil {
+			ips = append(ips, ip.(net.IP))
+		}
+	}
+	return ips, name
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLookupA(t *testing.T) {
+	addr, _ := StartTestServer(t, WithStore(NewMemoryStore(map[string]HostEntry{
+		"multi.example.test": {
+			A:    []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)},
+			AAAA: []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")},
+		},
+		"alias.example.test": {CNAME: "multi.example.test"},
+	})))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		lookup func(context.Context, string, string) ([]net.IP, error)
+		host   string
+		want   []net.IP
+	}{
+		{"A", LookupA, "multi.example.test", []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)}},
+		{"AAAA", LookupAAAA, "multi.example.test", []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}},
+		{"A through CNAME", LookupA, "alias.example.test.", []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, err := tt.lookup(ctx, addr, tt.host)
+			if err != nil {
+				t.Fatalf("Lookup(%s) failed: %v", tt.host, err)
+			}
+			if len(ips) != len(tt.want) {
+				t.Fatalf("Lookup(%s) = %v, want %v", tt.host, ips, tt.want)
+			}
+			for i := range ips {
+				if !ips[i].Equal(tt.want[i]) {
+					t.Errorf("Lookup(%s)[%d] = %v, want %v", tt.host, i, ips[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := LookupA(ctx, addr, "missing.example.test"); err == nil {
+		t.Error("LookupA() of a missing name succeeded, want error")
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := LookupA(canceled, addr, "multi.example.test"); err == nil {
+		t.Error("LookupA() with a canceled context succeeded, want error")
+	}
+}
+
+func TestLookupA_FollowsCNAMEAcrossQueries(t *testing.T) {
+	// The upstream answers the alias with only the CNAME, so the target needs a query of its own
+	var target bytes.Buffer
+	encodeDNSName("target.example.test", &target)
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		q := query.Questions[0]
+		if q.Name != "alias.example.test" {
+			return []Message{fakeReply(query, q, []byte{198, 51, 100, 7})}
+		}
+		reply := fakeReply(query, Question{Name: q.Name, Type: RecordTypeCNAME, Class: q.Class}, nil)
+		reply.Questions = []Question{q}
+		reply.Answers = []ResourceRecord{{Name: q.Name, Type: RecordTypeCNAME, Class: ClassIN, TTL: 30, RData: target.Bytes()}}
+		reply.Header.ANCount = 1
+		return []Message{reply}
+	})
+
+	ips, err := LookupA(context.Background(), addr, "alias.example.test")
+	if err != nil {
+		t.Fatalf("LookupA() failed: %v", err)
+	}
+	if want := []net.IP{{198, 51, 100, 7}}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("LookupA() = %v, want %v", ips, want)
+	}
+}
@@ -1,17 +1,37 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "parse" {
+		os.Exit(runParse(os.Args[2:], os.Stdout))
+	}
+
 	// You can use print statements as follows for debugging, they'll be visible when running tests.
 	fmt.Println("Logs from your program will appear here!")
 
-	// Uncomment this block to pass the first stage
-	//
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
+	cfg, err := ParseConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println("Failed to parse flags:", err)
+		os.Exit(2)
+	}
+
+	if err := ValidateCNAMEs(defaultStore.Snapshot(), MaxCNAMEChain); err != nil {
+		fmt.Println("Failed to load records:", err)
+		os.Exit(1)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Addr)
 	if err != nil {
 		fmt.Println("Failed to resolve UDP address:", err)
 		return
@@ -24,44 +44,163 @@ func main() {
 	}
 	defer udpConn.Close()
 
-	buf := make([]byte, MaxDNSPacketSize)
-
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
+	stats := NewQueryStats(DefaultStatsCapacity)
+	collectors := []MetricsCollector{stats}
+	drain := NewDrain(cfg.DrainRcode)
+	admin := &Admin{Stats: stats}
+	opts := []HandlerOption{WithConfig(cfg), WithStats(stats), WithMiddleware(drain.Middleware())}
+	if cfg.ShuffleAnswers {
+		seed := uint64(time.Now().UnixNano())
+		opts = append(opts, WithShuffler(NewShuffler(rand.NewPCG(seed, seed>>32))))
+	}
+	if cfg.NameQPS > 0 {
+		opts = append(opts, WithNameBudget(NewNameBudget(cfg.NameQPS)))
+	}
+	if cfg.RootHints != "" {
+		hints, err := LoadRootHints(cfg.RootHints)
 		if err != nil {
-			fmt.Println("Error receiving data:", err)
-			break
+			fmt.Println("Failed to load root hints:", err)
+			os.Exit(1)
 		}
+		opts = append(opts, WithRootHints(hints))
+	}
+	if cfg.RPZFile != "" {
+		rpz, err := LoadRPZ(cfg.RPZFile)
+		if err != nil {
+			fmt.Println("Failed to load response policy zone:", err)
+			os.Exit(1)
+		}
+		opts = append(opts, WithRPZ(rpz))
+	}
+	if cfg.Resolver != "" {
+		fmt.Printf("Forwarding queries to %s\n", cfg.Resolver)
+		upstreams, err := newUpstreamSetFromConfig(cfg)
+		if err != nil {
+			fmt.Println("Failed to configure upstream:", err)
+			return
+		}
+		defer upstreams.Close()
+		if cfg.HealthInterval > 0 {
+			stop := upstreams.StartHealthChecks(cfg.HealthInterval)
+			defer stop()
+		}
+		collectors = append(collectors, upstreams)
+		admin.Cache = NewCachingForwarder(NewCoalescingForwarder(upstreams), DefaultCacheCapacity)
+	} else if cfg.RootServers != "" {
+		fmt.Printf("Resolving iteratively from root servers %s\n", cfg.RootServers)
+		resolver, err := newIterativeResolverFromConfig(cfg)
+		if err != nil {
+			fmt.Println("Failed to configure iterative resolver:", err)
+			return
+		}
+		admin.Cache = NewCachingForwarder(NewCoalescingForwarder(resolver), DefaultCacheCapacity)
+	}
+	if cache := admin.Cache; cache != nil {
+		cache.ServeStale = cfg.ServeStale
+		cache.StaleMaxAge = cfg.StaleMaxAge
+		opts = append(opts, WithUpstream(cache))
+		if cfg.CacheFile != "" {
+			if n, err := cache.LoadFile(cfg.CacheFile); err != nil {
+				fmt.Println("Failed to load cache:", err)
+			} else {
+				fmt.Printf("Loaded %d cached answers from %s\n", n, cfg.CacheFile)
+			}
+			defer func() {
+				if err := cache.SaveFile(cfg.CacheFile); err != nil {
+					fmt.Println("Failed to save cache:", err)
+				}
+			}()
+		}
+	}
 
-		receivedData := buf[:size]
-		fmt.Printf("Received %d bytes from %s\n", size, source)
-		fmt.Printf("Raw request data: %x\n", receivedData)
+	if cfg.MetricsAddr != "" {
+		metricsServer := NewMetricsServer(cfg.MetricsAddr, collectors...)
+		defer metricsServer.Close()
 
-		// Basic validation: DNS messages must be at least header size
-		if size < DNSHeaderSize {
-			fmt.Printf("Packet too small: %d bytes (minimum %d required)\n", size, DNSHeaderSize)
-			continue
+		fmt.Printf("Serving metrics on %s%s\n", cfg.MetricsAddr, MetricsPath)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Println("Metrics server stopped:", err)
+			}
+		}()
+	}
+
+	if cfg.ControlAddr != "" {
+		// Records are compiled in, so reloading rechecks them and drops cached
+		// answers that may predate changes made through the control plane
+		admin.Reload = func() error {
+			if err := ValidateCNAMEs(defaultStore.Snapshot(), MaxCNAMEChain); err != nil {
+				return err
+			}
+			if admin.Cache != nil {
+				admin.Cache.Flush()
+			}
+			return nil
 		}
+		controlServer := NewControlServer(cfg.ControlAddr, defaultStore, drain, admin, cfg.ControlToken)
+		defer controlServer.Close()
 
-		fmt.Println("--- Processing DNS Request ---")
+		fmt.Printf("Serving ACME control plane, drain switch and admin commands on %s\n", cfg.ControlAddr)
+		go func() {
+			if err := controlServer.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Println("Control plane stopped:", err)
+			}
+		}()
+	}
 
-		// Process the DNS request
-		handler := NewDNSHandler(receivedData)
-		response, err := handler.Handle()
+	if cfg.TLSAddr != "" {
+		tlsListener, err := ListenTLS(cfg.TLSAddr, cfg.CertFile, cfg.KeyFile)
 		if err != nil {
-			fmt.Printf("Failed to handle DNS request: %v\n", err)
-			continue
+			fmt.Println("Failed to start DNS-over-TLS listener:", err)
+			return
 		}
+		defer tlsListener.Close()
 
-		fmt.Printf("Sending %d bytes response back to %s\n", len(response), source)
-		fmt.Printf("Raw response data: %x\n", response)
+		fmt.Printf("Serving DNS-over-TLS on %s\n", tlsListener.Addr())
+		go func() {
+			if err := serveStreamListener(tlsListener, cfg.TCPIdleTimeout, opts); err != nil {
+				fmt.Println("DNS-over-TLS listener stopped:", err)
+			}
+		}()
+	}
 
-		// Send response back to client
-		_, err = udpConn.WriteToUDP(response, source)
-		if err != nil {
-			fmt.Println("Failed to send response:", err)
+	if cfg.DoHAddr != "" {
+		dohServer := NewDoHServer(cfg.DoHAddr, opts)
+		defer dohServer.Close()
+
+		fmt.Printf("Serving DNS-over-HTTPS on %s%s\n", cfg.DoHAddr, DoHPath)
+		go func() {
+			if err := dohServer.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile); err != http.ErrServerClosed {
+				fmt.Println("DNS-over-HTTPS server stopped:", err)
+			}
+		}()
+	}
+
+	// Plain TCP on the same address takes the retries of clients told to by TC=1
+	tcpListener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fmt.Println("Failed to start TCP listener:", err)
+		return
+	}
+	defer tcpListener.Close()
+
+	fmt.Printf("Serving DNS over TCP on %s\n", tcpListener.Addr())
+	go func() {
+		if err := serveStreamListener(tcpListener, cfg.TCPIdleTimeout, opts); err != nil {
+			fmt.Println("TCP listener stopped:", err)
 		}
+	}()
+
+	// Closing the socket on SIGINT or SIGTERM stops serving and lets the deferred
+	// cleanup, such as saving the cache, run
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		fmt.Printf("Received %s, shutting down\n", <-signals)
+		udpConn.Close()
+	}()
 
-		fmt.Println("--- Request completed ---")
+	if err := serveUDP(udpConn, opts); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Println("Error receiving data:", err)
 	}
 }
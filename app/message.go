@@ -11,9 +11,12 @@ import (
 const (
 	MaxLabelLength      = 63
 	MaxDomainLength     = 253
-	CompressionMask     = 0xC0   // 11000000 - identifies a compression pointer
-	CompressionOffset   = 0x3FFF // 00111111 11111111 - mask for 14-bit offset
-	MaxCompressionJumps = 5      // Prevent infinite loops in compression
+	CompressionMask     = 0xC0      // 11000000 - identifies a compression pointer
+	CompressionOffset   = 0x3FFF    // 00111111 11111111 - mask for 14-bit offset
+	MaxCompressionJumps = 5         // pointers followed decoding one name, bounding loops and chains
+	MinQuestionSize     = 5         // root name + type + class
+	MinRecordSize       = 11        // root name + type + class + TTL + RDLENGTH
+	MaxTTL              = 1<<31 - 1 // largest TTL, the top bit being reserved (RFC 2181 section 8)
 )
 
 // CompressionMap tracks domain name positions for compression
@@ -26,6 +29,7 @@ func encodeDNSName(name string, buf *bytes.Buffer) error {
 }
 
 // encodeDNSNameWithCompression encodes a domain name with optional compression.
+// A nil compressionMap writes the name in full and remembers nothing.
 func encodeDNSNameWithCompression(name string, buf *bytes.Buffer, compressionMap CompressionMap) error {
 	if len(name) > MaxDomainLength {
 		return fmt.Errorf("domain name too long: %d bytes (max %d)", len(name), MaxDomainLength)
@@ -39,18 +43,24 @@ func encodeDNSNameWithCompression(name string, buf *bytes.Buffer, compressionMap
 			continue // Should not happen with well-formed domains, but good to guard.
 		}
 
-		if offset, found := compressionMap[suffix]; found {
-			// This suffix has been seen before. Write a pointer and we're done.
-			pointer := 0xC000 | (offset & 0x3FFF)
-			if err := binary.Write(buf, binary.BigEndian, uint16(pointer)); err != nil {
-				return fmt.Errorf("failed to write compression pointer for suffix %s: %w", suffix, err)
+		if compressionMap != nil {
+			// A pointer holds only 14 bits of offset, so a suffix written past
+			// CompressionOffset can't be pointed to and is written out again instead
+			if offset, found := compressionMap[suffix]; found && offset <= CompressionOffset {
+				// This suffix has been seen before. Write a pointer and we're done.
+				pointer := 0xC000 | offset
+				if err := binary.Write(buf, binary.BigEndian, uint16(pointer)); err != nil {
+					return fmt.Errorf("failed to write compression pointer for suffix %s: %w", suffix, err)
+				}
+				return nil
 			}
-			return nil
-		}
 
-		// This suffix is new. Record its current position before writing the next label.
-		// The position is relative to the start of the message (offset 0).
-		compressionMap[suffix] = buf.Len()
+			// This suffix is new. Record its current position before writing the next label.
+			// The position is relative to the start of the message (offset 0).
+			if buf.Len() <= CompressionOffset {
+				compressionMap[suffix] = buf.Len()
+			}
+		}
 
 		label := labels[i]
 		if len(label) > MaxLabelLength {
@@ -73,8 +83,9 @@ func decodeDNSName(data []byte, offset int) (string, int, error) {
 	return decodeDNSNameWithCompression(data, offset, 0)
 }
 
-// decodeDNSNameWithCompression decodes a DNS name with compression pointer support
-// jumps parameter tracks compression jumps to prevent infinite loops
+// decodeDNSNameWithCompression decodes a DNS name with compression pointer support.
+// jumps counts the pointers followed to reach offset, so a name reached through a
+// chain of more than MaxCompressionJumps pointers is rejected, loop or not.
 func decodeDNSNameWithCompression(data []byte, offset int, jumps int) (string, int, error) {
 	if offset >= len(data) {
 		return "", 0, fmt.Errorf("offset %d exceeds data length %d", offset, len(data))
@@ -152,31 +163,57 @@ func decodeDNSNameWithCompression(data []byte, offset int, jumps int) (string, i
 		}
 	}
 
+	// Pointers can splice together names that are each within the limit on their own
+	name := strings.Join(nameParts, ".")
+	if len(name) > MaxDomainLength {
+		return "", 0, fmt.Errorf("domain name too long: %d bytes (max %d)", len(name), MaxDomainLength)
+	}
+
 	// Return the saved offset if we encountered a compression pointer
 	// Otherwise return the current position
 	if savedOffset != -1 {
 		i = savedOffset
 	}
 
-	return strings.Join(nameParts, "."), i, nil
+	return name, i, nil
 }
 
 // header, question, answer, authority, and an additional space.
 type Message struct {
-	Header    MessageHeader
-	Questions []Question
-	Answers   []ResourceRecord
-	// Authority  []ResourceRecord
-	// Additional []ResourceRecord
+	Header     MessageHeader
+	Questions  []Question
+	Answers    []ResourceRecord
+	Authority  []ResourceRecord
+	Additional []ResourceRecord
+	EDNS       *OPTRecord // OPT pseudo-record, not counted in Header or kept in Additional
+}
+
+// MarshalOptions controls how a message is encoded
+type MarshalOptions struct {
+	NoCompression bool // write every name in full, never using compression pointers
 }
 
 // MarshalBinary serializes the entire DNS message with compression support
 func (m *Message) MarshalBinary() ([]byte, error) {
+	return m.MarshalWithOptions(MarshalOptions{})
+}
+
+// MarshalWithOptions encodes the message like MarshalBinary, as opts says
+func (m *Message) MarshalWithOptions(opts MarshalOptions) ([]byte, error) {
 	buf := new(bytes.Buffer)
-	compressionMap := make(CompressionMap)
+	var compressionMap CompressionMap
+	if !opts.NoCompression {
+		compressionMap = make(CompressionMap)
+	}
 
-	// Marshal header. We'll overwrite it later if needed, but this reserves the space.
-	headerData, err := m.Header.MarshalBinary()
+	// Marshal header. The OPT record goes last in the additional section.
+	header := m.Header
+	additional := m.Additional
+	if m.EDNS != nil {
+		header.ARCount++
+		additional = append(m.Additional[:len(m.Additional):len(m.Additional)], m.EDNS.ResourceRecord())
+	}
+	headerData, err := header.MarshalBinary()
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal header: %w", err)
 	}
@@ -195,99 +232,282 @@ func (m *Message) MarshalBinary() ([]byte, error) {
 		}
 	}
 
-	// Marshal answers with compression
-	for i, rr := range m.Answers {
-		if err := encodeDNSNameWithCompression(rr.Name, buf, compressionMap); err != nil {
-			return nil, fmt.Errorf("failed to encode answer %d name: %w", i, err)
-		}
-		if err := binary.Write(buf, binary.BigEndian, rr.Type); err != nil {
-			return nil, fmt.Errorf("failed to write answer type: %w", err)
-		}
-		if err := binary.Write(buf, binary.BigEndian, rr.Class); err != nil {
-			return nil, fmt.Errorf("failed to write answer class: %w", err)
-		}
-		if err := binary.Write(buf, binary.BigEndian, rr.TTL); err != nil {
-			return nil, fmt.Errorf("failed to write answer TTL: %w", err)
-		}
-		if err := binary.Write(buf, binary.BigEndian, uint16(len(rr.RData))); err != nil {
-			return nil, fmt.Errorf("failed to write answer RDLENGTH: %w", err)
-		}
-		if _, err := buf.Write(rr.RData); err != nil {
-			return nil, fmt.Errorf("failed to write answer RDATA: %w", err)
+	// Marshal answer, authority and additional records with compression.
+	// All sections share one buffer and compression map, so later records can
+	// point at names anywhere earlier in the message.
+	sections := []struct {
+		name    string
+		records []ResourceRecord
+	}{
+		{"answer", m.Answers},
+		{"authority", m.Authority},
+		{"additional", additional},
+	}
+	for _, section := range sections {
+		for i := range section.records {
+			if err := marshalRecord(buf, &section.records[i], compressionMap); err != nil {
+				return nil, fmt.Errorf("failed to marshal %s %d: %w", section.name, i, err)
+			}
 		}
 	}
 
 	return buf.Bytes(), nil
 }
 
-// UnmarshalBinary deserializes a DNS message with compression support
-func (m *Message) UnmarshalBinary(data []byte) error {
-	if len(data) < DNSHeaderSize {
-		return fmt.Errorf("data too short for DNS message: %d bytes", len(data))
+// marshalRecord writes a single resource record into buf using compressionMap
+func marshalRecord(buf *bytes.Buffer, rr *ResourceRecord, compressionMap CompressionMap) error {
+	if err := encodeDNSNameWithCompression(rr.Name, buf, compressionMap); err != nil {
+		return fmt.Errorf("failed to encode name: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, rr.Type); err != nil {
+		return fmt.Errorf("failed to write type: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, rr.Class); err != nil {
+		return fmt.Errorf("failed to write class: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, rr.TTL); err != nil {
+		return fmt.Errorf("failed to write TTL: %w", err)
 	}
 
-	// Unmarshal header
-	if err := m.Header.UnmarshalBinary(data[:DNSHeaderSize]); err != nil {
-		return fmt.Errorf("failed to unmarshal header: %w", err)
+	// Reserve RDLENGTH and backpatch it once the RDATA is written, since
+	// compressed names make the on-wire length differ from len(rr.RData)
+	lengthOffset := buf.Len()
+	buf.Write([]byte{0, 0})
+	if err := writeRData(buf, rr, compressionMap); err != nil {
+		return fmt.Errorf("failed to write RDATA: %w", err)
 	}
+	rdLength := buf.Len() - lengthOffset - 2
+	if rdLength > 0xFFFF {
+		return fmt.Errorf("RDATA too long: %d bytes", rdLength)
+	}
+	binary.BigEndian.PutUint16(buf.Bytes()[lengthOffset:], uint16(rdLength))
+	return nil
+}
 
-	offset := DNSHeaderSize
+// RDataField is one field of an RDATA layout: a domain name, or Fixed opaque bytes
+type RDataField struct {
+	Name  bool
+	Fixed int
+}
 
-	// Unmarshal questions
-	m.Questions = make([]Question, m.Header.QDCount)
-	for i := uint16(0); i < m.Header.QDCount; i++ {
-		name, bytesRead, err := decodeDNSName(data, offset)
-		if err != nil {
-			return fmt.Errorf("failed to decode question %d name: %w", i, err)
-		}
+// RDataLayout describes where the domain names are in a type's RDATA, which is all
+// the generic record path needs to know to move it between messages intact
+type RDataLayout struct {
+	Fields   []RDataField
+	Compress bool // names may be compressed on output (RFC 1035 types only, RFC 3597 section 4)
+}
 
-		// The bytesRead from decodeDNSName tells us the new position AFTER the name
-		nameEndOffset := bytesRead
+var (
+	nameField = RDataField{Name: true}
 
-		if nameEndOffset+4 > len(data) {
-			return fmt.Errorf("data too short for question %d type/class: need %d bytes, have %d", i, nameEndOffset+4, len(data))
-		}
+	// rdataLayouts holds the layouts of types with names in their RDATA, as
+	// given by their codecs when registered. Types without a layout, including
+	// ones we know nothing about, are opaque and carried byte for byte (RFC 3597).
+	rdataLayouts = map[uint16]RDataLayout{}
+)
 
-		m.Questions[i] = Question{
-			Name:  name,
-			Type:  binary.BigEndian.Uint16(data[nameEndOffset : nameEndOffset+2]),
-			Class: binary.BigEndian.Uint16(data[nameEndOffset+2 : nameEndOffset+4]),
+// writeRData writes the RDATA of rr into buf. Names inside the RDATA of types
+// whose layout allows it are compressed against the rest of the message; all
+// other RDATA is written verbatim.
+func writeRData(buf *bytes.Buffer, rr *ResourceRecord, compressionMap CompressionMap) error {
+	layout, found := rdataLayouts[rr.Type]
+	if !found || !layout.Compress {
+		if found && compressionMap != nil {
+			rememberRDataNames(rr.RData, layout, buf.Len(), compressionMap)
 		}
-		offset = nameEndOffset + 4
+		_, err := buf.Write(rr.RData)
+		return err
 	}
 
-	// Unmarshal answers
-	m.Answers = make([]ResourceRecord, m.Header.ANCount)
-	for i := uint16(0); i < m.Header.ANCount; i++ {
-		name, nameEndOffset, err := decodeDNSName(data, offset)
+	offset := 0
+	for _, field := range layout.Fields {
+		if !field.Name {
+			if offset+field.Fixed > len(rr.RData) {
+				return fmt.Errorf("%s RDATA too short: %d bytes", TypeName(rr.Type), len(rr.RData))
+			}
+			buf.Write(rr.RData[offset : offset+field.Fixed])
+			offset += field.Fixed
+			continue
+		}
+		name, next, err := decodeDNSName(rr.RData, offset)
 		if err != nil {
-			return fmt.Errorf("failed to decode answer %d name: %w", i, err)
+			return fmt.Errorf("failed to decode %s RDATA name: %w", TypeName(rr.Type), err)
 		}
-
-		if nameEndOffset+10 > len(data) {
-			return fmt.Errorf("data too short for answer %d fields", i)
+		if err := encodeDNSNameWithCompression(name, buf, compressionMap); err != nil {
+			return err
 		}
+		offset = next
+	}
+	if offset != len(rr.RData) {
+		return fmt.Errorf("unexpected %d bytes after %s RDATA", len(rr.RData)-offset, TypeName(rr.Type))
+	}
+	return nil
+}
 
-		rr := ResourceRecord{
-			Name:     name,
-			Type:     binary.BigEndian.Uint16(data[nameEndOffset : nameEndOffset+2]),
-			Class:    binary.BigEndian.Uint16(data[nameEndOffset+2 : nameEndOffset+4]),
-			TTL:      binary.BigEndian.Uint32(data[nameEndOffset+4 : nameEndOffset+8]),
-			RDLength: binary.BigEndian.Uint16(data[nameEndOffset+8 : nameEndOffset+10]),
+// rememberRDataNames records in compressionMap where the names of RDATA written
+// in full at base are, so names written later can point at them
+func rememberRDataNames(rdata []byte, layout RDataLayout, base int, compressionMap CompressionMap) {
+	offset := 0
+	for _, field := range layout.Fields {
+		if !field.Name {
+			offset += field.Fixed
+			continue
 		}
-		offset = nameEndOffset + 10
+		_, next, err := decodeDNSName(rdata, offset)
+		if err != nil {
+			return // writing it verbatim doesn't care, and nothing will point at it
+		}
+		for pos := offset; pos < next && rdata[pos] != 0 && rdata[pos] < CompressionMask && base+pos <= CompressionOffset; pos += 1 + int(rdata[pos]) {
+			suffix, _, err := decodeDNSName(rdata, pos)
+			if err != nil {
+				return
+			}
+			if _, found := compressionMap[suffix]; !found {
+				compressionMap[suffix] = base + pos
+			}
+		}
+		offset = next
+	}
+}
 
-		if offset+int(rr.RDLength) > len(data) {
-			return fmt.Errorf("data too short for answer %d RData", i)
+// expandRData returns a copy of the RDATA at msg[start:end] with any compressed
+// names expanded, so the record no longer depends on the message it came from.
+// RDATA of types without a layout is copied unchanged.
+func expandRData(msg []byte, rrType uint16, start, end int) ([]byte, error) {
+	layout, found := rdataLayouts[rrType]
+	if !found {
+		rdata := make([]byte, end-start)
+		copy(rdata, msg[start:end])
+		return rdata, nil
+	}
+
+	buf := new(bytes.Buffer)
+	offset := start
+	for _, field := range layout.Fields {
+		if !field.Name {
+			if offset+field.Fixed > end {
+				return nil, fmt.Errorf("%s RDATA too short: %d bytes", TypeName(rrType), end-start)
+			}
+			buf.Write(msg[offset : offset+field.Fixed])
+			offset += field.Fixed
+			continue
+		}
+		name, next, err := decodeDNSName(msg, offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand RDATA of type %d: %w", rrType, err)
+		}
+		if next > end {
+			return nil, fmt.Errorf("failed to expand RDATA of type %d: RDATA name runs past RDLENGTH", rrType)
 		}
+		if err := encodeDNSName(name, buf); err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+	if offset != end {
+		return nil, fmt.Errorf("RDATA of type %d has %d unexpected trailing bytes", rrType, end-offset)
+	}
+	return buf.Bytes(), nil
+}
 
-		rr.RData = make([]byte, rr.RDLength)
-		copy(rr.RData, data[offset:offset+int(rr.RDLength)])
-		offset += int(rr.RDLength)
+// UnmarshalBinary deserializes a DNS message with compression support.
+// Bytes after the last declared record are ignored.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	_, err := m.unmarshal(data)
+	return err
+}
 
-		m.Answers[i] = rr
+// UnmarshalBinaryStrict is like UnmarshalBinary but rejects messages with
+// trailing bytes after the last record of the declared sections
+func (m *Message) UnmarshalBinaryStrict(data []byte) error {
+	end, err := m.unmarshal(data)
+	if err != nil {
+		return err
+	}
+	if end != len(data) {
+		return fmt.Errorf("%d unexpected trailing bytes after offset %d", len(data)-end, end)
 	}
+	return nil
+}
 
+// unmarshal parses the message and returns the offset just past its last record
+func (m *Message) unmarshal(data []byte) (int, error) {
+	p := NewParser(data)
+
+	header, err := p.ReadHeader()
+	if err != nil {
+		return 0, fmt.Errorf("failed to unmarshal header: %w", err)
+	}
+	m.Header = header
+
+	if m.Questions, err = p.ReadQuestions(m.Header.QDCount); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal questions: %w", err)
+	}
+
+	// Unmarshal answer, authority and additional records
+	sections := []struct {
+		name    string
+		count   uint16
+		records *[]ResourceRecord
+	}{
+		{"answer", m.Header.ANCount, &m.Answers},
+		{"authority", m.Header.NSCount, &m.Authority},
+		{"additional", m.Header.ARCount, &m.Additional},
+	}
+	for _, section := range sections {
+		records, err := p.ReadRRs(section.count)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal %s section: %w", section.name, err)
+		}
+		*section.records = records
+	}
+
+	if err := m.extractEDNS(); err != nil {
+		return 0, err
+	}
+	return p.Offset(), nil
+}
+
+// setCounts makes the header's section counts match the records in each section.
+// The OPT record is counted when the message is marshalled.
+func (m *Message) setCounts() {
+	m.Header.QDCount = uint16(len(m.Questions))
+	m.Header.ANCount = uint16(len(m.Answers))
+	m.Header.NSCount = uint16(len(m.Authority))
+	m.Header.ARCount = uint16(len(m.Additional))
+}
+
+// extractEDNS moves the OPT record into m.EDNS. It belongs in the additional section,
+// but is recognized wherever it appears so misplaced records aren't served as data.
+func (m *Message) extractEDNS() error {
+	m.EDNS = nil
+	sections := []struct {
+		records *[]ResourceRecord
+		count   *uint16
+	}{
+		{&m.Answers, &m.Header.ANCount},
+		{&m.Authority, &m.Header.NSCount},
+		{&m.Additional, &m.Header.ARCount},
+	}
+	for _, section := range sections {
+		kept := (*section.records)[:0]
+		for _, rr := range *section.records {
+			if rr.Type != RecordTypeOPT {
+				kept = append(kept, rr)
+				continue
+			}
+			if m.EDNS != nil {
+				return fmt.Errorf("message has more than one OPT record")
+			}
+			opt, err := parseOPTRecord(rr)
+			if err != nil {
+				return fmt.Errorf("invalid OPT record: %w", err)
+			}
+			m.EDNS = opt
+			*section.count--
+		}
+		*section.records = kept
+	}
 	return nil
 }
 
@@ -361,13 +581,31 @@ func (h *MessageHeader) SetRA(ra uint8) {
 	h.Flags = (h.Flags &^ (1 << 7)) | (uint16(ra&1) << 7)
 }
 
-// Z is 3 bits (bits 4-6)
+// Z is 1 bit (bit 6), reserved and must be zero (RFC 1035, RFC 4035)
 func (h *MessageHeader) GetZ() uint8 {
-	return uint8((h.Flags >> 4) & 0x7)
+	return uint8((h.Flags >> 6) & 1)
 }
 
 func (h *MessageHeader) SetZ(z uint8) {
-	h.Flags = (h.Flags &^ (0x7 << 4)) | (uint16(z&0x7) << 4)
+	h.Flags = (h.Flags &^ (1 << 6)) | (uint16(z&1) << 6)
+}
+
+// AD is 1 bit (bit 5), authentic data (RFC 4035)
+func (h *MessageHeader) GetAD() uint8 {
+	return uint8((h.Flags >> 5) & 1)
+}
+
+func (h *MessageHeader) SetAD(ad uint8) {
+	h.Flags = (h.Flags &^ (1 << 5)) | (uint16(ad&1) << 5)
+}
+
+// CD is 1 bit (bit 4), checking disabled (RFC 4035)
+func (h *MessageHeader) GetCD() uint8 {
+	return uint8((h.Flags >> 4) & 1)
+}
+
+func (h *MessageHeader) SetCD(cd uint8) {
+	h.Flags = (h.Flags &^ (1 << 4)) | (uint16(cd&1) << 4)
 }
 
 // Rcode is 4 bits (bits 0-3)
@@ -379,6 +617,57 @@ func (h *MessageHeader) SetRcode(rcode uint8) {
 	h.Flags = (h.Flags &^ 0xF) | (uint16(rcode & 0xF))
 }
 
+// HeaderFlags is the flags field of a header unpacked into named fields
+type HeaderFlags struct {
+	QR     bool  // response
+	Opcode uint8 // 4 bits
+	AA     bool  // authoritative answer
+	TC     bool  // truncated
+	RD     bool  // recursion desired
+	RA     bool  // recursion available
+	Z      bool  // reserved, must be zero
+	AD     bool  // authentic data
+	CD     bool  // checking disabled
+	Rcode  uint8 // 4 bits
+}
+
+// GetFlags unpacks the flags field
+func (h *MessageHeader) GetFlags() HeaderFlags {
+	return HeaderFlags{
+		QR:     h.GetQR() == 1,
+		Opcode: h.GetOpcode(),
+		AA:     h.GetAA() == 1,
+		TC:     h.GetTC() == 1,
+		RD:     h.GetRD() == 1,
+		RA:     h.GetRA() == 1,
+		Z:      h.GetZ() == 1,
+		AD:     h.GetAD() == 1,
+		CD:     h.GetCD() == 1,
+		Rcode:  h.GetRcode(),
+	}
+}
+
+// SetFlags replaces the whole flags field with f. Opcode and Rcode are truncated to 4 bits.
+func (h *MessageHeader) SetFlags(f HeaderFlags) {
+	bit := func(b bool) uint8 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	h.Flags = 0
+	h.SetQR(bit(f.QR))
+	h.SetOpcode(f.Opcode)
+	h.SetAA(bit(f.AA))
+	h.SetTC(bit(f.TC))
+	h.SetRD(bit(f.RD))
+	h.SetRA(bit(f.RA))
+	h.SetZ(bit(f.Z))
+	h.SetAD(bit(f.AD))
+	h.SetCD(bit(f.CD))
+	h.SetRcode(f.Rcode)
+}
+
 func (h *MessageHeader) MarshalBinary() ([]byte, error) {
 	b := make([]byte, DNSHeaderSize)
 	b[0] = byte(h.Id >> 8)
@@ -485,6 +774,16 @@ type ResourceRecord struct {
 	RData    []byte
 }
 
+// receivedTTL returns the TTL to use for a record received with ttl. TTLs are
+// 31 bit values, and one with the top bit set is treated as 0 (RFC 2181 section 8).
+// OPT records use the field for EDNS flags instead, so theirs is kept as is.
+func receivedTTL(rrType uint16, ttl uint32) uint32 {
+	if rrType != RecordTypeOPT && ttl > MaxTTL {
+		return 0
+	}
+	return ttl
+}
+
 func (rr *ResourceRecord) MarshalBinary() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
@@ -519,6 +818,38 @@ func (rr *ResourceRecord) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// UnmarshalFrom parses a ResourceRecord from the full DNS message starting at offset.
+// Compressed names in the RDATA are expanded. It returns the new offset after this record.
+func (rr *ResourceRecord) UnmarshalFrom(msg []byte, offset int) (int, error) {
+	name, nameEndOffset, err := decodeDNSName(msg, offset)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode name: %w", err)
+	}
+
+	if nameEndOffset+10 > len(msg) {
+		return 0, fmt.Errorf("message too short for record fields at offset %d", nameEndOffset)
+	}
+
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(msg[nameEndOffset : nameEndOffset+2])
+	rr.Class = binary.BigEndian.Uint16(msg[nameEndOffset+2 : nameEndOffset+4])
+	rr.TTL = receivedTTL(rr.Type, binary.BigEndian.Uint32(msg[nameEndOffset+4:nameEndOffset+8]))
+	rr.RDLength = binary.BigEndian.Uint16(msg[nameEndOffset+8 : nameEndOffset+10])
+	offset = nameEndOffset + 10
+
+	if offset+int(rr.RDLength) > len(msg) {
+		return 0, fmt.Errorf("message too short for RData: need %d bytes, have %d", rr.RDLength, len(msg)-offset)
+	}
+
+	rdata, err := expandRData(msg, rr.Type, offset, offset+int(rr.RDLength))
+	if err != nil {
+		return 0, err
+	}
+	rr.RData = rdata
+
+	return offset + int(rr.RDLength), nil
+}
+
 func (rr *ResourceRecord) UnmarshalBinary(data []byte) error {
 	// Decode DNS name with compression support
 	name, bytesRead, err := decodeDNSName(data, 0)
@@ -535,7 +866,7 @@ func (rr *ResourceRecord) UnmarshalBinary(data []byte) error {
 
 	rr.Type = binary.BigEndian.Uint16(data[i : i+2])
 	rr.Class = binary.BigEndian.Uint16(data[i+2 : i+4])
-	rr.TTL = binary.BigEndian.Uint32(data[i+4 : i+8])
+	rr.TTL = receivedTTL(rr.Type, binary.BigEndian.Uint32(data[i+4:i+8]))
 	rr.RDLength = binary.BigEndian.Uint16(data[i+8 : i+10])
 	i += 10
 
@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -380,6 +384,53 @@ func TestQuestion_UnmarshalFrom(t *testing.T) {
 	}
 }
 
+func TestQuestion_UnmarshalFromPointerName(t *testing.T) {
+	rawData := []byte{
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// Question 1 at offset 12: example.com MX IN
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x0F, 0x00, 0x01,
+		// Question 2 at offset 29: just a pointer to offset 12, then AAAA CH, so
+		// type and class sit right after the 2 pointer bytes
+		0xC0, 0x0C,
+		0x00, 0x1C, 0x00, 0x03,
+		// Trailing bytes that would be misread as type/class if the offset ran on
+		0xFF, 0xFF, 0xFF, 0xFF,
+	}
+
+	tests := []struct {
+		name       string
+		offset     int
+		want       Question
+		wantOffset int
+	}{
+		{"spelled out", 12, Question{Name: "example.com", Type: RecordTypeMX, Class: ClassIN}, 29},
+		{"pointer only", 29, Question{Name: "example.com", Type: RecordTypeAAAA, Class: ClassCH}, 35},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q Question
+			next, err := q.UnmarshalFrom(rawData, tt.offset)
+			if err != nil {
+				t.Fatalf("UnmarshalFrom() failed: %v", err)
+			}
+			if q != tt.want {
+				t.Errorf("UnmarshalFrom() = %+v, want %+v", q, tt.want)
+			}
+			if next != tt.wantOffset {
+				t.Errorf("UnmarshalFrom() returned offset %d, want %d", next, tt.wantOffset)
+			}
+		})
+	}
+
+	// A pointer with nothing after it has no room for type and class
+	var q Question
+	if _, err := q.UnmarshalFrom(rawData[:31], 29); err == nil {
+		t.Error("UnmarshalFrom() of a pointer without type/class succeeded, want error")
+	}
+}
+
 func TestFullMessage_MarshalUnmarshal_Simple(t *testing.T) {
 	originalMessage := Message{
 		Header: MessageHeader{
@@ -530,3 +581,848 @@ func TestDNSName_DecodeWithCompressionLoop(t *testing.T) {
 		t.Errorf("Expected error message about compression jumps, but got: %v", err)
 	}
 }
+
+// pointerChain returns data with "example.com" at offset 0 followed by n pointers,
+// each pointing to the one before, the first to the name. It returns the offset of
+// the last pointer, which decodes through all n.
+func pointerChain(n int) ([]byte, int) {
+	var buf bytes.Buffer
+	encodeDNSName("example.com", &buf)
+	target := 0
+	for range n {
+		next := buf.Len()
+		buf.Write([]byte{CompressionMask | byte(target>>8), byte(target)})
+		target = next
+	}
+	return buf.Bytes(), target
+}
+
+func TestDNSName_DecodePointerChains(t *testing.T) {
+	tests := []struct {
+		pointers int
+		wantErr  bool
+	}{
+		{1, false},
+		{MaxCompressionJumps, false},
+		{MaxCompressionJumps + 1, true},
+		{4 * MaxCompressionJumps, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d pointers", tt.pointers), func(t *testing.T) {
+			data, start := pointerChain(tt.pointers)
+			name, next, err := decodeDNSName(data, start)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "too many compression jumps") {
+					t.Fatalf("decodeDNSName() = %q, %v, want a compression jumps error", name, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeDNSName() failed: %v", err)
+			}
+			if name != "example.com" || next != start+2 {
+				t.Errorf("decodeDNSName() = %q, %d, want example.com, %d", name, next, start+2)
+			}
+		})
+	}
+}
+
+func TestMessage_UnmarshalBoundsPointerChains(t *testing.T) {
+	// build returns a response whose second answer's owner name reaches the
+	// question name through n pointers. The first answer's opaque RDATA holds the
+	// n-1 intermediate pointers, where the parser never reads them as names.
+	build := func(n int) []byte {
+		data := []byte{0, 1, 0x80, 0, 0, 1, 0, 2, 0, 0, 0, 0}
+		data = append(data, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+
+		const opaqueType = 65280
+		rdataStart := len(data) + 2 + 10
+		data = append(data, 0xc0, 12, opaqueType>>8, opaqueType&0xff, 0, 1, 0, 0, 0, 60, 0, byte(2*(n-1)))
+		target := 12
+		for i := range n - 1 {
+			data = append(data, CompressionMask|byte(target>>8), byte(target))
+			target = rdataStart + 2*i
+		}
+		return append(data, CompressionMask|byte(target>>8), byte(target), 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+	}
+
+	var msg Message
+	if err := msg.UnmarshalBinary(build(MaxCompressionJumps)); err != nil {
+		t.Fatalf("UnmarshalBinary() with %d chained pointers failed: %v", MaxCompressionJumps, err)
+	}
+	if len(msg.Answers) != 2 || msg.Answers[1].Name != "example.com" {
+		t.Errorf("Answers = %+v, want the second owned by example.com", msg.Answers)
+	}
+
+	err := msg.UnmarshalBinary(build(MaxCompressionJumps + 1))
+	if err == nil || !strings.Contains(err.Error(), "too many compression jumps") {
+		t.Errorf("UnmarshalBinary() with %d chained pointers = %v, want a compression jumps error", MaxCompressionJumps+1, err)
+	}
+}
+
+func TestMessage_CompressedRDataLength(t *testing.T) {
+	var target bytes.Buffer
+	if err := encodeDNSName("example.com", &target); err != nil {
+		t.Fatalf("encodeDNSName failed: %v", err)
+	}
+
+	msg := Message{
+		Header: MessageHeader{Id: 0x0363, QDCount: 1, ANCount: 2},
+		Questions: []Question{
+			{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN},
+		},
+		Answers: []ResourceRecord{
+			{Name: "www.example.com", Type: RecordTypeCNAME, Class: ClassIN, TTL: 300, RData: target.Bytes()},
+			{Name: "example.com", Type: RecordTypeA, Class: ClassIN, TTL: 300, RData: []byte{93, 184, 216, 34}},
+		},
+	}
+	msg.Header.SetQR(1)
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	// Header, question (17 byte name + type/class), then the CNAME owner as a pointer
+	cnameFields := DNSHeaderSize + 17 + 4 + 2
+	rdLength := int(binary.BigEndian.Uint16(data[cnameFields+8 : cnameFields+10]))
+	rdataStart := cnameFields + 10
+
+	// "example.com" is already in the question, so the target is a single pointer
+	if rdLength != 2 {
+		t.Errorf("CNAME RDLENGTH = %d, want 2 (compressed pointer)", rdLength)
+	}
+	if data[rdataStart]&CompressionMask != CompressionMask {
+		t.Errorf("CNAME RDATA starts with %02x, want a compression pointer", data[rdataStart])
+	}
+
+	var parsed Message
+	if err := parsed.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() failed: %v", err)
+	}
+	if parsed.Answers[0].RDLength != uint16(rdLength) {
+		t.Errorf("Parsed RDLength = %d, want on-wire %d", parsed.Answers[0].RDLength, rdLength)
+	}
+	name, _, err := decodeDNSName(parsed.Answers[0].RData, 0)
+	if err != nil {
+		t.Fatalf("Failed to decode parsed CNAME RDATA: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("Parsed CNAME target = %q, want %q", name, "example.com")
+	}
+	if !bytes.Equal(parsed.Answers[1].RData, []byte{93, 184, 216, 34}) {
+		t.Errorf("A record after the CNAME = %v, want 93.184.216.34", parsed.Answers[1].RData)
+	}
+}
+
+func TestMessageHeader_ZADCDBits(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(h *MessageHeader)
+		want uint16
+	}{
+		{"Z", func(h *MessageHeader) { h.SetZ(1) }, 1 << 6},
+		{"AD", func(h *MessageHeader) { h.SetAD(1) }, 1 << 5},
+		{"CD", func(h *MessageHeader) { h.SetCD(1) }, 1 << 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h MessageHeader
+			tt.set(&h)
+			if h.Flags != tt.want {
+				t.Errorf("Flags = %#04x, want %#04x", h.Flags, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageHeader_Flags(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags HeaderFlags
+		want  uint16
+	}{
+		{"none", HeaderFlags{}, 0},
+		{"all", HeaderFlags{QR: true, Opcode: 0xF, AA: true, TC: true, RD: true, RA: true, Z: true, AD: true, CD: true, Rcode: 0xF}, 0xFFFF},
+		{"response", HeaderFlags{QR: true, Opcode: OpcodeStatus, AA: true, RD: true, RA: true, AD: true, Rcode: RCodeNXDomain}, 0x95A3},
+		{"query", HeaderFlags{Opcode: OpcodeQuery, TC: true, CD: true, Rcode: RCodeRefused}, 0x0215},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := MessageHeader{Id: 0x4649, Flags: 0x7878}
+			h.SetFlags(tt.flags)
+			if h.Flags != tt.want {
+				t.Errorf("Flags = %#04x, want %#04x", h.Flags, tt.want)
+			}
+			if got := h.GetFlags(); got != tt.flags {
+				t.Errorf("GetFlags() = %+v, want %+v", got, tt.flags)
+			}
+
+			data, err := h.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+			var parsed MessageHeader
+			if err := parsed.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() failed: %v", err)
+			}
+			if got := parsed.GetFlags(); got != tt.flags {
+				t.Errorf("GetFlags() after a round trip = %+v, want %+v", got, tt.flags)
+			}
+		})
+	}
+}
+
+func TestDNSName_DecodeRejectsOverlongCompressedName(t *testing.T) {
+	label := append([]byte{63}, bytes.Repeat([]byte{'a'}, 63)...)
+
+	// Three labels at offset 12, then three more labels followed by a pointer back to them.
+	// Each half is within the limit, but together they are 383 bytes.
+	data := make([]byte, DNSHeaderSize)
+	data = append(data, bytes.Repeat(label, 3)...)
+	data = append(data, 0)
+	second := len(data)
+	data = append(data, bytes.Repeat(label, 3)...)
+	data = append(data, 0xc0, DNSHeaderSize)
+
+	if _, _, err := decodeDNSName(data, DNSHeaderSize); err != nil {
+		t.Fatalf("decodeDNSName() of the first half failed: %v", err)
+	}
+	if name, _, err := decodeDNSName(data, second); err == nil {
+		t.Fatalf("decodeDNSName() accepted a %d byte name", len(name))
+	}
+}
+
+func TestMessage_UnmarshalRejectsImpossibleCounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		header MessageHeader
+	}{
+		{"questions", MessageHeader{QDCount: 0xFFFF}},
+		{"answers", MessageHeader{ANCount: 0xFFFF}},
+		{"additional", MessageHeader{ARCount: 0xFFFF}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.header.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+			var msg Message
+			if err := msg.UnmarshalBinary(data); err == nil {
+				t.Errorf("UnmarshalBinary() accepted a header-only packet claiming 65535 entries")
+			}
+		})
+	}
+}
+
+func TestMessage_UnmarshalBinaryStrict(t *testing.T) {
+	query := buildTestDNSQuery(0x7a7a, []Question{
+		{Name: "example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	padded := append(append([]byte(nil), query...), 0, 0, 0, 0)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantStrict bool // whether strict parsing should succeed
+	}{
+		{"exact", query, true},
+		{"padded", padded, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lenient Message
+			if err := lenient.UnmarshalBinary(tt.data); err != nil {
+				t.Errorf("UnmarshalBinary() failed: %v", err)
+			}
+
+			var strict Message
+			err := strict.UnmarshalBinaryStrict(tt.data)
+			if (err == nil) != tt.wantStrict {
+				t.Errorf("UnmarshalBinaryStrict() error = %v, want success %v", err, tt.wantStrict)
+			}
+		})
+	}
+}
+
+func TestMessage_UnmarshalRejectsOverlongCompressedQuestion(t *testing.T) {
+	label := append([]byte{63}, bytes.Repeat([]byte{'x'}, 63)...)
+
+	// The first question is a legal 191 byte name. The second repeats three labels and
+	// points at the first, for 383 bytes once expanded.
+	header := MessageHeader{Id: 0x0385, QDCount: 2}
+	data, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	data = append(data, bytes.Repeat(label, 3)...)
+	data = append(data, 0, 0, 1, 0, 1)
+	data = append(data, bytes.Repeat(label, 3)...)
+	data = append(data, 0xc0, DNSHeaderSize, 0, 1, 0, 1)
+
+	var msg Message
+	err = msg.UnmarshalBinary(data)
+	if err == nil {
+		t.Fatalf("UnmarshalBinary() accepted a %d byte question name", len(msg.Questions[1].Name))
+	}
+	if !bytes.Contains([]byte(err.Error()), []byte("domain name too long")) {
+		t.Errorf("UnmarshalBinary() error = %v, want a name length error", err)
+	}
+}
+
+// countCompressionPointers walks the names in a marshaled message, including those
+// in CNAME, NS and MX RDATA, and counts the ones ending in a compression pointer
+func countCompressionPointers(t *testing.T, data []byte) int {
+	t.Helper()
+
+	var header MessageHeader
+	if err := header.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Failed to parse header: %v", err)
+	}
+	pointers := 0
+	// skipName steps over the name at offset without following pointers
+	skipName := func(offset int) int {
+		for {
+			if offset >= len(data) {
+				t.Fatalf("Name runs past the end of the message")
+			}
+			length := data[offset]
+			switch {
+			case length&CompressionMask == CompressionMask:
+				pointers++
+				return offset + 2
+			case length == 0:
+				return offset + 1
+			}
+			offset += 1 + int(length)
+		}
+	}
+
+	offset := DNSHeaderSize
+	for range header.QDCount {
+		offset = skipName(offset) + 4
+	}
+	for range int(header.ANCount) + int(header.NSCount) + int(header.ARCount) {
+		offset = skipName(offset)
+		rrType := binary.BigEndian.Uint16(data[offset:])
+		rdLength := int(binary.BigEndian.Uint16(data[offset+8:]))
+		offset += 10
+		switch rrType {
+		case RecordTypeCNAME, RecordTypeNS, RecordTypePTR:
+			skipName(offset)
+		case RecordTypeMX:
+			skipName(offset + 2)
+		}
+		offset += rdLength
+	}
+	if offset != len(data) {
+		t.Fatalf("Walked %d of %d bytes", offset, len(data))
+	}
+	return pointers
+}
+
+func TestMessage_MarshalWithoutCompression(t *testing.T) {
+	var cname, mx bytes.Buffer
+	encodeDNSName("target.example.com", &cname)
+	mx.Write([]byte{0, 10})
+	encodeDNSName("mail.example.com", &mx)
+
+	msg := Message{
+		Header:    MessageHeader{Id: 0x0395, QDCount: 1, ANCount: 3},
+		Questions: []Question{{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}},
+		Answers: []ResourceRecord{
+			{Name: "www.example.com", Type: RecordTypeCNAME, Class: ClassIN, TTL: 60, RData: cname.Bytes()},
+			{Name: "target.example.com", Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1}},
+			{Name: "example.com", Type: RecordTypeMX, Class: ClassIN, TTL: 60, RData: mx.Bytes()},
+		},
+	}
+
+	compressed, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	uncompressed, err := msg.MarshalWithOptions(MarshalOptions{NoCompression: true})
+	if err != nil {
+		t.Fatalf("MarshalWithOptions() failed: %v", err)
+	}
+
+	if countCompressionPointers(t, compressed) == 0 {
+		t.Error("Default encoding has no compression pointers, so this test proves nothing")
+	}
+	if got := countCompressionPointers(t, uncompressed); got != 0 {
+		t.Errorf("Uncompressed encoding has %d compression pointers, want 0", got)
+	}
+	if len(uncompressed) <= len(compressed) {
+		t.Errorf("Uncompressed encoding is %d bytes, want more than the compressed %d", len(uncompressed), len(compressed))
+	}
+
+	var parsed Message
+	if err := parsed.UnmarshalBinaryStrict(uncompressed); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict() of the uncompressed encoding failed: %v", err)
+	}
+	if parsed.Questions[0] != msg.Questions[0] || len(parsed.Answers) != len(msg.Answers) {
+		t.Fatalf("Round trip = %+v, want %+v", parsed, msg)
+	}
+	for i, rr := range parsed.Answers {
+		if rr.Name != msg.Answers[i].Name || !bytes.Equal(rr.RData, msg.Answers[i].RData) {
+			t.Errorf("Answer %d round tripped as %s %x, want %s %x",
+				i, rr.Name, rr.RData, msg.Answers[i].Name, msg.Answers[i].RData)
+		}
+	}
+}
+
+func TestMessage_UnknownTypeRoundTrip(t *testing.T) {
+	// RDATA that would be mangled if it were decoded as a name: a compression
+	// pointer to the question, a label and a zero byte
+	rdata := []byte{0xC0, 0x0C, 3, 'f', 'o', 'o', 0, 0xFF}
+	msg := Message{
+		Header:    MessageHeader{Id: 0x2706, QDCount: 1, ANCount: 1},
+		Questions: []Question{{Name: "example.com", Type: 9999, Class: ClassIN}},
+		Answers:   []ResourceRecord{{Name: "example.com", Type: 9999, Class: ClassIN, TTL: 60, RData: rdata}},
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	rdataStart := len(data) - len(rdata)
+	if !bytes.Equal(data[rdataStart:], rdata) {
+		t.Errorf("Encoded RDATA = %x, want %x", data[rdataStart:], rdata)
+	}
+	if got := binary.BigEndian.Uint16(data[rdataStart-2:]); got != uint16(len(rdata)) {
+		t.Errorf("RDLENGTH = %d, want %d", got, len(rdata))
+	}
+
+	var parsed Message
+	if err := parsed.UnmarshalBinaryStrict(data); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict() failed: %v", err)
+	}
+	if len(parsed.Answers) != 1 || parsed.Answers[0].Type != 9999 || !bytes.Equal(parsed.Answers[0].RData, rdata) {
+		t.Errorf("Parsed answers = %+v, want the type 9999 record unchanged", parsed.Answers)
+	}
+}
+
+// prefixedNameCodec is a codec for a type whose RDATA is a byte then a name
+type prefixedNameCodec struct{ upperCodec }
+
+func (prefixedNameCodec) NameLayout() (RDataLayout, bool) {
+	return RDataLayout{Fields: []RDataField{{Fixed: 1}, {Name: true}}, Compress: true}, true
+}
+
+func TestRegisterRDataCodec_NameLayout(t *testing.T) {
+	const privateType = 65280 // first of the private use types (RFC 6895)
+	RegisterRDataCodec(privateType, prefixedNameCodec{})
+	t.Cleanup(func() {
+		delete(rdataCodecs, privateType)
+		delete(rdataLayouts, privateType)
+	})
+
+	var rdata bytes.Buffer
+	rdata.WriteByte(7)
+	encodeDNSName("target.example.com", &rdata)
+	msg := Message{
+		Header:    MessageHeader{Id: 0xff00, QDCount: 1, ANCount: 1},
+		Questions: []Question{{Name: "example.com", Type: privateType, Class: ClassIN}},
+		Answers:   []ResourceRecord{{Name: "example.com", Type: privateType, Class: ClassIN, TTL: 60, RData: rdata.Bytes()}},
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	if countCompressionPointers(t, data) != 1 {
+		t.Fatal("Answer owner name isn't compressed")
+	}
+	// The codec's layout lets the RDATA name compress against the question too
+	if !bytes.HasSuffix(data, []byte{7, 6, 't', 'a', 'r', 'g', 'e', 't', 0xC0, 0x0C}) {
+		t.Errorf("Encoded RDATA doesn't end in a pointer to example.com: %x", data)
+	}
+
+	var parsed Message
+	if err := parsed.UnmarshalBinaryStrict(data); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict() failed: %v", err)
+	}
+	if !bytes.Equal(parsed.Answers[0].RData, rdata.Bytes()) {
+		t.Errorf("Parsed RDATA = %x, want it expanded back to %x", parsed.Answers[0].RData, rdata.Bytes())
+	}
+}
+
+func TestMessage_AnswersSharingOwnerNameUsePointers(t *testing.T) {
+	msg := Message{Header: MessageHeader{Id: 0x0406, ANCount: 3}}
+	for i := byte(1); i <= 3; i++ {
+		msg.Answers = append(msg.Answers, ResourceRecord{
+			Name: "host.example.com", Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, i},
+		})
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	// With no question, the first answer writes the owner name in full right after the header
+	p := NewParser(data)
+	if _, err := p.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() failed: %v", err)
+	}
+	pointer := []byte{CompressionMask, DNSHeaderSize}
+	for i := range msg.Answers {
+		owner := p.Offset()
+		rr, err := p.ReadRR()
+		if err != nil {
+			t.Fatalf("ReadRR() %d failed: %v", i, err)
+		}
+		if rr.Name != "host.example.com" {
+			t.Errorf("Answer %d owner = %q, want host.example.com", i, rr.Name)
+		}
+		if i == 0 {
+			continue
+		}
+		// A 2 byte owner name is followed directly by the 10 bytes of fixed fields
+		if !bytes.Equal(data[owner:owner+2], pointer) || p.Offset()-owner != 2+10+4 {
+			t.Errorf("Answer %d owner encoded as %x, want the 2 byte pointer %x", i, data[owner:owner+2], pointer)
+		}
+	}
+}
+
+// multiNameRecords returns SOA and RP answers for example.com whose RDATA names
+// all end in example.com, so they could point at the question
+func multiNameRecords(t *testing.T) []ResourceRecord {
+	t.Helper()
+	soa := SOAData{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300}
+	rp := RPData{Mbox: "admin.example.com", TxtDname: "info.example.com"}
+	soaData, err := soa.MarshalBinary()
+	if err != nil {
+		t.Fatalf("SOA MarshalBinary() failed: %v", err)
+	}
+	rpData, err := rp.MarshalBinary()
+	if err != nil {
+		t.Fatalf("RP MarshalBinary() failed: %v", err)
+	}
+	return []ResourceRecord{
+		{Name: "example.com", Type: RecordTypeSOA, Class: ClassIN, TTL: 300, RData: soaData},
+		{Name: "example.com", Type: RecordTypeRP, Class: ClassIN, TTL: 300, RData: rpData},
+	}
+}
+
+func TestMessage_MultiNameRDataNotCompressed(t *testing.T) {
+	records := multiNameRecords(t)
+	msg := Message{
+		Header:    MessageHeader{Id: 0x0410, QDCount: 1, ANCount: uint16(len(records))},
+		Questions: []Question{{Name: "example.com", Type: RecordTypeSOA, Class: ClassIN}},
+		Answers:   records,
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	p := NewParser(data)
+	if _, err := p.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() failed: %v", err)
+	}
+	if _, err := p.ReadQuestion(); err != nil {
+		t.Fatalf("ReadQuestion() failed: %v", err)
+	}
+	for _, want := range records {
+		rr, err := p.ReadRR()
+		if err != nil {
+			t.Fatalf("ReadRR() failed: %v", err)
+		}
+		// Uncompressed RDATA is written exactly as stored
+		wire := data[p.Offset()-int(rr.RDLength) : p.Offset()]
+		if !bytes.Equal(wire, want.RData) {
+			t.Errorf("%s RDATA written as %x, want it uncompressed: %x", TypeName(rr.Type), wire, want.RData)
+		}
+	}
+}
+
+func TestMessage_MultiNameRDataPointersExpanded(t *testing.T) {
+	// A legacy packet with every SOA and RP RDATA name compressed against the question
+	header := MessageHeader{Id: 0x0411, QDCount: 1, ANCount: 2}
+	data, _ := header.MarshalBinary()
+	data = append(data, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 6, 0, 1)
+	pointer := []byte{CompressionMask, DNSHeaderSize}
+	withPointer := func(label string) []byte {
+		return append(append([]byte{byte(len(label))}, label...), pointer...)
+	}
+	appendRR := func(rrType uint16, rdata []byte) {
+		data = append(data, pointer...)
+		data = binary.BigEndian.AppendUint16(data, rrType)
+		data = binary.BigEndian.AppendUint16(data, ClassIN)
+		data = binary.BigEndian.AppendUint32(data, 300)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	soa := append(withPointer("ns1"), withPointer("hostmaster")...)
+	soa = binary.BigEndian.AppendUint32(soa, 1)
+	for _, v := range []uint32{7200, 3600, 1209600, 300} {
+		soa = binary.BigEndian.AppendUint32(soa, v)
+	}
+	appendRR(RecordTypeSOA, soa)
+	appendRR(RecordTypeRP, append(withPointer("admin"), withPointer("info")...))
+
+	var msg Message
+	if err := msg.UnmarshalBinaryStrict(data); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict() failed: %v", err)
+	}
+	for i, want := range multiNameRecords(t) {
+		if got := msg.Answers[i]; got.Type != want.Type || !bytes.Equal(got.RData, want.RData) {
+			t.Errorf("%s RDATA = %x, want pointers expanded: %x", TypeName(want.Type), got.RData, want.RData)
+		}
+	}
+}
+
+func TestMessage_RoundTripAllSectionsWithSharedNames(t *testing.T) {
+	name := func(n string) []byte {
+		var buf bytes.Buffer
+		if err := encodeDNSName(n, &buf); err != nil {
+			t.Fatalf("encodeDNSName(%q) failed: %v", n, err)
+		}
+		return buf.Bytes()
+	}
+	mx := append([]byte{0, 10}, name("mail.example.com")...)
+
+	msg := Message{
+		Header: MessageHeader{Id: 0x0417, QDCount: 1, ANCount: 3, NSCount: 2, ARCount: 3},
+		Questions: []Question{
+			{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN},
+		},
+		Answers: []ResourceRecord{
+			{Name: "www.example.com", Type: RecordTypeCNAME, Class: ClassIN, TTL: 300, RData: name("web.example.com")},
+			{Name: "web.example.com", Type: RecordTypeA, Class: ClassIN, TTL: 300, RData: []byte{192, 0, 2, 1}},
+			{Name: "example.com", Type: RecordTypeMX, Class: ClassIN, TTL: 300, RData: mx},
+		},
+		Authority: []ResourceRecord{
+			{Name: "example.com", Type: RecordTypeNS, Class: ClassIN, TTL: 3600, RData: name("ns1.example.com")},
+			{Name: "example.com", Type: RecordTypeNS, Class: ClassIN, TTL: 3600, RData: name("ns2.example.net")},
+		},
+		Additional: []ResourceRecord{
+			{Name: "ns1.example.com", Type: RecordTypeA, Class: ClassIN, TTL: 3600, RData: []byte{192, 0, 2, 53}},
+			{Name: "ns2.example.net", Type: RecordTypeA, Class: ClassIN, TTL: 3600, RData: []byte{198, 51, 100, 53}},
+			{Name: "mail.example.com", Type: RecordTypeAAAA, Class: ClassIN, TTL: 300, RData: net.ParseIP("2001:db8::25")},
+		},
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	// Every name after the question shares a suffix with an earlier one, so the
+	// owner names of the authority and additional records must all be pointers
+	p := NewParser(data)
+	if _, err := p.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() failed: %v", err)
+	}
+	if _, err := p.ReadQuestions(msg.Header.QDCount); err != nil {
+		t.Fatalf("ReadQuestions() failed: %v", err)
+	}
+	if _, err := p.ReadRRs(msg.Header.ANCount); err != nil {
+		t.Fatalf("ReadRRs() failed: %v", err)
+	}
+	for i := 0; i < int(msg.Header.NSCount+msg.Header.ARCount); i++ {
+		owner := p.Offset()
+		if _, err := p.ReadRR(); err != nil {
+			t.Fatalf("ReadRR() failed: %v", err)
+		}
+		if data[owner]&CompressionMask != CompressionMask {
+			// A name may start with labels before its pointer; find the pointer
+			end := owner
+			for data[end] != 0 && data[end]&CompressionMask != CompressionMask {
+				end += int(data[end]) + 1
+			}
+			if data[end] == 0 {
+				t.Errorf("Record %d after the answers has an uncompressed owner name at offset %d", i, owner)
+				continue
+			}
+			owner = end
+		}
+		if target := int(binary.BigEndian.Uint16(data[owner:]) & CompressionOffset); target >= owner {
+			t.Errorf("Pointer at offset %d points forward to %d", owner, target)
+		}
+	}
+
+	var parsed Message
+	if err := parsed.UnmarshalBinaryStrict(data); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict() failed: %v", err)
+	}
+	for _, section := range []*[]ResourceRecord{&parsed.Answers, &parsed.Authority, &parsed.Additional} {
+		for i := range *section {
+			(*section)[i].RDLength = 0
+		}
+	}
+	if !reflect.DeepEqual(parsed, msg) {
+		t.Errorf("Round trip changed the message:\n got %+v\nwant %+v", parsed, msg)
+	}
+}
+
+func TestMessage_NoPointersPastMaxOffset(t *testing.T) {
+	// 70 answers with 255 bytes of RDATA each push the tail of the message past
+	// 0x3FFF, so names first written there can't be pointed to
+	msg := Message{Header: MessageHeader{Id: 0x3fff}}
+	for i := range 70 {
+		msg.Answers = append(msg.Answers, ResourceRecord{
+			Name: "bulk.example.com", Type: 0xff00, Class: ClassIN, TTL: 60, RData: bytes.Repeat([]byte{byte(i)}, 255),
+		})
+	}
+	late := []string{"late.example.com", "late.example.com", "far.away.test", "far.away.test"}
+	for _, name := range late {
+		msg.Answers = append(msg.Answers, ResourceRecord{
+			Name: name, Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1},
+		})
+	}
+	msg.Header.ANCount = uint16(len(msg.Answers))
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	if len(data) <= CompressionOffset+100 {
+		t.Fatalf("Message is %d bytes, too short to test offsets past %d", len(data), CompressionOffset)
+	}
+
+	var got Message
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() failed: %v", err)
+	}
+	if len(got.Answers) != len(msg.Answers) {
+		t.Fatalf("Got %d answers, want %d", len(got.Answers), len(msg.Answers))
+	}
+	for i, rr := range got.Answers[70:] {
+		if rr.Name != late[i] {
+			t.Errorf("Late answer %d owner = %q, want %q", i, rr.Name, late[i])
+		}
+	}
+	for i, rr := range got.Answers[:70] {
+		if rr.Name != "bulk.example.com" || !bytes.Equal(rr.RData, msg.Answers[i].RData) {
+			t.Errorf("Answer %d = %q with %d bytes of RDATA, want it unchanged", i, rr.Name, len(rr.RData))
+		}
+	}
+
+	// late.example.com still points at example.com, written near the start
+	p := NewParser(data)
+	if _, err := p.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() failed: %v", err)
+	}
+	for range 70 {
+		if _, err := p.ReadRR(); err != nil {
+			t.Fatalf("ReadRR() failed: %v", err)
+		}
+	}
+	for range 2 {
+		owner := p.Offset()
+		if _, err := p.ReadRR(); err != nil {
+			t.Fatalf("ReadRR() failed: %v", err)
+		}
+		want := []byte{4, 'l', 'a', 't', 'e', CompressionMask}
+		if !bytes.Equal(data[owner:owner+len(want)], want) {
+			t.Errorf("late.example.com encoded as %x, want the label then a pointer", data[owner:owner+len(want)])
+		}
+	}
+}
+
+func TestResourceRecord_TTLTopBitReserved(t *testing.T) {
+	tests := []struct {
+		name   string
+		rrType uint16
+		ttl    uint32
+		want   uint32
+	}{
+		{"max", RecordTypeA, MaxTTL, MaxTTL},
+		{"top bit", RecordTypeA, 1 << 31, 0},
+		{"all ones", RecordTypeA, 0xFFFFFFFF, 0},
+		{"OPT flags", RecordTypeOPT, 0x80008000, 0x80008000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := ResourceRecord{Name: "example.com", Type: tt.rrType, Class: ClassIN, TTL: tt.ttl, RData: []byte{192, 0, 2, 1}}
+			data, err := rr.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+
+			var got ResourceRecord
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() failed: %v", err)
+			}
+			if got.TTL != tt.want {
+				t.Errorf("UnmarshalBinary() TTL = %#x, want %#x", got.TTL, tt.want)
+			}
+			if _, err := got.UnmarshalFrom(data, 0); err != nil {
+				t.Fatalf("UnmarshalFrom() failed: %v", err)
+			}
+			if got.TTL != tt.want {
+				t.Errorf("UnmarshalFrom() TTL = %#x, want %#x", got.TTL, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessage_AdditionalPointsAtSRVTarget(t *testing.T) {
+	srv := SRVData{Priority: 10, Weight: 60, Port: 5060, Target: "sip1.example.com"}
+	srvData, err := srv.MarshalBinary()
+	if err != nil {
+		t.Fatalf("SRV MarshalBinary() failed: %v", err)
+	}
+	msg := Message{
+		Header:    MessageHeader{Id: 0x0441, QDCount: 1, ANCount: 1, ARCount: 1},
+		Questions: []Question{{Name: "_sip._udp.example.com", Type: RecordTypeSRV, Class: ClassIN}},
+		Answers: []ResourceRecord{
+			{Name: "_sip._udp.example.com", Type: RecordTypeSRV, Class: ClassIN, TTL: 300, RData: srvData},
+		},
+		Additional: []ResourceRecord{
+			{Name: "sip1.example.com", Type: RecordTypeA, Class: ClassIN, TTL: 300, RData: []byte{192, 0, 2, 10}},
+		},
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+
+	p := NewParser(data)
+	if _, err := p.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() failed: %v", err)
+	}
+	if _, err := p.ReadQuestion(); err != nil {
+		t.Fatalf("ReadQuestion() failed: %v", err)
+	}
+	answerStart := p.Offset()
+	answer, err := p.ReadRR()
+	if err != nil {
+		t.Fatalf("ReadRR() answer failed: %v", err)
+	}
+	additionalStart := p.Offset()
+	additional, err := p.ReadRR()
+	if err != nil {
+		t.Fatalf("ReadRR() additional failed: %v", err)
+	}
+
+	// The SRV target is written in full, its 6 fixed bytes after the 2 byte
+	// owner pointer and 10 bytes of fixed fields
+	target := answerStart + 2 + 10 + 6
+	want := []byte("\x04sip1\x07example\x03com\x00")
+	if !bytes.Equal(data[target:target+len(want)], want) {
+		t.Errorf("SRV target encoded as %x, want it uncompressed (RFC 2782)", data[target:target+len(want)])
+	}
+	pointer := []byte{CompressionMask | byte(target>>8), byte(target)}
+	if !bytes.Equal(data[additionalStart:additionalStart+2], pointer) {
+		t.Errorf("Additional owner encoded as %x, want the pointer %x to the SRV target", data[additionalStart:additionalStart+2], pointer)
+	}
+
+	var decoded SRVData
+	if err := decoded.UnmarshalBinary(answer.RData); err != nil || decoded != srv {
+		t.Errorf("SRV RDATA decoded as %+v (%v), want %+v", decoded, err, srv)
+	}
+	if additional.Name != "sip1.example.com" {
+		t.Errorf("Additional owner = %q, want sip1.example.com", additional.Name)
+	}
+}
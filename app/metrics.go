@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// MetricsPath is where the metrics endpoint is served
+const MetricsPath = "/metrics"
+
+// MetricsCollector writes its metrics in the Prometheus text exposition format
+type MetricsCollector interface {
+	WriteMetrics(w io.Writer)
+}
+
+// MetricsHandler serves the metrics of all registered collectors
+type MetricsHandler struct {
+	collectors []MetricsCollector
+}
+
+// NewMetricsHandler creates a handler exposing the given collectors
+func NewMetricsHandler(collectors ...MetricsCollector) *MetricsHandler {
+	return &MetricsHandler{collectors: collectors}
+}
+
+func (m *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range m.collectors {
+		c.WriteMetrics(w)
+	}
+}
+
+// NewMetricsServer creates an HTTP server exposing the metrics endpoint on addr
+func NewMetricsServer(addr string, collectors ...MetricsCollector) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, NewMetricsHandler(collectors...))
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,29 @@
+package main
+
+// Handler answers a parsed DNS request with a response message
+type Handler interface {
+	ServeDNS(req *Message) (*Message, error)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(req *Message) (*Message, error)
+
+// ServeDNS calls f(req)
+func (f HandlerFunc) ServeDNS(req *Message) (*Message, error) {
+	return f(req)
+}
+
+// Middleware wraps a Handler to add behavior such as logging, metrics, rate
+// limiting or blocklisting. It may answer the request itself without calling next.
+type Middleware func(next Handler) Handler
+
+// Chain combines middleware into one. The first runs first (outermost), so
+// Chain(a, b)(h) serves a request through a, then b, then h.
+func Chain(mw ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			next = mw[i](next)
+		}
+		return next
+	}
+}
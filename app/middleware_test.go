@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestChain_Order(t *testing.T) {
+	var calls []string
+	tracing := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(req *Message) (*Message, error) {
+				calls = append(calls, name+" before")
+				resp, err := next.ServeDNS(req)
+				calls = append(calls, name+" after")
+				return resp, err
+			})
+		}
+	}
+	noop := func(next Handler) Handler { return next }
+
+	base := HandlerFunc(func(req *Message) (*Message, error) {
+		calls = append(calls, "handler")
+		return NewResponseBuilder(req).Build(), nil
+	})
+	if _, err := Chain(tracing("outer"), noop, tracing("inner"))(base).ServeDNS(&Message{}); err != nil {
+		t.Fatalf("ServeDNS() failed: %v", err)
+	}
+
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("Calls = %q, want %q", calls, want)
+	}
+}
+
+func TestDNSHandler_WithMiddleware(t *testing.T) {
+	counted := 0
+	counting := func(next Handler) Handler {
+		return HandlerFunc(func(req *Message) (*Message, error) {
+			counted += len(req.Questions)
+			return next.ServeDNS(req)
+		})
+	}
+	blocking := func(next Handler) Handler {
+		return HandlerFunc(func(req *Message) (*Message, error) {
+			for _, q := range req.Questions {
+				if q.Name == "blocked.example" {
+					return NewResponseBuilder(req).SetRcode(RCodeRefused).Build(), nil
+				}
+			}
+			return next.ServeDNS(req)
+		})
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		wantRcode uint8
+		wantCount int // answers
+	}{
+		{"passes through", "stackoverflow.com", RCodeNoError, 1},
+		{"answered by middleware", "blocked.example", RCodeRefused, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := counted
+			queryData := buildTestDNSQuery(0x6d77, []Question{{Name: tt.qname, Type: RecordTypeA, Class: ClassIN}})
+			response, err := NewDNSHandler(queryData, WithMiddleware(counting, blocking)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if len(respMsg.Answers) != tt.wantCount {
+				t.Errorf("Response has %d answers, want %d", len(respMsg.Answers), tt.wantCount)
+			}
+			if counted != before+1 {
+				t.Errorf("Counting middleware saw %d questions, want 1", counted-before)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import "fmt"
+
+// ParseError is an error decoding a message, with the offset of the field that failed
+type ParseError struct {
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parser reads a DNS message one part at a time, tracking how far it has got so
+// tools can report exactly where a malformed packet breaks. Errors are *ParseError.
+type Parser struct {
+	data   []byte
+	offset int
+}
+
+// NewParser creates a parser at the start of data
+func NewParser(data []byte) *Parser {
+	return &Parser{data: data}
+}
+
+// Offset returns the offset of the next byte to be read
+func (p *Parser) Offset() int {
+	return p.offset
+}
+
+// Remaining returns the number of bytes not read yet
+func (p *Parser) Remaining() int {
+	return len(p.data) - p.offset
+}
+
+// fail wraps err with the current offset
+func (p *Parser) fail(err error) error {
+	return &ParseError{Offset: p.offset, Err: err}
+}
+
+// ReadHeader reads the 12 byte message header
+func (p *Parser) ReadHeader() (MessageHeader, error) {
+	var header MessageHeader
+	if p.Remaining() < DNSHeaderSize {
+		return header, p.fail(fmt.Errorf("data too short for DNS header: %d bytes", p.Remaining()))
+	}
+	if err := header.UnmarshalBinary(p.data[p.offset : p.offset+DNSHeaderSize]); err != nil {
+		return header, p.fail(err)
+	}
+	p.offset += DNSHeaderSize
+	return header, nil
+}
+
+// ReadQuestion reads one question
+func (p *Parser) ReadQuestion() (Question, error) {
+	var q Question
+	next, err := q.UnmarshalFrom(p.data, p.offset)
+	if err != nil {
+		return Question{}, p.fail(err)
+	}
+	p.offset = next
+	return q, nil
+}
+
+// ReadRR reads one resource record, expanding compressed names in its RDATA
+func (p *Parser) ReadRR() (ResourceRecord, error) {
+	var rr ResourceRecord
+	next, err := rr.UnmarshalFrom(p.data, p.offset)
+	if err != nil {
+		return ResourceRecord{}, p.fail(err)
+	}
+	p.offset = next
+	return rr, nil
+}
+
+// ReadQuestions reads count questions. The count is checked against the data
+// before allocating for it, since a 12 byte packet can claim 65535 of them.
+func (p *Parser) ReadQuestions(count uint16) ([]Question, error) {
+	if need := int(count) * MinQuestionSize; need > p.Remaining() {
+		return nil, p.fail(fmt.Errorf("%d questions need at least %d bytes, have %d", count, need, p.Remaining()))
+	}
+	questions := make([]Question, count)
+	for i := range questions {
+		q, err := p.ReadQuestion()
+		if err != nil {
+			return nil, fmt.Errorf("question %d: %w", i, err)
+		}
+		questions[i] = q
+	}
+	return questions, nil
+}
+
+// ReadRRs reads count resource records, checking the count against the data first
+func (p *Parser) ReadRRs(count uint16) ([]ResourceRecord, error) {
+	if need := int(count) * MinRecordSize; need > p.Remaining() {
+		return nil, p.fail(fmt.Errorf("%d records need at least %d bytes, have %d", count, need, p.Remaining()))
+	}
+	records := make([]ResourceRecord, count)
+	for i := range records {
+		rr, err := p.ReadRR()
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		records[i] = rr
+	}
+	return records, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParser_ReadsMessage(t *testing.T) {
+	data := buildTestDNSQuery(0x7061, []Question{
+		{Name: "example.com", Type: RecordTypeA, Class: ClassIN},
+		{Name: "www.example.com", Type: RecordTypeAAAA, Class: ClassIN},
+	})
+
+	p := NewParser(data)
+	header, err := p.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() failed: %v", err)
+	}
+	if header.Id != 0x7061 || header.QDCount != 2 || p.Offset() != DNSHeaderSize {
+		t.Fatalf("ReadHeader() = ID %#04x, QDCount %d at offset %d", header.Id, header.QDCount, p.Offset())
+	}
+
+	// The second name is compressed to "www" and a pointer to the first
+	wantOffsets := []int{DNSHeaderSize + 13 + 4, DNSHeaderSize + 13 + 4 + 4 + 2 + 4}
+	for i, want := range wantOffsets {
+		if _, err := p.ReadQuestion(); err != nil {
+			t.Fatalf("ReadQuestion() %d failed: %v", i, err)
+		}
+		if p.Offset() != want {
+			t.Errorf("Offset() after question %d = %d, want %d", i, p.Offset(), want)
+		}
+	}
+	if p.Remaining() != 0 {
+		t.Errorf("Remaining() = %d after the last question, want 0", p.Remaining())
+	}
+}
+
+func TestParser_ErrorsReportOffset(t *testing.T) {
+	msg := Message{
+		Header:    MessageHeader{Id: 0x0396, QDCount: 1, ANCount: 1},
+		Questions: []Question{{Name: "example.com", Type: RecordTypeA, Class: ClassIN}},
+		Answers: []ResourceRecord{
+			{Name: "example.com", Type: RecordTypeA, Class: ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1}},
+		},
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	answerOffset := DNSHeaderSize + 13 + 4
+
+	tests := []struct {
+		name       string
+		length     int
+		wantOffset int
+	}{
+		{"in the header", 8, 0},
+		{"in the question", DNSHeaderSize + 6, DNSHeaderSize},
+		{"in the answer's fixed fields", answerOffset + 6, answerOffset},
+		{"in the answer's RDATA", len(data) - 1, answerOffset},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parsed Message
+			err := parsed.UnmarshalBinary(data[:tt.length])
+			if err == nil {
+				t.Fatal("UnmarshalBinary() accepted a truncated packet")
+			}
+
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("UnmarshalBinary() error = %v, want a *ParseError", err)
+			}
+			if parseErr.Offset != tt.wantOffset {
+				t.Errorf("ParseError.Offset = %d, want %d (%v)", parseErr.Offset, tt.wantOffset, err)
+			}
+			if !strings.Contains(err.Error(), "offset") {
+				t.Errorf("Error %q doesn't mention the offset", err)
+			}
+		})
+	}
+}
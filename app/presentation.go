@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// recordLine is one resource record written on a line in presentation format,
+// as in RPZ and root hints files
+type recordLine struct {
+	Name  string   // owner, without the trailing dot
+	TTL   uint32   // 0 when not given
+	Type  uint16   // record type
+	RData []string // RDATA fields in presentation format
+}
+
+// parseRecordLine parses the fields of a "name [ttl] [IN] type rdata" line
+func parseRecordLine(fields []string) (recordLine, error) {
+	if len(fields) < 3 {
+		return recordLine{}, fmt.Errorf("want name [ttl] [IN] type rdata, got %q", strings.Join(fields, " "))
+	}
+	line := recordLine{Name: strings.TrimSuffix(fields[0], ".")}
+	rest := fields[1:]
+
+	if n, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+		line.TTL = uint32(n)
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && strings.EqualFold(rest[0], "IN") {
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return recordLine{}, fmt.Errorf("missing type or rdata for %s", fields[0])
+	}
+	rrType, ok := TypeByName(rest[0])
+	if !ok {
+		return recordLine{}, fmt.Errorf("unknown record type %q", rest[0])
+	}
+	line.Type = rrType
+	line.RData = rest[1:]
+	return line, nil
+}
+
+// parseRData encodes RDATA of rrType given in presentation format. Names are
+// taken as fully qualified, with or without the trailing dot.
+func parseRData(rrType uint16, fields []string) ([]byte, error) {
+	switch rrType {
+	case RecordTypeA:
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", fields[0])
+		}
+		return ip, nil
+	case RecordTypeAAAA:
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", fields[0])
+		}
+		return ip.To16(), nil
+	case RecordTypeCNAME, RecordTypeNS, RecordTypePTR:
+		var rdata bytes.Buffer
+		if err := encodeDNSName(strings.TrimSuffix(fields[0], "."), &rdata); err != nil {
+			return nil, err
+		}
+		return rdata.Bytes(), nil
+	case RecordTypeTXT:
+		txt := NewTXTData(strings.Trim(strings.Join(fields, " "), `"`))
+		return txt.MarshalBinary()
+	}
+	return nil, fmt.Errorf("unsupported record type %s", TypeName(rrType))
+}
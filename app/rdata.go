@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// SOAData is the RDATA of an SOA record
+type SOAData struct {
+	MName   string // primary name server for the zone
+	RName   string // mailbox of the person responsible for the zone
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (s *SOAData) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := encodeDNSName(s.MName, buf); err != nil {
+		return nil, fmt.Errorf("failed to encode SOA MNAME: %w", err)
+	}
+	if err := encodeDNSName(s.RName, buf); err != nil {
+		return nil, fmt.Errorf("failed to encode SOA RNAME: %w", err)
+	}
+
+	for _, v := range []uint32{s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum} {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *SOAData) UnmarshalBinary(data []byte) error {
+	mname, offset, err := decodeDNSName(data, 0)
+	if err != nil {
+		return fmt.Errorf("failed to decode SOA MNAME: %w", err)
+	}
+	rname, offset, err := decodeDNSName(data, offset)
+	if err != nil {
+		return fmt.Errorf("failed to decode SOA RNAME: %w", err)
+	}
+
+	if offset+20 > len(data) {
+		return fmt.Errorf("data too short for SOA fields: need %d bytes, have %d", offset+20, len(data))
+	}
+
+	s.MName = mname
+	s.RName = rname
+	s.Serial = binary.BigEndian.Uint32(data[offset : offset+4])
+	s.Refresh = binary.BigEndian.Uint32(data[offset+4 : offset+8])
+	s.Retry = binary.BigEndian.Uint32(data[offset+8 : offset+12])
+	s.Expire = binary.BigEndian.Uint32(data[offset+12 : offset+16])
+	s.Minimum = binary.BigEndian.Uint32(data[offset+16 : offset+20])
+	return nil
+}
+
+// RPData is the RDATA of an RP record (RFC 1183)
+type RPData struct {
+	Mbox     string // mailbox of the responsible person, with "@" written as "."
+	TxtDname string // name with TXT records describing the person, "" (the root) for none
+}
+
+func (r *RPData) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeDNSName(r.Mbox, buf); err != nil {
+		return nil, fmt.Errorf("failed to encode RP mbox: %w", err)
+	}
+	if err := encodeDNSName(r.TxtDname, buf); err != nil {
+		return nil, fmt.Errorf("failed to encode RP txt-dname: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *RPData) UnmarshalBinary(data []byte) error {
+	mbox, offset, err := decodeDNSName(data, 0)
+	if err != nil {
+		return fmt.Errorf("failed to decode RP mbox: %w", err)
+	}
+	txt, offset, err := decodeDNSName(data, offset)
+	if err != nil {
+		return fmt.Errorf("failed to decode RP txt-dname: %w", err)
+	}
+	if offset != len(data) {
+		return fmt.Errorf("unexpected %d bytes after RP txt-dname", len(data)-offset)
+	}
+
+	r.Mbox = mbox
+	r.TxtDname = txt
+	return nil
+}
+
+// MaxCharacterString is the longest <character-string> in RDATA (RFC 1035 section 3.3)
+const MaxCharacterString = 255
+
+// TXTData is the RDATA of a TXT record: one or more character-strings
+type TXTData struct {
+	Strings []string
+}
+
+// NewTXTData splits value into as many character-strings as it needs
+func NewTXTData(value string) TXTData {
+	var txt TXTData
+	for len(value) > MaxCharacterString {
+		txt.Strings = append(txt.Strings, value[:MaxCharacterString])
+		value = value[MaxCharacterString:]
+	}
+	txt.Strings = append(txt.Strings, value)
+	return txt
+}
+
+func (t *TXTData) MarshalBinary() ([]byte, error) {
+	if len(t.Strings) == 0 {
+		return nil, fmt.Errorf("TXT record needs at least one string")
+	}
+
+	buf := new(bytes.Buffer)
+	for _, s := range t.Strings {
+		if len(s) > MaxCharacterString {
+			return nil, fmt.Errorf("TXT string too long: %d bytes (max %d)", len(s), MaxCharacterString)
+		}
+		buf.WriteByte(byte(len(s)))
+		buf.WriteString(s)
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *TXTData) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty TXT RDATA")
+	}
+
+	var strs []string
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		if offset+1+length > len(data) {
+			return fmt.Errorf("TXT string at offset %d runs past RDATA", offset)
+		}
+		strs = append(strs, string(data[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	t.Strings = strs
+	return nil
+}
+
+// String joins the character-strings back into the value they were split from
+func (t *TXTData) String() string {
+	return strings.Join(t.Strings, "")
+}
+
+// String returns the presentation format, e.g. "ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+func (s *SOAData) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(s.MName), fqdn(s.RName),
+		s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+}
+
+// String returns the presentation format, e.g. "admin.example.com. info.example.com."
+func (r *RPData) String() string {
+	return fqdn(r.Mbox) + " " + fqdn(r.TxtDname)
+}
+
+// MXData is the RDATA of an MX record
+type MXData struct {
+	Preference uint16 // lower is preferred
+	Exchange   string // host willing to act as a mail exchange
+}
+
+func (m *MXData) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, m.Preference)
+	if err := encodeDNSName(m.Exchange, buf); err != nil {
+		return nil, fmt.Errorf("failed to encode MX exchange: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *MXData) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 {
+		return fmt.Errorf("MX RDATA too short: %d bytes", len(data))
+	}
+	exchange, offset, err := decodeDNSName(data, 2)
+	if err != nil {
+		return fmt.Errorf("failed to decode MX exchange: %w", err)
+	}
+	if offset != len(data) {
+		return fmt.Errorf("unexpected %d bytes after MX exchange", len(data)-offset)
+	}
+
+	m.Preference = binary.BigEndian.Uint16(data[0:2])
+	m.Exchange = exchange
+	return nil
+}
+
+// String returns the presentation format, e.g. "10 mail.example.com."
+func (m *MXData) String() string {
+	return fmt.Sprintf("%d %s", m.Preference, fqdn(m.Exchange))
+}
+
+// SRVData is the RDATA of an SRV record (RFC 2782)
+type SRVData struct {
+	Priority uint16 // lower is tried first
+	Weight   uint16 // relative share among targets of the same priority
+	Port     uint16
+	Target   string // host providing the service
+}
+
+func (s *SRVData) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, s.Priority)
+	binary.Write(buf, binary.BigEndian, s.Weight)
+	binary.Write(buf, binary.BigEndian, s.Port)
+	if err := encodeDNSName(s.Target, buf); err != nil {
+		return nil, fmt.Errorf("failed to encode SRV target: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *SRVData) UnmarshalBinary(data []byte) error {
+	if len(data) < 7 {
+		return fmt.Errorf("SRV RDATA too short: %d bytes", len(data))
+	}
+	target, offset, err := decodeDNSName(data, 6)
+	if err != nil {
+		return fmt.Errorf("failed to decode SRV target: %w", err)
+	}
+	if offset != len(data) {
+		return fmt.Errorf("unexpected %d bytes after SRV target", len(data)-offset)
+	}
+
+	s.Priority = binary.BigEndian.Uint16(data[0:2])
+	s.Weight = binary.BigEndian.Uint16(data[2:4])
+	s.Port = binary.BigEndian.Uint16(data[4:6])
+	s.Target = target
+	return nil
+}
+
+// String returns the presentation format, e.g. "10 60 5060 sip.example.com."
+func (s *SRVData) String() string {
+	return fmt.Sprintf("%d %d %d %s", s.Priority, s.Weight, s.Port, fqdn(s.Target))
+}
+
+// DSData is the RDATA of a DS record, identifying a signed child zone's key (RFC 4034 section 5)
+type DSData struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (d *DSData) MarshalBinary() ([]byte, error) {
+	if len(d.Digest) == 0 {
+		return nil, fmt.Errorf("DS digest is empty")
+	}
+	buf := make([]byte, 4, 4+len(d.Digest))
+	binary.BigEndian.PutUint16(buf[0:2], d.KeyTag)
+	buf[2] = d.Algorithm
+	buf[3] = d.DigestType
+	return append(buf, d.Digest...), nil
+}
+
+func (d *DSData) UnmarshalBinary(data []byte) error {
+	if len(data) < 5 {
+		return fmt.Errorf("DS RDATA too short: %d bytes", len(data))
+	}
+	d.KeyTag = binary.BigEndian.Uint16(data[0:2])
+	d.Algorithm = data[2]
+	d.DigestType = data[3]
+	d.Digest = append([]byte(nil), data[4:]...)
+	return nil
+}
+
+// String returns the presentation format, e.g. "60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"
+func (d *DSData) String() string {
+	return fmt.Sprintf("%d %d %d %X", d.KeyTag, d.Algorithm, d.DigestType, d.Digest)
+}
+
+// fqdn writes name in presentation format, with its trailing dot
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
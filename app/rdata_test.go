@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTXTData_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantStrings int
+	}{
+		{"empty", "", 1},
+		{"short", "v=spf1 -all", 1},
+		{"exactly one string", strings.Repeat("a", MaxCharacterString), 1},
+		{"split", strings.Repeat("b", MaxCharacterString+10), 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txt := NewTXTData(tt.value)
+			if len(txt.Strings) != tt.wantStrings {
+				t.Errorf("NewTXTData() made %d strings, want %d", len(txt.Strings), tt.wantStrings)
+			}
+
+			data, err := txt.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+			var decoded TXTData
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() failed: %v", err)
+			}
+			if decoded.String() != tt.value {
+				t.Errorf("Round trip = %q, want %q", decoded.String(), tt.value)
+			}
+		})
+	}
+
+	var decoded TXTData
+	if err := decoded.UnmarshalBinary([]byte{5, 'a', 'b'}); err == nil {
+		t.Error("UnmarshalBinary() accepted a string running past the RDATA")
+	}
+}
+
+func TestRPData_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		rp   RPData
+	}{
+		{"with txt-dname", RPData{Mbox: "louie.trantor.umd.edu", TxtDname: "lam1.people.umd.edu"}},
+		{"no txt-dname", RPData{Mbox: "hostmaster.example.com", TxtDname: ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdata, err := tt.rp.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() failed: %v", err)
+			}
+			var decoded RPData
+			if err := decoded.UnmarshalBinary(rdata); err != nil {
+				t.Fatalf("UnmarshalBinary() failed: %v", err)
+			}
+			if decoded != tt.rp {
+				t.Errorf("Round trip = %+v, want %+v", decoded, tt.rp)
+			}
+
+			// Through a whole message, where the names sit after the owner name
+			msg := Message{
+				Header: MessageHeader{ANCount: 1},
+				Answers: []ResourceRecord{
+					{Name: "example.com", Type: RecordTypeRP, Class: ClassIN, TTL: 60, RData: rdata},
+				},
+			}
+			data, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("Message.MarshalBinary() failed: %v", err)
+			}
+			var parsed Message
+			if err := parsed.UnmarshalBinary(data); err != nil {
+				t.Fatalf("Message.UnmarshalBinary() failed: %v", err)
+			}
+			if err := decoded.UnmarshalBinary(parsed.Answers[0].RData); err != nil || decoded != tt.rp {
+				t.Errorf("RP from parsed message = %+v (err %v), want %+v", decoded, err, tt.rp)
+			}
+		})
+	}
+
+	var decoded RPData
+	rdata, _ := (&RPData{Mbox: "a.example.com", TxtDname: "b.example.com"}).MarshalBinary()
+	if err := decoded.UnmarshalBinary(append(rdata, 0)); err == nil {
+		t.Error("UnmarshalBinary() accepted trailing bytes")
+	}
+	if err := decoded.UnmarshalBinary(rdata[:5]); err == nil {
+		t.Error("UnmarshalBinary() accepted a truncated mbox")
+	}
+}
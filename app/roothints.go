@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// RootHints are the name servers of the root zone and their addresses, the
+// starting point for resolving from scratch and for priming caches (RFC 9609)
+type RootHints struct {
+	NS   []ResourceRecord // NS records for the root
+	Glue []ResourceRecord // A and AAAA records of the name servers
+}
+
+// DefaultRootHints are the root servers as published by IANA in named.root
+var DefaultRootHints = mustParseRootHints(defaultRootHintsFile)
+
+// defaultRootHintsFile is the IANA named.root file, trimmed of its header comments
+const defaultRootHintsFile = `
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000      AAAA  2801:1b8:10::b
+.                        3600000      NS    C.ROOT-SERVERS.NET.
+C.ROOT-SERVERS.NET.      3600000      A     192.33.4.12
+C.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2::c
+.                        3600000      NS    D.ROOT-SERVERS.NET.
+D.ROOT-SERVERS.NET.      3600000      A     199.7.91.13
+D.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2d::d
+.                        3600000      NS    E.ROOT-SERVERS.NET.
+E.ROOT-SERVERS.NET.      3600000      A     192.203.230.10
+E.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:a8::e
+.                        3600000      NS    F.ROOT-SERVERS.NET.
+F.ROOT-SERVERS.NET.      3600000      A     192.5.5.241
+F.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2f::f
+.                        3600000      NS    G.ROOT-SERVERS.NET.
+G.ROOT-SERVERS.NET.      3600000      A     192.112.36.4
+G.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:12::d0d
+.                        3600000      NS    H.ROOT-SERVERS.NET.
+H.ROOT-SERVERS.NET.      3600000      A     198.97.190.53
+H.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:1::53
+.                        3600000      NS    I.ROOT-SERVERS.NET.
+I.ROOT-SERVERS.NET.      3600000      A     192.36.148.17
+I.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fe::53
+.                        3600000      NS    J.ROOT-SERVERS.NET.
+J.ROOT-SERVERS.NET.      3600000      A     192.58.128.30
+J.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:c27::2:30
+.                        3600000      NS    K.ROOT-SERVERS.NET.
+K.ROOT-SERVERS.NET.      3600000      A     193.0.14.129
+K.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fd::1
+.                        3600000      NS    L.ROOT-SERVERS.NET.
+L.ROOT-SERVERS.NET.      3600000      A     199.7.83.42
+L.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:9f::42
+.                        3600000      NS    M.ROOT-SERVERS.NET.
+M.ROOT-SERVERS.NET.      3600000      A     202.12.27.33
+M.ROOT-SERVERS.NET.      3600000      AAAA  2001:dc3::35
+`
+
+// LoadRootHints reads root hints from the named.root file at path
+func LoadRootHints(path string) (*RootHints, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open root hints: %w", err)
+	}
+	defer f.Close()
+	return ParseRootHints(f)
+}
+
+// ParseRootHints reads root hints in named.root format: NS records for the root
+// and A and AAAA records for the servers, with comments starting with ";".
+// Every name server needs an address and every address a name server, and
+// errors give the line they were found on.
+func ParseRootHints(r io.Reader) (*RootHints, error) {
+	hints := &RootHints{}
+	nsLines := map[string]int{}   // line of each name server's NS record
+	glueLines := map[string]int{} // line of each name server's first address
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		line, err := parseRecordLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("root hints line %d: %w", n, err)
+		}
+		switch line.Type {
+		case RecordTypeNS:
+			if !isRootName(line.Name) {
+				return nil, fmt.Errorf("root hints line %d: NS record for %s, want one for the root", n, fields[0])
+			}
+		case RecordTypeA, RecordTypeAAAA:
+			if isRootName(line.Name) {
+				return nil, fmt.Errorf("root hints line %d: address record for the root", n)
+			}
+		default:
+			return nil, fmt.Errorf("root hints line %d: unexpected %s record, want NS, A or AAAA", n, TypeName(line.Type))
+		}
+		if len(line.RData) != 1 {
+			return nil, fmt.Errorf("root hints line %d: want one RDATA field, got %d", n, len(line.RData))
+		}
+		rdata, err := parseRData(line.Type, line.RData)
+		if err != nil {
+			return nil, fmt.Errorf("root hints line %d: %w", n, err)
+		}
+
+		rr := ResourceRecord{Name: line.Name, Type: line.Type, Class: ClassIN, TTL: line.TTL, RData: rdata}
+		if line.Type == RecordTypeNS {
+			server := strings.ToLower(strings.TrimSuffix(line.RData[0], "."))
+			if _, dup := nsLines[server]; dup {
+				return nil, fmt.Errorf("root hints line %d: %s is listed twice", n, line.RData[0])
+			}
+			nsLines[server] = n
+			hints.NS = append(hints.NS, rr)
+		} else {
+			if _, found := glueLines[strings.ToLower(line.Name)]; !found {
+				glueLines[strings.ToLower(line.Name)] = n
+			}
+			hints.Glue = append(hints.Glue, rr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read root hints: %w", err)
+	}
+	if len(hints.NS) == 0 {
+		return nil, fmt.Errorf("root hints have no NS records")
+	}
+
+	// named.root lists each server's addresses after its NS record, so they can
+	// only be matched up once the whole file is read
+	for _, rr := range hints.Glue {
+		server := strings.ToLower(rr.Name)
+		if _, found := nsLines[server]; !found {
+			return nil, fmt.Errorf("root hints line %d: address for %s, which isn't a root name server", glueLines[server], rr.Name)
+		}
+	}
+	for _, rr := range hints.NS {
+		target, _, _ := decodeDNSName(rr.RData, 0)
+		server := strings.ToLower(target)
+		if _, found := glueLines[server]; !found {
+			return nil, fmt.Errorf("root hints line %d: no address for name server %s", nsLines[server], target)
+		}
+	}
+	return hints, nil
+}
+
+// mustParseRootHints parses compiled-in root hints, panicking if they're invalid
+func mustParseRootHints(data string) *RootHints {
+	hints, err := ParseRootHints(strings.NewReader(data))
+	if err != nil {
+		panic(err)
+	}
+	return hints
+}
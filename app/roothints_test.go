@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRootHints(t *testing.T) {
+	hints, err := ParseRootHints(strings.NewReader(`;       This file holds the information on root name servers
+;
+; FORMERLY NS.INTERNIC.NET
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+; OPERATED BY ICANN
+;
+.                        3600000      NS    L.ROOT-SERVERS.NET.
+L.ROOT-SERVERS.NET.      3600000      A     199.7.83.42
+L.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:9f::42
+; End of file
+`))
+	if err != nil {
+		t.Fatalf("ParseRootHints() failed: %v", err)
+	}
+
+	var servers []string
+	for _, rr := range hints.NS {
+		if rr.Name != "" || rr.Type != RecordTypeNS || rr.TTL != 3600000 {
+			t.Errorf("NS record = %+v, want one for the root with TTL 3600000", rr)
+		}
+		ns, _, err := decodeDNSName(rr.RData, 0)
+		if err != nil {
+			t.Fatalf("Failed to decode NS RDATA: %v", err)
+		}
+		servers = append(servers, ns)
+	}
+	if len(servers) != 2 || servers[0] != "A.ROOT-SERVERS.NET" || servers[1] != "L.ROOT-SERVERS.NET" {
+		t.Errorf("Name servers = %v, want A and L", servers)
+	}
+
+	want := []struct {
+		name   string
+		rrType uint16
+		addr   string
+	}{
+		{"A.ROOT-SERVERS.NET", RecordTypeA, "198.41.0.4"},
+		{"A.ROOT-SERVERS.NET", RecordTypeAAAA, "2001:503:ba3e::2:30"},
+		{"L.ROOT-SERVERS.NET", RecordTypeA, "199.7.83.42"},
+		{"L.ROOT-SERVERS.NET", RecordTypeAAAA, "2001:500:9f::42"},
+	}
+	if len(hints.Glue) != len(want) {
+		t.Fatalf("Parsed %d address records, want %d", len(hints.Glue), len(want))
+	}
+	for i, rr := range hints.Glue {
+		if rr.Name != want[i].name || rr.Type != want[i].rrType || !net.IP(rr.RData).Equal(net.ParseIP(want[i].addr)) {
+			t.Errorf("Address record %d = %s %s %v, want %s %s %s", i, rr.Name, TypeName(rr.Type), net.IP(rr.RData), want[i].name, TypeName(want[i].rrType), want[i].addr)
+		}
+	}
+}
+
+func TestParseRootHints_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		hints string
+		want  string
+	}{
+		{"no name servers", "; nothing here\n", "no NS records"},
+		{"missing rdata", ". 3600000 NS\n", "line 1"},
+		{"NS below the root", ". NS A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET. A 198.41.0.4\nexample. NS ns.example.\n", "line 3: NS record for example."},
+		{"unexpected type", ". NS A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET. MX 10 mail.\n", "line 2: unexpected MX record"},
+		{"IPv6 in an A record", ". NS A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET. A 2001:503:ba3e::2:30\n", "line 2: invalid IPv4 address"},
+		{"IPv4 in an AAAA record", ". NS A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET. AAAA 198.41.0.4\n", "line 2: invalid IPv6 address"},
+		{"address for another server", ". NS A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET. A 198.41.0.4\nB.ROOT-SERVERS.NET. A 170.247.170.2\n", "line 3: address for B.ROOT-SERVERS.NET"},
+		{"server without an address", ". NS A.ROOT-SERVERS.NET.\n\n. NS B.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET. A 198.41.0.4\n", "line 3: no address for name server B.ROOT-SERVERS.NET"},
+		{"server listed twice", ". NS A.ROOT-SERVERS.NET.\n. NS a.root-servers.net\n", "line 2: a.root-servers.net is listed twice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRootHints(strings.NewReader(tt.hints))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseRootHints() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
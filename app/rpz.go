@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// RPZAction is what a response policy zone does to queries for a name
+type RPZAction int
+
+const (
+	RPZNXDomain  RPZAction = iota + 1 // CNAME . answers NXDOMAIN
+	RPZNoData                         // CNAME *. answers NOERROR without records
+	RPZLocalData                      // any other records replace the real answer
+)
+
+// rpzRule is the policy for one trigger name
+type rpzRule struct {
+	action  RPZAction
+	records []ResourceRecord // local data, owned by the trigger name
+}
+
+// RPZ is a response policy zone: names whose resolution is overridden before
+// normal resolution. Each line of an RPZ file holds one record,
+//
+//	name [ttl] [IN] type rdata
+//
+// where name may start with "*." to also match every name below it. Exact
+// names take precedence over wildcards, and closer wildcards over further ones.
+// CNAME . and CNAME *. select the NXDOMAIN and NODATA actions; A, AAAA, TXT and
+// other CNAME records are answered in place of the real records. Text after a
+// ";" is a comment.
+type RPZ struct {
+	rules map[string]*rpzRule // by lowercase name without the trailing dot
+}
+
+// LoadRPZ reads the response policy zone in the file at path
+func LoadRPZ(path string) (*RPZ, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RPZ: %w", err)
+	}
+	defer f.Close()
+	return ParseRPZ(f)
+}
+
+// ParseRPZ reads a response policy zone, reporting the line of any malformed record
+func ParseRPZ(r io.Reader) (*RPZ, error) {
+	rpz := &RPZ{rules: make(map[string]*rpzRule)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := rpz.add(fields); err != nil {
+			return nil, fmt.Errorf("RPZ line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read RPZ: %w", err)
+	}
+	return rpz, nil
+}
+
+// add adds the record in fields to the policy for its name
+func (z *RPZ) add(fields []string) error {
+	line, err := parseRecordLine(fields)
+	if err != nil {
+		return err
+	}
+	line.Name = strings.ToLower(line.Name)
+
+	rule, found := z.rules[line.Name]
+	if !found {
+		rule = &rpzRule{action: RPZLocalData}
+		z.rules[line.Name] = rule
+	}
+	if target := line.RData[0]; line.Type == RecordTypeCNAME && (target == "." || target == "*.") {
+		if len(rule.records) > 0 {
+			return fmt.Errorf("%s has both records and a CNAME %s action", fields[0], target)
+		}
+		rule.action = RPZNXDomain
+		if target == "*." {
+			rule.action = RPZNoData
+		}
+		return nil
+	}
+	if rule.action != RPZLocalData {
+		return fmt.Errorf("%s has both an action and records", fields[0])
+	}
+
+	switch line.Type {
+	case RecordTypeA, RecordTypeAAAA, RecordTypeCNAME, RecordTypeTXT:
+	default:
+		return fmt.Errorf("unsupported record type %s for %s", TypeName(line.Type), fields[0])
+	}
+	rdata, err := parseRData(line.Type, line.RData)
+	if err != nil {
+		return fmt.Errorf("invalid %s record for %s: %w", TypeName(line.Type), fields[0], err)
+	}
+	rule.records = append(rule.records, ResourceRecord{Name: line.Name, Type: line.Type, Class: ClassIN, TTL: line.TTL, RData: rdata})
+	return nil
+}
+
+// Rewrite applies the policy for q's name, if there is one. Local data is
+// answered under q's name; a name with local data but none of q's type, nor a
+// CNAME, gets a NODATA answer.
+func (z *RPZ) Rewrite(q Question) (Result, bool) {
+	rule := z.match(strings.ToLower(strings.TrimSuffix(q.Name, ".")))
+	if rule == nil {
+		return Result{}, false
+	}
+	switch rule.action {
+	case RPZNXDomain:
+		return Result{Rcode: RCodeNXDomain}, true
+	case RPZNoData:
+		return Result{}, true
+	}
+
+	var answers []ResourceRecord
+	for _, rr := range rule.records {
+		if rr.Type == q.Type || rr.Type == RecordTypeCNAME {
+			rr.Name = q.Name
+			rr.RData = cloneBytes(rr.RData)
+			answers = append(answers, rr)
+		}
+	}
+	return Result{Answers: answers}, true
+}
+
+// match finds the rule for name: its own, or else the closest wildcard above it
+func (z *RPZ) match(name string) *rpzRule {
+	if rule, found := z.rules[name]; found {
+		return rule
+	}
+	for parent := name; parent != ""; {
+		_, parent, _ = strings.Cut(parent, ".")
+		if rule, found := z.rules["*."+parent]; found {
+			return rule
+		}
+	}
+	return nil
+}
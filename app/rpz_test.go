@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testRPZ = `; test policy
+bad.example.com        CNAME .
+nodata.example.com     CNAME *.
+*.ads.example.com      CNAME .
+sinkhole.example.com   60 IN A 10.0.0.1
+sinkhole.example.com   TXT "blocked by policy"
+redirect.example.com   CNAME walled.example.net.
+`
+
+func TestDNSHandler_RPZ(t *testing.T) {
+	rpz, err := ParseRPZ(strings.NewReader(testRPZ))
+	if err != nil {
+		t.Fatalf("ParseRPZ() failed: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		q             Question
+		wantRcode     uint8
+		wantAnswers   []string
+		wantForwarded bool
+	}{
+		{"nxdomain", Question{Name: "bad.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNXDomain, nil, false},
+		{"nodata", Question{Name: "nodata.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, nil, false},
+		{"wildcard", Question{Name: "tracker.ads.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNXDomain, nil, false},
+		{"wildcard doesn't match its own name", Question{Name: "ads.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, []string{"10.0.0.1"}, true},
+		{"sinkhole address", Question{Name: "sinkhole.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, []string{"10.0.0.1"}, false},
+		{"sinkhole without the asked type", Question{Name: "sinkhole.example.com", Type: RecordTypeAAAA, Class: ClassIN}, RCodeNoError, nil, false},
+		{"replacement CNAME", Question{Name: "redirect.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, []string{"walled.example.net"}, false},
+		{"unlisted name", Question{Name: "good.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError, []string{"10.0.0.1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &flakyForwarder{}
+			response, err := NewDNSHandler(buildTestDNSQuery(0x0448, []Question{tt.q}), WithUpstream(upstream), WithRPZ(rpz)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if forwarded := upstream.calls.Load() > 0; forwarded != tt.wantForwarded {
+				t.Errorf("Forwarded = %v, want %v", forwarded, tt.wantForwarded)
+			}
+			if len(respMsg.Answers) != len(tt.wantAnswers) {
+				t.Fatalf("Response has %d answers, want %d", len(respMsg.Answers), len(tt.wantAnswers))
+			}
+			for i, rr := range respMsg.Answers {
+				if rr.Name != tt.q.Name {
+					t.Errorf("Answer %d owner = %q, want %q", i, rr.Name, tt.q.Name)
+				}
+				if rr.TTL == 0 {
+					t.Errorf("Answer %d has no TTL", i)
+				}
+				value, err := rr.Decode()
+				if err != nil {
+					t.Fatalf("Decode() failed: %v", err)
+				}
+				got := value
+				if ip, ok := value.(net.IP); ok {
+					got = ip.String()
+				}
+				if got != tt.wantAnswers[i] {
+					t.Errorf("Answer %d = %v, want %s", i, got, tt.wantAnswers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseRPZ_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		zone     string
+		wantLine string
+	}{
+		{"missing rdata", "ok.example.com CNAME .\nbad.example.com A\n", "line 2"},
+		{"unknown type", "bad.example.com BOGUS 1\n", "line 1"},
+		{"invalid address", "; comment\n\nbad.example.com A 10.0.0\n", "line 3"},
+		{"action and records", "bad.example.com A 10.0.0.1\nbad.example.com CNAME .\n", "line 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRPZ(strings.NewReader(tt.zone))
+			if err == nil || !strings.Contains(err.Error(), tt.wantLine) {
+				t.Errorf("ParseRPZ() error = %v, want one on %s", err, tt.wantLine)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+)
+
+// Shuffler spreads load across the addresses of a name by shuffling the records
+// within each RRset of an answer, so clients that take the first record don't
+// all pick the same one
+type Shuffler struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewShuffler creates a shuffler drawing from src. Production passes a time-seeded
+// source; tests pass a fixed one to get a reproducible order.
+func NewShuffler(src rand.Source) *Shuffler {
+	return &Shuffler{rng: rand.New(src)}
+}
+
+// Shuffle reorders records in place within each run of consecutive records sharing
+// an owner name and type. Runs keep their positions, so a CNAME still comes before
+// the records of its target.
+func (s *Shuffler) Shuffle(records []ResourceRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && records[end].Type == records[start].Type &&
+			strings.EqualFold(records[end].Name, records[start].Name) {
+			end++
+		}
+		run := records[start:end]
+		s.rng.Shuffle(len(run), func(i, j int) { run[i], run[j] = run[j], run[i] })
+		start = end
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// answerOrder returns the last address byte of each answer, in order
+func answerOrder(t *testing.T, opts ...HandlerOption) []byte {
+	t.Helper()
+	queryData := buildTestDNSQuery(0x0424, []Question{{Name: "pool.example.test", Type: RecordTypeA, Class: ClassIN}})
+	response, err := NewDNSHandler(queryData, opts...).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	var order []byte
+	for _, rr := range respMsg.Answers {
+		order = append(order, rr.RData[3])
+	}
+	return order
+}
+
+func TestShuffler_FixedSeedIsReproducible(t *testing.T) {
+	var addrs []net.IP
+	for i := range 8 {
+		addrs = append(addrs, net.IPv4(192, 0, 2, byte(i+1)))
+	}
+	store := WithStore(NewMemoryStore(map[string]HostEntry{"pool.example.test": {A: addrs}}))
+
+	unshuffled := answerOrder(t, store)
+	if want := []byte{1, 2, 3, 4, 5, 6, 7, 8}; !reflect.DeepEqual(unshuffled, want) {
+		t.Fatalf("Answers without a shuffler = %v, want store order %v", unshuffled, want)
+	}
+
+	run := func() [][]byte {
+		shuffler := NewShuffler(rand.NewPCG(42, 424))
+		var orders [][]byte
+		for range 3 {
+			orders = append(orders, answerOrder(t, store, WithShuffler(shuffler)))
+		}
+		return orders
+	}
+	first, second := run(), run()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Same seed gave different orders: %v and %v", first, second)
+	}
+	if reflect.DeepEqual(first[0], unshuffled) && reflect.DeepEqual(first[1], unshuffled) {
+		t.Errorf("Shuffled answers kept the store order: %v", first)
+	}
+}
+
+func TestShuffler_KeepsRRsetsInPlace(t *testing.T) {
+	cname := ResourceRecord{Name: "www.example.test", Type: RecordTypeCNAME, Class: ClassIN}
+	records := []ResourceRecord{cname}
+	for i := range 5 {
+		records = append(records, ResourceRecord{Name: "example.test", Type: RecordTypeA, Class: ClassIN, RData: []byte{192, 0, 2, byte(i)}})
+	}
+
+	NewShuffler(rand.NewPCG(1, 2)).Shuffle(records)
+	if records[0].Type != RecordTypeCNAME {
+		t.Errorf("CNAME moved from the front: %+v", records[0])
+	}
+	seen := make(map[byte]bool)
+	for _, rr := range records[1:] {
+		seen[rr.RData[3]] = true
+	}
+	if len(seen) != 5 {
+		t.Errorf("Shuffle() lost records, have %v", seen)
+	}
+}
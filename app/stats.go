@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultStatsCapacity bounds how many distinct names QueryStats tracks
+const DefaultStatsCapacity = 10000
+
+// QueryStats counts queries per record type and keeps approximate per-name counts
+// for the most queried names. Memory stays bounded under floods of unique names:
+// when the name table is full, the least queried half is pruned.
+type QueryStats struct {
+	capacity int
+
+	mu     sync.Mutex
+	types  map[uint16]uint64
+	names  map[string]uint64
+	total  uint64
+	pruned uint64 // number of times the name table was pruned
+}
+
+// NameCount is a queried name and how often it was seen
+type NameCount struct {
+	Name  string
+	Count uint64
+}
+
+// NewQueryStats creates stats tracking at most capacity distinct names
+func NewQueryStats(capacity int) *QueryStats {
+	if capacity < 2 {
+		capacity = 2
+	}
+	return &QueryStats{
+		capacity: capacity,
+		types:    make(map[uint16]uint64),
+		names:    make(map[string]uint64),
+	}
+}
+
+// Record counts one question
+func (s *QueryStats) Record(q Question) {
+	name := strings.ToLower(q.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+	s.types[q.Type]++
+	if _, tracked := s.names[name]; !tracked && len(s.names) >= s.capacity {
+		s.prune()
+	}
+	s.names[name]++
+}
+
+// prune drops the least queried half of the tracked names. Callers must hold s.mu.
+func (s *QueryStats) prune() {
+	counts := s.sortedNames()
+	for _, nc := range counts[len(counts)/2:] {
+		delete(s.names, nc.Name)
+	}
+	s.pruned++
+}
+
+// sortedNames returns the tracked names by descending count. Callers must hold s.mu.
+func (s *QueryStats) sortedNames() []NameCount {
+	counts := make([]NameCount, 0, len(s.names))
+	for name, count := range s.names {
+		counts = append(counts, NameCount{Name: name, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	return counts
+}
+
+// TopNames returns up to n of the most queried names, most queried first
+func (s *QueryStats) TopNames(n int) []NameCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := s.sortedNames()
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// TypeCounts returns the number of queries seen per record type
+func (s *QueryStats) TypeCounts() map[uint16]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[uint16]uint64, len(s.types))
+	for t, count := range s.types {
+		counts[t] = count
+	}
+	return counts
+}
+
+// Tracked returns how many distinct names are currently tracked
+func (s *QueryStats) Tracked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.names)
+}
+
+// WriteMetrics implements MetricsCollector, reporting the type counters and the top 10 names
+func (s *QueryStats) WriteMetrics(w io.Writer) {
+	types := s.TypeCounts()
+	ordered := make([]uint16, 0, len(types))
+	for t := range types {
+		ordered = append(ordered, t)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i] < ordered[j] })
+
+	fmt.Fprintln(w, "# HELP dns_queries_total Questions received, by record type.")
+	fmt.Fprintln(w, "# TYPE dns_queries_total counter")
+	for _, t := range ordered {
+		fmt.Fprintf(w, "dns_queries_total{type=%q} %d\n", TypeName(t), types[t])
+	}
+
+	fmt.Fprintln(w, "# HELP dns_top_name_queries Approximate question count for the most queried names.")
+	fmt.Fprintln(w, "# TYPE dns_top_name_queries gauge")
+	for _, nc := range s.TopNames(10) {
+		fmt.Fprintf(w, "dns_top_name_queries{name=%q} %d\n", nc.Name, nc.Count)
+	}
+}
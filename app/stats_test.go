@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueryStats_TopNamesAndTypes(t *testing.T) {
+	stats := NewQueryStats(100)
+
+	queries := []struct {
+		name  string
+		qtype uint16
+		times int
+	}{
+		{"popular.example.com", RecordTypeA, 50},
+		{"Popular.Example.com", RecordTypeAAAA, 10}, // same name, different case
+		{"second.example.com", RecordTypeA, 30},
+		{"third.example.com", RecordTypeMX, 5},
+	}
+	for _, q := range queries {
+		for i := 0; i < q.times; i++ {
+			stats.Record(Question{Name: q.name, Type: q.qtype, Class: ClassIN})
+		}
+	}
+
+	top := stats.TopNames(2)
+	want := []NameCount{{"popular.example.com", 60}, {"second.example.com", 30}}
+	if len(top) != 2 || top[0] != want[0] || top[1] != want[1] {
+		t.Errorf("TopNames(2) = %+v, want %+v", top, want)
+	}
+
+	types := stats.TypeCounts()
+	if types[RecordTypeA] != 80 || types[RecordTypeAAAA] != 10 || types[RecordTypeMX] != 5 {
+		t.Errorf("TypeCounts() = %v, want A=80 AAAA=10 MX=5", types)
+	}
+
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(stats).ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+	for _, line := range []string{
+		`dns_queries_total{type="A"} 80`,
+		`dns_queries_total{type="MX"} 5`,
+		`dns_top_name_queries{name="popular.example.com"} 60`,
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("Metrics missing %q:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestQueryStats_BoundedUnderUniqueNameFlood(t *testing.T) {
+	const capacity = 64
+	stats := NewQueryStats(capacity)
+
+	for i := 0; i < 100; i++ {
+		stats.Record(Question{Name: "hot.example.com", Type: RecordTypeA, Class: ClassIN})
+	}
+	for i := 0; i < 10000; i++ {
+		stats.Record(Question{Name: fmt.Sprintf("random%d.example.com", i), Type: RecordTypeA, Class: ClassIN})
+		if tracked := stats.Tracked(); tracked > capacity {
+			t.Fatalf("Tracking %d names, want at most %d", tracked, capacity)
+		}
+	}
+
+	top := stats.TopNames(1)
+	if len(top) != 1 || top[0].Name != "hot.example.com" || top[0].Count != 100 {
+		t.Errorf("TopNames(1) = %+v, want hot.example.com with 100 queries to survive pruning", top)
+	}
+}
+
+func TestDNSHandler_RecordsStats(t *testing.T) {
+	stats := NewQueryStats(DefaultStatsCapacity)
+	queryData := buildTestDNSQuery(0x0370, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+		{Name: "stackoverflow.com", Type: RecordTypeAAAA, Class: ClassIN},
+	})
+	if _, err := NewDNSHandler(queryData, WithStats(stats)).Handle(); err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	if top := stats.TopNames(1); len(top) != 1 || top[0].Count != 2 {
+		t.Errorf("TopNames(1) = %+v, want stackoverflow.com with 2 queries", top)
+	}
+}
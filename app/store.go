@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RecordStore is a source of records the handler answers from when it isn't forwarding.
+// Lookup returns no records and no error when the store has nothing for the question.
+type RecordStore interface {
+	Lookup(name string, qtype, qclass uint16) ([]ResourceRecord, error)
+}
+
+// MaxCNAMEChain is how many aliases Lookup follows before giving up, guarding against loops
+const MaxCNAMEChain = 8
+
+// HostEntry holds the addresses a name resolves to. Either list may be empty,
+// so a host can be IPv4-only, IPv6-only, or dual-stack. A name with a CNAME is
+// an alias: queries of any other type are answered with the CNAME and the
+// records of its target.
+type HostEntry struct {
+	A     []net.IP // IPv4 addresses served for A queries
+	AAAA  []net.IP // IPv6 addresses served for AAAA queries
+	TXT   []string // values served for TXT queries, one record each
+	CNAME string   // canonical name this name is an alias for, empty if it isn't one
+}
+
+// clone returns a deep copy of the entry
+func (e HostEntry) clone() HostEntry {
+	var txt []string
+	if e.TXT != nil {
+		txt = append([]string(nil), e.TXT...)
+	}
+	return HostEntry{A: cloneIPs(e.A), AAAA: cloneIPs(e.AAAA), TXT: txt, CNAME: e.CNAME}
+}
+
+// empty reports whether the entry has no records of any type
+func (e HostEntry) empty() bool {
+	return len(e.A) == 0 && len(e.AAAA) == 0 && len(e.TXT) == 0 && e.CNAME == ""
+}
+
+// MemoryStore is an in-memory record store that is safe for concurrent use.
+// Keys are domain names (wildcards like "*.example.com" are allowed).
+type MemoryStore struct {
+	mu       sync.RWMutex
+	records  map[string]HostEntry
+	fallback *HostEntry // served for names not in records, nil for no fallback
+}
+
+// defaultStore is the store used by handlers that don't have one configured
+var defaultStore = newMockStore()
+
+// newMockStore creates a store with the mock records that answers unknown names with defaultMockIP
+func newMockStore() *MemoryStore {
+	s := NewMemoryStore(mockDNSRecords)
+	s.SetFallback(&HostEntry{A: []net.IP{defaultMockIP}})
+	return s
+}
+
+// NewMemoryStore creates a store seeded with a copy of the given records
+func NewMemoryStore(records map[string]HostEntry) *MemoryStore {
+	s := &MemoryStore{records: make(map[string]HostEntry, len(records))}
+	for name, entry := range records {
+		s.records[name] = entry.clone()
+	}
+	return s
+}
+
+// Get looks up a domain, supporting wildcard patterns
+func (s *MemoryStore) Get(name string) (HostEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Try exact match first
+	if entry, found := s.records[name]; found {
+		return entry, true
+	}
+
+	// Try wildcard match: *.example.com matches foo.example.com
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 2 {
+		if entry, found := s.records["*."+parts[1]]; found {
+			return entry, true
+		}
+	}
+
+	if s.fallback != nil {
+		return *s.fallback, true
+	}
+	return HostEntry{}, false
+}
+
+// Lookup implements RecordStore. Records carry no TTL of their own, so answers
+// have a zero TTL and the handler applies its configured default.
+// A name that exists but has no addresses of the requested type yields no records (NODATA).
+// Aliases are followed within the store, so the answer is the CNAME chain then the target's records.
+func (s *MemoryStore) Lookup(name string, qtype, qclass uint16) ([]ResourceRecord, error) {
+	if qclass != ClassIN {
+		return nil, nil
+	}
+
+	var chain []ResourceRecord
+	for range MaxCNAMEChain + 1 {
+		entry, found := s.Get(name)
+		if !found {
+			return chain, nil
+		}
+		if entry.CNAME == "" || qtype == RecordTypeCNAME {
+			records, err := entryRecords(name, entry, qtype)
+			if err != nil {
+				return nil, err
+			}
+			return append(chain, records...), nil
+		}
+
+		alias, err := entryRecords(name, entry, RecordTypeCNAME)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, alias...)
+		name = entry.CNAME
+	}
+	return nil, fmt.Errorf("CNAME chain from %s is longer than %d", chain[0].Name, MaxCNAMEChain)
+}
+
+// entryRecords returns the records of type qtype held by the entry for name
+func entryRecords(name string, entry HostEntry, qtype uint16) ([]ResourceRecord, error) {
+	var records []ResourceRecord
+	switch qtype {
+	case RecordTypeA:
+		for _, ip := range entry.A {
+			if ip4 := ip.To4(); ip4 != nil {
+				records = append(records, ResourceRecord{Name: name, Type: RecordTypeA, Class: ClassIN, RData: cloneBytes(ip4)})
+			}
+		}
+	case RecordTypeAAAA:
+		for _, ip := range entry.AAAA {
+			if ip16 := ip.To16(); ip16 != nil && ip.To4() == nil {
+				records = append(records, ResourceRecord{Name: name, Type: RecordTypeAAAA, Class: ClassIN, RData: cloneBytes(ip16)})
+			}
+		}
+	case RecordTypeTXT:
+		for _, value := range entry.TXT {
+			txt := NewTXTData(value)
+			rdata, err := txt.MarshalBinary()
+			if err != nil {
+				return nil, fmt.Errorf("invalid TXT value for %s: %w", name, err)
+			}
+			records = append(records, ResourceRecord{Name: name, Type: RecordTypeTXT, Class: ClassIN, RData: rdata})
+		}
+	case RecordTypeCNAME:
+		if entry.CNAME != "" {
+			var rdata bytes.Buffer
+			if err := encodeDNSName(entry.CNAME, &rdata); err != nil {
+				return nil, fmt.Errorf("invalid CNAME target for %s: %w", name, err)
+			}
+			records = append(records, ResourceRecord{Name: name, Type: RecordTypeCNAME, Class: ClassIN, RData: rdata.Bytes()})
+		}
+	}
+	return records, nil
+}
+
+// Set adds or replaces the record for a domain
+func (s *MemoryStore) Set(name string, entry HostEntry) {
+	entry = entry.clone()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = entry
+}
+
+// AddTXT adds a TXT value to name, creating the name if it doesn't exist.
+// Adding a value that is already present does nothing.
+func (s *MemoryStore) AddTXT(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.records[name]
+	for _, existing := range entry.TXT {
+		if existing == value {
+			return
+		}
+	}
+	entry = entry.clone()
+	entry.TXT = append(entry.TXT, value)
+	s.records[name] = entry
+}
+
+// RemoveTXT removes a TXT value from name, and the name itself once it has no records left.
+// It reports whether the value was present.
+func (s *MemoryStore) RemoveTXT(name, value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, found := s.records[name]
+	if !found {
+		return false
+	}
+	for i, existing := range entry.TXT {
+		if existing != value {
+			continue
+		}
+		entry = entry.clone()
+		entry.TXT = append(entry.TXT[:i], entry.TXT[i+1:]...)
+		if entry.empty() {
+			delete(s.records, name)
+		} else {
+			s.records[name] = entry
+		}
+		return true
+	}
+	return false
+}
+
+// ValidateCNAMEs checks that every alias in records resolves within maxChain
+// steps, so loops are caught when records are loaded rather than at query time.
+// The error names every alias whose chain loops or runs too long.
+func ValidateCNAMEs(records map[string]HostEntry, maxChain int) error {
+	var loops, tooLong []string
+	for name, entry := range records {
+		if entry.CNAME == "" {
+			continue
+		}
+		seen := map[string]bool{name: true}
+		for steps := 1; ; steps++ {
+			target, found := records[entry.CNAME]
+			if !found {
+				// Wildcards match the same way Get does
+				if _, parent, ok := strings.Cut(entry.CNAME, "."); ok {
+					target, found = records["*."+parent]
+				}
+			}
+			if !found || target.CNAME == "" {
+				break
+			}
+			if seen[entry.CNAME] {
+				loops = append(loops, name)
+				break
+			}
+			if steps >= maxChain {
+				tooLong = append(tooLong, name)
+				break
+			}
+			seen[entry.CNAME] = true
+			entry = target
+		}
+	}
+	if len(loops) == 0 && len(tooLong) == 0 {
+		return nil
+	}
+
+	sort.Strings(loops)
+	sort.Strings(tooLong)
+	var problems []string
+	if len(loops) > 0 {
+		problems = append(problems, fmt.Sprintf("CNAME loops at %s", strings.Join(loops, ", ")))
+	}
+	if len(tooLong) > 0 {
+		problems = append(problems, fmt.Sprintf("CNAME chains longer than %d at %s", maxChain, strings.Join(tooLong, ", ")))
+	}
+	return fmt.Errorf("invalid records: %s", strings.Join(problems, "; "))
+}
+
+// SetFallback sets the entry served for names that aren't in the store, nil to disable
+func (s *MemoryStore) SetFallback(entry *HostEntry) {
+	if entry != nil {
+		clone := entry.clone()
+		entry = &clone
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = entry
+}
+
+// EmptyNonTerminal reports whether name has no records of its own but names
+// below it do, like b.example.com when only a.b.example.com is defined. It
+// scans the records in place, without the copying of Snapshot.
+func (s *MemoryStore) EmptyNonTerminal(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, found := s.records[name]; found {
+		return false
+	}
+	for owner := range s.records {
+		if owner != name && inDomain(owner, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot returns a copy of all records currently in the store
+func (s *MemoryStore) Snapshot() map[string]HostEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make(map[string]HostEntry, len(s.records))
+	for name, entry := range s.records {
+		snapshot[name] = entry.clone()
+	}
+	return snapshot
+}
+
+// cloneIPs returns a deep copy of a list of addresses
+func cloneIPs(ips []net.IP) []net.IP {
+	if ips == nil {
+		return nil
+	}
+	c := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		c[i] = net.IP(cloneBytes(ip))
+	}
+	return c
+}
+
+// cloneBytes returns a copy of b so callers can't mutate shared state
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStore_GetSet(t *testing.T) {
+	store := NewMemoryStore(map[string]HostEntry{
+		"*.example.com": {A: []net.IP{net.IPv4(10, 0, 0, 1)}},
+	})
+
+	if entry, found := store.Get("foo.example.com"); !found || !entry.A[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Get(foo.example.com) = %v, %v, want wildcard match", entry, found)
+	}
+
+	store.Set("foo.example.com", HostEntry{A: []net.IP{net.IPv4(10, 0, 0, 2)}})
+	if entry, found := store.Get("foo.example.com"); !found || !entry.A[0].Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Get(foo.example.com) = %v, %v, want exact match to win", entry, found)
+	}
+
+	if _, found := store.Get("example.org"); found {
+		t.Errorf("Get(example.org) found a record, want miss")
+	}
+
+	// Mutating a snapshot must not affect the store
+	snapshot := store.Snapshot()
+	snapshot["foo.example.com"].A[0][15] = 99
+	if entry, _ := store.Get("foo.example.com"); !entry.A[0].Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Snapshot shares memory with the store")
+	}
+}
+
+func TestMemoryStore_Fallback(t *testing.T) {
+	store := NewMemoryStore(nil)
+	store.SetFallback(&HostEntry{A: []net.IP{net.IPv4(8, 8, 8, 8)}})
+
+	records, err := store.Lookup("anything.example.org", RecordTypeA, ClassIN)
+	if err != nil || len(records) != 1 || !bytes.Equal(records[0].RData, []byte{8, 8, 8, 8}) {
+		t.Errorf("Lookup() with fallback = %+v, %v, want the fallback address", records, err)
+	}
+
+	store.SetFallback(nil)
+	if records, _ := store.Lookup("anything.example.org", RecordTypeA, ClassIN); len(records) != 0 {
+		t.Errorf("Lookup() without fallback = %+v, want no records", records)
+	}
+}
+
+// TestMemoryStore_ConcurrentAccess hammers reads while a writer updates entries.
+// Run with -race to detect unsynchronized access.
+func TestMemoryStore_ConcurrentAccess(t *testing.T) {
+	store := NewMemoryStore(mockDNSRecords)
+	queryData := buildTestDNSQuery(0x4242, []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	})
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			store.Set("stackoverflow.com", HostEntry{A: []net.IP{net.IPv4(10, 0, 0, byte(i))}})
+			store.Set(fmt.Sprintf("host%d.example.com", i%16), HostEntry{A: []net.IP{net.IPv4(10, 0, 1, byte(i))}})
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < 200; i++ {
+				if _, found := store.Get("stackoverflow.com"); !found {
+					t.Errorf("Get(stackoverflow.com) missed during concurrent writes")
+					return
+				}
+				_ = store.Snapshot()
+				if _, err := NewDNSHandler(queryData, WithStore(store)).Handle(); err != nil {
+					t.Errorf("Handle() failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	readers.Wait()
+	close(done)
+	wg.Wait()
+}
+
+func TestMemoryStore_EmptyNonTerminal(t *testing.T) {
+	store := NewMemoryStore(map[string]HostEntry{
+		"a.b.example.com": {A: []net.IP{net.IPv4(10, 0, 0, 1)}},
+		"example.com":     {A: []net.IP{net.IPv4(10, 0, 0, 2)}},
+	})
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"b.example.com", true},
+		{"example.com", false},     // has records of its own
+		{"a.b.example.com", false}, // likewise
+		{"c.example.com", false},   // nothing below it
+		{"ab.example.com", false},  // a.b is below b, not ab
+	}
+	for _, tt := range tests {
+		if got := store.EmptyNonTerminal(tt.name); got != tt.want {
+			t.Errorf("EmptyNonTerminal(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Zone lookups check for empty non-terminals on every query, so this mustn't copy the store
+	if allocs := testing.AllocsPerRun(100, func() { store.EmptyNonTerminal("b.example.com") }); allocs != 0 {
+		t.Errorf("EmptyNonTerminal() made %v allocations, want 0", allocs)
+	}
+}
+
+func TestMemoryStore_Lookup(t *testing.T) {
+	store := NewMemoryStore(mockDNSRecords)
+
+	records, err := store.Lookup("stackoverflow.com", RecordTypeA, ClassIN)
+	if err != nil {
+		t.Fatalf("Lookup() failed: %v", err)
+	}
+	if len(records) != 1 || !bytes.Equal(records[0].RData, []byte{151, 101, 129, 69}) {
+		t.Fatalf("Lookup(stackoverflow.com, A) = %+v, want one A record", records)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		qtype, qclass uint16
+	}{
+		{"stackoverflow.com", RecordTypeAAAA, ClassIN},
+		{"stackoverflow.com", RecordTypeA, 3},
+		{"missing.example.org", RecordTypeA, ClassIN},
+	} {
+		records, err := store.Lookup(tc.name, tc.qtype, tc.qclass)
+		if err != nil || len(records) != 0 {
+			t.Errorf("Lookup(%s, %d, %d) = %+v, %v, want no records", tc.name, tc.qtype, tc.qclass, records, err)
+		}
+	}
+}
+
+func TestMemoryStore_DualStack(t *testing.T) {
+	store := NewMemoryStore(map[string]HostEntry{
+		"dual.example.com": {
+			A:    []net.IP{net.IPv4(192, 0, 2, 1)},
+			AAAA: []net.IP{net.ParseIP("2001:db8::1")},
+		},
+		"v4only.example.com": {A: []net.IP{net.IPv4(192, 0, 2, 2)}},
+		"v6only.example.com": {AAAA: []net.IP{net.ParseIP("2001:db8::3")}},
+	})
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []byte // nil means NODATA
+	}{
+		{"dual.example.com", RecordTypeA, []byte{192, 0, 2, 1}},
+		{"dual.example.com", RecordTypeAAAA, net.ParseIP("2001:db8::1")},
+		{"v4only.example.com", RecordTypeA, []byte{192, 0, 2, 2}},
+		{"v4only.example.com", RecordTypeAAAA, nil},
+		{"v6only.example.com", RecordTypeAAAA, net.ParseIP("2001:db8::3")},
+		{"v6only.example.com", RecordTypeA, nil},
+	}
+
+	for _, tt := range tests {
+		records, err := store.Lookup(tt.name, tt.qtype, ClassIN)
+		if err != nil {
+			t.Fatalf("Lookup(%s, %d) failed: %v", tt.name, tt.qtype, err)
+		}
+		if tt.want == nil {
+			if len(records) != 0 {
+				t.Errorf("Lookup(%s, %d) = %+v, want NODATA", tt.name, tt.qtype, records)
+			}
+			continue
+		}
+		if len(records) != 1 || records[0].Type != tt.qtype || !bytes.Equal(records[0].RData, tt.want) {
+			t.Errorf("Lookup(%s, %d) = %+v, want one record with %v", tt.name, tt.qtype, records, tt.want)
+		}
+	}
+}
+
+func TestMemoryStore_CNAME(t *testing.T) {
+	store := NewMemoryStore(map[string]HostEntry{
+		"www.example.com":   {CNAME: "example.com"},
+		"cdn.example.com":   {CNAME: "www.example.com"},
+		"example.com":       {A: []net.IP{net.IPv4(192, 0, 2, 1)}},
+		"dangling.example":  {CNAME: "missing.example"},
+		"loop-a.example":    {CNAME: "loop-b.example"},
+		"loop-b.example":    {CNAME: "loop-a.example"},
+		"self-loop.example": {CNAME: "self-loop.example"},
+	})
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantTypes []uint16
+		wantErr   bool
+	}{
+		{"www.example.com", RecordTypeA, []uint16{RecordTypeCNAME, RecordTypeA}, false},
+		{"cdn.example.com", RecordTypeA, []uint16{RecordTypeCNAME, RecordTypeCNAME, RecordTypeA}, false},
+		{"www.example.com", RecordTypeAAAA, []uint16{RecordTypeCNAME}, false},
+		{"www.example.com", RecordTypeCNAME, []uint16{RecordTypeCNAME}, false},
+		{"dangling.example", RecordTypeA, []uint16{RecordTypeCNAME}, false},
+		{"loop-a.example", RecordTypeA, nil, true},
+		{"self-loop.example", RecordTypeA, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+TypeName(tt.qtype), func(t *testing.T) {
+			records, err := store.Lookup(tt.name, tt.qtype, ClassIN)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(records) != len(tt.wantTypes) {
+				t.Fatalf("Lookup() returned %d records, want %d", len(records), len(tt.wantTypes))
+			}
+			for i, rr := range records {
+				if rr.Type != tt.wantTypes[i] {
+					t.Errorf("Record %d has type %s, want %s", i, TypeName(rr.Type), TypeName(tt.wantTypes[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCNAMEs(t *testing.T) {
+	chain := func(n int) map[string]HostEntry {
+		records := map[string]HostEntry{"end.example": {A: []net.IP{net.IPv4(192, 0, 2, 1)}}}
+		for i := 0; i < n; i++ {
+			target := "end.example"
+			if i+1 < n {
+				target = fmt.Sprintf("hop%d.example", i+1)
+			}
+			records[fmt.Sprintf("hop%d.example", i)] = HostEntry{CNAME: target}
+		}
+		return records
+	}
+
+	tests := []struct {
+		name    string
+		records map[string]HostEntry
+		wantErr string // substring of the error, empty for none
+	}{
+		{"mock records", mockDNSRecords, ""},
+		{"longest allowed chain", chain(MaxCNAMEChain), ""},
+		{"chain too long", chain(MaxCNAMEChain + 1), "longer than 8 at hop0.example"},
+		{"dangling alias", map[string]HostEntry{"a.example": {CNAME: "missing.example"}}, ""},
+		{"self loop", map[string]HostEntry{"a.example": {CNAME: "a.example"}}, "loops at a.example"},
+		{"loop through a wildcard", map[string]HostEntry{
+			"a.example":       {CNAME: "x.wild.example"},
+			"*.wild.example":  {CNAME: "a.example"},
+			"ok.example":      {CNAME: "end.wild2.example"},
+			"*.wild2.example": {A: []net.IP{net.IPv4(192, 0, 2, 1)}},
+		}, "loops at *.wild.example, a.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCNAMEs(tt.records, MaxCNAMEChain)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("ValidateCNAMEs() = %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("ValidateCNAMEs() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// What ValidateCNAMEs accepts, Lookup can follow
+	store := NewMemoryStore(chain(MaxCNAMEChain))
+	if _, err := store.Lookup("hop0.example", RecordTypeA, ClassIN); err != nil {
+		t.Errorf("Lookup() of the longest allowed chain failed: %v", err)
+	}
+}
+
+func TestDNSHandler_LongTXTSplitIntoStrings(t *testing.T) {
+	value := strings.Repeat("0123456789", 60)
+	store := NewMemoryStore(map[string]HostEntry{"long.example.com": {TXT: []string{value}}})
+
+	query := buildTestDNSQuery(0x0445, []Question{{Name: "long.example.com", Type: RecordTypeTXT, Class: ClassIN}})
+	response, err := NewDNSHandler(query, WithStore(store)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 1 {
+		t.Fatalf("Got %d answers, want one TXT record", len(respMsg.Answers))
+	}
+
+	var txt TXTData
+	if err := txt.UnmarshalBinary(respMsg.Answers[0].RData); err != nil {
+		t.Fatalf("Failed to decode TXT RDATA: %v", err)
+	}
+	wantLens := []int{MaxCharacterString, MaxCharacterString, 600 - 2*MaxCharacterString}
+	if len(txt.Strings) != len(wantLens) {
+		t.Fatalf("TXT record has %d character-strings, want %d", len(txt.Strings), len(wantLens))
+	}
+	for i, s := range txt.Strings {
+		if len(s) != wantLens[i] {
+			t.Errorf("Character-string %d is %d bytes, want %d", i, len(s), wantLens[i])
+		}
+	}
+	if txt.String() != value {
+		t.Errorf("Joined TXT value = %q, want the original", txt.String())
+	}
+
+	// Only the typed encoder refuses a single string that can't fit
+	overlong := TXTData{Strings: []string{value}}
+	if _, err := overlong.MarshalBinary(); err == nil {
+		t.Error("MarshalBinary() accepted a 600 byte character-string")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// TCPIdleTimeout is how long a stream connection may sit idle between queries by default
+const TCPIdleTimeout = 10 * time.Second
+
+// readTCPMessage reads one DNS message framed with a 2-byte length prefix (RFC 1035 section 4.2.2)
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(prefix[:])
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("failed to read %d byte message: %w", length, err)
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes one DNS message with its 2-byte length prefix
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return fmt.Errorf("message too long for TCP framing: %d bytes", len(msg))
+	}
+
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	_, err := w.Write(framed)
+	return err
+}
+
+// serveStreamListener accepts connections on ln and serves each one in its own goroutine,
+// closing connections idle for longer than idle. It returns when the listener is closed.
+func serveStreamListener(ln net.Listener, idle time.Duration, opts []HandlerOption) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		go serveStream(conn, idle, opts)
+	}
+}
+
+// serveStream answers length-prefixed queries on conn until the client closes it,
+// goes idle for longer than idle, or sends something we can't handle. Errors only
+// affect this connection. Clients asking with EDNS keepalive are told the idle timeout.
+func serveStream(conn net.Conn, idle time.Duration, opts []HandlerOption) {
+	defer conn.Close()
+	opts = append(opts[:len(opts):len(opts)], WithKeepalive(idle))
+	source := conn.RemoteAddr()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(idle))
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Printf("TLS handshake with %s failed: %v\n", source, err)
+			return
+		}
+	}
+
+	for {
+		conn.SetDeadline(time.Now().Add(idle))
+
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Printf("Closing connection from %s: %v\n", source, err)
+			}
+			return
+		}
+		fmt.Printf("Received %d bytes over stream from %s\n", len(query), source)
+
+		if len(query) < DNSHeaderSize {
+			fmt.Printf("Packet too small: %d bytes (minimum %d required)\n", len(query), DNSHeaderSize)
+			return
+		}
+
+		response, err := NewDNSHandler(query, opts...).HandleSafely()
+		if err != nil {
+			fmt.Printf("Failed to handle DNS request: %v\n", err)
+			return
+		}
+
+		if err := writeTCPMessage(conn, response); err != nil {
+			fmt.Printf("Failed to send response to %s: %v\n", source, err)
+			return
+		}
+	}
+}
+
+// ListenTLS opens a DNS-over-TLS listener (RFC 7858) on addr with the given certificate
+func ListenTLS(addr, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	ln, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate creates a self-signed certificate for 127.0.0.1 and returns
+// the PEM file paths and a pool that trusts it
+func writeTestCertificate(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns-server test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestTCPFraming(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeTCPMessage(&buf, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("writeTCPMessage() failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0, 3, 1, 2, 3}) {
+		t.Errorf("writeTCPMessage() wrote %v, want length prefix then payload", buf.Bytes())
+	}
+
+	msg, err := readTCPMessage(&buf)
+	if err != nil {
+		t.Fatalf("readTCPMessage() failed: %v", err)
+	}
+	if !bytes.Equal(msg, []byte{1, 2, 3}) {
+		t.Errorf("readTCPMessage() = %v, want [1 2 3]", msg)
+	}
+
+	if _, err := readTCPMessage(bytes.NewReader([]byte{0, 5, 1})); err == nil {
+		t.Errorf("readTCPMessage() accepted a short message")
+	}
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	certFile, keyFile, pool := writeTestCertificate(t)
+
+	ln, err := ListenTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("ListenTLS() failed: %v", err)
+	}
+	defer ln.Close()
+	go serveStreamListener(ln, TCPIdleTimeout, nil)
+
+	// A client that never completes the handshake must not take the server down
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	bad.Write([]byte("this is not a TLS client hello"))
+	bad.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("TLS dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Two queries on one connection exercise the framing loop
+	for i, id := range []uint16{0x0853, 0x0854} {
+		query := buildTestDNSQuery(id, []Question{
+			{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+		})
+		if err := writeTCPMessage(conn, query); err != nil {
+			t.Fatalf("Failed to send query %d: %v", i, err)
+		}
+		response, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read response %d: %v", i, err)
+		}
+
+		var respMsg Message
+		if err := respMsg.UnmarshalBinary(response); err != nil {
+			t.Fatalf("Failed to parse response %d: %v", i, err)
+		}
+		if respMsg.Header.Id != id || len(respMsg.Answers) != 1 {
+			t.Errorf("Response %d: ID=%d answers=%d, want ID=%d and 1 answer", i, respMsg.Header.Id, len(respMsg.Answers), id)
+		}
+	}
+}
+
+// exchangeTCP sends query on conn and returns the parsed response
+func exchangeTCP(t *testing.T, conn net.Conn, query Message) Message {
+	t.Helper()
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	if err := writeTCPMessage(conn, queryData); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	data, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	return respMsg
+}
+
+func TestServeStream_EDNSKeepalive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	const idle = 300 * time.Millisecond
+	go serveStreamListener(ln, idle, nil)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	question := Question{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}
+	keepalive := []EDNSOption{{Code: EDNSOptionKeepalive}}
+	resp := exchangeTCP(t, conn, Message{
+		Header:    MessageHeader{Id: 0x0419, QDCount: 1},
+		Questions: []Question{question},
+		EDNS:      &OPTRecord{UDPSize: 1232, Options: keepalive},
+	})
+	if resp.EDNS == nil {
+		t.Fatal("Response has no OPT record")
+	}
+	opt, found := resp.EDNS.Option(EDNSOptionKeepalive)
+	if !found {
+		t.Fatal("Response has no keepalive option")
+	}
+	if timeout, ok, err := parseKeepalive(opt); err != nil || !ok || timeout != idle {
+		t.Errorf("Keepalive timeout = %s (ok %t, err %v), want %s", timeout, ok, err, idle)
+	}
+
+	// Only clients that ask are told
+	resp = exchangeTCP(t, conn, Message{
+		Header:    MessageHeader{Id: 0x041a, QDCount: 1},
+		Questions: []Question{question},
+		EDNS:      &OPTRecord{UDPSize: 1232},
+	})
+	if _, found := resp.EDNS.Option(EDNSOptionKeepalive); found {
+		t.Error("Response to a query without keepalive has a keepalive option")
+	}
+
+	// Clients mustn't send a timeout of their own
+	resp = exchangeTCP(t, conn, Message{
+		Header:    MessageHeader{Id: 0x041b, QDCount: 1},
+		Questions: []Question{question},
+		EDNS:      &OPTRecord{UDPSize: 1232, Options: []EDNSOption{KeepaliveOption(time.Minute)}},
+	})
+	if resp.Header.GetRcode() != RCodeFormat {
+		t.Errorf("RCode for a client keepalive timeout = %d, want FORMERR", resp.Header.GetRcode())
+	}
+
+	// Once idle for the announced timeout, the server closes the connection
+	start := time.Now()
+	if _, err := readTCPMessage(conn); err == nil {
+		t.Fatal("Read a message from an idle connection")
+	}
+	if elapsed := time.Since(start); elapsed < idle/2 || elapsed > idle+time.Second {
+		t.Errorf("Idle connection closed after %s, want about %s", elapsed, idle)
+	}
+}
+
+func TestDNSHandler_KeepaliveIgnoredOverUDP(t *testing.T) {
+	query := Message{
+		Header:    MessageHeader{Id: 0x041c, QDCount: 1},
+		Questions: []Question{{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}},
+		EDNS:      &OPTRecord{UDPSize: 1232, Options: []EDNSOption{{Code: EDNSOptionKeepalive}}},
+	}
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	response, err := NewDNSHandler(queryData, WithUDP()).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if respMsg.EDNS == nil {
+		t.Fatal("Response has no OPT record")
+	}
+	if _, found := respMsg.EDNS.Option(EDNSOptionKeepalive); found {
+		t.Error("UDP response has a keepalive option")
+	}
+}
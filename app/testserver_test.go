@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// StartTestServer runs the server on a random loopback port with the given options,
+// over UDP and TCP on the same port, and returns that address and a function that
+// stops it. The server is also stopped when the test ends.
+func StartTestServer(t *testing.T, opts ...HandlerOption) (addr string, stop func()) {
+	t.Helper()
+	return startTestServerOn(t, net.IPv4(127, 0, 0, 1), opts...)
+}
+
+// startTestServerOn is like StartTestServer listening on ip instead of 127.0.0.1
+func startTestServerOn(t *testing.T, ip net.IP, opts ...HandlerOption) (addr string, stop func()) {
+	t.Helper()
+
+	// The port the OS picks for TCP may already be taken for UDP, so retry a few times
+	var ln net.Listener
+	var conn *net.UDPConn
+	for attempt := 0; ; attempt++ {
+		var err error
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+		if err != nil {
+			t.Fatalf("Failed to listen on TCP: %v", err)
+		}
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: ln.Addr().(*net.TCPAddr).Port})
+		if err == nil {
+			break
+		}
+		ln.Close()
+		if attempt == 9 {
+			t.Fatalf("Failed to listen on UDP: %v", err)
+		}
+	}
+
+	go serveUDP(conn, opts)
+	go serveStreamListener(ln, TCPIdleTimeout, opts)
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			conn.Close()
+			ln.Close()
+		})
+	}
+	t.Cleanup(stop)
+	return conn.LocalAddr().String(), stop
+}
+
+// queryTestServer sends query to the server at addr over network ("udp" or "tcp")
+// and returns the parsed response
+func queryTestServer(t *testing.T, network, addr string, query Message) Message {
+	t.Helper()
+
+	conn, err := net.DialTimeout(network, addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial %s %s: %v", network, addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if network == "tcp" {
+		return exchangeTCP(t, conn, query)
+	}
+
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	if _, err := conn.Write(queryData); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	buf := make([]byte, MaxUDPQuerySize)
+	size, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(buf[:size]); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	return respMsg
+}
+
+func TestStartTestServer(t *testing.T) {
+	addr, stop := StartTestServer(t)
+	query := Message{
+		Header:    MessageHeader{Id: 0x0422, QDCount: 1},
+		Questions: []Question{{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}},
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		resp := queryTestServer(t, network, addr, query)
+		if resp.Header.Id != query.Header.Id || len(resp.Answers) != 1 {
+			t.Errorf("%s response has ID %d and %d answers, want ID %d and 1 answer",
+				network, resp.Header.Id, len(resp.Answers), query.Header.Id)
+		}
+	}
+
+	stop()
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Error("Server still accepts TCP connections after stop")
+	}
+}
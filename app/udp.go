@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// serveUDP answers queries arriving on conn until reading from it fails.
+// Queries are read into a MaxUDPQuerySize buffer, so EDNS queries over 512 bytes
+// arrive whole; responses are still capped at 512 bytes unless the client negotiated more.
+// Each query is handled in its own goroutine, so a slow one doesn't hold up the rest.
+func serveUDP(conn *net.UDPConn, opts []HandlerOption) error {
+	udpOpts := append(opts[:len(opts):len(opts)], WithUDP())
+	buf := make([]byte, MaxUDPQuerySize)
+
+	for {
+		size, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		receivedData := buf[:size]
+		fmt.Printf("Received %d bytes from %s\n", size, source)
+		fmt.Printf("Raw request data: %x\n", receivedData)
+
+		// Basic validation: DNS messages must be at least header size
+		if size < DNSHeaderSize {
+			fmt.Printf("Packet too small: %d bytes (minimum %d required)\n", size, DNSHeaderSize)
+			continue
+		}
+
+		// The buffer is reused for the next datagram, so the query gets its own copy
+		go serveUDPQuery(conn, source, cloneBytes(receivedData), udpOpts)
+	}
+}
+
+// serveUDPQuery answers one query received on conn from source
+func serveUDPQuery(conn *net.UDPConn, source *net.UDPAddr, query []byte, udpOpts []HandlerOption) {
+	fmt.Println("--- Processing DNS Request ---")
+
+	// Process the DNS request
+	client := source.AddrPort().Addr().Unmap()
+	handler := NewDNSHandler(query, append(udpOpts[:len(udpOpts):len(udpOpts)], WithClient(client))...)
+	response, err := handler.HandleSafely()
+	if err != nil {
+		fmt.Printf("Failed to handle DNS request: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Sending %d bytes response back to %s\n", len(response), source)
+	fmt.Printf("Raw response data: %x\n", response)
+
+	// Send response back to client
+	_, err = conn.WriteToUDP(response, source)
+	if err != nil {
+		fmt.Println("Failed to send response:", err)
+	}
+
+	fmt.Println("--- Request completed ---")
+}
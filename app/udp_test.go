@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeUDP_QueryLargerThan512Bytes(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go serveUDP(conn, nil)
+
+	// 40 questions with distinct names don't compress into 512 bytes
+	var questions []Question
+	for i := range 40 {
+		questions = append(questions, Question{Name: fmt.Sprintf("host%02d.example%02d.org", i, i), Type: RecordTypeA, Class: ClassIN})
+	}
+	header := MessageHeader{Id: 0x4000, QDCount: uint16(len(questions))}
+	header.SetRD(1)
+	query := Message{Header: header, Questions: questions, EDNS: &OPTRecord{UDPSize: 4096}}
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	if len(queryData) <= MaxDNSPacketSize {
+		t.Fatalf("Query is only %d bytes, want more than %d", len(queryData), MaxDNSPacketSize)
+	}
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(queryData); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+
+	buf := make([]byte, 0xFFFF)
+	size, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(buf[:size]); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if respMsg.Header.Id != 0x4000 || respMsg.Header.GetRcode() != RCodeNoError {
+		t.Fatalf("Response ID %#04x RCode %d, want 0x4000 NOERROR", respMsg.Header.Id, respMsg.Header.GetRcode())
+	}
+	if len(respMsg.Questions) != len(questions) {
+		t.Fatalf("Response echoes %d questions, want all %d", len(respMsg.Questions), len(questions))
+	}
+	if last := respMsg.Questions[len(questions)-1]; last != questions[len(questions)-1] {
+		t.Errorf("Last question = %+v, want %+v", last, questions[len(questions)-1])
+	}
+	if len(respMsg.Answers) != len(questions) {
+		t.Errorf("Response has %d answers, want one per question", len(respMsg.Answers))
+	}
+	if respMsg.EDNS == nil {
+		t.Error("Response has no OPT record, so the query's EDNS record was lost")
+	}
+}
+
+func TestServeUDP_PanicAnswersServFail(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	panicky := func(next Handler) Handler {
+		return HandlerFunc(func(req *Message) (*Message, error) {
+			panic("deliberate test panic")
+		})
+	}
+	go serveUDP(conn, []HandlerOption{WithMiddleware(panicky)})
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// The second query checks the server survived the first panic
+	for _, id := range []uint16{0x4070, 0x4071} {
+		question := Question{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN}
+		if _, err := client.Write(buildTestDNSQuery(id, []Question{question})); err != nil {
+			t.Fatalf("Failed to send query: %v", err)
+		}
+
+		buf := make([]byte, MaxDNSPacketSize)
+		size, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read response to query %#04x: %v", id, err)
+		}
+		var respMsg Message
+		if err := respMsg.UnmarshalBinary(buf[:size]); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if respMsg.Header.Id != id || respMsg.Header.GetRcode() != RCodeServFail {
+			t.Errorf("Response ID %#04x RCode %d, want %#04x SERVFAIL", respMsg.Header.Id, respMsg.Header.GetRcode(), id)
+		}
+		if len(respMsg.Questions) != 1 || respMsg.Questions[0] != question {
+			t.Errorf("Response questions = %+v, want %+v echoed", respMsg.Questions, question)
+		}
+	}
+}
+
+func TestServeUDP_SlowQueryDoesNotBlockOthers(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	release := make(chan struct{})
+	defer close(release)
+	stalling := func(next Handler) Handler {
+		return HandlerFunc(func(req *Message) (*Message, error) {
+			if req.Questions[0].Name == "slow.example.com" {
+				<-release
+			}
+			return next.ServeDNS(req)
+		})
+	}
+	go serveUDP(conn, []HandlerOption{WithMiddleware(stalling)})
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	slow := Question{Name: "slow.example.com", Type: RecordTypeA, Class: ClassIN}
+	fast := Question{Name: "fast.example.com", Type: RecordTypeA, Class: ClassIN}
+	if _, err := client.Write(buildTestDNSQuery(0x4080, []Question{slow})); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	if _, err := client.Write(buildTestDNSQuery(0x4081, []Question{fast})); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+
+	buf := make([]byte, MaxDNSPacketSize)
+	size, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read a response while the slow query was stalled: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(buf[:size]); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if respMsg.Header.Id != 0x4081 {
+		t.Errorf("First response ID = %#04x, want %#04x for the fast query", respMsg.Header.Id, 0x4081)
+	}
+}
+
+func TestServe_IPv4AndIPv6TransportsAnswerIdentically(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	// One server instance: both listeners share the same store and budget
+	opts := []HandlerOption{
+		WithStore(NewMemoryStore(mockDNSRecords)),
+		WithNameBudget(NewNameBudget(100)),
+	}
+	addr4, _ := startTestServerOn(t, net.IPv4(127, 0, 0, 1), opts...)
+	addr6, _ := startTestServerOn(t, net.IPv6loopback, opts...)
+
+	questions := []Question{
+		{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+		{Name: "dual.example.com", Type: RecordTypeAAAA, Class: ClassIN},
+		{Name: "www.stackoverflow.com", Type: RecordTypeA, Class: ClassIN},
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		for i, q := range questions {
+			t.Run(fmt.Sprintf("%s %s", network, q.Name), func(t *testing.T) {
+				query := Message{Header: MessageHeader{Id: uint16(0x0423 + i), QDCount: 1}, Questions: []Question{q}}
+				resp4 := queryTestServer(t, network, addr4, query)
+				resp6 := queryTestServer(t, network, addr6, query)
+
+				if len(resp4.Answers) == 0 {
+					t.Fatalf("IPv4 response has no answers")
+				}
+				if resp4.Header != resp6.Header {
+					t.Errorf("Headers differ: IPv4 %+v, IPv6 %+v", resp4.Header, resp6.Header)
+				}
+				if resp4.String() != resp6.String() {
+					t.Errorf("Responses differ:\nIPv4:\n%s\nIPv6:\n%s", resp4.String(), resp6.String())
+				}
+			})
+		}
+	}
+}
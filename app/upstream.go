@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// DefaultUpstreamTimeout bounds a single exchange with the upstream resolver
+const DefaultUpstreamTimeout = 2 * time.Second
+
+// Upstream forwards questions to a recursive resolver. Queries go over UDP and
+// fall back to TCP when the reply is truncated; with TLS set they go over
+// DNS-over-TLS instead. Stream connections are pooled and reused.
+type Upstream struct {
+	Addr    string        // resolver address, e.g. "8.8.8.8:53"
+	Timeout time.Duration // deadline for a single exchange, including retries
+	TLS     *tls.Config   // when set, queries use DNS-over-TLS instead of UDP
+	Pool    *ConnPool     // idle TCP/TLS connections to the resolver
+
+	NoRecursion bool // send queries with RD=0, for talking to authoritative servers
+
+	// EDNSBufferSize is the UDP payload size advertised in an OPT record on every
+	// query, so upstreams can answer with more than 512 bytes before truncating.
+	// 0 sends queries without EDNS.
+	EDNSBufferSize uint16
+}
+
+// NewUpstream creates an upstream client for the resolver at addr
+func NewUpstream(addr string) *Upstream {
+	return &Upstream{
+		Addr:           addr,
+		Timeout:        DefaultUpstreamTimeout,
+		Pool:           NewConnPool(DefaultPoolIdleTimeout, DefaultPoolMaxPerHost),
+		EDNSBufferSize: EDNSUDPSize,
+	}
+}
+
+// newUpstreamFromConfig creates the upstream client described by the configuration
+func newUpstreamFromConfig(cfg Config) (*Upstream, error) {
+	upstream := NewUpstream(cfg.Resolver)
+	upstream.Pool = NewConnPool(cfg.UpstreamIdleTimeout, cfg.UpstreamMaxConns)
+	upstream.EDNSBufferSize = uint16(cfg.EDNSBuffer)
+
+	if cfg.ResolverTLS {
+		host, _, err := net.SplitHostPort(cfg.Resolver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolver address %s: %w", cfg.Resolver, err)
+		}
+		upstream.TLS = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	return upstream, nil
+}
+
+// RcodeError is returned by Exchange when the upstream answers with an rcode other
+// than NOERROR. Authority is the reply's authority section, where a negative answer
+// has the SOA saying how long it may be cached (RFC 2308).
+type RcodeError struct {
+	Addr      string
+	Rcode     uint8
+	Authority []ResourceRecord
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("%s answered with rcode %d", e.Addr, e.Rcode)
+}
+
+// Negative reports whether the error is the answer that the name doesn't exist,
+// which asking elsewhere or serving stale data shouldn't override, rather than a failure
+func (e *RcodeError) Negative() bool {
+	return e.Rcode == RCodeNXDomain
+}
+
+// Exchange sends a single question to the upstream resolver and returns its answers.
+// Replies that don't match the outgoing query are discarded and reading continues
+// until a matching reply arrives or the deadline passes. A reply with any rcode but
+// NOERROR is an *RcodeError: NXDOMAIN to pass on to the client, others such as
+// SERVFAIL so callers can try elsewhere or fall back to stale data.
+func (u *Upstream) Exchange(q Question) ([]ResourceRecord, error) {
+	answers, _, err := u.ExchangeSubnet(q, netip.Prefix{})
+	return answers, err
+}
+
+// ExchangeSubnet is like Exchange, but tells the upstream the question is asked
+// on behalf of a client in subnet with an EDNS Client Subnet option (RFC 7871),
+// and returns the scope the upstream says the answers apply to. An invalid
+// subnet sends none.
+func (u *Upstream) ExchangeSubnet(q Question, subnet netip.Prefix) ([]ResourceRecord, netip.Prefix, error) {
+	reply, err := u.exchangeMessage(q, subnet)
+	if err != nil {
+		return nil, netip.Prefix{}, err
+	}
+	if rcode := reply.Header.GetRcode(); rcode != RCodeNoError {
+		return nil, netip.Prefix{}, &RcodeError{Addr: u.Addr, Rcode: rcode, Authority: matchingClass(q, reply.Authority)}
+	}
+	return reply.Answers, replyScope(reply, subnet), nil
+}
+
+// ExchangeMessage is like Exchange but returns the whole reply, including its
+// rcode and the authority and additional sections
+func (u *Upstream) ExchangeMessage(q Question) (*Message, error) {
+	return u.exchangeMessage(q, netip.Prefix{})
+}
+
+// exchangeMessage is ExchangeMessage with an ECS option for subnet, when it's valid
+func (u *Upstream) exchangeMessage(q Question, subnet netip.Prefix) (*Message, error) {
+	query := newUpstreamQuery(q)
+	if u.NoRecursion {
+		query.Header.SetRD(0)
+	}
+	if u.EDNSBufferSize > 0 {
+		query.EDNS = &OPTRecord{UDPSize: u.EDNSBufferSize}
+	}
+	if subnet.IsValid() {
+		if query.EDNS == nil {
+			// ECS needs an OPT record even when we'd otherwise send none
+			query.EDNS = &OPTRecord{UDPSize: MaxDNSPacketSize}
+		}
+		query.EDNS.Options = append(query.EDNS.Options, ClientSubnet{Source: subnet}.Option())
+	}
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal upstream query: %w", err)
+	}
+
+	var reply *Message
+	if u.TLS != nil {
+		reply, err = u.exchangeStream(&query, queryData)
+	} else {
+		reply, err = u.exchangeUDP(&query, queryData)
+		if err == nil && reply.Header.GetTC() == 1 {
+			fmt.Printf("Upstream reply for %s truncated, retrying over TCP\n", q.Name)
+			reply, err = u.exchangeStream(&query, queryData)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply.Answers = matchingClass(q, reply.Answers)
+	return reply, nil
+}
+
+// matchingClass drops records whose class differs from the question's, which only
+// a buggy or malicious upstream would answer with. A QCLASS of ANY matches every class.
+func matchingClass(q Question, records []ResourceRecord) []ResourceRecord {
+	if q.Class == ClassANY {
+		return records
+	}
+	kept := records[:0]
+	for _, rr := range records {
+		if rr.Class != q.Class {
+			fmt.Printf("Dropping upstream answer %s with class %d for a class %d question\n", rr.Name, rr.Class, q.Class)
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+// exchangeUDP sends the query over UDP and waits for a matching reply. Each query
+// gets its own socket on an OS-chosen ephemeral port, so a spoofed reply has to
+// guess the source port as well as the random ID, and come from the upstream's address.
+func (u *Upstream) exchangeUDP(query *Message, queryData []byte) (*Message, error) {
+	raddr, err := net.ResolveUDPAddr("udp", u.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve upstream address %s: %w", u.Addr, err)
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upstream socket: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(u.Timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set upstream deadline: %w", err)
+	}
+	if _, err := conn.WriteToUDP(queryData, raddr); err != nil {
+		return nil, fmt.Errorf("failed to send query to %s: %w", u.Addr, err)
+	}
+
+	buf := make([]byte, max(MaxDNSPacketSize, int(u.EDNSBufferSize)))
+	for {
+		size, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, u.readError(query, err)
+		}
+		if source.AddrPort().Addr().Unmap() != raddr.AddrPort().Addr().Unmap() || source.Port != raddr.Port {
+			fmt.Printf("Discarding upstream reply from %s, expected %s\n", source, raddr)
+			continue
+		}
+
+		var reply Message
+		if err := reply.UnmarshalBinary(buf[:size]); err != nil {
+			fmt.Printf("Discarding malformed upstream reply: %v\n", err)
+			continue
+		}
+		if err := validateUpstreamReply(query, &reply); err != nil {
+			fmt.Printf("Discarding upstream reply: %v\n", err)
+			continue
+		}
+		return &reply, nil
+	}
+}
+
+// exchangeStream sends the query over a pooled TCP or TLS connection. A reused
+// connection may have been closed by the server while idle, so a failure on one
+// is retried once on a fresh connection.
+func (u *Upstream) exchangeStream(query *Message, queryData []byte) (*Message, error) {
+	deadline := time.Now().Add(u.Timeout)
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := u.Pool.Get(u.Addr, func() (net.Conn, error) {
+			return u.dialStream(deadline)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", u.Addr, err)
+		}
+
+		reply, err := u.roundTripStream(conn, query, queryData, deadline)
+		if err == nil {
+			u.Pool.Put(u.Addr, conn)
+			return reply, nil
+		}
+
+		conn.Close()
+		if !reused || attempt > 0 {
+			return nil, err
+		}
+		fmt.Printf("Pooled connection to %s failed (%v), redialing\n", u.Addr, err)
+	}
+}
+
+// dialStream opens a new TCP or TLS connection to the upstream
+func (u *Upstream) dialStream(deadline time.Time) (net.Conn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+	if u.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", u.Addr, u.TLS)
+	}
+	return dialer.Dial("tcp", u.Addr)
+}
+
+// roundTripStream writes one framed query on conn and reads framed messages until a matching reply
+func (u *Upstream) roundTripStream(conn net.Conn, query *Message, queryData []byte, deadline time.Time) (*Message, error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set upstream deadline: %w", err)
+	}
+	if err := writeTCPMessage(conn, queryData); err != nil {
+		return nil, fmt.Errorf("failed to send query to %s: %w", u.Addr, err)
+	}
+
+	for {
+		data, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, u.readError(query, err)
+		}
+
+		var reply Message
+		if err := reply.UnmarshalBinary(data); err != nil {
+			fmt.Printf("Discarding malformed upstream reply: %v\n", err)
+			continue
+		}
+		if err := validateUpstreamReply(query, &reply); err != nil {
+			fmt.Printf("Discarding upstream reply: %v\n", err)
+			continue
+		}
+		return &reply, nil
+	}
+}
+
+// readError converts a read failure into the error returned to callers
+func (u *Upstream) readError(query *Message, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("no valid reply from %s for %s within %s", u.Addr, query.Questions[0].Name, u.Timeout)
+	}
+	return fmt.Errorf("failed to read reply from %s: %w", u.Addr, err)
+}
+
+// newUpstreamQuery builds a recursive query for q with a random ID
+func newUpstreamQuery(q Question) Message {
+	header := MessageHeader{
+		Id:      uint16(rand.Uint32()),
+		QDCount: 1,
+	}
+	header.SetOpcode(OpcodeQuery)
+	header.SetRD(1)
+
+	return Message{
+		Header:    header,
+		Questions: []Question{q},
+	}
+}
+
+// validateUpstreamReply checks that reply answers the query we sent
+func validateUpstreamReply(query, reply *Message) error {
+	if reply.Header.GetQR() != 1 {
+		return fmt.Errorf("message is not a response")
+	}
+	if reply.Header.Id != query.Header.Id {
+		return fmt.Errorf("ID mismatch: got %d, want %d", reply.Header.Id, query.Header.Id)
+	}
+	if len(reply.Questions) != 1 {
+		return fmt.Errorf("reply has %d questions, want 1", len(reply.Questions))
+	}
+
+	got, want := reply.Questions[0], query.Questions[0]
+	if !strings.EqualFold(got.Name, want.Name) || got.Type != want.Type || got.Class != want.Class {
+		return fmt.Errorf("question mismatch: got %s (Type=%d, Class=%d), want %s (Type=%d, Class=%d)",
+			got.Name, got.Type, got.Class, want.Name, want.Type, want.Class)
+	}
+	return nil
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startFakeUpstream runs a UDP resolver on a random loopback port. For each query,
+// respond returns the replies to send back, in order.
+func startFakeUpstream(t *testing.T, respond func(query *Message) []Message) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start fake upstream: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxDNSPacketSize)
+		for {
+			size, source, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query Message
+			if err := query.UnmarshalBinary(buf[:size]); err != nil {
+				continue
+			}
+			for _, reply := range respond(&query) {
+				data, err := reply.MarshalBinary()
+				if err != nil {
+					continue
+				}
+				conn.WriteToUDP(data, source)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// fakeReply builds a response to query that claims to answer q with an address record.
+// Questions for other types (like health check probes) get an empty answer section.
+func fakeReply(query *Message, q Question, ip []byte) Message {
+	header := MessageHeader{
+		Id:      query.Header.Id,
+		QDCount: 1,
+	}
+	header.SetQR(1)
+	header.SetRD(query.Header.GetRD())
+	header.SetRA(1)
+
+	msg := Message{
+		Header:    header,
+		Questions: []Question{q},
+	}
+	if q.Type == RecordTypeA || q.Type == RecordTypeAAAA {
+		msg.Answers = []ResourceRecord{
+			{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 30, RData: ip},
+		}
+		msg.Header.ANCount = 1
+	}
+	return msg
+}
+
+func TestUpstream_Exchange(t *testing.T) {
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		return []Message{fakeReply(query, query.Questions[0], []byte{1, 2, 3, 4})}
+	})
+
+	answers, err := NewUpstream(addr).Exchange(Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN})
+	if err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	if len(answers) != 1 || answers[0].Name != "example.com" {
+		t.Fatalf("Exchange() answers = %+v, want one answer for example.com", answers)
+	}
+}
+
+// negativeReply answers query with rcode and an example.com SOA in the authority
+// section, with a TTL of 300 and a minimum of 60
+func negativeReply(t *testing.T, query *Message, rcode uint8) Message {
+	t.Helper()
+	reply := fakeReply(query, query.Questions[0], nil)
+	reply.Answers, reply.Header.ANCount = nil, 0
+	reply.Header.SetRcode(rcode)
+	soa := SOAData{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1, Refresh: 7200, Retry: 900, Expire: 1209600, Minimum: 60}
+	rdata, err := soa.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	reply.Authority = []ResourceRecord{{Name: "example.com", Type: RecordTypeSOA, Class: ClassIN, TTL: 300, RData: rdata}}
+	reply.Header.NSCount = 1
+	return reply
+}
+
+func TestDNSHandler_ForwardsUpstreamRcode(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcode     uint8
+		authority int
+	}{
+		{"NXDOMAIN", RCodeNXDomain, 1},
+		{"REFUSED", RCodeRefused, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startFakeUpstream(t, func(query *Message) []Message {
+				return []Message{negativeReply(t, query, tt.rcode)}
+			})
+			queryData := buildTestDNSQuery(0x0380, []Question{{Name: "missing.example.com", Type: RecordTypeA, Class: ClassIN}})
+			response, err := NewDNSHandler(queryData, WithUpstream(NewUpstream(addr))).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.rcode {
+				t.Errorf("RCode = %d, want the upstream's %d", got, tt.rcode)
+			}
+			if len(respMsg.Authority) != tt.authority || respMsg.Authority[0].Type != RecordTypeSOA {
+				t.Errorf("Authority = %+v, want the upstream's SOA", respMsg.Authority)
+			}
+		})
+	}
+}
+
+func TestUpstream_RejectsMismatchedQuestion(t *testing.T) {
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		wrong := query.Questions[0]
+		wrong.Name = "evil.example.net"
+		return []Message{fakeReply(query, wrong, []byte{6, 6, 6, 6})}
+	})
+
+	upstream := NewUpstream(addr)
+	upstream.Timeout = 200 * time.Millisecond
+
+	answers, err := upstream.Exchange(Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN})
+	if err == nil {
+		t.Fatalf("Exchange() accepted a reply for the wrong name: %+v", answers)
+	}
+	if !strings.Contains(err.Error(), "no valid reply") {
+		t.Errorf("Exchange() error = %v, want a timeout after discarding the reply", err)
+	}
+}
+
+func TestDNSHandler_SilentUpstreamAnswersServFail(t *testing.T) {
+	addr := startFakeUpstream(t, func(query *Message) []Message { return nil })
+	upstream := NewUpstream(addr)
+	upstream.Timeout = 100 * time.Millisecond
+
+	queryData := buildTestDNSQuery(0x0360, []Question{{Name: "example.com", Type: RecordTypeA, Class: ClassIN}})
+	response, err := NewDNSHandler(queryData, WithUpstream(upstream)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed, leaving the client without a response: %v", err)
+	}
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if respMsg.Header.Id != 0x0360 || respMsg.Header.GetRcode() != RCodeServFail {
+		t.Errorf("Response ID %#04x RCode %d, want 0x0360 SERVFAIL", respMsg.Header.Id, respMsg.Header.GetRcode())
+	}
+}
+
+func TestUpstream_SkipsMismatchedReplyUntilValid(t *testing.T) {
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		q := query.Questions[0]
+		wrongType := q
+		wrongType.Type = RecordTypeAAAA
+		// Name case differs from the query, which must still be accepted
+		rightName := q
+		rightName.Name = strings.ToUpper(q.Name)
+		return []Message{
+			fakeReply(query, wrongType, []byte{6, 6, 6, 6}),
+			fakeReply(query, rightName, []byte{1, 2, 3, 4}),
+		}
+	})
+
+	answers, err := NewUpstream(addr).Exchange(Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN})
+	if err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	if len(answers) != 1 || answers[0].RData[0] != 1 {
+		t.Fatalf("Exchange() answers = %+v, want the valid reply's answer", answers)
+	}
+}
+
+func TestDNSHandler_ForwardsToUpstream(t *testing.T) {
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		return []Message{fakeReply(query, query.Questions[0], []byte{9, 9, 9, 9})}
+	})
+
+	queryData := buildTestDNSQuery(0x7777, []Question{
+		{Name: "forwarded.example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData, WithUpstream(NewUpstream(addr))).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 1 || respMsg.Answers[0].RData[0] != 9 {
+		t.Fatalf("Response answers = %+v, want the upstream's answer", respMsg.Answers)
+	}
+}
+
+// startFakeStreamUpstream runs a resolver that answers truncated over UDP and fully over
+// TCP on the same loopback port. It returns the address and a function reporting how
+// many TCP connections were accepted.
+func startFakeStreamUpstream(t *testing.T) (string, func() int64) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start fake TCP upstream: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					data, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					var query Message
+					if err := query.UnmarshalBinary(data); err != nil {
+						return
+					}
+					reply := fakeReply(&query, query.Questions[0], []byte{5, 5, 5, 5})
+					replyData, _ := reply.MarshalBinary()
+					writeTCPMessage(conn, replyData)
+				}
+			}()
+		}
+	}()
+
+	udpAddr := net.UDPAddrFromAddrPort(ln.Addr().(*net.TCPAddr).AddrPort())
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Skipf("UDP port %s unavailable alongside TCP: %v", udpAddr, err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxDNSPacketSize)
+		for {
+			size, source, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query Message
+			if err := query.UnmarshalBinary(buf[:size]); err != nil {
+				continue
+			}
+			reply := fakeReply(&query, query.Questions[0], nil)
+			reply.Header.ANCount = 0
+			reply.Answers = nil
+			reply.Header.SetTC(1)
+			data, _ := reply.MarshalBinary()
+			udpConn.WriteToUDP(data, source)
+		}
+	}()
+
+	return ln.Addr().String(), accepted.Load
+}
+
+func TestUpstream_TCPFallbackReusesConnection(t *testing.T) {
+	addr, accepted := startFakeStreamUpstream(t)
+	upstream := NewUpstream(addr)
+	defer upstream.Pool.Close()
+
+	for i, name := range []string{"first.example.com", "second.example.com"} {
+		answers, err := upstream.Exchange(Question{Name: name, Type: RecordTypeA, Class: ClassIN})
+		if err != nil {
+			t.Fatalf("Exchange() %d failed: %v", i, err)
+		}
+		if len(answers) != 1 || answers[0].RData[0] != 5 {
+			t.Fatalf("Exchange() %d answers = %+v, want the TCP reply", i, answers)
+		}
+	}
+
+	if n := accepted(); n != 1 {
+		t.Errorf("Upstream accepted %d TCP connections, want 1 reused connection", n)
+	}
+	if idle := upstream.Pool.Idle(addr); idle != 1 {
+		t.Errorf("Pool holds %d idle connections, want 1", idle)
+	}
+}
+
+func TestUpstream_DNSOverTLS(t *testing.T) {
+	certFile, keyFile, pool := writeTestCertificate(t)
+	ln, err := ListenTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("ListenTLS() failed: %v", err)
+	}
+	defer ln.Close()
+	go serveStreamListener(ln, TCPIdleTimeout, nil)
+
+	upstream := NewUpstream(ln.Addr().String())
+	upstream.TLS = &tls.Config{RootCAs: pool}
+	defer upstream.Pool.Close()
+
+	for i := 0; i < 2; i++ {
+		answers, err := upstream.Exchange(Question{Name: "stackoverflow.com", Type: RecordTypeA, Class: ClassIN})
+		if err != nil {
+			t.Fatalf("Exchange() %d failed: %v", i, err)
+		}
+		if len(answers) != 1 {
+			t.Fatalf("Exchange() %d answers = %+v, want 1", i, answers)
+		}
+	}
+	if idle := upstream.Pool.Idle(upstream.Addr); idle != 1 {
+		t.Errorf("Pool holds %d idle connections, want 1", idle)
+	}
+}
+
+func TestUpstream_RandomSourcePortPerQuery(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start fake upstream: %v", err)
+	}
+	defer conn.Close()
+
+	ports := make(chan int, 2)
+	go func() {
+		buf := make([]byte, MaxDNSPacketSize)
+		for {
+			size, source, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query Message
+			if err := query.UnmarshalBinary(buf[:size]); err != nil {
+				continue
+			}
+			ports <- source.Port
+			reply := fakeReply(&query, query.Questions[0], []byte{1, 2, 3, 4})
+			data, _ := reply.MarshalBinary()
+			conn.WriteToUDP(data, source)
+		}
+	}()
+
+	upstream := NewUpstream(conn.LocalAddr().String())
+	for i := 0; i < 2; i++ {
+		if _, err := upstream.Exchange(Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN}); err != nil {
+			t.Fatalf("Exchange() %d failed: %v", i, err)
+		}
+	}
+
+	first, second := <-ports, <-ports
+	if first == second {
+		t.Errorf("Both queries were sent from port %d, want a new source port per query", first)
+	}
+}
+
+func TestUpstream_IgnoresReplyFromWrongSource(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start fake upstream: %v", err)
+	}
+	defer conn.Close()
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start attacker: %v", err)
+	}
+	defer attacker.Close()
+
+	go func() {
+		buf := make([]byte, MaxDNSPacketSize)
+		size, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query Message
+		if err := query.UnmarshalBinary(buf[:size]); err != nil {
+			return
+		}
+		// The forged reply matches the ID and question but comes from another address
+		forged := fakeReply(&query, query.Questions[0], []byte{6, 6, 6, 6})
+		data, _ := forged.MarshalBinary()
+		attacker.WriteToUDP(data, source)
+		time.Sleep(20 * time.Millisecond)
+		reply := fakeReply(&query, query.Questions[0], []byte{1, 2, 3, 4})
+		data, _ = reply.MarshalBinary()
+		conn.WriteToUDP(data, source)
+	}()
+
+	answers, err := NewUpstream(conn.LocalAddr().String()).Exchange(Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN})
+	if err != nil {
+		t.Fatalf("Exchange() failed: %v", err)
+	}
+	if len(answers) != 1 || answers[0].RData[0] != 1 {
+		t.Fatalf("Exchange() answers = %+v, want the upstream's answer, not the forged one", answers)
+	}
+}
+
+func TestDNSHandler_ForwardsUnknownTypeUnchanged(t *testing.T) {
+	rdata := []byte{0xC0, 0x0C, 0x00, 0x01, 0x02}
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		reply := fakeReply(query, query.Questions[0], nil)
+		reply.Answers = []ResourceRecord{
+			{Name: query.Questions[0].Name, Type: 9999, Class: ClassIN, TTL: 30, RData: rdata},
+		}
+		reply.Header.ANCount = 1
+		return []Message{reply}
+	})
+
+	queryData := buildTestDNSQuery(0x2707, []Question{{Name: "opaque.example.com", Type: 9999, Class: ClassIN}})
+	response, err := NewDNSHandler(queryData, WithUpstream(NewUpstream(addr))).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinaryStrict(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 1 || respMsg.Answers[0].Type != 9999 || !bytes.Equal(respMsg.Answers[0].RData, rdata) {
+		t.Errorf("Forwarded answers = %+v, want the type 9999 record with RDATA %x", respMsg.Answers, rdata)
+	}
+}
+
+func TestUpstream_AdvertisesEDNSBuffer(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want uint16 // 0 for no OPT record
+	}{
+		{"default", nil, EDNSUDPSize},
+		{"configured", []string{"--edns-buffer", "1400"}, 1400},
+		{"disabled", []string{"--edns-buffer", "0"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := make(chan *Message, 1)
+			addr := startFakeUpstream(t, func(query *Message) []Message {
+				queries <- query
+				return []Message{fakeReply(query, query.Questions[0], []byte{192, 0, 2, 1})}
+			})
+
+			cfg, err := ParseConfig(append([]string{"--resolver", addr}, tt.args...))
+			if err != nil {
+				t.Fatalf("ParseConfig() failed: %v", err)
+			}
+			set, err := newUpstreamSetFromConfig(cfg)
+			if err != nil {
+				t.Fatalf("newUpstreamSetFromConfig() failed: %v", err)
+			}
+			defer set.Close()
+
+			queryData := buildTestDNSQuery(0x4544, []Question{{Name: "example.com", Type: RecordTypeA, Class: ClassIN}})
+			if _, err := NewDNSHandler(queryData, WithUpstream(set)).Handle(); err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			query := <-queries
+			switch {
+			case tt.want == 0 && query.EDNS != nil:
+				t.Errorf("Forwarded query has an OPT record advertising %d, want none", query.EDNS.UDPSize)
+			case tt.want != 0 && query.EDNS == nil:
+				t.Errorf("Forwarded query has no OPT record, want one advertising %d", tt.want)
+			case tt.want != 0 && query.EDNS.UDPSize != tt.want:
+				t.Errorf("Forwarded query advertises %d, want %d", query.EDNS.UDPSize, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstream_DropsAnswersWithMismatchedClass(t *testing.T) {
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		q := query.Questions[0]
+		reply := fakeReply(query, q, []byte{192, 0, 2, 1})
+		reply.Answers = append(reply.Answers, ResourceRecord{
+			Name: q.Name, Type: q.Type, Class: ClassCH, TTL: 30, RData: []byte{203, 0, 113, 66},
+		})
+		reply.Header.ANCount = uint16(len(reply.Answers))
+		return []Message{reply}
+	})
+
+	queryData := buildTestDNSQuery(0x0412, []Question{{Name: "example.com", Type: RecordTypeA, Class: ClassIN}})
+	response, err := NewDNSHandler(queryData, WithUpstream(NewUpstream(addr))).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(respMsg.Answers) != 1 {
+		t.Fatalf("Response has %d answers, want only the IN one", len(respMsg.Answers))
+	}
+	if rr := respMsg.Answers[0]; rr.Class != ClassIN || !bytes.Equal(rr.RData, []byte{192, 0, 2, 1}) {
+		t.Errorf("Answer class %d RDATA %v, want the IN answer 192.0.2.1", rr.Class, rr.RData)
+	}
+}
+
+func TestMatchingClass(t *testing.T) {
+	records := []ResourceRecord{
+		{Name: "example.com", Type: RecordTypeA, Class: ClassIN, TTL: 30, RData: []byte{192, 0, 2, 1}},
+		{Name: "example.com", Type: RecordTypeA, Class: ClassCH, TTL: 30, RData: []byte{203, 0, 113, 66}},
+	}
+	tests := []struct {
+		class uint16
+		want  int
+	}{
+		{ClassIN, 1},
+		{ClassCH, 1},
+		{ClassANY, 2},
+	}
+	for _, tt := range tests {
+		q := Question{Name: "example.com", Type: RecordTypeA, Class: tt.class}
+		if got := matchingClass(q, append([]ResourceRecord(nil), records...)); len(got) != tt.want {
+			t.Errorf("matchingClass() for class %d kept %d records, want %d", tt.class, len(got), tt.want)
+		}
+	}
+}
+
+func TestUpstream_TTLWithTopBitSetIsZero(t *testing.T) {
+	var queries atomic.Int64
+	addr := startFakeUpstream(t, func(query *Message) []Message {
+		queries.Add(1)
+		reply := fakeReply(query, query.Questions[0], []byte{192, 0, 2, 1})
+		reply.Answers[0].TTL = 0xFFFFFFFF
+		return []Message{reply}
+	})
+
+	cache := NewCachingForwarder(NewUpstream(addr), DefaultCacheCapacity)
+	q := Question{Name: "forever.example.com", Type: RecordTypeA, Class: ClassIN}
+	for range 2 {
+		answers, err := cache.Exchange(q)
+		if err != nil {
+			t.Fatalf("Exchange() failed: %v", err)
+		}
+		if len(answers) != 1 || answers[0].TTL != 0 {
+			t.Fatalf("Exchange() answers = %+v, want one with TTL 0", answers)
+		}
+	}
+	if cache.Len() != 0 || queries.Load() != 2 {
+		t.Errorf("Cache holds %d entries after %d upstream queries, want the answer left uncached", cache.Len(), queries.Load())
+	}
+}
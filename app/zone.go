@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Zone is a zone the server is authoritative for: the host records it serves
+// directly and the subzones it delegates to other name servers.
+type Zone struct {
+	Origin string       // apex of the zone, e.g. "example.com"
+	Hosts  *MemoryStore // records served authoritatively, including glue
+
+	mu          sync.RWMutex
+	delegations map[string][]string // delegated subzone -> its name servers
+	ds          map[string][]DSData // signed delegated subzone -> its DS RRset
+	nameServers []string            // name servers for the zone itself
+}
+
+// NewZone creates a zone for origin serving the given host records
+func NewZone(origin string, hosts map[string]HostEntry) *Zone {
+	return &Zone{
+		Origin:      strings.ToLower(origin),
+		Hosts:       NewMemoryStore(hosts),
+		delegations: make(map[string][]string),
+		ds:          make(map[string][]DSData),
+	}
+}
+
+// LoadZone is like NewZone but first checks the host records, rejecting CNAME
+// chains that loop or are longer than MaxCNAMEChain
+func LoadZone(origin string, hosts map[string]HostEntry) (*Zone, error) {
+	if err := ValidateCNAMEs(hosts, MaxCNAMEChain); err != nil {
+		return nil, fmt.Errorf("failed to load zone %s: %w", origin, err)
+	}
+	return NewZone(origin, hosts), nil
+}
+
+// Delegate hands child, a subzone of the zone, to the given name servers.
+// Addresses for name servers inside the zone should be added to Hosts as glue.
+func (z *Zone) Delegate(child string, nameServers ...string) error {
+	child = strings.ToLower(child)
+	if child == z.Origin || !inDomain(child, z.Origin) {
+		return fmt.Errorf("%s is not a subzone of %s", child, z.Origin)
+	}
+	if len(nameServers) == 0 {
+		return fmt.Errorf("delegation of %s has no name servers", child)
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.delegations[child] = append([]string(nil), nameServers...)
+	return nil
+}
+
+// SetDS marks child, an existing delegation, as signed with the keys ds identifies.
+// Its DS RRset is served from this side of the cut and sent with referrals.
+func (z *Zone) SetDS(child string, ds ...DSData) error {
+	child = strings.ToLower(child)
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, found := z.delegations[child]; !found {
+		return fmt.Errorf("%s is not delegated from %s", child, z.Origin)
+	}
+	z.ds[child] = append([]DSData(nil), ds...)
+	return nil
+}
+
+// IsDelegation reports whether name is exactly a delegation cut
+func (z *Zone) IsDelegation(name string) bool {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	_, found := z.delegations[strings.ToLower(name)]
+	return found
+}
+
+// dsRecords returns the DS RRset held for the delegation cut, empty when unsigned
+func (z *Zone) dsRecords(cut string, ttl uint32) []ResourceRecord {
+	z.mu.RLock()
+	ds := z.ds[strings.ToLower(cut)]
+	z.mu.RUnlock()
+
+	var records []ResourceRecord
+	for _, d := range ds {
+		rdata, err := d.MarshalBinary()
+		if err != nil {
+			fmt.Printf("Skipping invalid DS for %s: %v\n", cut, err)
+			continue
+		}
+		records = append(records, ResourceRecord{Name: cut, Type: RecordTypeDS, Class: ClassIN, TTL: ttl, RData: rdata})
+	}
+	return records
+}
+
+// SetNameServers sets the zone's own name servers, sent with positive answers
+// unless minimal responses are configured
+func (z *Zone) SetNameServers(nameServers ...string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.nameServers = append([]string(nil), nameServers...)
+}
+
+// NameServers returns NS records for the zone's own name servers and the in-zone
+// glue for them, both empty when none are set. Like Referral, a ttl of 0 leaves
+// the records without one, for the caller to apply per-type defaults.
+func (z *Zone) NameServers(ttl uint32) (authority, glue []ResourceRecord) {
+	z.mu.RLock()
+	nameServers := z.nameServers
+	z.mu.RUnlock()
+	return z.nsRecords(z.Origin, nameServers, ttl)
+}
+
+// Lookup implements RecordStore by answering from the zone's host records. A
+// wildcard doesn't match a name that exists as an empty non-terminal (RFC 4592
+// section 2.2.2), so such names get no records.
+func (z *Zone) Lookup(name string, qtype, qclass uint16) ([]ResourceRecord, error) {
+	if qtype == RecordTypeDS && qclass == ClassIN {
+		return z.dsRecords(name, 0), nil
+	}
+	if z.emptyNonTerminal(name) {
+		return nil, nil
+	}
+	return z.Hosts.Lookup(name, qtype, qclass)
+}
+
+// Exists reports whether name exists in the zone: the apex, a name with records,
+// or an empty non-terminal above one (RFC 8020)
+func (z *Zone) Exists(name string) bool {
+	name = strings.ToLower(name)
+	if name == z.Origin {
+		return true
+	}
+	if _, found := z.Hosts.Get(name); found {
+		return true
+	}
+	return z.IsDelegation(name) || z.emptyNonTerminal(name)
+}
+
+// emptyNonTerminal reports whether name has no records of its own but names
+// below it do, like b.example.com when only a.b.example.com is defined
+func (z *Zone) emptyNonTerminal(name string) bool {
+	return z.Hosts.EmptyNonTerminal(strings.ToLower(name))
+}
+
+// Referral returns the NS records of the delegation covering name, followed by its
+// DS RRset if the child is signed, and the in-zone glue for its name servers, all
+// with the given ttl. ok is false when name isn't below a delegation cut.
+func (z *Zone) Referral(name string, ttl uint32) (authority, glue []ResourceRecord, ok bool) {
+	cut, nameServers := z.delegationFor(name)
+	if cut == "" {
+		return nil, nil, false
+	}
+	authority, glue = z.nsRecords(cut, nameServers, ttl)
+	return append(authority, z.dsRecords(cut, ttl)...), glue, true
+}
+
+// nsRecords returns NS records at owner for nameServers and the in-zone glue for them
+func (z *Zone) nsRecords(owner string, nameServers []string, ttl uint32) (authority, glue []ResourceRecord) {
+	for _, ns := range nameServers {
+		var rdata bytes.Buffer
+		if err := encodeDNSName(ns, &rdata); err != nil {
+			fmt.Printf("Skipping invalid name server %s for %s: %v\n", ns, owner, err)
+			continue
+		}
+		authority = append(authority, ResourceRecord{
+			Name: owner, Type: RecordTypeNS, Class: ClassIN, TTL: ttl, RData: rdata.Bytes(),
+		})
+
+		// Glue is only needed (and only trusted) for name servers inside our zone
+		if !inDomain(ns, z.Origin) {
+			continue
+		}
+		for _, qtype := range []uint16{RecordTypeA, RecordTypeAAAA} {
+			records, _ := z.Hosts.Lookup(ns, qtype, ClassIN)
+			for _, rr := range records {
+				rr.TTL = ttl
+				glue = append(glue, rr)
+			}
+		}
+	}
+	return authority, glue
+}
+
+// delegationFor returns the closest delegation cut at or above name
+func (z *Zone) delegationFor(name string) (string, []string) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	for labels := strings.ToLower(name); labels != ""; {
+		if nameServers, found := z.delegations[labels]; found {
+			return labels, nameServers
+		}
+		_, parent, found := strings.Cut(labels, ".")
+		if !found {
+			break
+		}
+		labels = parent
+	}
+	return "", nil
+}
+
+// inDomain reports whether name is domain or one of its subdomains, ignoring case
+func inDomain(name, domain string) bool {
+	name, domain = strings.ToLower(name), strings.ToLower(domain)
+	if domain == "" {
+		return true
+	}
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestZone creates example.com with child.example.com delegated to one in-zone
+// name server (which needs glue) and one out-of-zone name server (which doesn't)
+func newTestZone(t *testing.T) *Zone {
+	t.Helper()
+
+	zone := NewZone("example.com", map[string]HostEntry{
+		"www.example.com": {A: []net.IP{net.IPv4(192, 0, 2, 1)}},
+		"ns1.child.example.com": {
+			A:    []net.IP{net.IPv4(192, 0, 2, 53)},
+			AAAA: []net.IP{net.ParseIP("2001:db8::53")},
+		},
+	})
+	if err := zone.Delegate("child.example.com", "ns1.child.example.com", "ns.other.net"); err != nil {
+		t.Fatalf("Delegate() failed: %v", err)
+	}
+	return zone
+}
+
+func TestZone_Delegate(t *testing.T) {
+	zone := NewZone("example.com", nil)
+
+	tests := []struct {
+		name    string
+		child   string
+		ns      []string
+		wantErr bool
+	}{
+		{"subzone", "child.example.com", []string{"ns1.child.example.com"}, false},
+		{"apex", "example.com", []string{"ns1.example.com"}, true},
+		{"outside zone", "example.net", []string{"ns1.example.net"}, true},
+		{"no name servers", "other.example.com", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := zone.Delegate(tt.child, tt.ns...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Delegate(%q) error = %v, wantErr %v", tt.child, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_ReferralToDelegatedChild(t *testing.T) {
+	queryData := buildTestDNSQuery(0x4e53, []Question{
+		{Name: "host.child.example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData, WithZone(newTestZone(t))).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	var respMsg Message
+	if err := respMsg.UnmarshalBinary(response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if respMsg.Header.GetAA() != 0 {
+		t.Error("Referral has AA set")
+	}
+	if len(respMsg.Answers) != 0 {
+		t.Errorf("Referral has %d answers, want 0", len(respMsg.Answers))
+	}
+
+	var nameServers []string
+	for _, rr := range respMsg.Authority {
+		if rr.Type != RecordTypeNS || rr.Name != "child.example.com" {
+			t.Errorf("Unexpected authority record %s type %d", rr.Name, rr.Type)
+			continue
+		}
+		ns, _, err := decodeDNSName(rr.RData, 0)
+		if err != nil {
+			t.Fatalf("Failed to decode NS RDATA: %v", err)
+		}
+		nameServers = append(nameServers, ns)
+	}
+	if len(nameServers) != 2 || nameServers[0] != "ns1.child.example.com" || nameServers[1] != "ns.other.net" {
+		t.Errorf("Authority name servers = %v, want [ns1.child.example.com ns.other.net]", nameServers)
+	}
+
+	if len(respMsg.Additional) != 2 {
+		t.Fatalf("Additional has %d records, want A and AAAA glue", len(respMsg.Additional))
+	}
+	for _, rr := range respMsg.Additional {
+		if rr.Name != "ns1.child.example.com" {
+			t.Errorf("Glue for %s, want only ns1.child.example.com", rr.Name)
+		}
+	}
+	if respMsg.Additional[0].Type != RecordTypeA || respMsg.Additional[1].Type != RecordTypeAAAA {
+		t.Errorf("Glue types = %d, %d, want A then AAAA", respMsg.Additional[0].Type, respMsg.Additional[1].Type)
+	}
+}
+
+func TestDNSHandler_AuthoritativeAnswer(t *testing.T) {
+	addr, _ := StartTestServer(t, WithZone(newTestZone(t)))
+	query := Message{
+		Header:    MessageHeader{Id: 0x4141, QDCount: 1},
+		Questions: []Question{{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN}},
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			respMsg := queryTestServer(t, network, addr, query)
+			if respMsg.Header.GetAA() != 1 {
+				t.Error("Answer from the zone doesn't have AA set")
+			}
+			if len(respMsg.Answers) != 1 || len(respMsg.Authority) != 0 {
+				t.Errorf("Response has %d answers and %d authority records, want 1 and 0",
+					len(respMsg.Answers), len(respMsg.Authority))
+			}
+		})
+	}
+}
+
+func TestDNSHandler_NegativeAnswers(t *testing.T) {
+	zone := newTestZone(t)
+	zone.Hosts.Set("host.internal.example.com", HostEntry{A: []net.IP{net.IPv4(192, 0, 2, 7)}})
+
+	tests := []struct {
+		name      string
+		q         Question
+		wantRcode uint8
+	}{
+		{"NODATA for a name with other types", Question{Name: "www.example.com", Type: RecordTypeAAAA, Class: ClassIN}, RCodeNoError},
+		{"NODATA for the apex", Question{Name: "example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError},
+		{"NODATA for an empty non-terminal", Question{Name: "internal.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNoError},
+		{"NXDOMAIN for a missing name", Question{Name: "missing.example.com", Type: RecordTypeA, Class: ClassIN}, RCodeNXDomain},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := NewDNSHandler(buildTestDNSQuery(0x6e78, []Question{tt.q}), WithZone(zone)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if respMsg.Header.GetAA() != 1 {
+				t.Error("Negative answer from the zone doesn't have AA set")
+			}
+			if len(respMsg.Answers) != 0 {
+				t.Errorf("Negative answer has %d answers, want 0", len(respMsg.Answers))
+			}
+			if len(respMsg.Authority) != 1 || respMsg.Authority[0].Type != RecordTypeSOA ||
+				respMsg.Authority[0].Name != "example.com" {
+				t.Fatalf("Authority = %+v, want the zone's SOA", respMsg.Authority)
+			}
+		})
+	}
+}
+
+func TestZone_EmptyNonTerminals(t *testing.T) {
+	hosts := map[string]HostEntry{"a.b.example.com": {A: []net.IP{net.IPv4(192, 0, 2, 1)}}}
+	withWildcard := map[string]HostEntry{
+		"a.b.example.com": {A: []net.IP{net.IPv4(192, 0, 2, 1)}},
+		"*.example.com":   {A: []net.IP{net.IPv4(192, 0, 2, 99)}},
+	}
+
+	tests := []struct {
+		name        string
+		hosts       map[string]HostEntry
+		qname       string
+		wantRcode   uint8
+		wantAnswers int
+	}{
+		{"empty non-terminal is NODATA", hosts, "b.example.com", RCodeNoError, 0},
+		{"absent name is NXDOMAIN", hosts, "x.example.com", RCodeNXDomain, 0},
+		{"exact name answers", hosts, "a.b.example.com", RCodeNoError, 1},
+		{"wildcard doesn't cover an empty non-terminal", withWildcard, "b.example.com", RCodeNoError, 0},
+		{"wildcard covers an absent name", withWildcard, "x.example.com", RCodeNoError, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryData := buildTestDNSQuery(0x0426, []Question{{Name: tt.qname, Type: RecordTypeA, Class: ClassIN}})
+			response, err := NewDNSHandler(queryData, WithZone(NewZone("example.com", tt.hosts))).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if len(respMsg.Answers) != tt.wantAnswers {
+				t.Errorf("Response has %d answers, want %d", len(respMsg.Answers), tt.wantAnswers)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_DelegationDS(t *testing.T) {
+	zone := newTestZone(t)
+	if err := zone.Delegate("unsigned.example.com", "ns.other.net"); err != nil {
+		t.Fatalf("Delegate() failed: %v", err)
+	}
+	ds := DSData{KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: bytes.Repeat([]byte{0xab}, 32)}
+	if err := zone.SetDS("child.example.com", ds); err != nil {
+		t.Fatalf("SetDS() failed: %v", err)
+	}
+	if err := zone.SetDS("www.example.com", ds); err == nil {
+		t.Error("SetDS() for a name that isn't delegated succeeded, want error")
+	}
+
+	query := func(name string, qtype uint16) Message {
+		t.Helper()
+		response, err := NewDNSHandler(buildTestDNSQuery(0x0427, []Question{{Name: name, Type: qtype, Class: ClassIN}}), WithZone(zone)).Handle()
+		if err != nil {
+			t.Fatalf("Handle() failed: %v", err)
+		}
+		var respMsg Message
+		if err := respMsg.UnmarshalBinary(response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return respMsg
+	}
+
+	t.Run("referral carries the DS RRset", func(t *testing.T) {
+		resp := query("www.child.example.com", RecordTypeA)
+		var types []string
+		for _, rr := range resp.Authority {
+			types = append(types, TypeName(rr.Type))
+		}
+		if got := strings.Join(types, " "); got != "NS NS DS" {
+			t.Fatalf("Referral authority types = %q, want %q", got, "NS NS DS")
+		}
+		value, err := resp.Authority[2].Decode()
+		if err != nil {
+			t.Fatalf("Decode() failed: %v", err)
+		}
+		if got := value.(DSData); got.KeyTag != ds.KeyTag || !bytes.Equal(got.Digest, ds.Digest) {
+			t.Errorf("Referral DS = %+v, want %+v", got, ds)
+		}
+	})
+
+	t.Run("DS query at the cut is answered by the parent", func(t *testing.T) {
+		resp := query("child.example.com", RecordTypeDS)
+		if resp.Header.GetAA() != 1 || len(resp.Answers) != 1 || resp.Answers[0].Type != RecordTypeDS {
+			t.Errorf("DS response AA=%d answers=%+v, want an authoritative DS answer", resp.Header.GetAA(), resp.Answers)
+		}
+	})
+
+	t.Run("unsigned child has no DS", func(t *testing.T) {
+		resp := query("unsigned.example.com", RecordTypeDS)
+		if got := resp.Header.GetRcode(); got != RCodeNoError || len(resp.Answers) != 0 {
+			t.Errorf("DS response rcode=%d answers=%d, want NODATA", got, len(resp.Answers))
+		}
+		if len(resp.Authority) != 1 || resp.Authority[0].Type != RecordTypeSOA {
+			t.Errorf("Authority = %+v, want the zone's SOA", resp.Authority)
+		}
+	})
+}
+
+func TestDNSHandler_ZoneTypeTTLs(t *testing.T) {
+	zone := newTestZone(t)
+	cfg, err := ParseConfig([]string{"--ttl", "300", "--type-ttl", "A=30", "--type-ttl", "NS=86400"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		q        Question
+		section  func(*Message) []ResourceRecord
+		wantTTLs []uint32
+	}{
+		{"A answer", Question{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN},
+			func(m *Message) []ResourceRecord { return m.Answers }, []uint32{30}},
+		{"referral NS", Question{Name: "www.child.example.com", Type: RecordTypeA, Class: ClassIN},
+			func(m *Message) []ResourceRecord { return m.Authority }, []uint32{86400, 86400}},
+		// Glue AAAA has no type-specific TTL, so it gets the global one
+		{"referral glue", Question{Name: "www.child.example.com", Type: RecordTypeA, Class: ClassIN},
+			func(m *Message) []ResourceRecord { return m.Additional }, []uint32{30, 300}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := NewDNSHandler(buildTestDNSQuery(0x0428, []Question{tt.q}), WithZone(zone), WithConfig(cfg)).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			var ttls []uint32
+			for _, rr := range tt.section(&respMsg) {
+				ttls = append(ttls, rr.TTL)
+			}
+			if !reflect.DeepEqual(ttls, tt.wantTTLs) {
+				t.Errorf("TTLs = %v, want %v", ttls, tt.wantTTLs)
+			}
+		})
+	}
+}
+
+func TestLoadZone_RejectsCNAMELoops(t *testing.T) {
+	_, err := LoadZone("example.com", map[string]HostEntry{
+		"a.example.com":   {CNAME: "b.example.com"},
+		"b.example.com":   {CNAME: "a.example.com"},
+		"www.example.com": {A: []net.IP{net.IPv4(192, 0, 2, 1)}},
+	})
+	if err == nil {
+		t.Fatal("LoadZone() accepted a CNAME loop")
+	}
+	if !strings.Contains(err.Error(), "a.example.com, b.example.com") {
+		t.Errorf("LoadZone() error = %v, want both looping names reported", err)
+	}
+
+	if _, err := LoadZone("example.com", map[string]HostEntry{
+		"www.example.com": {CNAME: "example.com"},
+		"example.com":     {A: []net.IP{net.IPv4(192, 0, 2, 1)}},
+	}); err != nil {
+		t.Errorf("LoadZone() rejected a valid alias: %v", err)
+	}
+}
+
+func TestDNSHandler_RefusesOutOfZoneWithoutRecursion(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []HandlerOption
+		wantRcode uint8
+		wantRA    uint8
+	}{
+		{"authoritative-only", []HandlerOption{WithZone(newTestZone(t))}, RCodeRefused, 0},
+		{"with an upstream", []HandlerOption{WithZone(newTestZone(t)), WithUpstream(&flakyForwarder{})}, RCodeNoError, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryData := buildTestDNSQuery(0x7266, []Question{
+				{Name: "unknown.example.org", Type: RecordTypeA, Class: ClassIN},
+			})
+			response, err := NewDNSHandler(queryData, tt.opts...).Handle()
+			if err != nil {
+				t.Fatalf("Handle() failed: %v", err)
+			}
+
+			var respMsg Message
+			if err := respMsg.UnmarshalBinary(response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if respMsg.Header.GetRD() != 1 {
+				t.Error("Response doesn't echo RD")
+			}
+			if got := respMsg.Header.GetRcode(); got != tt.wantRcode {
+				t.Errorf("Response RCode = %d, want %d", got, tt.wantRcode)
+			}
+			if got := respMsg.Header.GetRA(); got != tt.wantRA {
+				t.Errorf("Response RA = %d, want %d", got, tt.wantRA)
+			}
+			if tt.wantRcode == RCodeRefused && len(respMsg.Answers) != 0 {
+				t.Errorf("Refused response has %d answers, want 0", len(respMsg.Answers))
+			}
+		})
+	}
+}
+
+func TestDNSHandler_ReferralGlueOwnersPointAtNSRData(t *testing.T) {
+	queryData := buildTestDNSQuery(0x4e54, []Question{
+		{Name: "host.child.example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+	response, err := NewDNSHandler(queryData, WithZone(newTestZone(t))).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+
+	p := NewParser(response)
+	header, err := p.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() failed: %v", err)
+	}
+	if _, err := p.ReadQuestions(header.QDCount); err != nil {
+		t.Fatalf("ReadQuestions() failed: %v", err)
+	}
+	if _, err := p.ReadRRs(header.ANCount); err != nil {
+		t.Fatalf("ReadRRs() failed: %v", err)
+	}
+
+	// Find where the in-zone name server is written in the NS RDATA
+	nsRData := -1
+	for i := 0; i < int(header.NSCount); i++ {
+		rr, err := p.ReadRR()
+		if err != nil {
+			t.Fatalf("ReadRR() failed: %v", err)
+		}
+		if ns, _, _ := decodeDNSName(rr.RData, 0); ns == "ns1.child.example.com" {
+			nsRData = p.Offset() - int(rr.RDLength)
+		}
+	}
+	if nsRData < 0 {
+		t.Fatal("No NS record for ns1.child.example.com")
+	}
+
+	if header.ARCount != 2 {
+		t.Fatalf("Additional has %d records, want A and AAAA glue", header.ARCount)
+	}
+	for i := 0; i < int(header.ARCount); i++ {
+		owner := p.Offset()
+		rr, err := p.ReadRR()
+		if err != nil {
+			t.Fatalf("ReadRR() failed: %v", err)
+		}
+		pointer := []byte{CompressionMask | byte(nsRData>>8), byte(nsRData)}
+		if !bytes.Equal(response[owner:owner+2], pointer) {
+			t.Errorf("%s glue owner encoded as %x, want pointer %x to the NS RDATA at offset %d",
+				TypeName(rr.Type), response[owner:owner+2], pointer, nsRData)
+		}
+	}
+}
+
+func TestDNSHandler_MinimalResponses(t *testing.T) {
+	zone := newTestZone(t)
+	zone.Hosts.Set("ns1.example.com", HostEntry{A: []net.IP{net.IPv4(192, 0, 2, 54)}})
+	zone.SetNameServers("ns1.example.com", "ns.other.net")
+	queryData := buildTestDNSQuery(0x4242, []Question{
+		{Name: "www.example.com", Type: RecordTypeA, Class: ClassIN},
+	})
+
+	full, err := NewDNSHandler(queryData, WithZone(zone)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	cfg, err := ParseConfig([]string{"--minimal-responses"})
+	if err != nil {
+		t.Fatalf("ParseConfig() failed: %v", err)
+	}
+	minimal, err := NewDNSHandler(queryData, WithZone(zone), WithConfig(cfg)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() with minimal responses failed: %v", err)
+	}
+
+	var fullMsg, minimalMsg Message
+	if err := fullMsg.UnmarshalBinary(full); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if err := minimalMsg.UnmarshalBinary(minimal); err != nil {
+		t.Fatalf("Failed to parse minimal response: %v", err)
+	}
+	if len(fullMsg.Answers) != 1 || len(fullMsg.Authority) != 2 || len(fullMsg.Additional) != 1 {
+		t.Errorf("Response has %d/%d/%d records, want 1 answer, 2 NS and 1 glue",
+			len(fullMsg.Answers), len(fullMsg.Authority), len(fullMsg.Additional))
+	}
+	if len(minimalMsg.Answers) != 1 || len(minimalMsg.Authority) != 0 || len(minimalMsg.Additional) != 0 {
+		t.Errorf("Minimal response has %d/%d/%d records, want the answer only",
+			len(minimalMsg.Answers), len(minimalMsg.Authority), len(minimalMsg.Additional))
+	}
+	if len(minimal) >= len(full) {
+		t.Errorf("Minimal response is %d bytes, want fewer than the full %d", len(minimal), len(full))
+	}
+
+	// Referrals need their NS records and glue regardless
+	referral, err := NewDNSHandler(buildTestDNSQuery(0x4243, []Question{
+		{Name: "www.child.example.com", Type: RecordTypeA, Class: ClassIN},
+	}), WithZone(zone), WithConfig(cfg)).Handle()
+	if err != nil {
+		t.Fatalf("Handle() of a referral failed: %v", err)
+	}
+	var referralMsg Message
+	if err := referralMsg.UnmarshalBinary(referral); err != nil {
+		t.Fatalf("Failed to parse referral: %v", err)
+	}
+	if len(referralMsg.Authority) != 2 || len(referralMsg.Additional) != 2 {
+		t.Errorf("Minimal referral has %d NS and %d glue records, want 2 and 2",
+			len(referralMsg.Authority), len(referralMsg.Additional))
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// zoneToken is a word of a zone file entry, with quotes and escapes removed
+// from quoted strings
+type zoneToken struct {
+	text string
+}
+
+// zoneEntry is one entry of a zone file: a line, or several joined by parentheses
+type zoneEntry struct {
+	line       int // the line it starts on
+	tokens     []zoneToken
+	blankOwner bool // starts with whitespace, so its owner is the previous entry's
+}
+
+// LoadZoneFile reads the records of the zone file at path, with names relative to origin
+func LoadZoneFile(path, origin string) ([]ResourceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zone file: %w", err)
+	}
+	defer f.Close()
+	return ParseZoneFile(f, origin)
+}
+
+// ParseZoneFile reads records in the master file format of RFC 1035 section 5,
+// with names relative to origin until a $ORIGIN says otherwise. It supports
+// $ORIGIN and $TTL (RFC 2308), "@" for the origin, owners left blank to repeat
+// the previous one, parentheses around records spanning lines, TTLs with units
+// like 1h30m, and A, AAAA, NS, CNAME, PTR, MX, TXT, SOA and SRV records of
+// class IN. Records without a TTL get the $TTL, or else the last TTL given.
+// Names in the result have no trailing dot, like everywhere else.
+func ParseZoneFile(r io.Reader, origin string) ([]ResourceRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
+	}
+	entries, err := splitZoneEntries(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &zoneParser{origin: strings.TrimSuffix(origin, ".")}
+	for _, entry := range entries {
+		if err := p.parseEntry(entry); err != nil {
+			return nil, fmt.Errorf("zone file line %d: %w", entry.line, err)
+		}
+	}
+	return p.records, nil
+}
+
+// splitZoneEntries splits a zone file into entries, dropping comments and
+// joining lines inside parentheses
+func splitZoneEntries(data string) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var entry zoneEntry
+	var word strings.Builder
+	inWord, depth, line := false, 0, 1
+	startOfLine := true
+
+	endWord := func() {
+		if inWord {
+			entry.tokens = append(entry.tokens, zoneToken{text: word.String()})
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if startOfLine && depth == 0 {
+			entry = zoneEntry{line: line, blankOwner: c == ' ' || c == '\t'}
+		}
+		startOfLine = false
+
+		switch c {
+		case ';':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case '"':
+			endWord()
+			var quoted strings.Builder
+			for i++; ; i++ {
+				if i >= len(data) || data[i] == '\n' {
+					return nil, fmt.Errorf("zone file line %d: unterminated quoted string", line)
+				}
+				if data[i] == '"' {
+					break
+				}
+				if data[i] == '\\' && i+1 < len(data) && data[i+1] != '\n' {
+					i++
+				}
+				quoted.WriteByte(data[i])
+			}
+			entry.tokens = append(entry.tokens, zoneToken{text: quoted.String()})
+		case '(':
+			endWord()
+			depth++
+		case ')':
+			endWord()
+			if depth == 0 {
+				return nil, fmt.Errorf("zone file line %d: unbalanced closing parenthesis", line)
+			}
+			depth--
+		case ' ', '\t', '\r':
+			endWord()
+		case '\n':
+			endWord()
+			line++
+			startOfLine = true
+			if depth == 0 {
+				if len(entry.tokens) > 0 {
+					entries = append(entries, entry)
+				}
+				entry = zoneEntry{}
+			}
+		default:
+			if c == '\\' && i+1 < len(data) {
+				word.WriteByte(c)
+				i++
+				c = data[i]
+			}
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endWord()
+	if depth > 0 {
+		return nil, fmt.Errorf("zone file line %d: unclosed parenthesis", entry.line)
+	}
+	if len(entry.tokens) > 0 {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// zoneParser holds the state carried from one zone file entry to the next
+type zoneParser struct {
+	origin     string // current origin, without the trailing dot
+	defaultTTL uint32 // from $TTL
+	hasDefault bool
+	lastTTL    uint32 // the last TTL given explicitly
+	hasLast    bool
+	owner      string // owner of the previous record
+	records    []ResourceRecord
+}
+
+// parseEntry handles a directive or a record
+func (p *zoneParser) parseEntry(entry zoneEntry) error {
+	tokens := entry.tokens
+	if !entry.blankOwner && strings.HasPrefix(tokens[0].text, "$") {
+		return p.parseDirective(tokens)
+	}
+
+	owner := p.owner
+	if !entry.blankOwner {
+		owner = p.absolute(tokens[0].text)
+		tokens = tokens[1:]
+	} else if len(p.records) == 0 {
+		return fmt.Errorf("record has no owner and there's no previous one")
+	}
+
+	// TTL and class may come in either order, both optional
+	ttl, hasTTL := uint32(0), false
+	for len(tokens) > 0 {
+		if t, err := parseZoneTTL(tokens[0].text); err == nil && !hasTTL {
+			ttl, hasTTL = t, true
+		} else if strings.EqualFold(tokens[0].text, "IN") {
+		} else if _, known := classNames[strings.ToUpper(tokens[0].text)]; known {
+			return fmt.Errorf("unsupported class %s, only IN is", tokens[0].text)
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("record for %s has no type", fqdn(owner))
+	}
+	rrType, ok := TypeByName(tokens[0].text)
+	if !ok {
+		return fmt.Errorf("unknown record type %q", tokens[0].text)
+	}
+
+	switch {
+	case hasTTL:
+		p.lastTTL, p.hasLast = ttl, true
+	case p.hasDefault:
+		ttl = p.defaultTTL
+	case p.hasLast:
+		ttl = p.lastTTL
+	default:
+		return fmt.Errorf("record for %s has no TTL and there's no $TTL", fqdn(owner))
+	}
+
+	rdata, err := p.rdata(rrType, tokens[1:])
+	if err != nil {
+		return fmt.Errorf("invalid %s record for %s: %w", TypeName(rrType), fqdn(owner), err)
+	}
+	p.owner = owner
+	p.records = append(p.records, ResourceRecord{Name: owner, Type: rrType, Class: ClassIN, TTL: ttl, RData: rdata})
+	return nil
+}
+
+// classNames are the classes that may appear in a zone file
+var classNames = map[string]bool{"IN": true, "CH": true, "CS": true, "HS": true}
+
+// parseDirective handles $ORIGIN and $TTL
+func (p *zoneParser) parseDirective(tokens []zoneToken) error {
+	if len(tokens) != 2 {
+		return fmt.Errorf("%s takes one argument, got %d", tokens[0].text, len(tokens)-1)
+	}
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		p.origin = p.absolute(tokens[1].text)
+	case "$TTL":
+		ttl, err := parseZoneTTL(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.defaultTTL, p.hasDefault = ttl, true
+	default:
+		return fmt.Errorf("unsupported directive %s", tokens[0].text)
+	}
+	return nil
+}
+
+// absolute returns name as a fully qualified name without the trailing dot:
+// "@" is the origin, names ending in a dot are already absolute, and any
+// other name is relative to the origin
+func (p *zoneParser) absolute(name string) string {
+	switch {
+	case name == "@":
+		return p.origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case p.origin == "":
+		return name
+	}
+	return name + "." + p.origin
+}
+
+// rdata encodes the RDATA of an rrType record from its fields, expanding names
+// relative to the origin
+func (p *zoneParser) rdata(rrType uint16, fields []zoneToken) ([]byte, error) {
+	want := map[uint16]int{
+		RecordTypeA: 1, RecordTypeAAAA: 1, RecordTypeNS: 1, RecordTypeCNAME: 1, RecordTypePTR: 1,
+		RecordTypeMX: 2, RecordTypeSRV: 4, RecordTypeSOA: 7,
+	}
+	if n, fixed := want[rrType]; fixed && len(fields) != n {
+		return nil, fmt.Errorf("want %d RDATA fields, got %d", n, len(fields))
+	}
+	text := make([]string, len(fields))
+	for i, field := range fields {
+		text[i] = field.text
+	}
+
+	switch rrType {
+	case RecordTypeA, RecordTypeAAAA:
+		return parseRData(rrType, text)
+	case RecordTypeNS, RecordTypeCNAME, RecordTypePTR:
+		var rdata bytes.Buffer
+		if err := encodeDNSName(p.absolute(text[0]), &rdata); err != nil {
+			return nil, err
+		}
+		return rdata.Bytes(), nil
+	case RecordTypeMX:
+		preference, err := strconv.ParseUint(text[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preference %q", text[0])
+		}
+		mx := MXData{Preference: uint16(preference), Exchange: p.absolute(text[1])}
+		return mx.MarshalBinary()
+	case RecordTypeSRV:
+		var numbers [3]uint16
+		for i := range numbers {
+			n, err := strconv.ParseUint(text[i], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority, weight or port %q", text[i])
+			}
+			numbers[i] = uint16(n)
+		}
+		srv := SRVData{Priority: numbers[0], Weight: numbers[1], Port: numbers[2], Target: p.absolute(text[3])}
+		return srv.MarshalBinary()
+	case RecordTypeSOA:
+		serial, err := strconv.ParseUint(text[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid serial %q", text[2])
+		}
+		var timers [4]uint32
+		for i := range timers {
+			if timers[i], err = parseZoneTTL(text[3+i]); err != nil {
+				return nil, err
+			}
+		}
+		soa := SOAData{
+			MName:   p.absolute(text[0]),
+			RName:   p.absolute(text[1]),
+			Serial:  uint32(serial),
+			Refresh: timers[0],
+			Retry:   timers[1],
+			Expire:  timers[2],
+			Minimum: timers[3],
+		}
+		return soa.MarshalBinary()
+	case RecordTypeTXT:
+		if len(text) == 0 {
+			return nil, fmt.Errorf("TXT record needs at least one string")
+		}
+		txt := TXTData{Strings: text}
+		return txt.MarshalBinary()
+	}
+	return nil, fmt.Errorf("unsupported record type %s", TypeName(rrType))
+}
+
+// zoneTTLUnits are the units a zone file TTL may be given in, as in BIND
+var zoneTTLUnits = map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+
+// parseZoneTTL parses a TTL in seconds, or in units like 1h30m
+func parseZoneTTL(s string) (uint32, error) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			n = n*10 + uint64(c-'0')
+			digits = true
+		} else if unit, ok := zoneTTLUnits[c|0x20]; ok && digits {
+			total += n * unit
+			n, digits = 0, false
+		} else {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		if n > MaxTTL || total > MaxTTL {
+			return 0, fmt.Errorf("TTL %q out of range", s)
+		}
+	}
+	if digits {
+		return 0, fmt.Errorf("invalid TTL %q, a number without a unit must come alone", s)
+	}
+	return uint32(total), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseZoneFile(t *testing.T) {
+	rrs, err := ParseZoneFile(strings.NewReader(`; example.com, as served by ns1
+$ORIGIN example.com.
+$TTL 1h
+@       IN  SOA ns1 hostmaster (
+                2024010101 ; serial
+                2h         ; refresh
+                15m        ; retry
+                2w         ; expire
+                300 )      ; minimum
+        IN  NS  ns1
+            NS  ns2.example.net.
+            MX  10 mail
+@           A   192.0.2.1
+www     300 IN  A     192.0.2.10
+        IN  300 AAAA  2001:db8::10
+mail        A   192.0.2.25
+ftp         CNAME www
+@           TXT "v=spf1 mx -all" "say \"hi\""
+_sip._tcp   SRV 10 60 5060 sip.example.com.
+
+$ORIGIN 2.0.192.in-addr.arpa.
+10      1d  PTR www.example.com.
+`), "")
+	if err != nil {
+		t.Fatalf("ParseZoneFile() failed: %v", err)
+	}
+
+	want := []string{
+		"example.com.\t3600\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2024010101 7200 900 1209600 300",
+		"example.com.\t3600\tIN\tNS\tns1.example.com.",
+		"example.com.\t3600\tIN\tNS\tns2.example.net.",
+		"example.com.\t3600\tIN\tMX\t10 mail.example.com.",
+		"example.com.\t3600\tIN\tA\t192.0.2.1",
+		"www.example.com.\t300\tIN\tA\t192.0.2.10",
+		"www.example.com.\t300\tIN\tAAAA\t2001:db8::10",
+		"mail.example.com.\t3600\tIN\tA\t192.0.2.25",
+		"ftp.example.com.\t3600\tIN\tCNAME\twww.example.com.",
+		"example.com.\t3600\tIN\tTXT\t\"v=spf1 mx -all\" \"say \\\"hi\\\"\"",
+		"_sip._tcp.example.com.\t3600\tIN\tSRV\t10 60 5060 sip.example.com.",
+		"10.2.0.192.in-addr.arpa.\t86400\tIN\tPTR\twww.example.com.",
+	}
+	if len(rrs) != len(want) {
+		for _, rr := range rrs {
+			t.Log(rr.String())
+		}
+		t.Fatalf("Parsed %d records, want %d", len(rrs), len(want))
+	}
+	for i, rr := range rrs {
+		if got := rr.String(); got != want[i] {
+			t.Errorf("Record %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestParseZoneFile_TTLs(t *testing.T) {
+	rrs, err := ParseZoneFile(strings.NewReader("a 60 A 192.0.2.1\nb A 192.0.2.2\n$TTL 1h30m\nc A 192.0.2.3\n"), "example.com")
+	if err != nil {
+		t.Fatalf("ParseZoneFile() failed: %v", err)
+	}
+	for i, want := range []uint32{60, 60, 5400} {
+		if rrs[i].TTL != want {
+			t.Errorf("Record %d TTL = %d, want %d", i, rrs[i].TTL, want)
+		}
+	}
+}
+
+func TestParseZoneFile_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		want string
+	}{
+		{"no TTL", "www A 192.0.2.1\n", "line 1: record for www. has no TTL"},
+		{"no previous owner", "$TTL 60\n  A 192.0.2.1\n", "line 2: record has no owner"},
+		{"unknown type", "$TTL 60\nwww BOGUS 1\n", "line 2: unknown record type"},
+		{"unsupported type", "$TTL 60\nwww LOC 52 22 23 N 4 53 32 E -2m\n", "line 2: invalid LOC record for www.: unsupported record type"},
+		{"other class", "$TTL 60\nwww CH A 192.0.2.1\n", "line 2: unsupported class CH"},
+		{"bad address", "$TTL 60\nwww A 2001:db8::1\n", "line 2: invalid A record for www."},
+		{"missing rdata", "$TTL 60\n@ MX 10\n", "line 2: invalid MX record"},
+		{"bad TTL", "$TTL 1x\n", "line 1: invalid TTL"},
+		{"include", "$INCLUDE other.zone\n", "line 1: unsupported directive $INCLUDE"},
+		{"unclosed parenthesis", "$TTL 60\n@ SOA ns1 hostmaster (\n1 2 3 4 5\n", "line 2: unclosed parenthesis"},
+		{"unbalanced parenthesis", "$TTL 60\n@ A 192.0.2.1 )\n", "line 2: unbalanced closing parenthesis"},
+		{"unterminated string", "$TTL 60\n@ TXT \"open\n", "line 2: unterminated quoted string"},
+		{"long string", "$TTL 60\n@ TXT " + strings.Repeat("x", 256) + "\n", "line 2: invalid TXT record"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseZoneFile(strings.NewReader(tt.zone), "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseZoneFile() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseZoneFile_RelativeNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		zone   string
+		want   []string
+	}{
+		{
+			name: "relative owner",
+			zone: "$ORIGIN example.com.\n$TTL 60\nwww A 192.0.2.1\n",
+			want: []string{"www.example.com.\t60\tIN\tA\t192.0.2.1"},
+		},
+		{
+			name: "relative CNAME target",
+			zone: "$ORIGIN example.com.\n$TTL 60\nftp.example.com. CNAME www\n",
+			want: []string{"ftp.example.com.\t60\tIN\tCNAME\twww.example.com."},
+		},
+		{
+			name: "relative and absolute names together",
+			zone: "$ORIGIN example.com.\n$TTL 60\n" +
+				"@ SOA ns1 hostmaster.example.net. 1 2 3 4 5\n" +
+				"  NS ns1\n" +
+				"  NS ns.example.net.\n" +
+				"  MX 10 mail.example.net.\n" +
+				"  MX 20 mail\n" +
+				"www CNAME www.example.net.\n" +
+				"www.example.org. CNAME @\n",
+			want: []string{
+				"example.com.\t60\tIN\tSOA\tns1.example.com. hostmaster.example.net. 1 2 3 4 5",
+				"example.com.\t60\tIN\tNS\tns1.example.com.",
+				"example.com.\t60\tIN\tNS\tns.example.net.",
+				"example.com.\t60\tIN\tMX\t10 mail.example.net.",
+				"example.com.\t60\tIN\tMX\t20 mail.example.com.",
+				"www.example.com.\t60\tIN\tCNAME\twww.example.net.",
+				"www.example.org.\t60\tIN\tCNAME\texample.com.",
+			},
+		},
+		{
+			name: "relative $ORIGIN",
+			zone: "$ORIGIN example.com.\n$TTL 60\n$ORIGIN lab\nhost A 192.0.2.1\n",
+			want: []string{"host.lab.example.com.\t60\tIN\tA\t192.0.2.1"},
+		},
+		{
+			name:   "origin given by the caller",
+			origin: "example.com.",
+			zone:   "$TTL 60\n@ NS ns1\nns1 A 192.0.2.53\n",
+			want: []string{
+				"example.com.\t60\tIN\tNS\tns1.example.com.",
+				"ns1.example.com.\t60\tIN\tA\t192.0.2.53",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrs, err := ParseZoneFile(strings.NewReader(tt.zone), tt.origin)
+			if err != nil {
+				t.Fatalf("ParseZoneFile() failed: %v", err)
+			}
+			if len(rrs) != len(tt.want) {
+				t.Fatalf("Parsed %d records, want %d", len(rrs), len(tt.want))
+			}
+			for i, rr := range rrs {
+				if got := rr.String(); got != tt.want[i] {
+					t.Errorf("Record %d = %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}